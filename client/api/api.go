@@ -4,32 +4,41 @@ import (
 	"client/consistency"
 	"client/monitor"
 	"client/util"
-	"client/optimizer"
+	"context"
+	"errors"
 	"fmt"
 	"net/http"
 	"bytes"
 	"encoding/json"
 	"os"
-	"strconv"
+	"sort"
+	"sync/atomic"
 	"time"
-	"math/rand"
-	"sync"
 )
 
 
-var GlobalConfig *util.ReplicationConfig
+const configWatchRetryDelay = 1 * time.Second
 
-// =====================
-// HTTP Client
-// =====================
+// Config refreshes are rate limited, a failing primary makes every write ask for one
+const configRefreshCooldown = 1 * time.Second
 
-var httpClient = &http.Client{
-    Transport: &http.Transport{
-        MaxIdleConns:        100,
-        MaxIdleConnsPerHost: 100,
-        IdleConnTimeout:     90 * time.Second,
-    },
-}
+// Returned by reads of keys that don't exist (or were deleted) on the node that was read from
+var ErrKeyNotFound = errors.New("key not found")
+
+// Returned by PutIfVersion when the object was written since the expected version
+var ErrVersionConflict = errors.New("object was modified since the expected version")
+
+// Returned by GetAt when the storage nodes no longer keep the version of the key at the requested timestamp
+var ErrVersionNotRetained = errors.New("version is not retained by the storage nodes")
+
+// ErrWriteOutcomeUnknown is matched by the error of a write that its context cut short, the primary may still have applied it
+var ErrWriteOutcomeUnknown = errors.New("write was cut short, it may still have been applied")
+
+// A node that has not caught up with the timestamp of a GetAt yet, the next candidate is asked
+var errNotCaughtUp = errors.New("node has not caught up with the timestamp")
+
+// Attempts of a read on one node, a Get that has other nodes to fall back on makes a single one per node
+const readAttempts = 3
 
 // =====================
 // Core API Methods
@@ -38,7 +47,7 @@ var httpClient = &http.Client{
 // TODO: The session monitoring functions should be implemented
 // Default: Each session starts with a default SLA, but the Get reqs in the session could specify their SLA's also 
 
-func BeginSession(sla *consistency.SLA, serverSelectionPolicy util.ServerSelectionPolicy) *util.Session {
+func (c *Client) BeginSession(sla *consistency.SLA, serverSelectionPolicy util.ServerSelectionPolicy) *util.Session {
 	return &util.Session{
 		DefaultSLA: sla,
 		ServerSelectionPolicy: serverSelectionPolicy,
@@ -48,10 +57,10 @@ func BeginSession(sla *consistency.SLA, serverSelectionPolicy util.ServerSelecti
 	}
 }
 
-func EndSession(s *util.Session) {
+func (c *Client) EndSession(s *util.Session) {
 	// Print Monitoring data 
 	fmt.Println("Monitor Utilities are: ")
-	fmt.Println(monitor.GetUtilities())
+	fmt.Println(c.monitor.GetUtilities())
 
 	// 1. Compute average utility
 	var total float64
@@ -80,44 +89,112 @@ func EndSession(s *util.Session) {
 type Record struct {
     Key   string `json:"key"`
     Value string `json:"value"`
+    ExpectedTimestamp *int64 `json:"expected_timestamp,omitempty"`
+    TTLMs int64 `json:"ttl_ms,omitempty"`	// the key reads as missing this long after the write (0: never)
+    Epoch int64 `json:"epoch"`	// epoch of the shard config the write was routed with
 }
 
-var artificialLags = make(map[string]time.Duration)
-var lagMu sync.RWMutex
-
-var coldStartRTTCounter int = 0
-
 // ========== GET/PUT Endpoints ==========
 
 // This will update session metadata on write timestamps
-func Put(s *util.Session, key string, value string) error {
-    shardID := determineShardForKey(key)
+func (c *Client) Put(s *util.Session, key string, value string) error {
+	return c.put(context.Background(), s, key, value, nil, 0)
+}
+
+// PutContext is Put under ctx: cancelling it aborts the write, and the write gets the operation timeout (see SetOperationTimeout)
+// A write cut short this way may still have been applied by the primary: its error matches ErrWriteOutcomeUnknown
+// (and context.DeadlineExceeded or context.Canceled), and the session marks the key with util.UnknownWriteTS
+func (c *Client) PutContext(ctx context.Context, s *util.Session, key string, value string) error {
+	return c.put(ctx, s, key, value, nil, 0)
+}
 
-	rec := Record{
-		Key:   key,
-		Value: value,
+// Put of a key that expires: from ttl after the write on, reads of the key return ErrKeyNotFound (e.g. for session tokens)
+// The expiry is replicated with the value, a secondary expires the key once its HighTS passes the expiry
+func (c *Client) PutWithTTL(s *util.Session, key string, value string, ttl time.Duration) error {
+	if ttl <= 0 {
+		return fmt.Errorf("ttl must be positive, got %v", ttl)
 	}
+	return c.put(context.Background(), s, key, value, nil, ttl)
+}
+
+// Optimistic concurrency: the put only succeeds if the object timestamp on the primary is still expectedTS
+// Typically expectedTS is s.ObjectsRead[key], i.e. the version this session read last.
+// On a conflict ErrVersionConflict is returned and s.ObjectsRead[key] is moved to the current version,
+// so the caller can re-read the key and retry.
+func (c *Client) PutIfVersion(s *util.Session, key string, value string, expectedTS int64) error {
+	return c.put(context.Background(), s, key, value, &expectedTS, 0)
+}
+
+func (c *Client) put(ctx context.Context, s *util.Session, key string, value string, expectedTS *int64, ttl time.Duration) error {
+	ctx, cancel := c.withOperationTimeout(ctx, s.DefaultSLA)
+	defer cancel()
 
-	recordJson, _ := json.Marshal(rec)
-	url := fmt.Sprintf("http://%s/set", GlobalConfig.Shards[shardID].Primary)
+	var putTS int64
+	var rtt time.Duration
+	var primary string
+	var err error
+	if c.currentTransport() == GRPCTransport {
+		putTS, rtt, primary, err = c.putGRPC(ctx, key, value, expectedTS, ttl)
+	} else {
+		putTS, rtt, primary, err = c.putHTTP(ctx, key, value, expectedTS, ttl)
+	}
 
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(recordJson))
+	// The client gets the current version back, so it can re-read and retry
+	if err == ErrVersionConflict {
+		s.ObjectsRead[key] = putTS
+		return ErrVersionConflict
+	}
 	if err != nil {
-		return fmt.Errorf("failed to create request: %v", err)
+		return writeError(ctx, s, key, err)
 	}
-	req.Header.Set("Content-Type", "application/json")
 
-	start := time.Now()
-	resp, err := httpClient.Do(req)
-	rtt := time.Since(start)
+	// If no error, then update RTT window in monitor
+	c.recordRTT(primary, rtt)
+	
 
-	// Adjust RTT is there is a lag associated wih Primary
-	rtt += getArtificialLag(GlobalConfig.Shards[shardID].Primary)
+	// Update write timestamp of the session
+	// fmt.Printf("Set succeeded. Updating session write timestamp: %d\n", putTS)
+	s.ObjectsWritten[key] = putTS          
+
+	// The conditional write was based on the version read, which is now our own write
+	if expectedTS != nil {
+		s.ObjectsRead[key] = putTS
+	}
+
+    return nil
+}
+
+// Returns the put timestamp (the current object timestamp on ErrVersionConflict) + the rtt + the primary that was used
+func (c *Client) putHTTP(ctx context.Context, key string, value string, expectedTS *int64, ttl time.Duration) (int64, time.Duration, string, error) {
+	resp, rtt, primary, err := c.postToPrimary(ctx, key, "/set", func(epoch int64) any {
+		return Record{
+			Key:   key,
+			Value: value,
+			ExpectedTimestamp: expectedTS,
+			TTLMs: ttl.Milliseconds(),
+			Epoch: epoch,
+		}
+	})
+
+	if err == nil && resp.StatusCode == http.StatusConflict {
+		defer resp.Body.Close()
+		var conflict struct {
+			CurrentTimestamp int64 `json:"current_timestamp"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&conflict); err != nil {
+			return -1, rtt, primary, fmt.Errorf("Failed to decode response: %v", err)
+		}
+		return conflict.CurrentTimestamp, rtt, primary, ErrVersionConflict
+	}
 
 	if err != nil || resp.StatusCode != http.StatusOK {
 		fmt.Printf("An error happened invoking the put endpoint of the storage node\n")
 		fmt.Printf("%v \n", err)
-		return fmt.Errorf("HTTP error: %v", err)
+		if err == nil {
+			resp.Body.Close()
+			return -1, rtt, primary, fmt.Errorf("put failed with status %d", resp.StatusCode)
+		}
+		return -1, rtt, primary, fmt.Errorf("HTTP error: %v", err)
 	}
 
 	defer resp.Body.Close()
@@ -128,277 +205,731 @@ func Put(s *util.Session, key string, value string) error {
 	}
 	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
 		fmt.Printf("Failed to decode response: %v", err)
-		return fmt.Errorf("Failed to decode response: %v", err)
+		return -1, rtt, primary, fmt.Errorf("Failed to decode response: %v", err)
 	}
+	return result.SetTimestamp, rtt, primary, nil
+}
 
-	// If no error, then update RTT window in monitor
-	coldStartRTTCounter++
-	if (coldStartRTTCounter > 5) {
-		monitor.RecordRTT(GlobalConfig.Shards[shardID].Primary, rtt)
+// Deletes the key on its primary, the delete timestamp counts as a write of the session
+func (c *Client) Delete(s *util.Session, key string) error {
+	return c.DeleteContext(context.Background(), s, key)
+}
+
+// DeleteContext is Delete under ctx, with the operation timeout like PutContext
+func (c *Client) DeleteContext(ctx context.Context, s *util.Session, key string) error {
+	ctx, cancel := c.withOperationTimeout(ctx, s.DefaultSLA)
+	defer cancel()
+
+	var deleteTS int64
+	var rtt time.Duration
+	var primary string
+	var err error
+	if c.currentTransport() == GRPCTransport {
+		deleteTS, rtt, primary, err = c.deleteGRPC(ctx, key)
+	} else {
+		deleteTS, rtt, primary, err = c.deleteHTTP(ctx, key)
+	}
+	if err != nil {
+		return writeError(ctx, s, key, err)
 	}
-	
 
-	// Update write timestamp of the session
-	// fmt.Printf("Set succeeded. Updating session write timestamp: %d\n", result.SetTimestamp)
-	s.ObjectsWritten[key] = result.SetTimestamp          
+	c.recordRTT(primary, rtt)
 
-    return nil
+	// A later read-my-writes Get must see the delete
+	s.ObjectsWritten[key] = deleteTS
+
+	return nil
+}
+
+// Returns the delete timestamp + the rtt + the primary that was used
+func (c *Client) deleteHTTP(ctx context.Context, key string) (int64, time.Duration, string, error) {
+	resp, rtt, primary, err := c.postToPrimary(ctx, key, "/delete", func(epoch int64) any {
+		return Record{Key: key, Epoch: epoch}
+	})
+	if err != nil {
+		return -1, rtt, primary, fmt.Errorf("HTTP error: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return -1, rtt, primary, fmt.Errorf("delete failed with status %d", resp.StatusCode)
+	}
+
+	var result struct {
+		DeleteTimestamp int64 `json:"delete_timestamp"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return -1, rtt, primary, fmt.Errorf("Failed to decode response: %v", err)
+	}
+	return result.DeleteTimestamp, rtt, primary, nil
+}
+
+// Sends a write to the primary of the shard of the key, the body is built per attempt since it carries the epoch of the shard config
+// If the primary can't be reached, or answers 421 (it is not the primary in that epoch, e.g. after a failover),
+// the config is fetched from the coordinator and the write is retried once if the shard moved to a newer epoch (unless ctx is done).
+// Returns the response + the rtt + the primary that was used
+func (c *Client) postToPrimary(ctx context.Context, key string, path string, body func(epoch int64) any) (*http.Response, time.Duration, string, error) {
+	for attempt := 1; ; attempt++ {
+		config := c.Config()
+		shardID := determineShardForKey(config, key)
+		if shardID < 0 {
+			return nil, 0, "", fmt.Errorf("no shard found for key %s", key)
+		}
+		shard := config.Shards[shardID]
+
+		data, _ := json.Marshal(body(shard.Epoch))
+		req, err := http.NewRequestWithContext(ctx, "POST", fmt.Sprintf("http://%s%s", shard.Primary, path), bytes.NewBuffer(data))
+		if err != nil {
+			return nil, 0, shard.Primary, fmt.Errorf("failed to create request: %v", err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+
+		start := time.Now()
+		resp, err := c.httpClient.Do(req)
+		rtt := time.Since(start)
+
+		// Adjust RTT is there is a lag associated wih Primary
+		rtt += c.getArtificialLag(shard.Primary)
+
+		// A node that knows of a newer epoch tells us which one, so the refresh is not skipped by the cooldown
+		var nodeEpoch int64
+		if err == nil && resp.StatusCode == http.StatusMisdirectedRequest {
+			var misdirected struct {
+				Epoch int64 `json:"epoch"`
+			}
+			json.NewDecoder(resp.Body).Decode(&misdirected)
+			resp.Body.Close()
+			resp = nil
+			nodeEpoch = misdirected.Epoch
+			err = fmt.Errorf("%s is not the primary of shard %d in epoch %d", shard.Primary, shard.ShardId, shard.Epoch)
+		}
+		if err == nil || attempt > 1 || ctx.Err() != nil {
+			return resp, rtt, shard.Primary, err
+		}
+
+		c.refreshConfig(nodeEpoch)
+		current := c.Config()
+		currentID := determineShardForKey(current, key)
+		if currentID < 0 || current.Shards[currentID].Epoch == shard.Epoch {
+			return resp, rtt, shard.Primary, err
+		}
+		fmt.Printf("Shard %d moved to epoch %d, retrying on the primary %s\n", current.Shards[currentID].ShardId, current.Shards[currentID].Epoch, current.Shards[currentID].Primary)
+	}
 }
 
 // Return:Value of the key requested + which subSLA was hit
 // Server selection policy from the session is used to choose the destination server
-func Get(s *util.Session, key string, sla *consistency.SLA) (string, consistency.SubSLA, error) {
-
-	if (s.ServerSelectionPolicy == util.Pileus) {
-		fmt.Println("Doing a Pileus Get:")
-		return PileusGet(s, key, sla)
-	} else if (s.ServerSelectionPolicy == util.Random) {
-		fmt.Println("Doing a Random Get:")
-		return randomGet(s, key, sla)
-	} else if (s.ServerSelectionPolicy == util.Primary) {
-		fmt.Println("Doing a Primary-Only Get:")
-		return primaryOnlyGet(s, key, sla)
-	} else if (s.ServerSelectionPolicy == util.Closest) {
-		fmt.Println("Doing a Closest Get:")
-		return closestGet(s, key, sla)
-	} else {
-		return PileusGet(s, key, sla)
+func (c *Client) Get(s *util.Session, key string, sla *consistency.SLA) (string, consistency.SubSLA, error) {
+	return c.GetContext(context.Background(), s, key, sla)
+}
+
+// GetContext is Get under ctx: cancelling it aborts the read, and the read gets the operation timeout (see SetOperationTimeout),
+// by default the latency bound of the least preferred sub-SLA, since a later answer meets none of them
+// A read cut by the deadline counts as a miss of the SLA, its error matches context.DeadlineExceeded
+func (c *Client) GetContext(ctx context.Context, s *util.Session, key string, sla *consistency.SLA) (string, consistency.SubSLA, error) {
+	activeSLA := s.DefaultSLA
+	if sla != nil {
+		activeSLA = sla
 	}
+	ctx, cancel := c.withOperationTimeout(ctx, activeSLA)
+	defer cancel()
+
+	policy := selectionPolicy(s.ServerSelectionPolicy)
+	fmt.Printf("Doing a %s Get:\n", policy.name)
+	return c.get(ctx, s, key, activeSLA, policy.policy)
 }
 
-func PileusGet(s *util.Session, key string, sla *consistency.SLA) (string, consistency.SubSLA, error) {
-	// Determine SLA for the op: use session default if not specified by input
+func (c *Client) PileusGet(s *util.Session, key string, sla *consistency.SLA) (string, consistency.SubSLA, error) {
 	activeSLA := s.DefaultSLA
 	if sla != nil {
 		activeSLA = sla
 	}
+	ctx, cancel := c.withOperationTimeout(context.Background(), activeSLA)
+	defer cancel()
+	return c.get(ctx, s, key, activeSLA, selectionPolicy(util.Pileus).policy)
+}
 
-	// Find the storage node that maximizes the utility
-	storageNode, targetSubSLA, minReadTSPerSubSLA := optimizer.FindNodeToRead(s, key, activeSLA)
-	fmt.Printf("chosen storage node is %v and chosen subsla is %v\n", storageNode, targetSubSLA)
-	fmt.Printf("minReadTSPerSubSLA for subslas is %v\n", minReadTSPerSubSLA)
+// Reads the key from the nodes the policy selects (in their order) and scores the read against the SLA, the same way for every policy
+// Without an SLA (neither the session nor the Get has one) there is nothing to score, the key is read from its primary
+func (c *Client) get(ctx context.Context, s *util.Session, key string, activeSLA *consistency.SLA, policy SelectionPolicy) (string, consistency.SubSLA, error) {
+	config := c.Config()
+	if activeSLA == nil {
+		shard := config.ShardForKey(key)
+		if shard == nil {
+			return "", consistency.SubSLA{}, fmt.Errorf("no shard found for key %s", key)
+		}
+		val, _, _, _, err := c.readFromNode(ctx, key, shard.Primary, readAttempts)
+		return val, consistency.SubSLA{}, contextError(ctx, err)
+	}
 
-	// Perform the read + calculate exact utility achieved
-	val, obj_ts, node_hts, rtt, err := readFromNode(key, storageNode)
+	nodes, err := policy.SelectNodes(s, key, activeSLA, PolicyView{Config: config, Monitor: c.monitor, Optimizer: c.optimizer})
+	if err == nil {
+		nodes, err = replicasOf(config, key, nodes)
+	}
+	if err != nil {
+		s.Utilities = append(s.Utilities, 0.0)
+		c.monitor.RecordUtility(0.0)
+		return "", consistency.SubSLA{}, err
+	}
 
+	// Nodes known to be down are only asked after the others
+	var up, down []string
+	for _, node := range nodes {
+		if c.monitor.IsDown(node) {
+			down = append(down, node)
+		} else {
+			up = append(up, node)
+		}
+	}
+	nodes = append(up, down...)
+
+	// Falls through to the next node while the reads fail (or meet no sub-SLA) and the context has time left,
+	// the latency of a read includes the time spent on the nodes before
+	var lastErr error
+	var spent time.Duration
+	var failed, answered bool
+	var answeredVal string
+	var answeredErr error
+	for i, storageNode := range nodes {
+		if i > 0 {
+			if ctx.Err() != nil {
+				break
+			}
+			fmt.Printf("Falling back to %s after %v\n", storageNode, spent)
+		}
+
+		// The last node gets all the attempts, the others one each
+		attempts := 1
+		if i == len(nodes)-1 {
+			attempts = readAttempts
+		}
+
+		start := time.Now()
+		val, obj_ts, node_hts, rtt, err := c.readFromNode(ctx, key, storageNode, attempts)
+		if err != nil && err != ErrKeyNotFound {
+			// A read cut by the deadline (or cancellation) of the Get says nothing about the node
+			if ctx.Err() == nil {
+				c.monitor.RecordFailure(storageNode)
+			}
+			spent += time.Since(start)
+			failed = true
+			lastErr = err
+			continue
+		}
+
+		read := ReadResult{Node: storageNode, Timestamp: obj_ts, HighTS: node_hts, RTT: spent + rtt}
+		if subAchieved := c.evaluateRead(s, key, activeSLA, config, read); subAchieved != nil {
+			// Update session read utilities
+			s.Utilities = append(s.Utilities, subAchieved.Utility)
+			c.monitor.RecordUtility(subAchieved.Utility)
+
+			// Update the read timestamp of the object read
+			fmt.Printf("Updating session read timestamp: %d\n", obj_ts)
+			s.ObjectsRead[key] = obj_ts
+
+			return val, *subAchieved, err
+		}
+
+		// A later node may still meet a less preferred sub-SLA (e.g. the primary, where the consistency was not met)
+		spent += rtt
+		answered, answeredVal, answeredErr = true, val, err
+	}
+
+	// The nodes may be down for good (e.g. a failed primary), the next reads should use the current config
+	if failed && ctx.Err() == nil {
+		c.refreshConfig(0)
+	}
+
+	s.Utilities = append(s.Utilities, 0.0)
+	c.monitor.RecordUtility(0.0)
+
+	// If no sub-sla is achieved, a missing key is still reported as missing
+	if answered {
+		fmt.Println("No utility could be computed, because gained subSLA was null")
+		if answeredErr == ErrKeyNotFound {
+			return "", consistency.SubSLA{}, ErrKeyNotFound
+		}
+		return answeredVal, consistency.SubSLA{}, fmt.Errorf("no utility could be computed")
+	}
+
+	// Out of time (or cancelled): no sub-SLA is met, and the nodes are not to blame
+	if ctx.Err() != nil {
+		fmt.Printf("Read of key %s ran out of time: %v\n", key, lastErr)
+		return "", consistency.SubSLA{}, contextError(ctx, lastErr)
+	}
+	return "", consistency.SubSLA{}, lastErr
+}
+
+// Keeps the nodes (in their order) that replicate the key, a policy may offer others, e.g. the closest node of the config
+func replicasOf(config *util.ReplicationConfig, key string, nodes []string) ([]string, error) {
+	shard := config.ShardForKey(key)
+	if shard == nil {
+		return nil, fmt.Errorf("no shard found for key %s", key)
+	}
+
+	var replicas []string
+	for _, node := range nodes {
+		if node == shard.Primary || contains(shard.Secondaries, node) {
+			replicas = append(replicas, node)
+		}
+	}
+	if len(replicas) == 0 {
+		return nil, ErrNoNodeSelected
+	}
+	return replicas, nil
+}
+
+// Evaluates a read that got an answer against the SLA and records the statuses of its sub-SLAs with the monitor
+func (c *Client) evaluateRead(s *util.Session, key string, activeSLA *consistency.SLA, config *util.ReplicationConfig, read ReadResult) *consistency.SubSLA {
 	// Calculate and track utility based on get_timestamp and rtt (consistency + latency)
-	subAchieved, detailedSubStatus := detectSubSLAHit(obj_ts, node_hts, rtt, targetSubSLA, activeSLA, minReadTSPerSubSLA)
-	
-	fmt.Println("Detailed Sub Status is when going to %s", storageNode)
+	subAchieved, detailedSubStatus := EvaluateRead(config, s, key, activeSLA, read)
+
+	fmt.Printf("Detailed Sub Status is when going to %s\n", read.Node)
 	fmt.Println(detailedSubStatus)
 
 	readStatus := monitor.ReadStatus{
-		Node:          storageNode,
+		Node:          read.Node,
 		SubSLADetails: detailedSubStatus,
 	}
-	monitor.RecordReadStatus(readStatus)
+	c.monitor.RecordReadStatus(readStatus)
+	return subAchieved
+}
 
-	// If no sub-sla is achieved
-	if subAchieved == nil {
-		fmt.Println("No utility could be computed, because gained subSLA was null")
-		s.Utilities = append(s.Utilities, 0.0)
-		monitor.RecordUtility(0.0)
-		return val, consistency.SubSLA{}, fmt.Errorf("no utility could be computed")
+// ========== Snapshot Reads ==========
+
+// GetAt reads the key as of timestamp ts (e.g. several keys at the same point in time, or a bounded-staleness read)
+// Any replica whose HighTS covers ts can serve it: the ones the monitor saw catch up are asked by increasing average RTT,
+// then the primary (which serves any timestamp up to now). The session's read timestamps are left as they are,
+// since a read in the past says nothing about the latest versions.
+func (c *Client) GetAt(s *util.Session, key string, ts int64) (string, error) {
+	config := c.Config()
+	shardID := determineShardForKey(config, key)
+	if shardID < 0 {
+		return "", fmt.Errorf("no shard found for key %s", key)
 	}
+	shard := config.Shards[shardID]
 
-	// Update session read utilities
-	s.Utilities = append(s.Utilities, subAchieved.Utility)
-	monitor.RecordUtility(subAchieved.Utility)
+	var candidates []string
+	for _, node := range shard.Secondaries {
+		if c.monitor.GetHTS(node, shard.ShardId) >= ts {
+			candidates = append(candidates, node)
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return c.monitor.GetAvgRTT(candidates[i]) < c.monitor.GetAvgRTT(candidates[j])
+	})
+	candidates = append(candidates, shard.Primary)
+
+	var err error
+	for _, node := range candidates {
+		var val string
+		val, err = c.readAtFromNode(key, node, ts)
+		if err != errNotCaughtUp {
+			return val, err
+		}
+		fmt.Printf("%s has not caught up with %d yet, trying the next node\n", node, ts)
+	}
+	return "", err
+}
+
+// Reads the version of the key as of timestamp at from the node (/get?at=)
+func (c *Client) readAtFromNode(key string, storageNode string, at int64) (string, error) {
+	if c.currentTransport() == GRPCTransport {
+		return c.readAtFromNodeGRPC(key, storageNode, at)
+	}
 
-	// Update the read timestamp of the object read
-	fmt.Printf("Updating session read timestamp: %d\n", obj_ts)
-	s.ObjectsRead[key] = obj_ts
+	resp, err := c.httpClient.Get(fmt.Sprintf("http://%s/get?key=%s&at=%d", storageNode, key, at))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
 
-	return val, *subAchieved, err
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusNotFound:
+	case http.StatusTooEarly:
+		return "", errNotCaughtUp
+	case http.StatusGone:
+		return "", ErrVersionNotRetained
+	default:
+		return "", fmt.Errorf("read of key %s at %d failed with status %d", key, at, resp.StatusCode)
+	}
+
+	var response struct {
+		Value  string `json:"value"`
+		HighTS int64  `json:"highTS"`
+		Found  bool   `json:"found"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return "", err
+	}
+	c.recordHTS(storageNode, key, response.HighTS)
+	if !response.Found {
+		return "", ErrKeyNotFound
+	}
+	return response.Value, nil
 }
 
-// =====================
-// Get Functions for Eval
-// =====================
+// ========== Batch GET/PUT Endpoints ==========
+
+// Result of a single key of a MultiGet
+type KeyResult struct {
+	Value  string
+	SubSLA consistency.SubSLA	// sub-SLA achieved for this key (empty if none)
+	Err    error
+}
 
-// This is for evaluation purposes
-func primaryOnlyGet(s *util.Session, key string, sla *consistency.SLA) (string, consistency.SubSLA, error) {
+// Reads several keys with one request per shard [the keys of a shard are read from the same node]
+// The optimizer picks the node for each shard, and the sub-SLA achieved is reported for every key
+func (c *Client) MultiGet(s *util.Session, keys []string, sla *consistency.SLA) map[string]KeyResult {
+	// Determine SLA for the op: use session default if not specified by input
 	activeSLA := s.DefaultSLA
 	if sla != nil {
 		activeSLA = sla
 	}
 
-	if (activeSLA == nil) {
-		shardID := determineShardForKey(key)
-		// I want the highTS and onjTS back as well
-		val, _, _, _, err := readFromNode(key, GlobalConfig.Shards[shardID].Primary)
-		return val, consistency.SubSLA{}, err
-	}
+	results := make(map[string]KeyResult, len(keys))
+	for shardID, shardKeys := range groupKeysByShard(c.Config(), keys) {
+		if shardID < 0 {
+			for _, key := range shardKeys {
+				results[key] = KeyResult{Err: fmt.Errorf("no shard found for key %s", key)}
+			}
+			continue
+		}
 
-	shardID := determineShardForKey(key)
-	val, _, _, rtt, err := readFromNode(key, GlobalConfig.Shards[shardID].Primary)
+		storageNode, targetSubSLA, _ := c.optimizer.FindNodeToReadMulti(s, shardKeys, activeSLA)
+		fmt.Printf("chosen storage node for shard %d is %v and chosen subsla is %v\n", shardID, storageNode, targetSubSLA)
 
-	if (err != nil) {
-		// Some error happened for the key
-		fmt.Println("primary-only read failed with error")
-		fmt.Println(err)
-		s.Utilities = append(s.Utilities, 0.0)
-		return val, consistency.SubSLA{}, fmt.Errorf("No subSLA met")
-	}
+		records, rtt, err := c.readManyFromNode(shardKeys, storageNode)
+		if err != nil {
+			for _, key := range shardKeys {
+				results[key] = KeyResult{Err: err}
+			}
+			continue
+		}
+
+		// The whole group shares the rtt and the HighTS of the node, but the consistency is checked per key
+		for _, key := range shardKeys {
+			rec := records[key]
+			subAchieved, detailedSubStatus := EvaluateRead(c.Config(), s, key, activeSLA, ReadResult{Node: storageNode, Timestamp: rec.Timestamp, HighTS: rec.HighTS, RTT: rtt})
+
+			c.monitor.RecordReadStatus(monitor.ReadStatus{
+				Node:          storageNode,
+				SubSLADetails: detailedSubStatus,
+			})
+
+			var keyErr error
+			if !rec.Found {
+				keyErr = ErrKeyNotFound
+			}
+
+			if subAchieved == nil {
+				s.Utilities = append(s.Utilities, 0.0)
+				c.monitor.RecordUtility(0.0)
+				if keyErr == nil {
+					keyErr = fmt.Errorf("no utility could be computed")
+				}
+				results[key] = KeyResult{Value: rec.Value, Err: keyErr}
+				continue
+			}
 
-	// If we always go to primary, consistency is always met, the RTT is the only thing to check for the utility checking
-	for _, sub := range activeSLA.SubSLAs {
-		if rtt <= sub.Latency.Duration {
-			subAchieved := &sub // make a copy
 			s.Utilities = append(s.Utilities, subAchieved.Utility)
-			return val, *subAchieved, err
+			c.monitor.RecordUtility(subAchieved.Utility)
+			s.ObjectsRead[key] = rec.Timestamp
+
+			results[key] = KeyResult{Value: rec.Value, SubSLA: *subAchieved, Err: keyErr}
 		}
 	}
 
-	// If we have not returned yet, then no sub-SLA is met
-	fmt.Println("No utility could be computed for primary-only read")
-	s.Utilities = append(s.Utilities, 0.0)
-	return val, consistency.SubSLA{}, fmt.Errorf("No subSLA met")
+	return results
 }
 
-// TODO: utility calculation in these functions should be better generalized
-func randomGet(s *util.Session, key string, sla *consistency.SLA) (string, consistency.SubSLA, error) {
-	activeSLA := s.DefaultSLA
-	if sla != nil {
-		activeSLA = sla
+// Writes several keys with one request per shard (to the primary of the shard)
+// Keys are written independently, the returned map holds the error of every key that failed (it is empty if all succeeded)
+func (c *Client) MultiPut(s *util.Session, records map[string]string) map[string]error {
+	return c.multiPut(s, records, nil)
+}
+
+// MultiPut of keys that expire, each one ttls[key] after its write (see PutWithTTL), keys without a ttl don't expire
+func (c *Client) MultiPutWithTTL(s *util.Session, records map[string]string, ttls map[string]time.Duration) map[string]error {
+	failed := make(map[string]error)
+	for key, ttl := range ttls {
+		if _, ok := records[key]; ok && ttl < 0 {
+			failed[key] = fmt.Errorf("ttl must not be negative, got %v for key %s", ttl, key)
+		}
+	}
+	if len(failed) > 0 {
+		return failed
 	}
+	return c.multiPut(s, records, ttls)
+}
 
-	rand.Seed(time.Now().UnixNano())
-	randomIndex := rand.Intn(len(GlobalConfig.Nodes))
-	randomNode := GlobalConfig.Nodes[randomIndex]
-	fmt.Println("Random Node is %s", randomNode.Id)
+func (c *Client) multiPut(s *util.Session, records map[string]string, ttls map[string]time.Duration) map[string]error {
+	keys := make([]string, 0, len(records))
+	for key := range records {
+		keys = append(keys, key)
+	}
 
-	shardID := determineShardForKey(key)
-	primaryForKey := GlobalConfig.Shards[shardID].Primary
+	failed := make(map[string]error)
+	for shardID, shardKeys := range groupKeysByShard(c.Config(), keys) {
+		if shardID < 0 {
+			for _, key := range shardKeys {
+				failed[key] = fmt.Errorf("no shard found for key %s", key)
+			}
+			continue
+		}
 
-	val, _, node_hts, rtt, err := readFromNode(key, randomNode.Address)
-	fmt.Println("RTT was %f", rtt)
+		// Keys of one shard share the primary, the first one routes the request
+		resp, rtt, primary, err := c.postToPrimary(context.Background(), shardKeys[0], "/mset", func(epoch int64) any {
+			var req struct {
+				Records []Record `json:"records"`
+			}
+			for _, key := range shardKeys {
+				req.Records = append(req.Records, Record{Key: key, Value: records[key], TTLMs: ttls[key].Milliseconds(), Epoch: epoch})
+			}
+			return req
+		})
 
-	if (err != nil) {
-		// Some error happened for the key
-		fmt.Println("random read failed with error")
-		fmt.Println(err)
-		s.Utilities = append(s.Utilities, 0.0)
-		return val, consistency.SubSLA{}, fmt.Errorf("No subSLA met")
-	}
+		if err == nil && resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			err = fmt.Errorf("mset failed with status %d", resp.StatusCode)
+		}
+		if err != nil {
+			for _, key := range shardKeys {
+				failed[key] = err
+			}
+			continue
+		}
+
+		var result struct {
+			Results []struct {
+				Key          string `json:"key"`
+				PutTimestamp int64  `json:"put_timestamp"`
+				Error        string `json:"error"`
+			} `json:"results"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			for _, key := range shardKeys {
+				failed[key] = fmt.Errorf("Failed to decode response: %v", err)
+			}
+			continue
+		}
 
-	if (activeSLA.ID == "cart_sla") {
-		_, _, minReadTSPerSubSLA := optimizer.FindNodeToRead(s, key, activeSLA)
-		fmt.Println(minReadTSPerSubSLA)
+		c.recordRTT(primary, rtt)
 
-		// check node high ts
-		for i, sub := range activeSLA.SubSLAs {
-			if rtt <= sub.Latency.Duration {
-				if (node_hts >= minReadTSPerSubSLA[i]) {
-					subAchieved := &sub
-					s.Utilities = append(s.Utilities, subAchieved.Utility)
-					return val, *subAchieved, err
-				}
+		for _, res := range result.Results {
+			if res.Error != "" {
+				failed[res.Key] = errors.New(res.Error)
+				continue
 			}
+			s.ObjectsWritten[res.Key] = res.PutTimestamp
 		}
-		
-		// If didn't return yet, no sub-SLA was met 
-		fmt.Println("None of the utilities for password-checking is met, returning nil: \n")
-		s.Utilities = append(s.Utilities, 0.0)
-		return val, consistency.SubSLA{}, fmt.Errorf("No subSLA met")
 	}
 
-	if (activeSLA.ID == "psw_sla") {
-		for _, sub := range activeSLA.SubSLAs {
-			if (rtt <= sub.Latency.Duration && randomNode.Address == primaryForKey) {
-				fmt.Println("Random Node happened to be Primary")
-				subAchieved := &sub 
-				s.Utilities = append(s.Utilities, subAchieved.Utility)
-				return val, *subAchieved, err
-			}
-			if ( rtt <= sub.Latency.Duration && sub.Consistency == 0) {
-				subAchieved := &sub 
-				s.Utilities = append(s.Utilities, subAchieved.Utility)
-				return val, *subAchieved, err
-			} 
+	return failed
+}
+
+// Writes several keys of one shard atomically: the primary stamps all of them with a single timestamp and replicates them as one unit,
+// so no replica ever shows some of the writes without the others. Every key is recorded as written by the session with that timestamp.
+// Keys of different shards can't be written together, MultiPut writes independent keys.
+func (c *Client) PutMulti(s *util.Session, records map[string]string) error {
+	if len(records) == 0 {
+		return nil
+	}
+	keys := make([]string, 0, len(records))
+	for key := range records {
+		keys = append(keys, key)
+	}
+
+	groups := groupKeysByShard(c.Config(), keys)
+	if len(groups) != 1 || groups[-1] != nil {
+		return fmt.Errorf("the %d keys of a transaction must belong to one shard, they are in %d", len(keys), len(groups))
+	}
+
+	resp, rtt, primary, err := c.postToPrimary(context.Background(), keys[0], "/txn", func(epoch int64) any {
+		var req struct {
+			Records []Record `json:"records"`
+		}
+		for _, key := range keys {
+			req.Records = append(req.Records, Record{Key: key, Value: records[key], Epoch: epoch})
 		}
+		return req
+	})
+	if err != nil {
+		return fmt.Errorf("HTTP error: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("transaction failed with status %d", resp.StatusCode)
 	}
 
-	// If we have not returned yet, then no sub-SLA is met
-	fmt.Println("No utility could be computed for random read")
-	s.Utilities = append(s.Utilities, 0.0)
-	return val, consistency.SubSLA{}, fmt.Errorf("No subSLA met")
+	var result struct {
+		PutTimestamp int64 `json:"put_timestamp"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return fmt.Errorf("Failed to decode response: %v", err)
+	}
+
+	c.recordRTT(primary, rtt)
+
+	for _, key := range keys {
+		s.ObjectsWritten[key] = result.PutTimestamp
+	}
+	return nil
 }
 
-func closestGet(s *util.Session, key string, sla *consistency.SLA) (string, consistency.SubSLA, error) {
-	activeSLA := s.DefaultSLA
-	if sla != nil {
-		activeSLA = sla
+// Groups the keys by the index of their shard in the config (keys that do not belong to any shard are under -1)
+func groupKeysByShard(config *util.ReplicationConfig, keys []string) map[int][]string {
+	groups := make(map[int][]string)
+	for _, key := range keys {
+		shardID := determineShardForKey(config, key)
+		groups[shardID] = append(groups[shardID], key)
 	}
+	return groups
+}
+
+// Per-key result of /mget
+type mgetRecord struct {
+	Key       string `json:"key"`
+	Value     string `json:"value"`
+	Timestamp int64  `json:"timestamp"`
+	HighTS    int64  `json:"highTS"`
+	Found     bool   `json:"found"`
+}
 
-	// Finding the closest server based on the monitoring data
-	closestNode, minRTT := monitor.GetLowestAvgRTTNode()
-	fmt.Println("Closest Node is %s with minRTT %d", closestNode, minRTT)
+// Reads the keys from the storage node in a single request, returns the records by key + the rtt
+func (c *Client) readManyFromNode(keys []string, storageNode string) (map[string]mgetRecord, time.Duration, error) {
+	body, _ := json.Marshal(map[string][]string{"keys": keys})
 
-	shardID := determineShardForKey(key)
-	primaryForKey := GlobalConfig.Shards[shardID].Primary
+	start := time.Now()
+	resp, err := c.httpClient.Post(fmt.Sprintf("http://%s/mget", storageNode), "application/json", bytes.NewBuffer(body))
+	rtt := time.Since(start)
 
-	val, _, node_hts, rtt, err := readFromNode(key, closestNode)
-	fmt.Println("RTT was %f", rtt)
+	// Adjust RTT with the artificial lag
+	rtt += c.getArtificialLag(storageNode)
 
-	// TODO: here the retry mechanism should be done
-	if (err != nil) {
-		// Some error happened for the key
-		fmt.Println("closest read failed with error")
-		fmt.Println(err)
-		s.Utilities = append(s.Utilities, 0.0)
-		return val, consistency.SubSLA{}, fmt.Errorf("No subSLA met")
+	if err != nil {
+		return nil, rtt, fmt.Errorf("HTTP error: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, rtt, fmt.Errorf("mget failed with status %d", resp.StatusCode)
 	}
 
-	if (activeSLA.ID == "cart_sla") || (activeSLA.ID == "new_sla") {
-		_, _, minReadTSPerSubSLA := optimizer.FindNodeToRead(s, key, activeSLA)
-		fmt.Println(minReadTSPerSubSLA)
+	var response struct {
+		Results []mgetRecord `json:"results"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return nil, rtt, fmt.Errorf("Failed to decode response: %v", err)
+	}
 
-		// check node high ts
-		for i, sub := range activeSLA.SubSLAs {
-			if rtt <= sub.Latency.Duration {
-				if (node_hts >= minReadTSPerSubSLA[i]) {
-					subAchieved := &sub
-					s.Utilities = append(s.Utilities, subAchieved.Utility)
-					return val, *subAchieved, err
-				}
-			}
+	records := make(map[string]mgetRecord, len(response.Results))
+	var highTS int64
+	for _, rec := range response.Results {
+		records[rec.Key] = rec
+		if rec.HighTS > highTS {
+			highTS = rec.HighTS
 		}
-		
-		// If didn't return yet, no sub-SLA was met 
-		fmt.Println("None of the utilities for password-checking is met, returning nil: \n")
-		s.Utilities = append(s.Utilities, 0.0)
-		return val, consistency.SubSLA{}, fmt.Errorf("No subSLA met")
 	}
 
-	if (activeSLA.ID == "psw_sla") {
-		for _, sub := range activeSLA.SubSLAs {
-			if (rtt <= sub.Latency.Duration && closestNode == primaryForKey) {
-				fmt.Println("Closest Node happened to be Primary")
-				subAchieved := &sub 
-				s.Utilities = append(s.Utilities, subAchieved.Utility)
-				return val, *subAchieved, err
-			}
-			if ( rtt <= sub.Latency.Duration && sub.Consistency == 0) {
-				subAchieved := &sub 
-				s.Utilities = append(s.Utilities, subAchieved.Utility)
-				return val, *subAchieved, err
-			} 
-		}
+	// The keys are of one shard (see MultiGet)
+	c.recordRTT(storageNode, rtt)
+	if len(keys) > 0 {
+		c.recordHTS(storageNode, keys[0], highTS)
 	}
-	
-	// If we have not returned yet, then no sub-SLA is met
-	fmt.Println("No utility could be computed for closest read")
-	s.Utilities = append(s.Utilities, 0.0)
-	return val, consistency.SubSLA{}, fmt.Errorf("No subSLA met")
+
+	return records, rtt, nil
 }
 
 // =====================
 // Helper Functions
 // =====================
 
+// Records the HighTS the node answered a read of the key with, it is the HighTS of the shard of the key on the node
+func (c *Client) recordHTS(node string, key string, hts int64) {
+	if shard := c.Config().ShardForKey(key); shard != nil {
+		c.monitor.RecordHTS(node, shard.ShardId, hts)
+	}
+}
+
+// Whether the list contains e
+func contains(list []string, e string) bool {
+	for _, item := range list {
+		if item == e {
+			return true
+		}
+	}
+	return false
+}
+
+// ========== Operation Deadlines ==========
+
+// Caps ctx at the operation timeout of the client under the SLA, an earlier deadline of ctx itself is kept
+func (c *Client) withOperationTimeout(ctx context.Context, sla *consistency.SLA) (context.Context, context.CancelFunc) {
+	timeout := time.Duration(atomic.LoadInt64(&c.operationTimeout))
+	if timeout == 0 {
+		timeout = sla.LeastPreferredLatency()
+	}
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// The error of an operation that ctx cut short, it matches the error of ctx (context.DeadlineExceeded or context.Canceled), a missing key was still answered and stays ErrKeyNotFound
+func contextError(ctx context.Context, err error) error {
+	ctxErr := ctx.Err()
+	if err == nil || err == ErrKeyNotFound || ctxErr == nil || errors.Is(err, ctxErr) {
+		return err
+	}
+	return fmt.Errorf("%w: %v", ctxErr, err)
+}
+
+// The error of a write that failed, one that ctx cut short is a writeOutcomeError and marks the key in the session
+func writeError(ctx context.Context, s *util.Session, key string, err error) error {
+	ctxErr := ctx.Err()
+	if ctxErr == nil {
+		return err
+	}
+	s.ObjectsWritten[key] = util.UnknownWriteTS
+	return &writeOutcomeError{ctxErr: ctxErr, err: err}
+}
+
+// A write cut short by its context, it matches both ErrWriteOutcomeUnknown and the error of the context
+type writeOutcomeError struct {
+	ctxErr error
+	err    error
+}
+
+func (e *writeOutcomeError) Error() string {
+	return fmt.Sprintf("%v (%v): %v", ErrWriteOutcomeUnknown, e.ctxErr, e.err)
+}
+
+func (e *writeOutcomeError) Unwrap() error {
+	return e.ctxErr
+}
+
+func (e *writeOutcomeError) Is(target error) bool {
+	return target == ErrWriteOutcomeUnknown
+}
+
+// Sleeps for d, unless ctx is done before (its error is returned then)
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
 // Loads the sharding and replicaiton config
-func LoadReplicationConfig(path string) error { 
+func (c *Client) LoadReplicationConfig(path string) error {
 	data, err := os.ReadFile(path)
 	if err != nil {
 		return err
@@ -409,6 +940,124 @@ func LoadReplicationConfig(path string) error {
 		return err
 	}
 
+	return c.installReplicationConfig(&config)
+}
+
+// Returns the current replication config, callers should load it once per operation
+func (c *Client) Config() *util.ReplicationConfig {
+	config, _ := c.config.Load().(*util.ReplicationConfig)
+	return config
+}
+
+// Sets the base URL of the configuration coordinator, without it the client keeps the config it loaded
+// The client then watches the coordinator, and installs every new config version it publishes
+func (c *Client) SetCoordinator(baseURL string) {
+	c.configMu.Lock()
+	defer c.configMu.Unlock()
+
+	c.coordinatorURL = baseURL
+	if !c.watchingConfig {
+		c.watchingConfig = true
+		go c.watchConfig()
+	}
+}
+
+// Fetches the current config from the coordinator and installs it if it is newer
+// Refreshes are done at most once per configRefreshCooldown, unless a storage node reported an epoch (atLeast) the client does not have yet
+func (c *Client) refreshConfig(atLeast int64) {
+	c.configMu.Lock()
+	defer c.configMu.Unlock()
+
+	if c.coordinatorURL == "" {
+		return
+	}
+	if atLeast <= c.Config().Epoch && time.Since(c.lastConfigRefresh) < configRefreshCooldown {
+		return
+	}
+	c.lastConfigRefresh = time.Now()
+
+	config, err := fetchConfig(c.httpClient, c.coordinatorURL, -1)
+	if err != nil {
+		fmt.Printf("Failed to fetch the config from the coordinator: %v\n", err)
+		return
+	}
+	if err := c.installIfNewer(config); err != nil {
+		fmt.Printf("Invalid config from the coordinator: %v\n", err)
+	}
+}
+
+// Long-polls the coordinator for the versions after the installed one, and installs them as they are published
+func (c *Client) watchConfig() {
+	for {
+		c.configMu.Lock()
+		baseURL := c.coordinatorURL
+		c.configMu.Unlock()
+
+		// Without a config yet, the current one is returned right away
+		after := int64(-1)
+		if current := c.Config(); current != nil {
+			after = current.Epoch
+		}
+
+		config, err := fetchConfig(c.watchClient, baseURL, after)
+		if err != nil {
+			fmt.Printf("Failed to watch the config of the coordinator: %v\n", err)
+			time.Sleep(configWatchRetryDelay)
+			continue
+		}
+		if config == nil {
+			// The poll timed out without a new version
+			continue
+		}
+
+		c.configMu.Lock()
+		err = c.installIfNewer(config)
+		c.configMu.Unlock()
+		if err != nil {
+			fmt.Printf("Invalid config from the coordinator: %v\n", err)
+			time.Sleep(configWatchRetryDelay)
+		}
+	}
+}
+
+// Gets /config from the coordinator, with after >= 0 it waits for a version with a newer epoch (nil if none came up)
+func fetchConfig(client *http.Client, baseURL string, after int64) (*util.ReplicationConfig, error) {
+	url := baseURL + "/config"
+	if after >= 0 {
+		url = fmt.Sprintf("%s?after=%d", url, after)
+	}
+
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotModified {
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status %d", resp.StatusCode)
+	}
+
+	var config util.ReplicationConfig
+	if err := json.NewDecoder(resp.Body).Decode(&config); err != nil {
+		return nil, fmt.Errorf("invalid config: %v", err)
+	}
+	return &config, nil
+}
+
+// Installs the config unless the client already has its epoch (must hold c.configMu)
+func (c *Client) installIfNewer(config *util.ReplicationConfig) error {
+	if current := c.Config(); current != nil && config.Epoch <= current.Epoch {
+		return nil
+	}
+	fmt.Printf("Installing config epoch %d\n", config.Epoch)
+	return c.installReplicationConfig(config)
+}
+
+// Resolves the secondary addresses of the config and makes it the config of the client (and the optimizer)
+func (c *Client) installReplicationConfig(config *util.ReplicationConfig) error {
 	// From the secondary IDs assign the secondary endpoints
 	nodeIDToAddress := make(map[string]string)
 	for _, node := range config.Nodes {
@@ -428,36 +1077,37 @@ func LoadReplicationConfig(path string) error {
 		config.Shards[i].Secondaries = secondaryAddrs
 	}
 
-	GlobalConfig = &config
+	// Swapped as a whole, operations in flight keep the version they loaded
+	c.config.Store(config)
 
 	// Also udpate the optimizer with the same config
-	optimizer.Init(GlobalConfig)
+	c.optimizer.Init(config)
 
 	fmt.Println("Loaded the config and it is:")
-	fmt.Println(GlobalConfig)
+	fmt.Println(config)
 
 	return nil 
 }
 
-func determineShardForKey(string_key string) int {
-	key, err := strconv.Atoi(string_key)
-	if err != nil {
-		fmt.Printf("Error happened in getting the int value of the key")
+// Index of the shard of the key in the config
+// Keys are placed by the partitioning of the config (see partition.Scheme), -1 if no shard holds the key
+func determineShardForKey(config *util.ReplicationConfig, key string) int {
+	i := config.ShardIndexForKey(key)
+	if i < 0 {
+		fmt.Printf("No shard found for key %s (partitioning by %s)\n", key, config.Partitioning.Name())
 		return -1
 	}
-   
-    for i, shard := range GlobalConfig.Shards {
-    
-        if key >= shard.RangeStart && key <= shard.RangeEnd {
-            fmt.Printf("Key %d belongs to shard #%d: %+v\n", key, i, shard)
-            return i
-        }
-    }
-    panic(fmt.Sprintf("No shard found for key: %d", key))
+	fmt.Printf("Key %s belongs to shard #%d: %+v\n", key, i, config.Shards[i])
+	return i
 }
 
 // Return Values: value, read_ts of the object, ConditionCode, utility , error (if any)
-func readFromNode(key string, storageNode string) (string, int64, int64, time.Duration, error) {
+// The attempts stop once ctx is done
+func (c *Client) readFromNode(ctx context.Context, key string, storageNode string, attempts int) (string, int64, int64, time.Duration, error) {
+	if c.currentTransport() == GRPCTransport {
+		return c.readFromNodeGRPC(ctx, key, storageNode, attempts)
+	}
+
 	url := fmt.Sprintf("http://%s/get?key=%s", storageNode, key)
 
 	var lastErr error
@@ -468,13 +1118,28 @@ func readFromNode(key string, storageNode string) (string, int64, int64, time.Du
 		HighTS    int64  `json:"highTS"`
 	}
 
-	for attempt := 1; attempt <= 3; attempt++ {
+	for attempt := 1; attempt <= attempts; attempt++ {
+		req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+		if err != nil {
+			return "", -1, -1, 0, fmt.Errorf("failed to create request: %v", err)
+		}
+
 		start := time.Now()
-		resp, err := http.Get(url)
+		resp, err := c.httpClient.Do(req)
 		rtt := time.Since(start)
 
 		// Adjust RTT with the artificial lag
-		rtt += getArtificialLag(storageNode)
+		rtt += c.getArtificialLag(storageNode)
+
+		// Missing (or deleted) keys still come with the timestamps of the node, so there is no point in retrying
+		if err == nil && resp.StatusCode == http.StatusNotFound {
+			defer resp.Body.Close()
+			if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+				return "", -1, -1, rtt, ErrKeyNotFound
+			}
+			c.recordHTS(storageNode, key, response.HighTS)
+			return "", response.Timestamp, response.HighTS, rtt, ErrKeyNotFound
+		}
 
 		if err != nil || resp.StatusCode != http.StatusOK {
 			if resp != nil {
@@ -482,7 +1147,9 @@ func readFromNode(key string, storageNode string) (string, int64, int64, time.Du
 			}
 			fmt.Printf("Attempt %d failed: error invoking GET on %s\n", attempt, storageNode)
 			lastErr = fmt.Errorf("HTTP error (attempt %d): %v", attempt, err)
-			time.Sleep(100 * time.Millisecond) // optional small delay between retries
+			if attempt == attempts || sleepContext(ctx, 100 * time.Millisecond) != nil { // optional small delay between retries
+				break
+			}
 			continue
 		}
 
@@ -491,17 +1158,16 @@ func readFromNode(key string, storageNode string) (string, int64, int64, time.Du
 		if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
 			fmt.Printf("Attempt %d failed: error decoding response\n", attempt)
 			lastErr = err
-			time.Sleep(100 * time.Millisecond)
+			if attempt == attempts || sleepContext(ctx, 100 * time.Millisecond) != nil {
+				break
+			}
 			continue
 		}
 
 		// If successful, record metrics and return
 		
-		coldStartRTTCounter++
-		if (coldStartRTTCounter > 5) {
-			monitor.RecordRTT(storageNode, rtt)
-		}
-		monitor.RecordHTS(storageNode, response.HighTS)
+		c.recordRTT(storageNode, rtt)
+		c.recordHTS(storageNode, key, response.HighTS)
 		return response.Value, response.Timestamp, response.HighTS, rtt, nil
 	}
 
@@ -509,122 +1175,38 @@ func readFromNode(key string, storageNode string) (string, int64, int64, time.Du
 	return "", -1, -1, 0, lastErr
 }
 
-// TODO: This implementation is right now highly tuned for the SLA's we are testing. Generalize this implementation
-// I think we have everything to make thi sfunction general!
-func detectSubSLAHit(obj_ts int64, node_hts int64, rtt time.Duration, targetSubSLA consistency.SubSLA, activeSLA *consistency.SLA, minReadTSPerSubSLA []int64) (*consistency.SubSLA, []monitor.SubSLAStatus) {
-	var statuses []monitor.SubSLAStatus
-
-	if activeSLA.ID == "psw_sla" {
-		for _, sub := range activeSLA.SubSLAs {
-			status := monitor.SubSLAStatus{SubSLA: sub, Status: "NA"}
-
-			if targetSubSLA.Consistency == 4 { // Strong
-				if rtt <= sub.Latency.Duration {
-					status.Status = "Met"
-					statuses = append(statuses, status)
-					subGained := sub
-					return &subGained, statuses
-				} else {
-					status.Status = "Lat_Not_Met"
-				}
-			} else if targetSubSLA.Consistency == 0 { // Eventual
-				if sub.Consistency == 0 {
-					if rtt <= sub.Latency.Duration {
-						status.Status = "Met"
-						statuses = append(statuses, status)
-						subGained := sub
-						return &subGained, statuses
-					} else {
-						status.Status = "Lat_Not_Met"
-					}
-				}
-			}
-			statuses = append(statuses, status)
-		}
-
-		fmt.Println("None of the utilities for password-checking is met, returning nil")
-		return nil, statuses
-	}
-
-	if activeSLA.ID == "cart_sla" || activeSLA.ID == "dynamic_cart_sla" {
-		fmt.Println("detectSubSLAHit for cart_sla")
-		fmt.Println(minReadTSPerSubSLA)
-		fmt.Printf("node_hts is %d and rtt is %v\n", node_hts, rtt)
-
-		for i, sub := range activeSLA.SubSLAs {
-			status := monitor.SubSLAStatus{SubSLA: sub, Status: "NA"}
-			if rtt > sub.Latency.Duration {
-				status.Status = "Lat_Not_Met"
-			} else if node_hts < minReadTSPerSubSLA[i] {
-				status.Status = "Consistency_Not_Met"
-			} else {
-				status.Status = "Met"
-				statuses = append(statuses, status)
-				subGained := sub
-				return &subGained, statuses
-			}
-			statuses = append(statuses, status)
-		}
-
-		fmt.Println("None of the utilities for cart-checking is met, returning nil")
-		return nil, statuses
-	}
-
-	if activeSLA.ID == "new_sla" {
-		fmt.Println(minReadTSPerSubSLA)
-		fmt.Printf("node_hts is %d and rtt is %v\n", node_hts, rtt)
-
-		for i, sub := range activeSLA.SubSLAs {
-			status := monitor.SubSLAStatus{SubSLA: sub, Status: "NA"}
-			if rtt > sub.Latency.Duration {
-				status.Status = "Lat_Not_Met"
-			} else if node_hts < minReadTSPerSubSLA[i] {
-				status.Status = "Consistency_Not_Met"
-			} else {
-				status.Status = "Met"
-				statuses = append(statuses, status)
-				subGained := sub
-				return &subGained, statuses
-			}
-			statuses = append(statuses, status)
-		}
-
-		fmt.Println("None of the utilities is met, returning nil")
-		return nil, statuses
-	}
-
-	fmt.Println("SLA ID not recognized, returning nil")
-	return nil, statuses
-}
-
 // =====================
 // Monitoring Functions
 // =====================
 
 // Note: We added this to our client-api, but this could also be done in the "beginSession" function
 // Start RTT for each node in the replicaiton config
-func SendProbes() {
-	for _, node := range GlobalConfig.Nodes {
-		err := MeasureProbeRTT(node.Address, 2, 5)	// Pass timeout and pingCount to the function as well
+func (c *Client) SendProbes() {
+	for _, node := range c.Config().Nodes {
+		err := c.MeasureProbeRTT(node.Address, 2, 5)	// Pass timeout and pingCount to the function as well
 		
 		if (err != nil) {
-			fmt.Println("Error happened sending probes to node: %s\n", node.Address)
+			fmt.Printf("Error happened sending probes to node: %s\n", node.Address)
 		}
 		
 	} 
 }
 
-func MeasureProbeRTT(host string, timeout time.Duration, pingCount int) error {
+func (c *Client) MeasureProbeRTT(host string, timeout time.Duration, pingCount int) error {
+	if c.currentTransport() == GRPCTransport {
+		return c.measureProbeRTTGRPC(host, timeout, pingCount)
+	}
+
 	url := fmt.Sprintf("http://%s/probe", host)
 	fmt.Println("Probing URL:", url)
 
-	// Temporarily set timeout on shared client (optional, but acceptable for controlled use)
-	httpClient.Timeout = timeout * time.Second
+	// Probes share the connections of the client, but not its timeout
+	probeClient := &http.Client{Transport: c.httpClient.Transport, Timeout: timeout * time.Second}
 
 	// Warm-up phase (not timed)
 	warmupCount := 2
 	for i := 0; i < warmupCount; i++ {
-		resp, err := httpClient.Get(url)
+		resp, err := probeClient.Get(url)
 		if err != nil {
 			fmt.Printf("Warm-up error pinging %s: %v\n", url, err)
 			continue
@@ -635,7 +1217,7 @@ func MeasureProbeRTT(host string, timeout time.Duration, pingCount int) error {
 	// Actual RTT measurement phase
 	for i := 0; i < pingCount; i++ {
 		start := time.Now()
-		resp, err := httpClient.Get(url)
+		resp, err := probeClient.Get(url)
 		elapsed := time.Since(start)
 
 		if err != nil {
@@ -645,7 +1227,7 @@ func MeasureProbeRTT(host string, timeout time.Duration, pingCount int) error {
 		resp.Body.Close()
 
 		if resp.StatusCode == http.StatusOK {
-			monitor.RecordRTT(host, time.Duration(elapsed.Milliseconds()) * time.Millisecond)
+			c.monitor.RecordRTT(host, time.Duration(elapsed.Milliseconds()) * time.Millisecond)
 		} else {
 			return err
 		}
@@ -653,49 +1235,53 @@ func MeasureProbeRTT(host string, timeout time.Duration, pingCount int) error {
 	return nil
 }
 
-func SetArtificialLat(nodeId string, lag time.Duration) {
-	lagMu.Lock()
-	defer lagMu.Unlock()
+func (c *Client) SetArtificialLat(nodeId string, lag time.Duration) {
+	c.lagMu.Lock()
+	defer c.lagMu.Unlock()
 
 	found := false
-	for _, node := range GlobalConfig.Nodes {
+	for _, node := range c.Config().Nodes {
 		if node.Id == nodeId {
-			artificialLags[node.Address] = lag
+			c.artificialLags[node.Address] = lag
 			found = true
 			break
 		}
 	}
 	if !found {
-		fmt.Printf("Warning: nodeId %s not found in GlobalConfig.Nodes\n", nodeId)
+		fmt.Printf("Warning: nodeId %s not found in the nodes of the config\n", nodeId)
 	}
 }
 
-func getArtificialLag(node string) time.Duration {
-	lagMu.RLock()
-	defer lagMu.RUnlock()
-	return artificialLags[node]
+func (c *Client) getArtificialLag(node string) time.Duration {
+	c.lagMu.RLock()
+	defer c.lagMu.RUnlock()
+	return c.artificialLags[node]
 }
 
 // =====================
 // Debugging Functions
 // =====================
 
-func PrintRTTs() {
-	for _, node := range GlobalConfig.Nodes {
-		fmt.Println(node.Id, monitor.GetRTTs(node.Address))
+func (c *Client) PrintRTTs() {
+	for _, node := range c.Config().Nodes {
+		fmt.Println(node.Id, c.monitor.GetRTTs(node.Address))
 	}
 }
 
 // ==========================================
 // Helper Functions for the Pe-Laoding Phase
 // ==========================================
-func GetPrimaryLatestKey(key string) (value string, obj_ts int64, high_timestamp int64, err error) {
-	shardID := determineShardForKey(key)
-	val, obj_ts, node_hts, _, err := readFromNode(key, GlobalConfig.Shards[shardID].Primary)
+func (c *Client) GetPrimaryLatestKey(key string) (value string, obj_ts int64, high_timestamp int64, err error) {
+	config := c.Config()
+	shardID := determineShardForKey(config, key)
+	if shardID < 0 {
+		return "", -1, -1, fmt.Errorf("no shard found for key %s", key)
+	}
+	val, obj_ts, node_hts, _, err := c.readFromNode(context.Background(), key, config.Shards[shardID].Primary, readAttempts)
 	return val, obj_ts, node_hts, err
 }	
 
-func WaitForSecondaries(target_ts int64, target_key string) {
+func (c *Client) WaitForSecondaries(target_ts int64, target_key string) {
 	// Now wait for secondaries to reach the obj_ts
 	fmt.Println("Waiting for secondaries to catch up...")
 
@@ -711,11 +1297,16 @@ func WaitForSecondaries(target_ts int64, target_key string) {
 		case <-ticker.C:
 			allCaughtUp := true
 
-			shardID := determineShardForKey(target_key)
-				for _, secondary := range GlobalConfig.Shards[shardID].Secondaries {
+			config := c.Config()
+			shardID := determineShardForKey(config, target_key)
+			if shardID < 0 {
+				fmt.Printf("No shard found for key %s\n", target_key)
+				return
+			}
+				for _, secondary := range config.Shards[shardID].Secondaries {
 				url := fmt.Sprintf("http://%s/status", secondary)
 
-				resp, err := http.Get(url)
+				resp, err := c.httpClient.Get(url)
 				if err != nil {
 					fmt.Printf("Failed to contact secondary %s: %v\n", secondary, err)
 					allCaughtUp = false
@@ -731,8 +1322,8 @@ func WaitForSecondaries(target_ts int64, target_key string) {
 				}
 				resp.Body.Close()
 
-				// Get timestamp for the relevant shard
-				secTimestamp := status[shardID]
+				// Get timestamp for the relevant shard (the status is keyed by shard id, which a split or merge can set apart from the index)
+				secTimestamp := status[config.Shards[shardID].ShardId]
 				if secTimestamp < target_ts {
 					fmt.Printf("Secondary %s for shard %d not caught up (has %d, want %d)\n", secondary, shardID, secTimestamp, target_ts)
 					allCaughtUp = false
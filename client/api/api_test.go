@@ -0,0 +1,93 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"client/consistency"
+	"client/util"
+)
+
+// Client of a single shard [0, 1000] whose primary is the server
+func newTestClient(t *testing.T, server *httptest.Server) *Client {
+	t.Helper()
+	primary := strings.TrimPrefix(server.URL, "http://")
+	config := &util.ReplicationConfig{
+		Nodes:  []util.StorageNode{{Id: "node1", Address: primary}},
+		Shards: []util.Shard{{ShardId: 0, RangeStart: 0, RangeEnd: 1000, Primary: primary, PrimaryID: "node1"}},
+	}
+	c, err := NewClient(config, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// Primary that answers every write with put_timestamp 42 after delay
+func slowPrimary(delay time.Duration) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(delay)
+		json.NewEncoder(w).Encode(map[string]int64{"put_timestamp": 42})
+	}))
+}
+
+var writeSLA = &consistency.SLA{ID: "new_sla", SubSLAs: []consistency.SubSLA{
+	{Consistency: consistency.ReadMyWrites, Latency: consistency.LatencyBound{Duration: 50 * time.Millisecond}, Utility: 1},
+}}
+
+func TestPutWithinTheLeastPreferredLatencyRecordsItsTimestamp(t *testing.T) {
+	server := slowPrimary(0)
+	defer server.Close()
+	c := newTestClient(t, server)
+
+	s := c.BeginSession(writeSLA, util.Pileus)
+	if err := c.PutContext(context.Background(), s, "key1", "a"); err != nil {
+		t.Fatal(err)
+	}
+	if s.ObjectsWritten["key1"] != 42 {
+		t.Errorf("written timestamp of key1 = %d, want 42", s.ObjectsWritten["key1"])
+	}
+}
+
+func TestPutCutShortHasAnUnknownOutcome(t *testing.T) {
+	server := slowPrimary(200 * time.Millisecond)
+	defer server.Close()
+	c := newTestClient(t, server)
+
+	// Capped at the 50ms of the only sub-SLA of the session
+	s := c.BeginSession(writeSLA, util.Pileus)
+	err := c.PutContext(context.Background(), s, "key1", "a")
+	if !errors.Is(err, ErrWriteOutcomeUnknown) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("PutContext past the latency bound = %v, want ErrWriteOutcomeUnknown and context.DeadlineExceeded", err)
+	}
+	if s.ObjectsWritten["key1"] != util.UnknownWriteTS {
+		t.Errorf("written timestamp of key1 = %d, want util.UnknownWriteTS", s.ObjectsWritten["key1"])
+	}
+
+	// Only the primary is sure to have the write, if it was applied
+	nodes, minReadTS := c.optimizer.SelectNodesForReadMyWrites(c.Config(), s, "key1")
+	if len(nodes) != 1 || nodes[0] != c.Config().Shards[0].Primary || minReadTS != -1 {
+		t.Errorf("read-my-writes after the unknown outcome = (%v, %d), want only the primary", nodes, minReadTS)
+	}
+}
+
+func TestCancelledDeleteHasAnUnknownOutcome(t *testing.T) {
+	server := slowPrimary(200 * time.Millisecond)
+	defer server.Close()
+	c := newTestClient(t, server)
+	c.SetOperationTimeout(-1)
+
+	s := c.BeginSession(writeSLA, util.Pileus)
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+	err := c.DeleteContext(ctx, s, "key1")
+	if !errors.Is(err, ErrWriteOutcomeUnknown) || !errors.Is(err, context.Canceled) {
+		t.Errorf("cancelled DeleteContext = %v, want ErrWriteOutcomeUnknown and context.Canceled", err)
+	}
+}
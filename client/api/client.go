@@ -0,0 +1,248 @@
+package api
+
+import (
+	"client/consistency"
+	"client/monitor"
+	"client/optimizer"
+	"client/util"
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	pileuspb "pileus/proto"
+)
+
+// =====================
+// Pileus Client
+// =====================
+
+// Client talks to one Pileus cluster: it owns its replication config, its monitor and optimizer, and its transport to the storage nodes.
+// Several clients can run side by side in one process, e.g. against two clusters or for isolated experiments.
+// The package-level functions (Get, Put, ...) use a default client, configured with LoadReplicationConfig and SetCoordinator.
+type Client struct {
+	// Current replication config (a *util.ReplicationConfig), a new version replaces it as a whole
+	// Operations load it once through Config, so they keep working on one version while a newer one is installed
+	config atomic.Value
+
+	// Base URL of the configuration coordinator (e.g. http://host:8080), the client watches it for new config versions
+	coordinatorURL string
+	watchingConfig bool
+
+	// Watches are long-polls that the coordinator holds open until the next version, they must not be cut by a client timeout
+	watchClient *http.Client
+
+	// Config refreshes are rate limited, a failing primary makes every write ask for one
+	configMu          sync.Mutex
+	lastConfigRefresh time.Time
+
+	httpClient *http.Client
+
+	// Transport of Get, Put, PutIfVersion, Delete and the probes (MultiGet, MultiPut and the config watch always use HTTP)
+	// A Transport, accessed atomically since SetTransport may run while operations are in flight
+	transport int32
+	grpcConns *pileuspb.Conns
+
+	// Added to the measured RTTs of the nodes (by address), to emulate slower links
+	artificialLags map[string]time.Duration
+	lagMu          sync.RWMutex
+
+	// The first RTTs of a client include the connection setup, they are not recorded
+	coldStartRTTCounter int64
+
+	// Cap of Get, Put and Delete (see SetOperationTimeout), a time.Duration accessed atomically
+	operationTimeout int64
+
+	monitor   *monitor.Monitor
+	optimizer *optimizer.Optimizer
+}
+
+// Options of a new Client, the zero value reads and writes over HTTP and keeps the config the client was created with
+type Options struct {
+	Transport      Transport		// HTTPTransport by default, GRPCTransport needs the grpcAddress of every node in the config
+	CoordinatorURL string			// coordinator to watch for new config versions (see SetCoordinator)
+	HTTPClient     *http.Client		// for the requests to the storage nodes, by default one that keeps connections alive
+	OperationTimeout time.Duration	// cap of Get, Put and Delete, by default the latency bound of the least preferred sub-SLA (see SetOperationTimeout)
+}
+
+// NewClient returns a client for the cluster of the config, with a monitor and an optimizer of its own
+func NewClient(config *util.ReplicationConfig, options Options) (*Client, error) {
+	if config == nil {
+		return nil, errors.New("a client needs a replication config")
+	}
+
+	m := monitor.New()
+	c := newClient(m, optimizer.New(m), options)
+	if err := c.installReplicationConfig(config); err != nil {
+		return nil, err
+	}
+	if options.CoordinatorURL != "" {
+		c.SetCoordinator(options.CoordinatorURL)
+	}
+	return c, nil
+}
+
+func newClient(m *monitor.Monitor, o *optimizer.Optimizer, options Options) *Client {
+	httpClient := options.HTTPClient
+	if httpClient == nil {
+		httpClient = &http.Client{
+			Transport: &http.Transport{
+				MaxIdleConns:        100,
+				MaxIdleConnsPerHost: 100,
+				IdleConnTimeout:     90 * time.Second,
+			},
+		}
+	}
+
+	return &Client{
+		watchClient:    &http.Client{},
+		httpClient:     httpClient,
+		transport:      int32(options.Transport),
+		grpcConns:      pileuspb.NewConns(),
+		artificialLags: make(map[string]time.Duration),
+		operationTimeout: int64(options.OperationTimeout),
+		monitor:        m,
+		optimizer:      o,
+	}
+}
+
+// SetOperationTimeout caps the time of Get, Put and Delete (and their Context variants), on top of the deadline of their context
+// With 0 (the default) an operation is capped at the latency bound of the least preferred sub-SLA of its SLA (the session's for writes),
+// since a later answer meets none of the sub-SLAs; a negative timeout leaves the operations uncapped
+func (c *Client) SetOperationTimeout(timeout time.Duration) {
+	atomic.StoreInt64(&c.operationTimeout, int64(timeout))
+}
+
+// Monitor returns the monitor of the client, e.g. to set up the utility reports to the coordinator (see monitor.SetDynamicConfigData)
+func (c *Client) Monitor() *monitor.Monitor {
+	return c.monitor
+}
+
+// Records the RTT of a request to the node with the monitor, once the client is past its cold start
+func (c *Client) recordRTT(node string, rtt time.Duration) {
+	if atomic.AddInt64(&c.coldStartRTTCounter, 1) > 5 {
+		c.monitor.RecordRTT(node, rtt)
+	}
+}
+
+// =====================
+// Default Client
+// =====================
+
+// The package-level functions use the default client, it works with the default monitor and optimizer of their packages
+var defaultClient = newClient(monitor.Default(), optimizer.Default(), Options{})
+
+// DefaultClient returns the client that the package-level functions use
+func DefaultClient() *Client {
+	return defaultClient
+}
+
+func BeginSession(sla *consistency.SLA, serverSelectionPolicy util.ServerSelectionPolicy) *util.Session {
+	return defaultClient.BeginSession(sla, serverSelectionPolicy)
+}
+
+func EndSession(s *util.Session) {
+	defaultClient.EndSession(s)
+}
+
+func Put(s *util.Session, key string, value string) error {
+	return defaultClient.Put(s, key, value)
+}
+
+func PutContext(ctx context.Context, s *util.Session, key string, value string) error {
+	return defaultClient.PutContext(ctx, s, key, value)
+}
+
+func PutWithTTL(s *util.Session, key string, value string, ttl time.Duration) error {
+	return defaultClient.PutWithTTL(s, key, value, ttl)
+}
+
+func PutIfVersion(s *util.Session, key string, value string, expectedTS int64) error {
+	return defaultClient.PutIfVersion(s, key, value, expectedTS)
+}
+
+func Delete(s *util.Session, key string) error {
+	return defaultClient.Delete(s, key)
+}
+
+func DeleteContext(ctx context.Context, s *util.Session, key string) error {
+	return defaultClient.DeleteContext(ctx, s, key)
+}
+
+func Get(s *util.Session, key string, sla *consistency.SLA) (string, consistency.SubSLA, error) {
+	return defaultClient.Get(s, key, sla)
+}
+
+func GetContext(ctx context.Context, s *util.Session, key string, sla *consistency.SLA) (string, consistency.SubSLA, error) {
+	return defaultClient.GetContext(ctx, s, key, sla)
+}
+
+func PileusGet(s *util.Session, key string, sla *consistency.SLA) (string, consistency.SubSLA, error) {
+	return defaultClient.PileusGet(s, key, sla)
+}
+
+func GetAt(s *util.Session, key string, ts int64) (string, error) {
+	return defaultClient.GetAt(s, key, ts)
+}
+
+func MultiGet(s *util.Session, keys []string, sla *consistency.SLA) map[string]KeyResult {
+	return defaultClient.MultiGet(s, keys, sla)
+}
+
+func MultiPut(s *util.Session, records map[string]string) map[string]error {
+	return defaultClient.MultiPut(s, records)
+}
+
+func MultiPutWithTTL(s *util.Session, records map[string]string, ttls map[string]time.Duration) map[string]error {
+	return defaultClient.MultiPutWithTTL(s, records, ttls)
+}
+
+func PutMulti(s *util.Session, records map[string]string) error {
+	return defaultClient.PutMulti(s, records)
+}
+
+func LoadReplicationConfig(path string) error {
+	return defaultClient.LoadReplicationConfig(path)
+}
+
+func GlobalConfig() *util.ReplicationConfig {
+	return defaultClient.Config()
+}
+
+func SetCoordinator(baseURL string) {
+	defaultClient.SetCoordinator(baseURL)
+}
+
+func SetTransport(t Transport) {
+	defaultClient.SetTransport(t)
+}
+
+func SetOperationTimeout(timeout time.Duration) {
+	defaultClient.SetOperationTimeout(timeout)
+}
+
+func SendProbes() {
+	defaultClient.SendProbes()
+}
+
+func MeasureProbeRTT(host string, timeout time.Duration, pingCount int) error {
+	return defaultClient.MeasureProbeRTT(host, timeout, pingCount)
+}
+
+func SetArtificialLat(nodeId string, lag time.Duration) {
+	defaultClient.SetArtificialLat(nodeId, lag)
+}
+
+func PrintRTTs() {
+	defaultClient.PrintRTTs()
+}
+
+func GetPrimaryLatestKey(key string) (value string, obj_ts int64, high_timestamp int64, err error) {
+	return defaultClient.GetPrimaryLatestKey(key)
+}
+
+func WaitForSecondaries(target_ts int64, target_key string) {
+	defaultClient.WaitForSecondaries(target_ts, target_key)
+}
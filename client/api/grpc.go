@@ -0,0 +1,228 @@
+package api
+
+import (
+	"client/util"
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	pileuspb "pileus/proto"
+)
+
+// =====================
+// gRPC Transport
+// =====================
+
+type Transport int
+
+const (
+	HTTPTransport Transport = iota
+	GRPCTransport
+)
+
+// SetTransport picks the transport to the storage nodes, GRPCTransport needs the grpcAddress of every node in the config
+// It can be switched while the client is in use (operations in flight finish on the transport they started with),
+// e.g. to compare the RTTs of both transports for the same workload
+func (c *Client) SetTransport(t Transport) {
+	atomic.StoreInt32(&c.transport, int32(t))
+}
+
+// Transport of the operations that start now
+func (c *Client) currentTransport() Transport {
+	return Transport(atomic.LoadInt32(&c.transport))
+}
+
+// Returns the Storage client of the node with the given (HTTP) address
+func (c *Client) storageClient(config *util.ReplicationConfig, node string) (pileuspb.StorageClient, error) {
+	for _, n := range config.Nodes {
+		if n.Address != node {
+			continue
+		}
+		if n.GRPCAddress == "" {
+			return nil, fmt.Errorf("node %s has no gRPC address in the config", n.Id)
+		}
+		conn, err := c.grpcConns.Get(n.GRPCAddress)
+		if err != nil {
+			return nil, err
+		}
+		return pileuspb.NewStorageClient(conn), nil
+	}
+	return nil, fmt.Errorf("node %s is not in the config", node)
+}
+
+// readFromNode over gRPC
+func (c *Client) readFromNodeGRPC(ctx context.Context, key string, storageNode string, attempts int) (string, int64, int64, time.Duration, error) {
+	client, err := c.storageClient(c.Config(), storageNode)
+	if err != nil {
+		return "", -1, -1, 0, err
+	}
+
+	var lastErr error
+	for attempt := 1; attempt <= attempts; attempt++ {
+		start := time.Now()
+		response, err := client.Get(ctx, &pileuspb.GetRequest{Key: key})
+		rtt := time.Since(start)
+
+		// Adjust RTT with the artificial lag
+		rtt += c.getArtificialLag(storageNode)
+
+		if err != nil {
+			fmt.Printf("Attempt %d failed: error invoking GET on %s\n", attempt, storageNode)
+			lastErr = fmt.Errorf("gRPC error (attempt %d): %v", attempt, err)
+			if attempt == attempts || sleepContext(ctx, 100 * time.Millisecond) != nil {
+				break
+			}
+			continue
+		}
+
+		// Missing (or deleted) keys still come with the timestamps of the node, so there is no point in retrying
+		c.recordHTS(storageNode, key, response.HighTs)
+		if !response.Found {
+			return "", response.Timestamp, response.HighTs, rtt, ErrKeyNotFound
+		}
+
+		c.recordRTT(storageNode, rtt)
+		return response.Value, response.Timestamp, response.HighTs, rtt, nil
+	}
+
+	// All attempts failed
+	return "", -1, -1, 0, lastErr
+}
+
+// readAtFromNode over gRPC
+func (c *Client) readAtFromNodeGRPC(key string, storageNode string, at int64) (string, error) {
+	client, err := c.storageClient(c.Config(), storageNode)
+	if err != nil {
+		return "", err
+	}
+
+	response, err := client.Get(context.Background(), &pileuspb.GetRequest{Key: key, At: &at})
+	switch status.Code(err) {
+	case codes.OK:
+	case codes.Unavailable:
+		return "", errNotCaughtUp
+	case codes.OutOfRange:
+		return "", ErrVersionNotRetained
+	default:
+		return "", err
+	}
+
+	c.recordHTS(storageNode, key, response.HighTs)
+	if !response.Found {
+		return "", ErrKeyNotFound
+	}
+	return response.Value, nil
+}
+
+func (c *Client) putGRPC(ctx context.Context, key string, value string, expectedTS *int64, ttl time.Duration) (int64, time.Duration, string, error) {
+	return c.writeToPrimaryGRPC(ctx, key, func(client pileuspb.StorageClient, epoch int64, opts ...grpc.CallOption) (*pileuspb.WriteResponse, error) {
+		return client.Set(ctx, &pileuspb.SetRequest{
+			Key:               key,
+			Value:             value,
+			Epoch:             epoch,
+			ExpectedTimestamp: expectedTS,
+			TtlMs:             ttl.Milliseconds(),
+		}, opts...)
+	})
+}
+
+func (c *Client) deleteGRPC(ctx context.Context, key string) (int64, time.Duration, string, error) {
+	return c.writeToPrimaryGRPC(ctx, key, func(client pileuspb.StorageClient, epoch int64, opts ...grpc.CallOption) (*pileuspb.WriteResponse, error) {
+		return client.Delete(ctx, &pileuspb.DeleteRequest{Key: key, Epoch: epoch}, opts...)
+	})
+}
+
+// postToPrimary over gRPC: a write the primary can't take, or turns down for another epoch (FAILED_PRECONDITION),
+// is retried once if the shard moved to a newer epoch in the meantime
+// Returns the write timestamp (the current object timestamp on ErrVersionConflict) + the rtt + the primary that was used
+func (c *Client) writeToPrimaryGRPC(ctx context.Context, key string, write func(client pileuspb.StorageClient, epoch int64, opts ...grpc.CallOption) (*pileuspb.WriteResponse, error)) (int64, time.Duration, string, error) {
+	for attempt := 1; ; attempt++ {
+		config := c.Config()
+		shardID := determineShardForKey(config, key)
+		if shardID < 0 {
+			return -1, 0, "", fmt.Errorf("no shard found for key %s", key)
+		}
+		shard := config.Shards[shardID]
+
+		client, err := c.storageClient(config, shard.Primary)
+		if err != nil {
+			return -1, 0, shard.Primary, err
+		}
+
+		var trailer metadata.MD
+		start := time.Now()
+		response, err := write(client, shard.Epoch, grpc.Trailer(&trailer))
+		rtt := time.Since(start)
+
+		// Adjust RTT is there is a lag associated wih Primary
+		rtt += c.getArtificialLag(shard.Primary)
+
+		// A node that knows of a newer epoch tells us which one, so the refresh is not skipped by the cooldown
+		var nodeEpoch int64
+		switch status.Code(err) {
+		case codes.OK:
+			return response.Timestamp, rtt, shard.Primary, nil
+		case codes.Aborted:
+			return pileuspb.TrailerInt(trailer, pileuspb.CurrentTimestampTrailer), rtt, shard.Primary, ErrVersionConflict
+		case codes.FailedPrecondition:
+			nodeEpoch = pileuspb.TrailerInt(trailer, pileuspb.EpochTrailer)
+		case codes.Unavailable, codes.DeadlineExceeded:
+		default:
+			return -1, rtt, shard.Primary, err
+		}
+		if attempt > 1 || ctx.Err() != nil {
+			return -1, rtt, shard.Primary, err
+		}
+
+		c.refreshConfig(nodeEpoch)
+		current := c.Config()
+		currentID := determineShardForKey(current, key)
+		if currentID < 0 || current.Shards[currentID].Epoch == shard.Epoch {
+			return -1, rtt, shard.Primary, err
+		}
+		fmt.Printf("Shard %d moved to epoch %d, retrying on the primary %s\n", current.Shards[currentID].ShardId, current.Shards[currentID].Epoch, current.Shards[currentID].Primary)
+	}
+}
+
+// MeasureProbeRTT over gRPC
+func (c *Client) measureProbeRTTGRPC(host string, timeout time.Duration, pingCount int) error {
+	client, err := c.storageClient(c.Config(), host)
+	if err != nil {
+		return err
+	}
+	fmt.Println("Probing over gRPC:", host)
+
+	probe := func() error {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout * time.Second)
+		defer cancel()
+		_, err := client.Probe(ctx, &pileuspb.ProbeRequest{})
+		return err
+	}
+
+	// Warm-up phase (not timed), it also sets up the connection
+	warmupCount := 2
+	for i := 0; i < warmupCount; i++ {
+		if err := probe(); err != nil {
+			fmt.Printf("Warm-up error pinging %s: %v\n", host, err)
+		}
+	}
+
+	// Actual RTT measurement phase
+	for i := 0; i < pingCount; i++ {
+		start := time.Now()
+		err := probe()
+		elapsed := time.Since(start)
+
+		if err != nil {
+			fmt.Printf("Error pinging %s: %v\n", host, err)
+			continue
+		}
+		c.monitor.RecordRTT(host, time.Duration(elapsed.Milliseconds()) * time.Millisecond)
+	}
+	return nil
+}
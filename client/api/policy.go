@@ -0,0 +1,188 @@
+package api
+
+import (
+	"client/consistency"
+	"client/monitor"
+	"client/optimizer"
+	"client/util"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+// =====================
+// Server Selection Policies
+// =====================
+
+// SelectionPolicy picks the nodes a Get reads from, the read itself and its utility are the same for every policy (see EvaluateRead)
+// Register one with RegisterSelectionPolicy and pass the value it returns to BeginSession
+type SelectionPolicy interface {
+	// SelectNodes returns the addresses of the nodes to read the key from, the best one first (sla is never nil)
+	// The Get falls through to the next node while the ones before fail, or are known to be down, and there is time left
+	SelectNodes(s *util.Session, key string, sla *consistency.SLA, view PolicyView) ([]string, error)
+}
+
+// PolicyView is what a policy chooses with: the config and the measurements of the client that does the Get
+// Policies only read from it, the monitor keeps recording the other reads of the client meanwhile
+type PolicyView struct {
+	Config    *util.ReplicationConfig
+	Monitor   *monitor.Monitor
+	Optimizer *optimizer.Optimizer
+}
+
+// SelectionPolicyFunc turns a function into a SelectionPolicy
+type SelectionPolicyFunc func(s *util.Session, key string, sla *consistency.SLA, view PolicyView) ([]string, error)
+
+func (f SelectionPolicyFunc) SelectNodes(s *util.Session, key string, sla *consistency.SLA, view PolicyView) ([]string, error) {
+	return f(s, key, sla, view)
+}
+
+// Returned by a policy that has no node to offer for the key
+var ErrNoNodeSelected = errors.New("selection policy found no node to read from")
+
+type registeredPolicy struct {
+	name   string
+	policy SelectionPolicy
+}
+
+// Policies by their ServerSelectionPolicy value, the built-in ones have the values of the util constants
+var (
+	policiesMu sync.RWMutex
+	policies   = map[util.ServerSelectionPolicy]registeredPolicy{
+		util.Primary: {"primary", SelectionPolicyFunc(selectPrimary)},
+		util.Random:  {"random", SelectionPolicyFunc(selectRandom)},
+		util.Closest: {"closest", SelectionPolicyFunc(selectClosest)},
+		util.Pileus:  {"pileus", SelectionPolicyFunc(selectPileus)},
+	}
+)
+
+// RegisterSelectionPolicy adds a policy (e.g. round-robin or least-loaded) under a unique name,
+// sessions begun with the returned value read with it
+func RegisterSelectionPolicy(name string, policy SelectionPolicy) (util.ServerSelectionPolicy, error) {
+	if name == "" || policy == nil {
+		return 0, errors.New("a selection policy needs a name and an implementation")
+	}
+
+	policiesMu.Lock()
+	defer policiesMu.Unlock()
+
+	next := util.ServerSelectionPolicy(0)
+	for value, registered := range policies {
+		if registered.name == name {
+			return 0, fmt.Errorf("selection policy %q is already registered", name)
+		}
+		if value >= next {
+			next = value + 1
+		}
+	}
+	policies[next] = registeredPolicy{name, policy}
+	return next, nil
+}
+
+// LookupSelectionPolicy returns the value of the policy registered under the name (e.g. "pileus" from a command line flag)
+func LookupSelectionPolicy(name string) (util.ServerSelectionPolicy, bool) {
+	policiesMu.RLock()
+	defer policiesMu.RUnlock()
+
+	for value, registered := range policies {
+		if registered.name == name {
+			return value, true
+		}
+	}
+	return 0, false
+}
+
+// Returns the policy of the value, unknown values read with Pileus
+func selectionPolicy(value util.ServerSelectionPolicy) registeredPolicy {
+	policiesMu.RLock()
+	defer policiesMu.RUnlock()
+
+	if registered, ok := policies[value]; ok {
+		return registered
+	}
+	return policies[util.Pileus]
+}
+
+// ========== Built-in Policies ==========
+
+// Returns the nodes that hold the key, its primary first, the other nodes of the config don't replicate it
+func shardReplicas(config *util.ReplicationConfig, key string) ([]string, error) {
+	shard := config.ShardForKey(key)
+	if shard == nil {
+		return nil, fmt.Errorf("no shard found for key %s", key)
+	}
+	return append([]string{shard.Primary}, shard.Secondaries...), nil
+}
+
+// Always reads from the primary of the key, for evaluation purposes
+func selectPrimary(s *util.Session, key string, sla *consistency.SLA, view PolicyView) ([]string, error) {
+	shard := view.Config.ShardForKey(key)
+	if shard == nil {
+		return nil, fmt.Errorf("no shard found for key %s", key)
+	}
+	return []string{shard.Primary}, nil
+}
+
+// Source of selectRandom, a rand.Rand is not safe for concurrent use
+var (
+	randomMu sync.Mutex
+	random   = rand.New(rand.NewSource(time.Now().UnixNano()))
+)
+
+// Reads from the replicas of the key in a random order, for evaluation purposes
+func selectRandom(s *util.Session, key string, sla *consistency.SLA, view PolicyView) ([]string, error) {
+	replicas, err := shardReplicas(view.Config, key)
+	if err != nil {
+		return nil, err
+	}
+	randomMu.Lock()
+	random.Shuffle(len(replicas), func(i, j int) {
+		replicas[i], replicas[j] = replicas[j], replicas[i]
+	})
+	randomMu.Unlock()
+	fmt.Printf("Random Node is %s\n", replicas[0])
+	return replicas, nil
+}
+
+// Reads from the replicas of the key by increasing average RTT (replicas without RTTs last), for evaluation purposes
+func selectClosest(s *util.Session, key string, sla *consistency.SLA, view PolicyView) ([]string, error) {
+	replicas, err := shardReplicas(view.Config, key)
+	if err != nil {
+		return nil, err
+	}
+
+	var measured, unmeasured []string
+	for _, node := range replicas {
+		if len(view.Monitor.GetRTTs(node)) > 0 {
+			measured = append(measured, node)
+		} else {
+			unmeasured = append(unmeasured, node)
+		}
+	}
+	if len(measured) == 0 {
+		return nil, ErrNoNodeSelected
+	}
+	sort.SliceStable(measured, func(i, j int) bool {
+		return view.Monitor.GetAvgRTT(measured[i]) < view.Monitor.GetAvgRTT(measured[j])
+	})
+	fmt.Printf("Closest Node is %s with minRTT %v\n", measured[0], view.Monitor.GetAvgRTT(measured[0]))
+	return append(measured, unmeasured...), nil
+}
+
+// Reads from the nodes by expected utility of the SLA (see optimizer.FindNodeToRead)
+func selectPileus(s *util.Session, key string, sla *consistency.SLA, view PolicyView) ([]string, error) {
+	candidates := view.Optimizer.FindNodeToRead(s, key, sla)
+	if len(candidates) == 0 {
+		return nil, ErrNoNodeSelected
+	}
+	fmt.Printf("chosen storage node is %v and chosen subsla is %v\n", candidates[0].Node, candidates[0].SubSLA)
+
+	var nodes []string
+	for _, candidate := range candidates {
+		nodes = append(nodes, candidate.Node)
+	}
+	return nodes, nil
+}
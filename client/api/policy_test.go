@@ -0,0 +1,97 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"client/consistency"
+	"client/monitor"
+	"client/util"
+)
+
+// Shard [0, 1000] on primary:8080 and secondary:8080, other:8080 only holds other keys
+var policyConfig = &util.ReplicationConfig{
+	Nodes: []util.StorageNode{
+		{Id: "primary", Address: "primary:8080"},
+		{Id: "secondary", Address: "secondary:8080"},
+		{Id: "other", Address: "other:8080"},
+	},
+	Shards: []util.Shard{{ShardId: 0, RangeStart: 0, RangeEnd: 1000, Primary: "primary:8080", Secondaries: []string{"secondary:8080"}}},
+}
+
+func TestRandomReadsFromAReplicaOfTheKey(t *testing.T) {
+	view := PolicyView{Config: policyConfig, Monitor: monitor.New()}
+	for i := 0; i < 100; i++ {
+		nodes, err := selectRandom(nil, "user1", writeSLA, view)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(nodes) != 2 {
+			t.Fatalf("random reads of user1 from %v, want its 2 replicas", nodes)
+		}
+		for _, node := range nodes {
+			if node != "primary:8080" && node != "secondary:8080" {
+				t.Fatalf("random read of user1 from %s, not a replica of its shard", node)
+			}
+		}
+	}
+}
+
+func TestClosestReadsFromTheClosestReplicaOfTheKey(t *testing.T) {
+	m := monitor.New()
+	m.RecordRTT("other:8080", time.Millisecond)
+	m.RecordRTT("primary:8080", 20*time.Millisecond)
+	m.RecordRTT("secondary:8080", 10*time.Millisecond)
+	view := PolicyView{Config: policyConfig, Monitor: m}
+
+	nodes, err := selectClosest(nil, "user1", writeSLA, view)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nodes) != 2 || nodes[0] != "secondary:8080" || nodes[1] != "primary:8080" {
+		t.Errorf("closest reads of user1 from %v, want [secondary:8080 primary:8080]", nodes)
+	}
+}
+
+func TestGetOnlyReadsFromReplicasAndReportsAMissingKey(t *testing.T) {
+	var primaryReads, otherReads int32
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&primaryReads, 1)
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]int64{"timestamp": 0, "highTS": 0})
+	}))
+	defer primary.Close()
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&otherReads, 1)
+	}))
+	defer other.Close()
+
+	c := newTestClient(t, primary)
+	otherAddress := strings.TrimPrefix(other.URL, "http://")
+	config := *c.Config()
+	config.Nodes = append(config.Nodes, util.StorageNode{Id: "node2", Address: otherAddress})
+	c.config.Store(&config)
+
+	// Meets no sub-SLA, no read is that fast
+	sla := &consistency.SLA{ID: "fast", SubSLAs: []consistency.SubSLA{
+		{Consistency: consistency.Strong, Latency: consistency.LatencyBound{Duration: time.Nanosecond}, Utility: 1},
+	}}
+	policy := SelectionPolicyFunc(func(s *util.Session, key string, sla *consistency.SLA, view PolicyView) ([]string, error) {
+		return []string{otherAddress, config.Shards[0].Primary}, nil
+	})
+
+	s := c.BeginSession(sla, util.Pileus)
+	_, _, err := c.get(context.Background(), s, "user1", sla, policy)
+	if err != ErrKeyNotFound {
+		t.Errorf("Get of a missing key = %v, want ErrKeyNotFound", err)
+	}
+	if otherReads != 0 || primaryReads != 1 {
+		t.Errorf("%d reads from the other node and %d from the primary, want 0 and 1", otherReads, primaryReads)
+	}
+}
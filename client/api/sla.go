@@ -0,0 +1,92 @@
+package api
+
+import (
+	"client/consistency"
+	"client/monitor"
+	"client/util"
+	"time"
+)
+
+// =====================
+// Sub-SLA Evaluation
+// =====================
+
+// ReadResult is what a node answered to a read, the input of EvaluateRead
+type ReadResult struct {
+	Node      string        // address of the node that was read from
+	Timestamp int64         // timestamp of the object read (of the tombstone for a missing key)
+	HighTS    int64         // HighTS of the node at the time of the read
+	RTT       time.Duration // including the artificial lag of the node
+}
+
+// EvaluateRead decides which sub-SLA of the SLA a read of the key in session s met: the first one (in order of preference)
+// whose latency bound covers the RTT and whose consistency the node could guarantee, nil if there is none.
+// The statuses of the sub-SLAs up to that one ("Met", "Lat_Not_Met" or "Consistency_Not_Met") are returned for the monitor.
+// The session must not be updated with the read yet, since monotonic reads compare against the previous reads of the key.
+func EvaluateRead(config *util.ReplicationConfig, s *util.Session, key string, sla *consistency.SLA, read ReadResult) (*consistency.SubSLA, []monitor.SubSLAStatus) {
+	var statuses []monitor.SubSLAStatus
+	if sla == nil {
+		return nil, statuses
+	}
+
+	shard := config.ShardForKey(key)
+
+	for _, sub := range sla.SubSLAs {
+		status := monitor.SubSLAStatus{Node: read.Node, SubSLA: sub}
+		if read.RTT > sub.Latency.Duration {
+			status.Status = "Lat_Not_Met"
+		} else if !consistencyMet(s, key, sub, read, shard) {
+			status.Status = "Consistency_Not_Met"
+		} else {
+			status.Status = "Met"
+			statuses = append(statuses, status)
+			subGained := sub
+			return &subGained, statuses
+		}
+		statuses = append(statuses, status)
+	}
+
+	return nil, statuses
+}
+
+// Whether the node that was read from guarantees the consistency of the sub-SLA
+// The primary of the shard has every write of the key, so it meets all levels; a secondary has seen the writes up to its HighTS.
+// Nodes that don't replicate the shard of the key meet none.
+func consistencyMet(s *util.Session, key string, sub consistency.SubSLA, read ReadResult, shard *util.Shard) bool {
+	if shard == nil {
+		return false
+	}
+	if read.Node == shard.Primary {
+		return true
+	}
+	if !contains(shard.Secondaries, read.Node) {
+		return false
+	}
+
+	// The version read is at least as recent as its own timestamp and as the HighTS of the node
+	seen := read.HighTS
+	if read.Timestamp > seen {
+		seen = read.Timestamp
+	}
+
+	switch sub.Consistency {
+	case consistency.Eventual:
+		return true
+
+	// The version read must be the last write of the key in this session or a later one
+	case consistency.ReadMyWrites:
+		return seen >= s.ObjectsWritten[key]
+
+	// The version read must be at least as recent as the last read of the key in this session
+	case consistency.MonotonicReads:
+		return seen >= s.ObjectsRead[key]
+
+	// The node must have seen every write older than the staleness bound (no bound: every write)
+	case consistency.Bounded:
+		return read.HighTS >= util.HLCFromTime(time.Now().Add(-sub.Staleness()))
+
+	// Only the primary is guaranteed to have the latest write
+	default:
+		return false
+	}
+}
@@ -0,0 +1,112 @@
+package api
+
+import (
+	"client/consistency"
+	"client/util"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func subSLA(level consistency.ConsistencyLevel, latency time.Duration) consistency.SubSLA {
+	return consistency.SubSLA{Consistency: level, Latency: consistency.LatencyBound{Duration: latency}, Utility: 1}
+}
+
+// Bounded sub-SLA of 100ms with the staleness bound (none if nil)
+func boundedSubSLA(bound *time.Duration) consistency.SubSLA {
+	sub := subSLA(consistency.Bounded, 100*time.Millisecond)
+	sub.StalenessBound = bound
+	return sub
+}
+
+func slaOf(subs ...consistency.SubSLA) *consistency.SLA {
+	return &consistency.SLA{ID: "test", SubSLAs: subs}
+}
+
+func TestEvaluateRead(t *testing.T) {
+	config := &util.ReplicationConfig{
+		Shards: []util.Shard{{
+			ShardId:     0,
+			RangeStart:  0,
+			RangeEnd:    1000,
+			Primary:     "primary:8080",
+			Secondaries: []string{"secondary:8080"},
+		}},
+	}
+
+	now := util.HLCFromTime(time.Now())
+	minute := time.Minute
+
+	tests := []struct {
+		name     string
+		key      string
+		sla      *consistency.SLA
+		read     ReadResult
+		wantSub  int      // index of the sub-SLA met, -1 for none
+		statuses []string // status of every sub-SLA evaluated
+	}{
+		{"no SLA", "user1", nil, ReadResult{Node: "primary:8080", Timestamp: 0, HighTS: 0, RTT: time.Millisecond}, -1, nil},
+		{"primary meets strong", "user1", slaOf(subSLA(consistency.Strong, 100*time.Millisecond)),
+			ReadResult{Node: "primary:8080", Timestamp: now-200, HighTS: 0, RTT: 10*time.Millisecond}, 0, []string{"Met"}},
+		{"secondary never meets strong", "user1", slaOf(subSLA(consistency.Strong, 100*time.Millisecond)),
+			ReadResult{Node: "secondary:8080", Timestamp: now-200, HighTS: now, RTT: 10*time.Millisecond}, -1, []string{"Consistency_Not_Met"}},
+		{"too slow for the first, in time for the second", "user1",
+			slaOf(subSLA(consistency.Strong, 10*time.Millisecond), subSLA(consistency.Eventual, 100*time.Millisecond)),
+			ReadResult{Node: "primary:8080", Timestamp: now-200, HighTS: 0, RTT: 50*time.Millisecond}, 1, []string{"Lat_Not_Met", "Met"}},
+		{"too slow for every sub-SLA", "user1", slaOf(subSLA(consistency.Eventual, 10*time.Millisecond)),
+			ReadResult{Node: "secondary:8080", Timestamp: now-200, HighTS: now, RTT: 50*time.Millisecond}, -1, []string{"Lat_Not_Met"}},
+		{"eventual on a secondary", "user1", slaOf(subSLA(consistency.Eventual, 100*time.Millisecond)),
+			ReadResult{Node: "secondary:8080", Timestamp: 0, HighTS: 0, RTT: 10*time.Millisecond}, 0, []string{"Met"}},
+		{"eventual on a node without the shard", "user1", slaOf(subSLA(consistency.Eventual, 100*time.Millisecond)),
+			ReadResult{Node: "other:8080", Timestamp: now, HighTS: now, RTT: 10*time.Millisecond}, -1, []string{"Consistency_Not_Met"}},
+		{"key without a shard", "user5000", slaOf(subSLA(consistency.Eventual, 100*time.Millisecond)),
+			ReadResult{Node: "primary:8080", Timestamp: now, HighTS: now, RTT: 10*time.Millisecond}, -1, []string{"Consistency_Not_Met"}},
+		{"read my writes by HighTS", "user1", slaOf(subSLA(consistency.ReadMyWrites, 100*time.Millisecond)),
+			ReadResult{Node: "secondary:8080", Timestamp: now-300, HighTS: now-100, RTT: 10*time.Millisecond}, 0, []string{"Met"}},
+		{"read my writes by the version read", "user1", slaOf(subSLA(consistency.ReadMyWrites, 100*time.Millisecond)),
+			ReadResult{Node: "secondary:8080", Timestamp: now-100, HighTS: now-300, RTT: 10*time.Millisecond}, 0, []string{"Met"}},
+		{"read my writes on a lagging secondary", "user1", slaOf(subSLA(consistency.ReadMyWrites, 100*time.Millisecond)),
+			ReadResult{Node: "secondary:8080", Timestamp: now-300, HighTS: now-200, RTT: 10*time.Millisecond}, -1, []string{"Consistency_Not_Met"}},
+		{"monotonic reads by HighTS", "user1", slaOf(subSLA(consistency.MonotonicReads, 100*time.Millisecond)),
+			ReadResult{Node: "secondary:8080", Timestamp: now-300, HighTS: now-50, RTT: 10*time.Millisecond}, 0, []string{"Met"}},
+		{"monotonic reads going back", "user1", slaOf(subSLA(consistency.MonotonicReads, 100*time.Millisecond)),
+			ReadResult{Node: "secondary:8080", Timestamp: now-300, HighTS: now-60, RTT: 10*time.Millisecond}, -1, []string{"Consistency_Not_Met"}},
+		{"monotonic reads of an unread key", "user2", slaOf(subSLA(consistency.MonotonicReads, 100*time.Millisecond)),
+			ReadResult{Node: "secondary:8080", Timestamp: 0, HighTS: 0, RTT: 10*time.Millisecond}, 0, []string{"Met"}},
+		{"bounded within the bound", "user1", slaOf(boundedSubSLA(&minute)),
+			ReadResult{Node: "secondary:8080", Timestamp: 0, HighTS: now, RTT: 10*time.Millisecond}, 0, []string{"Met"}},
+		{"bounded too stale", "user1", slaOf(boundedSubSLA(&minute)),
+			ReadResult{Node: "secondary:8080", Timestamp: 0, HighTS: util.HLCFromTime(time.Now().Add(-time.Hour)), RTT: 10*time.Millisecond}, -1, []string{"Consistency_Not_Met"}},
+		{"bounded without a bound", "user1", slaOf(boundedSubSLA(nil)),
+			ReadResult{Node: "secondary:8080", Timestamp: 0, HighTS: util.HLCFromTime(time.Now().Add(-time.Second)), RTT: 10*time.Millisecond}, -1, []string{"Consistency_Not_Met"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			session := &util.Session{
+				ObjectsWritten: map[string]int64{"user1": now - 100},
+				ObjectsRead:    map[string]int64{"user1": now - 50},
+			}
+			got, statuses := EvaluateRead(config, session, tt.key, tt.sla, tt.read)
+
+			if tt.wantSub == -1 {
+				if got != nil {
+					t.Errorf("EvaluateRead() met %+v, want none", *got)
+				}
+			} else if got == nil || !reflect.DeepEqual(*got, tt.sla.SubSLAs[tt.wantSub]) {
+				t.Errorf("EvaluateRead() met %v, want sub-SLA %d", got, tt.wantSub)
+			}
+
+			var gotStatuses []string
+			for _, status := range statuses {
+				if status.Node != tt.read.Node {
+					t.Errorf("status of node %s, want %s", status.Node, tt.read.Node)
+				}
+				gotStatuses = append(gotStatuses, status.Status)
+			}
+			if !reflect.DeepEqual(gotStatuses, tt.statuses) {
+				t.Errorf("EvaluateRead() statuses = %v, want %v", gotStatuses, tt.statuses)
+			}
+		})
+	}
+}
@@ -13,6 +13,7 @@ import (
 	"os"
 	"strings"
 	"math/rand"
+	"net/url"
 )
 
 type Record struct {
@@ -50,14 +51,21 @@ func main() {
 	// Load node info for reconfiguration
 	configuration_config, err := loadClientConfigByRegion("clients_config.json", "utah")
 	if err != nil {
-		fmt.Println("Failed to load client config: %v\n", err)
+		fmt.Printf("Failed to load client config: %v\n", err)
+	}
+
+	// After a primary failover the client fetches the new config from the coordinator (same host as the /report endpoint)
+	if configuration_config != nil {
+		if coordinator, err := url.Parse(configuration_config.CoordinatorURL); err == nil {
+			api.SetCoordinator(fmt.Sprintf("%s://%s", coordinator.Scheme, coordinator.Host))
+		}
 	}
 
 	// Before sending the workloads, send monitoring probes to the nodes to get RTT 
 	// TODO: we can use probes also for HighTS to begin [for each shard]
 	api.SendProbes()
 
-	fmt.Println("Checking the RTT's after sending init probes\n")
+	fmt.Println("Checking the RTT's after sending init probes")
 	api.PrintRTTs()
 
 	// Set Dynamic Configuration Coordination for Monitor
@@ -32,8 +32,24 @@ type SubSLA struct {
 	Utility     float64
 }
 
+// Staleness bound of a Bounded sub-SLA, without one no staleness at all is allowed (0)
+func (sub SubSLA) Staleness() time.Duration {
+	if sub.StalenessBound == nil {
+		return 0
+	}
+	return *sub.StalenessBound
+}
+
 // Ordered from most to least preferred
 type SLA struct {
 	ID      string
 	SubSLAs []SubSLA
-}
\ No newline at end of file
+}
+
+// Latency bound of the least preferred sub-SLA, an answer after it meets none of them (0 without sub-SLAs)
+func (sla *SLA) LeastPreferredLatency() time.Duration {
+	if sla == nil || len(sla.SubSLAs) == 0 {
+		return 0
+	}
+	return sla.SubSLAs[len(sla.SubSLAs)-1].Latency.Duration
+}
@@ -4,10 +4,12 @@ import (
 	"sync"
 	"time"
 	"fmt"
+	"context"
 	"encoding/json"
 	"client/consistency"
 	"bytes"
 	"net/http"
+	pileuspb "pileus/proto"
 )
 
 // Size of the sliding window
@@ -15,6 +17,9 @@ import (
 const maxSamples = 100
 const utilityDropThreshold = 0.6
 
+// A node whose read failed counts as down for this long, unless it answers before
+const nodeDownPeriod = 5 * time.Second
+
 
 type SubSLAStatus struct {
 	Node   string `json:"node"`
@@ -48,11 +53,18 @@ type ReadStatusWindow struct {
 	full    bool
 }
 
+// A shard on a node, every shard of a node replicates up to a HighTS of its own
+type nodeShard struct {
+	node  string
+	shard int
+}
+
 // Monitor also needs a mutex on modifying the map of all nodes [map changing might not be thread-safe]
-// Right now this is a one-per-client monitoring strategy.
+// Right now this is a one-per-client monitoring strategy: every api.Client records into its own Monitor.
 type Monitor struct {
 	nodeRTTs map[string]*RTTWindow 		// Map of node -> RTT window
-	nodeHTS map[string]*int64 			// Map of node -> High Timestamp
+	nodeHTS map[nodeShard]int64 		// Map of (node, shard) -> High Timestamp of the shard on the node
+	nodeFailures map[string]time.Time	// Map of node -> time of its last failed read (removed once it answers)
 	utilities *UtilityWindow
 	readHistogram map[string]int
 	
@@ -61,44 +73,66 @@ type Monitor struct {
 	region         string
 	sla            consistency.SLA
 	coordinatorURL string
+	coordinatorGRPC string		// gRPC address of the coordinator, if reports go over gRPC
 	doCoordination bool
 	lastUtilityReport time.Time
 
 	mu   sync.RWMutex
 }
 
-var globalMonitor = &Monitor{
-	nodeRTTs: make(map[string]*RTTWindow),
-	nodeHTS: make(map[string]*int64),
-	utilities: &UtilityWindow{samples: make([]float64, maxSamples)}, 
-	readHistogram: make(map[string]int),
-	lastUtilityReport: time.Time{},
+// New returns an empty monitor, every api.Client has its own (see Default for the one of the package-level functions)
+func New() *Monitor {
+	return &Monitor{
+		nodeRTTs: make(map[string]*RTTWindow),
+		nodeHTS: make(map[nodeShard]int64),
+		nodeFailures: make(map[string]time.Time),
+		utilities: &UtilityWindow{samples: make([]float64, maxSamples)}, 
+		readHistogram: make(map[string]int),
+		lastUtilityReport: time.Time{},
+	}
 }
 
-func SetDynamicConfigData(clientID, region string, sla consistency.SLA, coordinatorURL string, doCoordination bool) {
-	globalMonitor.mu.Lock()
-	defer globalMonitor.mu.Unlock()
+var globalMonitor = New()
 
-	globalMonitor.clientID = clientID
-	globalMonitor.region = region
-	globalMonitor.sla = sla
-	globalMonitor.coordinatorURL = coordinatorURL
-	globalMonitor.doCoordination = doCoordination
+// Default returns the monitor that the package-level functions below use
+func Default() *Monitor {
+	return globalMonitor
 }
 
+func (m *Monitor) SetDynamicConfigData(clientID, region string, sla consistency.SLA, coordinatorURL string, doCoordination bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.clientID = clientID
+	m.region = region
+	m.sla = sla
+	m.coordinatorURL = coordinatorURL
+	m.doCoordination = doCoordination
+}
+
+// SetCoordinatorGRPC sends the utility drop reports to the Coordinator gRPC service at address, instead of the coordinatorURL
+func (m *Monitor) SetCoordinatorGRPC(address string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.coordinatorGRPC = address
+}
+
+var grpcConns = pileuspb.NewConns()
+
 // RecordRTT is called by the API layer to track RTTs.
-func RecordRTT(node string, rtt time.Duration) {
+func (m *Monitor) RecordRTT(node string, rtt time.Duration) {
 	fmt.Printf("Recording RTT: node=%s, rtt=%v\n", node, rtt)
 
-	globalMonitor.mu.Lock()
-	defer globalMonitor.mu.Unlock()
+	m.mu.Lock()
+	defer m.mu.Unlock()
 
-	window, exists := globalMonitor.nodeRTTs[node]
+	window, exists := m.nodeRTTs[node]
 	
 	// If it does not exist then make a window for the node
 	if !exists {
 		window = &RTTWindow{samples: make([]time.Duration, maxSamples)}
-		globalMonitor.nodeRTTs[node] = window
+		m.nodeRTTs[node] = window
 	}
 
 	window.mu.Lock()
@@ -111,22 +145,43 @@ func RecordRTT(node string, rtt time.Duration) {
 	}
 }
 
-func RecordHTS(node string, hts int64) {
-	globalMonitor.mu.Lock()
-	defer globalMonitor.mu.Unlock()
+// Record the HighTS the node answered a read of a key of the shard with
+func (m *Monitor) RecordHTS(node string, shardID int, hts int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 
-	globalMonitor.nodeHTS[node] = &hts
+	m.nodeHTS[nodeShard{node, shardID}] = hts
+
+	// Every answer comes with the HighTS of the node, so it is up again
+	delete(m.nodeFailures, node)
+}
+
+// Record a read of the node that got no answer (the node is down, or unreachable from this client)
+func (m *Monitor) RecordFailure(node string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.nodeFailures[node] = time.Now()
+}
+
+// Whether a read of the node failed within the last nodeDownPeriod, and it has not answered since
+func (m *Monitor) IsDown(node string) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	failedAt, exists := m.nodeFailures[node]
+	return exists && time.Since(failedAt) < nodeDownPeriod
 }
 
 // Record the utility gained after communicating with a "storageNode"
-func RecordUtility(utility float64) {
-	globalMonitor.mu.Lock()
-	window := globalMonitor.utilities
-	clientID := globalMonitor.clientID
-	region := globalMonitor.region
-	active_sla := globalMonitor.sla
-	coordinatorURL := globalMonitor.coordinatorURL
-	globalMonitor.mu.Unlock()
+func (m *Monitor) RecordUtility(utility float64) {
+	m.mu.Lock()
+	window := m.utilities
+	clientID := m.clientID
+	region := m.region
+	active_sla := m.sla
+	coordinatorURL := m.coordinatorURL
+	m.mu.Unlock()
 
 	window.mu.Lock()
 	window.samples[window.index] = utility
@@ -137,14 +192,14 @@ func RecordUtility(utility float64) {
 	window.mu.Unlock()
 
 	// Now safe to call GetAverageUtility (no lock is held)
-	if (globalMonitor.doCoordination && GetAverageUtility() < utilityDropThreshold) {
+	if (m.doCoordination && m.GetAverageUtility() < utilityDropThreshold) {
 		fmt.Println("utility dropped, take action")
-		SendUtilityDropReport(clientID, region, active_sla, coordinatorURL)
+		m.SendUtilityDropReport(clientID, region, active_sla, coordinatorURL)
 	}
 }
 
-func RecordReadStatus(status ReadStatus) {
-	globalMonitor.mu.Lock()
+func (m *Monitor) RecordReadStatus(status ReadStatus) {
+	m.mu.Lock()
 	
 	keyBytes, err := json.Marshal(status)
 	if err != nil {
@@ -153,11 +208,11 @@ func RecordReadStatus(status ReadStatus) {
 	}
 	key := string(keyBytes)
 
-	globalMonitor.readHistogram[key]++
+	m.readHistogram[key]++
 
-	globalMonitor.mu.Unlock()
+	m.mu.Unlock()
 
-	// PrintReadHistogram()
+	// m.PrintReadHistogram()
 }
 
 /*
@@ -165,10 +220,10 @@ func RecordReadStatus(status ReadStatus) {
 */
 
 // GetRTTs returns a copy of the RTT samples for a node
-func GetRTTs(node string) []time.Duration {
-	globalMonitor.mu.RLock()
-	window, exists := globalMonitor.nodeRTTs[node]
-	globalMonitor.mu.RUnlock()
+func (m *Monitor) GetRTTs(node string) []time.Duration {
+	m.mu.RLock()
+	window, exists := m.nodeRTTs[node]
+	m.mu.RUnlock()
 	if !exists {
 		return nil
 	}
@@ -186,22 +241,19 @@ func GetRTTs(node string) []time.Duration {
 	return result
 }
 
-func GetHTS(node string) int64 {
-	globalMonitor.mu.RLock()
-	defer globalMonitor.mu.RUnlock()
+// GetHTS returns the last HighTS of the shard on the node, 0 before the node answered a read of the shard
+func (m *Monitor) GetHTS(node string, shardID int) int64 {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
 
-	ptr, exists := globalMonitor.nodeHTS[node]
-	if !exists || ptr == nil {
-		return 0
-	}
-	return *ptr
+	return m.nodeHTS[nodeShard{node, shardID}]
 }
 
-func GetUtilities() []float64 {
-	globalMonitor.mu.RLock()  
-	defer globalMonitor.mu.RUnlock()
+func (m *Monitor) GetUtilities() []float64 {
+	m.mu.RLock()  
+	defer m.mu.RUnlock()
 
-	window := globalMonitor.utilities
+	window := m.utilities
 
 	window.mu.Lock() 
 	defer window.mu.Unlock()
@@ -216,10 +268,10 @@ func GetUtilities() []float64 {
 	return result
 }
 
-func GetAvgRTT(node string) time.Duration {
-	globalMonitor.mu.RLock()
-	window, exists := globalMonitor.nodeRTTs[node]
-	globalMonitor.mu.RUnlock()
+func (m *Monitor) GetAvgRTT(node string) time.Duration {
+	m.mu.RLock()
+	window, exists := m.nodeRTTs[node]
+	m.mu.RUnlock()
 	if !exists {
 		return 0 // Or some sentinel value like time.Duration(-1)
 	}
@@ -248,11 +300,11 @@ func GetAvgRTT(node string) time.Duration {
 	return total / time.Duration(count)
 }
 
-func GetRTTPerNode() map[string]float64 {
+func (m *Monitor) GetRTTPerNode() map[string]float64 {
 	rtts := make(map[string]float64)
 
-	globalMonitor.mu.RLock()
-	for node, window := range globalMonitor.nodeRTTs {
+	m.mu.RLock()
+	for node, window := range m.nodeRTTs {
 		window.mu.Lock()
 
 		var total time.Duration
@@ -276,16 +328,16 @@ func GetRTTPerNode() map[string]float64 {
 			rtts[node] = float64(avg.Milliseconds())
 		}
 	}
-	globalMonitor.mu.RUnlock()
+	m.mu.RUnlock()
 
 	return rtts
 }
 
-func GetAverageUtility() float64 {
-	globalMonitor.mu.Lock()
-	defer globalMonitor.mu.Unlock()
+func (m *Monitor) GetAverageUtility() float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 
-	window := globalMonitor.utilities
+	window := m.utilities
 
 	window.mu.Lock()
 	defer window.mu.Unlock()
@@ -310,14 +362,14 @@ func GetAverageUtility() float64 {
 	return total / float64(count)
 }
 
-func GetLowestAvgRTTNode() (string, time.Duration) {
-	globalMonitor.mu.RLock()
-	defer globalMonitor.mu.RUnlock()
+func (m *Monitor) GetLowestAvgRTTNode() (string, time.Duration) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
 
 	var minNode string
 	var minRTT time.Duration = -1 // sentinel value to indicate uninitialized state
 
-	for node, window := range globalMonitor.nodeRTTs {
+	for node, window := range m.nodeRTTs {
 		window.mu.Lock()
 
 		var total time.Duration
@@ -352,10 +404,10 @@ func GetLowestAvgRTTNode() (string, time.Duration) {
 }
 
 // TODO: this maybe won't capture the recent changes/increases to the RTT's
-func ProbabilityOfRTTBelow(node string, threshold time.Duration, optimistic bool) float64 {
-	globalMonitor.mu.RLock()
-	window, exists := globalMonitor.nodeRTTs[node]
-	globalMonitor.mu.RUnlock()
+func (m *Monitor) ProbabilityOfRTTBelow(node string, threshold time.Duration, optimistic bool) float64 {
+	m.mu.RLock()
+	window, exists := m.nodeRTTs[node]
+	m.mu.RUnlock()
 
 	// if RTT for the node doesn't exists yet, assume it is fast
 	if !exists {
@@ -398,13 +450,13 @@ func ProbabilityOfRTTBelow(node string, threshold time.Duration, optimistic bool
 	return float64(count) / float64(total)
 }
 
-func PrintReadHistogram() {
-	globalMonitor.mu.RLock()
-	defer globalMonitor.mu.RUnlock()
+func (m *Monitor) PrintReadHistogram() {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
 
 	fmt.Println("ReadStatus Histogram:")
 
-	for k, count := range globalMonitor.readHistogram {
+	for k, count := range m.readHistogram {
 		var status ReadStatus
 		if err := json.Unmarshal([]byte(k), &status); err != nil {
 			fmt.Println("Error unmarshaling key:", err)
@@ -427,36 +479,37 @@ type UtilityDropReport struct {
 	RTTs            map[string]float64      `json:"rtts"`
 }
 
-func SendUtilityDropReport(clientID string, region string, sla consistency.SLA, coordinatorURL string) {
-	globalMonitor.mu.Lock()
+func (m *Monitor) SendUtilityDropReport(clientID string, region string, sla consistency.SLA, coordinatorURL string) {
+	m.mu.Lock()
 
 	now := time.Now()
 	
 	// Controlling how frequent we send this to the coordinator
-	if now.Sub(globalMonitor.lastUtilityReport) < 2*time.Second {
-		globalMonitor.mu.Unlock()
+	if now.Sub(m.lastUtilityReport) < 2*time.Second {
+		m.mu.Unlock()
 		fmt.Println("Skipped utility report due to rate limit")
 		return
 	}
-	globalMonitor.lastUtilityReport = now
+	m.lastUtilityReport = now
 
 	// Clone data
 	histCopy := make(map[string]int)
-	for k, v := range globalMonitor.readHistogram {
+	for k, v := range m.readHistogram {
 		histCopy[k] = v
 	}
 
-	globalMonitor.utilities.mu.Lock()
+	m.utilities.mu.Lock()
 	var sum float64
 	var count int
-	for _, u := range globalMonitor.utilities.samples {
+	for _, u := range m.utilities.samples {
 		if u != 0 {
 			sum += u
 			count++
 		}
 	}
-	globalMonitor.utilities.mu.Unlock()
-	globalMonitor.mu.Unlock()
+	m.utilities.mu.Unlock()
+	coordinatorGRPC := m.coordinatorGRPC
+	m.mu.Unlock()
 
 	avgUtility := 0.0
 	if count > 0 {
@@ -469,7 +522,12 @@ func SendUtilityDropReport(clientID string, region string, sla consistency.SLA,
 		AvgUtility: 	avgUtility,
 		SLA:        	sla,
 		ReadHistogram:  histCopy,
-		RTTs: 			GetRTTPerNode(),
+		RTTs: 			m.GetRTTPerNode(),
+	}
+
+	if coordinatorGRPC != "" {
+		sendUtilityDropReportGRPC(report, coordinatorGRPC)
+		return
 	}
 
 	payload, err := json.Marshal(report)
@@ -486,3 +544,119 @@ func SendUtilityDropReport(clientID string, region string, sla consistency.SLA,
 	defer resp.Body.Close()
 	fmt.Printf("Utility drop report sent (status %d)\n", resp.StatusCode)
 }
+
+// Sends the report to the Coordinator gRPC service
+func sendUtilityDropReportGRPC(report UtilityDropReport, address string) {
+	conn, err := grpcConns.Get(address)
+	if err != nil {
+		fmt.Println("Failed to send utility drop report:", err)
+		return
+	}
+
+	req := &pileuspb.UtilityDropReport{
+		ClientId:  report.ClientID,
+		Region:    report.Region,
+		Utility:   report.AvgUtility,
+		Sla:       &pileuspb.SLA{Id: report.SLA.ID},
+		Histogram: make(map[string]int32, len(report.ReadHistogram)),
+		Rtts:      report.RTTs,
+	}
+	for _, sub := range report.SLA.SubSLAs {
+		subSLA := &pileuspb.SubSLA{
+			Consistency:  int32(sub.Consistency),
+			LatencyNanos: int64(sub.Latency.Duration),
+			Utility:      sub.Utility,
+		}
+		if sub.StalenessBound != nil {
+			bound := int64(*sub.StalenessBound)
+			subSLA.StalenessBoundNanos = &bound
+		}
+		req.Sla.SubSlas = append(req.Sla.SubSlas, subSLA)
+	}
+	for key, count := range report.ReadHistogram {
+		req.Histogram[key] = int32(count)
+	}
+
+	resp, err := pileuspb.NewCoordinatorClient(conn).Report(context.Background(), req)
+	if err != nil {
+		fmt.Println("Failed to send utility drop report:", err)
+		return
+	}
+	fmt.Printf("Utility drop report sent over gRPC (skipped: %v)\n", resp.Skipped)
+}
+
+// ========== Default Monitor ==========
+
+// The package-level functions record into and read from the default monitor (see Default)
+
+func SetDynamicConfigData(clientID, region string, sla consistency.SLA, coordinatorURL string, doCoordination bool) {
+	globalMonitor.SetDynamicConfigData(clientID, region, sla, coordinatorURL, doCoordination)
+}
+
+func SetCoordinatorGRPC(address string) {
+	globalMonitor.SetCoordinatorGRPC(address)
+}
+
+func RecordRTT(node string, rtt time.Duration) {
+	globalMonitor.RecordRTT(node, rtt)
+}
+
+func RecordHTS(node string, shardID int, hts int64) {
+	globalMonitor.RecordHTS(node, shardID, hts)
+}
+
+func RecordFailure(node string) {
+	globalMonitor.RecordFailure(node)
+}
+
+func IsDown(node string) bool {
+	return globalMonitor.IsDown(node)
+}
+
+func RecordUtility(utility float64) {
+	globalMonitor.RecordUtility(utility)
+}
+
+func RecordReadStatus(status ReadStatus) {
+	globalMonitor.RecordReadStatus(status)
+}
+
+func GetRTTs(node string) []time.Duration {
+	return globalMonitor.GetRTTs(node)
+}
+
+func GetHTS(node string, shardID int) int64 {
+	return globalMonitor.GetHTS(node, shardID)
+}
+
+func GetUtilities() []float64 {
+	return globalMonitor.GetUtilities()
+}
+
+func GetAvgRTT(node string) time.Duration {
+	return globalMonitor.GetAvgRTT(node)
+}
+
+func GetRTTPerNode() map[string]float64 {
+	return globalMonitor.GetRTTPerNode()
+}
+
+func GetAverageUtility() float64 {
+	return globalMonitor.GetAverageUtility()
+}
+
+func GetLowestAvgRTTNode() (string, time.Duration) {
+	return globalMonitor.GetLowestAvgRTTNode()
+}
+
+func ProbabilityOfRTTBelow(node string, threshold time.Duration, optimistic bool) float64 {
+	return globalMonitor.ProbabilityOfRTTBelow(node, threshold, optimistic)
+}
+
+func PrintReadHistogram() {
+	globalMonitor.PrintReadHistogram()
+}
+
+func SendUtilityDropReport(clientID string, region string, sla consistency.SLA, coordinatorURL string) {
+	globalMonitor.SendUtilityDropReport(clientID, region, sla, coordinatorURL)
+}
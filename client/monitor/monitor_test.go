@@ -0,0 +1,20 @@
+package monitor
+
+import "testing"
+
+func TestHTSIsKeptPerShardOfANode(t *testing.T) {
+	m := New()
+	m.RecordHTS("node1:8080", 0, 100)
+	m.RecordHTS("node1:8080", 1, 50)
+
+	// A read of shard 1 must not make shard 0 of the node look behind (or the other way around)
+	if got := m.GetHTS("node1:8080", 0); got != 100 {
+		t.Errorf("HighTS of shard 0 = %d, want 100", got)
+	}
+	if got := m.GetHTS("node1:8080", 1); got != 50 {
+		t.Errorf("HighTS of shard 1 = %d, want 50", got)
+	}
+	if got := m.GetHTS("node2:8080", 0); got != 0 {
+		t.Errorf("HighTS of a node without reads = %d, want 0", got)
+	}
+}
@@ -5,8 +5,9 @@ import (
 	"client/consistency"
 	"client/util"
 	"client/monitor"
+	"sort"
 	"time"
-	"strconv"
+	"sync/atomic"
 )
 
 type SubUtility struct {
@@ -14,31 +15,122 @@ type SubUtility struct {
 	Node    string
 }
 
-var replicationConfig *util.ReplicationConfig
+// A node to read from, with the sub-SLA it is expected to meet and the expected utility of that
+type Candidate struct {
+	Node    string
+	SubSLA  consistency.SubSLA
+	Utility float32
+}
 
-// This is called from the client-side api/lib to init the replication data on the optimizer side
-func Init(config *util.ReplicationConfig) {
-	replicationConfig = config
-	fmt.Printf("Optimizor: Replication Config is Set to %v\n", replicationConfig)
+// Optimizer picks the nodes to read from, with the RTTs and HighTS of the nodes its monitor recorded
+// Every api.Client has its own (see Default for the one of the package-level functions)
+type Optimizer struct {
+	// Holds the current *util.ReplicationConfig, a new version replaces it as a whole
+	// Every search loads it once, so all of its sub-SLAs are evaluated against the same version
+	replicationConfig atomic.Value
+	monitor *monitor.Monitor
+}
+
+func New(m *monitor.Monitor) *Optimizer {
+	return &Optimizer{monitor: m}
+}
+
+var defaultOptimizer = New(monitor.Default())
+
+// Default returns the optimizer that the package-level functions below use, it works with the default monitor
+func Default() *Optimizer {
+	return defaultOptimizer
+}
+
+// This is called from the client-side api/lib to init the replication data on the optimizer side (and on every new config version)
+func (o *Optimizer) Init(config *util.ReplicationConfig) {
+	o.replicationConfig.Store(config)
+	fmt.Printf("Optimizor: Replication Config is Set to %v\n", config)
+}
+
+func (o *Optimizer) currentConfig() *util.ReplicationConfig {
+	config, _ := o.replicationConfig.Load().(*util.ReplicationConfig)
+	return config
+}
+
+// FindNodeToRead ranks the nodes to read the key from by expected utility, the best one first
+// Every node that satisfies the consistency of a sub-SLA is a candidate, for the sub-SLA where its utility is the highest;
+// nodes that are known to be down (see monitor.IsDown) come last, so a read can still fall back on them
+func (o *Optimizer) FindNodeToRead(s *util.Session, key string, sla *consistency.SLA) []Candidate {
+	type rankedCandidate struct {
+		Candidate
+		subIndex int
+		avgRTT   time.Duration
+	}
+	var candidates []rankedCandidate
+	config := o.currentConfig()
+
+	for i, sub := range sla.SubSLAs {
+		nodes, _ := o.SelectNodesForConsistency(config, s, key, sub.Consistency, sub.StalenessBound)
+		for _, node := range nodes {
+			var utility float32
+			if !o.monitor.IsDown(node) {
+				// the last input to the function is being optmistic in the probability calculation
+				utility = float32(sub.Utility * o.monitor.ProbabilityOfRTTBelow(node, sub.Latency.Duration, true))
+			}
+			candidates = append(candidates, rankedCandidate{
+				Candidate: Candidate{Node: node, SubSLA: sub, Utility: utility},
+				subIndex:  i,
+				avgRTT:    o.monitor.GetAvgRTT(node),
+			})
+		}
+	}
+
+	// Ties go to the more preferred sub-SLA, then to the node with the lower average RTT
+	sort.SliceStable(candidates, func(i, j int) bool {
+		a, b := candidates[i], candidates[j]
+		if a.Utility != b.Utility {
+			return a.Utility > b.Utility
+		}
+		if a.subIndex != b.subIndex {
+			return a.subIndex < b.subIndex
+		}
+		return a.avgRTT < b.avgRTT
+	})
+
+	// A node is only tried once, for its best sub-SLA
+	var ranked []Candidate
+	seen := make(map[string]bool)
+	for _, candidate := range candidates {
+		if !seen[candidate.Node] {
+			seen[candidate.Node] = true
+			ranked = append(ranked, candidate.Candidate)
+		}
+	}
+	return ranked
 }
 
-// FindNodeToRead selects the node with the highest utility for the given key and SLA
-// The last return value is the list of min_read_timestamp for all sub_sla's [used for utility calculation] 
-func FindNodeToRead(s *util.Session, key string, sla *consistency.SLA) (string, consistency.SubSLA, []int64) {
+// FindNodeToReadMulti is FindNodeToRead for a group of keys of the same shard that are read from a single node
+// A node is only a candidate for a sub-SLA if it satisfies the consistency for every key of the group
+// The last return value holds the min_read_timestamp for all sub_sla's of each key
+func (o *Optimizer) FindNodeToReadMulti(s *util.Session, keys []string, sla *consistency.SLA) (string, consistency.SubSLA, map[string][]int64) {
 
 	var chosenNode string
 	var chosenSubSLA consistency.SubSLA
-	var minTSPerSubSLA []int64	// this holds the minReadTimestamp for each sub-SLA
+	minTSPerKey := make(map[string][]int64)
 
 	maxUtility := float32(-1)
+	config := o.currentConfig()
 
 	for _, sub := range sla.SubSLAs {
-		subUtility, minReadTS := ComputeUtilityForSubSLA(s, key, &sub)
-		minTSPerSubSLA = append(minTSPerSubSLA, minReadTS)
-
-		// TODO: handle stale nodes [when the utility is zero] [could be an optimization]
-		// if subUtility.Utility <= 0 { ... }
+		var candidates []string
+		for i, key := range keys {
+			nodes, minReadTS := o.SelectNodesForConsistency(config, s, key, sub.Consistency, sub.StalenessBound)
+			minTSPerKey[key] = append(minTSPerKey[key], minReadTS)
+
+			if i == 0 {
+				candidates = nodes
+			} else {
+				candidates = intersectNodes(candidates, nodes)
+			}
+		}
 
+		subUtility := o.utilityOfNodes(candidates, &sub)
 		if subUtility.Utility > maxUtility {
 			maxUtility = subUtility.Utility
 			chosenSubSLA = sub
@@ -46,25 +138,44 @@ func FindNodeToRead(s *util.Session, key string, sla *consistency.SLA) (string,
 		}
 	}
 
-	return chosenNode, chosenSubSLA, minTSPerSubSLA
+	return chosenNode, chosenSubSLA, minTSPerKey
+}
+
+// Returns the nodes of a that are also in b
+func intersectNodes(a []string, b []string) []string {
+	var common []string
+	for _, node := range a {
+		for _, other := range b {
+			if node == other {
+				common = append(common, node)
+				break
+			}
+		}
+	}
+	return common
 }
 
 // Returns the best node for a given SubSLA
-func ComputeUtilityForSubSLA(s *util.Session, key string, sub *consistency.SubSLA) (SubUtility, int64) {
+func (o *Optimizer) ComputeUtilityForSubSLA(config *util.ReplicationConfig, s *util.Session, key string, sub *consistency.SubSLA) (SubUtility, int64) {
+	// Only filter those nodes that satisfy the consistency
+	nodes, minReadTS := o.SelectNodesForConsistency(config, s, key, sub.Consistency, sub.StalenessBound)
+
+	return o.utilityOfNodes(nodes, sub), minReadTS
+}
+
+// Picks the node (out of the ones satisfying the consistency) that is most likely to meet the latency of the sub-SLA
+func (o *Optimizer) utilityOfNodes(nodes []string, sub *consistency.SubSLA) SubUtility {
 	var chosen string
 	var maxProb float64 = -1
 
-	// Only filter those nodes that satisfy the consistency
-	nodes, minReadTS := SelectNodesForConsistency(s, key, sub.Consistency, sub.StalenessBound)
-
 	for _, node := range nodes {
-		prob := monitor.ProbabilityOfRTTBelow(node, sub.Latency.Duration, true) // the last input to the function is being optmistic in the probability calculation
+		prob := o.monitor.ProbabilityOfRTTBelow(node, sub.Latency.Duration, true) // the last input to the function is being optmistic in the probability calculation
 
 		if prob > maxProb {
 			maxProb = prob
 			chosen = node
 		} else if prob == maxProb {	// Break ties with lower average RTT
-			if monitor.GetAvgRTT(node) < monitor.GetAvgRTT(chosen) {
+			if o.monitor.GetAvgRTT(node) < o.monitor.GetAvgRTT(chosen) {
 				chosen = node
 			}
 		}
@@ -76,18 +187,18 @@ func ComputeUtilityForSubSLA(s *util.Session, key string, sub *consistency.SubSL
 	return SubUtility{
 		Utility: utility,
 		Node:    chosen,
-	}, minReadTS
+	}
 }
 
 // returns nodes that can serve a given consistency requirement
-func SelectNodesForConsistency(session *util.Session, key string, level consistency.ConsistencyLevel, bound *time.Duration) ([]string, int64) {
+func (o *Optimizer) SelectNodesForConsistency(config *util.ReplicationConfig, session *util.Session, key string, level consistency.ConsistencyLevel, bound *time.Duration) ([]string, int64) {
 	var selected []string
 	var minReadTS int64
 
 	// TODO: implement the helper functions for other consistency levels below
 	switch level {
 		case consistency.Strong:
-			selected = append(selected, SelectNodesForStrongConsistency(key)...)
+			selected = append(selected, SelectNodesForStrongConsistency(config, key)...)
 
 			// For strong consistency, minReadTS is not defined per client [we always go to primary]
 			// TODO: Is this right?
@@ -95,27 +206,27 @@ func SelectNodesForConsistency(session *util.Session, key string, level consiste
 
 		// last preceding Put(key) in the same session
 		case consistency.ReadMyWrites:
-			nodes, requiredReadTS := SelectNodesForReadMyWrites(session, key)
+			nodes, requiredReadTS := o.SelectNodesForReadMyWrites(config, session, key)
 			selected = append(selected, nodes...)
 			minReadTS = requiredReadTS
 		
 		// last preceding GET(key) in the same session
 		case consistency.MonotonicReads:
-			nodes, requiredReadTS := SelectNodesForMonotonicReads(session, key)
+			nodes, requiredReadTS := o.SelectNodesForMonotonicReads(config, session, key)
 			selected = append(selected, nodes...)
 			minReadTS = requiredReadTS
 
 		case consistency.Bounded:
-			nodes, requiredReadTS := SelectNodesForBoundedStaleness(session, key, bound)
+			nodes, requiredReadTS := o.SelectNodesForBoundedStaleness(config, session, key, bound)
 			selected = append(selected, nodes...)
 			minReadTS = requiredReadTS
 
 		case consistency.Eventual:
-			selected = append(selected, SelectNodesForEventualConsistency(key)...)
+			selected = append(selected, SelectNodesForEventualConsistency(config, key)...)
 			minReadTS = 0.0
 
 		default:
-			selected = append(selected, SelectNodesForStrongConsistency(key)...)
+			selected = append(selected, SelectNodesForStrongConsistency(config, key)...)
 			minReadTS = -1 
 	}
 
@@ -123,21 +234,13 @@ func SelectNodesForConsistency(session *util.Session, key string, level consiste
 }
 
 // Always return the primary for the key
-func SelectNodesForStrongConsistency(key string) []string {
+func SelectNodesForStrongConsistency(config *util.ReplicationConfig, key string) []string {
 	var selected []string
 
-	numericKey, err := strconv.Atoi(key)
-	if err != nil {
-		fmt.Printf("Error: Could not convert key to numeric value.")
-		return selected
-	}
-
 	// Find the primary for the key and return
-	for _, shard := range replicationConfig.Shards {
-		if (numericKey >= shard.RangeStart && numericKey <= shard.RangeEnd) {
-			selected = append(selected, shard.Primary)
-			return selected
-		}
+	if shard := config.ShardForKey(key); shard != nil {
+		selected = append(selected, shard.Primary)
+		return selected
 	}
 
 	// If no shard found, return empty
@@ -145,19 +248,24 @@ func SelectNodesForStrongConsistency(key string) []string {
 	return selected
 }
 
-// Return all storage nodes
-func SelectNodesForEventualConsistency(key string) []string {
+// Return all replicas of the shard of the key
+func SelectNodesForEventualConsistency(config *util.ReplicationConfig, key string) []string {
 	var selected []string
 
-	// Add all storage nodes addresses
-	for _, node := range replicationConfig.Nodes {
-			selected = append(selected, node.Address)
-		}
+	// Add the primary and the secondaries of the shard
+	if shard := config.ShardForKey(key); shard != nil {
+		selected = append(selected, shard.Primary)
+		selected = append(selected, shard.Secondaries...)
+		return selected
+	}
+
+	// If no shard found, return empty
+	fmt.Println("Error: Did not find a shard which the key belongs to!")
 	return selected
 }
 
 // Nodes that have value written by the last preceding Put(key) in the same session
-func SelectNodesForReadMyWrites(session *util.Session, key string) ([]string, int64) {
+func (o *Optimizer) SelectNodesForReadMyWrites(config *util.ReplicationConfig, session *util.Session, key string) ([]string, int64) {
 	fmt.Printf("entered SelectNodesForReadMyWrites \n")
 	var selected []string
 	var minHighTS int64
@@ -171,33 +279,28 @@ func SelectNodesForReadMyWrites(session *util.Session, key string) ([]string, in
 	fmt.Printf("Last write is %d\n",  session.ObjectsWritten[key])
 	fmt.Printf("minHighTS is set to %d \n", minHighTS)
 
-	numericKey, err := strconv.Atoi(key)
-	if err != nil {
-		fmt.Printf("Error: Could not convert key to numeric value.\n")
+	shard := config.ShardForKey(key)
+	if shard == nil {
+		fmt.Println("Error: Did not find a shard which the key belongs to!")
 		return selected, minHighTS
 	}
 
-	primary := ""
 	// Add primary of shard
-	for _, shard := range replicationConfig.Shards {
-		if numericKey >= shard.RangeStart && numericKey <= shard.RangeEnd {
-			primary = shard.Primary
-			selected = append(selected, primary)
-			break
-		}
-	}
+	primary := shard.Primary
+	selected = append(selected, primary)
 
-	// Also add secondaries that are sufficiently up-to-date
-	for _, node := range replicationConfig.Nodes {
-		if node.Address == primary {
-			continue 
-		}
+	// The last write may or may not have been applied, only the primary has it for sure (like strong consistency)
+	if minHighTS == util.UnknownWriteTS {
+		return selected, -1
+	}
 
-		highTS := monitor.GetHTS(node.Address)
+	// Also add the secondaries of the shard that are sufficiently up-to-date (the other nodes don't replicate the key)
+	for _, secondary := range shard.Secondaries {
+		highTS := o.monitor.GetHTS(secondary, shard.ShardId)
 		fmt.Printf("Node highTS is %d \n", highTS)
 
 		if highTS >= minHighTS {
-			selected = append(selected, node.Address)
+			selected = append(selected, secondary)
 		}
 	}
 
@@ -205,7 +308,7 @@ func SelectNodesForReadMyWrites(session *util.Session, key string) ([]string, in
 	return selected, minHighTS
 }
 
-func SelectNodesForMonotonicReads(session *util.Session, key string) ([]string, int64) {
+func (o *Optimizer) SelectNodesForMonotonicReads(config *util.ReplicationConfig, session *util.Session, key string) ([]string, int64) {
 	fmt.Printf("entered SelectNodesForMonotonicReads \n")
 	var selected []string
 	var minHighTS int64
@@ -219,33 +322,23 @@ func SelectNodesForMonotonicReads(session *util.Session, key string) ([]string,
 	fmt.Printf("Last read is %d\n",  session.ObjectsRead[key])
 	fmt.Printf("minHighTS is set to %d \n", minHighTS)
 
-	numericKey, err := strconv.Atoi(key)
-	if err != nil {
-		fmt.Printf("Error: Could not convert key to numeric value.\n")
+	shard := config.ShardForKey(key)
+	if shard == nil {
+		fmt.Println("Error: Did not find a shard which the key belongs to!")
 		return selected, minHighTS
 	}
 
-	primary := ""
 	// Add primary of shard
-	for _, shard := range replicationConfig.Shards {
-		if numericKey >= shard.RangeStart && numericKey <= shard.RangeEnd {
-			primary = shard.Primary
-			selected = append(selected, primary)
-			break
-		}
-	}
-
-	// Also add secondaries that are sufficiently up-to-date
-	for _, node := range replicationConfig.Nodes {
-		if node.Address == primary {
-			continue 
-		}
+	primary := shard.Primary
+	selected = append(selected, primary)
 
-		highTS := monitor.GetHTS(node.Address)
+	// Also add the secondaries of the shard that are sufficiently up-to-date (the other nodes don't replicate the key)
+	for _, secondary := range shard.Secondaries {
+		highTS := o.monitor.GetHTS(secondary, shard.ShardId)
 		fmt.Printf("Node highTS is %d \n", highTS)
 
 		if highTS >= minHighTS {
-			selected = append(selected, node.Address)
+			selected = append(selected, secondary)
 		}
 	}
 
@@ -254,51 +347,81 @@ func SelectNodesForMonotonicReads(session *util.Session, key string) ([]string,
 }
 
 // The input bound is in Milliseconds
-func SelectNodesForBoundedStaleness(session *util.Session, key string, bound *time.Duration) ([]string, int64) {
+func (o *Optimizer) SelectNodesForBoundedStaleness(config *util.ReplicationConfig, session *util.Session, key string, bound *time.Duration) ([]string, int64) {
 	fmt.Printf("entered SelectNodesForBoundedStaleness \n")
 	var selected []string
 	var minHighTS int64
 
-	// Get the last time key was written in this session
-	minHighTS = time.Now().Add(-*bound).UnixMilli()
+	// Nodes must have seen every write older than the staleness bound (no bound: every write, like consistency.SubSLA.Staleness)
+	var staleness time.Duration
+	if bound != nil {
+		staleness = *bound
+	}
+	minHighTS = util.HLCFromTime(time.Now().Add(-staleness))
 
-	fmt.Println("Curr time is", time.Now().UnixMilli())
+	fmt.Println("Curr time is", util.HLCFromTime(time.Now()))
 	fmt.Printf("minHighTS is set to %d \n", minHighTS)
 
-	numericKey, err := strconv.Atoi(key)
-	if err != nil {
-		fmt.Printf("Error: Could not convert key to numeric value.\n")
+	shard := config.ShardForKey(key)
+	if shard == nil {
+		fmt.Println("Error: Did not find a shard which the key belongs to!")
 		return selected, minHighTS
 	}
 
-	primary := ""
 	// Add primary of shard
-	for _, shard := range replicationConfig.Shards {
-		if numericKey >= shard.RangeStart && numericKey <= shard.RangeEnd {
-			primary = shard.Primary
-			selected = append(selected, primary)
-
-			primaryHighTS := monitor.GetHTS(primary)
-			fmt.Printf("Primary highTS is %d \n", primaryHighTS)
-			break
-		}
-	}
+	primary := shard.Primary
+	selected = append(selected, primary)
 
+	primaryHighTS := o.monitor.GetHTS(primary, shard.ShardId)
+	fmt.Printf("Primary highTS is %d \n", primaryHighTS)
 
-	// Also add secondaries that are sufficiently up-to-date
-	for _, node := range replicationConfig.Nodes {
-		if node.Address == primary {
-			continue 
-		}
 
-		highTS := monitor.GetHTS(node.Address)
+	// Also add the secondaries of the shard that are sufficiently up-to-date (the other nodes don't replicate the key)
+	for _, secondary := range shard.Secondaries {
+		highTS := o.monitor.GetHTS(secondary, shard.ShardId)
 		fmt.Printf("Node highTS is %d \n", highTS)
 
 		if highTS >= minHighTS {
-			selected = append(selected, node.Address)
+			selected = append(selected, secondary)
 		}
 	}
 
 	fmt.Printf("returnung the nodes %v\n", selected)
 	return selected, minHighTS
-}
\ No newline at end of file
+}
+
+// ========== Default Optimizer ==========
+
+// The package-level functions use the default optimizer (see Default)
+
+func Init(config *util.ReplicationConfig) {
+	defaultOptimizer.Init(config)
+}
+
+func FindNodeToRead(s *util.Session, key string, sla *consistency.SLA) []Candidate {
+	return defaultOptimizer.FindNodeToRead(s, key, sla)
+}
+
+func FindNodeToReadMulti(s *util.Session, keys []string, sla *consistency.SLA) (string, consistency.SubSLA, map[string][]int64) {
+	return defaultOptimizer.FindNodeToReadMulti(s, keys, sla)
+}
+
+func ComputeUtilityForSubSLA(config *util.ReplicationConfig, s *util.Session, key string, sub *consistency.SubSLA) (SubUtility, int64) {
+	return defaultOptimizer.ComputeUtilityForSubSLA(config, s, key, sub)
+}
+
+func SelectNodesForConsistency(config *util.ReplicationConfig, session *util.Session, key string, level consistency.ConsistencyLevel, bound *time.Duration) ([]string, int64) {
+	return defaultOptimizer.SelectNodesForConsistency(config, session, key, level, bound)
+}
+
+func SelectNodesForReadMyWrites(config *util.ReplicationConfig, session *util.Session, key string) ([]string, int64) {
+	return defaultOptimizer.SelectNodesForReadMyWrites(config, session, key)
+}
+
+func SelectNodesForMonotonicReads(config *util.ReplicationConfig, session *util.Session, key string) ([]string, int64) {
+	return defaultOptimizer.SelectNodesForMonotonicReads(config, session, key)
+}
+
+func SelectNodesForBoundedStaleness(config *util.ReplicationConfig, session *util.Session, key string, bound *time.Duration) ([]string, int64) {
+	return defaultOptimizer.SelectNodesForBoundedStaleness(config, session, key, bound)
+}
@@ -3,12 +3,14 @@ package util
 import (
 	"encoding/json"
 	"fmt"
+	"math"
 	"os"
 	"sort"
 	"strings"
 	"time"
 
 	"client/consistency"
+	"pileus/partition"
 )
 
 // Structs for importing raw SLA's from config files
@@ -35,21 +37,49 @@ type Shard struct {
 	RangeStart int `json:"start"`
 	RangeEnd   int `json:"end"`
 	Primary	string `json:"primary"` 
+	PrimaryID string `json:"primaryID"`
 	SecondaryIDs []string `json:"secondaryIDs"`
 	Secondaries []string
+	Epoch int64 `json:"epoch"`	// configuration epoch in which the primary was installed, sent along with writes
 	HighTS  int64
 }
 
 type StorageNode struct {
 	Id string `json:"nodeId"`
 	Address   string `json:"nodeAddress"`
+	GRPCAddress string `json:"grpcAddress,omitempty"`	// where the node serves gRPC, needed for api.GRPCTransport
 }
 
 type ReplicationConfig struct {
 	Nodes  []StorageNode `json:"nodes"`
 	Shards []Shard `json:"shards"`
+	Epoch  int64 `json:"epoch"`	// bumped by the coordinator on every reconfiguration (e.g. a primary failover)
+	Partitioning partition.Scheme `json:"partitioning,omitempty"`	// how keys map to the shard ranges, as on the storage nodes
 }
 
+// ShardIndexForKey returns the index (in Shards) of the shard whose range holds the position of the key, or -1 if there is none
+// A key on a shared boundary goes to the shard of partition.Owner, as on the storage nodes
+func (c *ReplicationConfig) ShardIndexForKey(key string) int {
+	position, err := c.Partitioning.Position(key)
+	if err != nil {
+		return -1
+	}
+	ranges := make([]partition.ShardRange, len(c.Shards))
+	for i, shard := range c.Shards {
+		ranges[i] = partition.ShardRange{ID: shard.ShardId, Start: shard.RangeStart, End: shard.RangeEnd}
+	}
+	return partition.Owner(position, ranges)
+}
+
+// ShardForKey returns the shard of the key, or nil if there is none (see ShardIndexForKey)
+func (c *ReplicationConfig) ShardForKey(key string) *Shard {
+	if i := c.ShardIndexForKey(key); i >= 0 {
+		return &c.Shards[i]
+	}
+	return nil
+}
+
+// Picks the policy a session reads with, the built-in ones are below and api.RegisterSelectionPolicy adds others
 type ServerSelectionPolicy int
 
 const (
@@ -61,14 +91,33 @@ const (
 
 // Session should hold state for read-my-writes and monotonic consistency levels
 // TODO: Add session-specific state for monotonic reads, etc.
+// Timestamps in ObjectsWritten/ObjectsRead are the hybrid logical clock values issued by the storage nodes
 type Session struct {
 	DefaultSLA *consistency.SLA
 	ServerSelectionPolicy ServerSelectionPolicy		// This is added purely for testing capabilities
-	ObjectsWritten map[string]int64
+	ObjectsWritten map[string]int64		// UnknownWriteTS for a key whose last write may or may not have been applied
 	ObjectsRead map[string]int64
 	Utilities []float64
 }
 
+// Recorded in Session.ObjectsWritten for a write cut short by its context: the primary may have applied it at any timestamp,
+// so only the primary is known to have it and read-my-writes reads of the key go there until the next write
+const UnknownWriteTS int64 = math.MaxInt64
+
+// Object timestamps and HighTS are hybrid logical clocks: (physical ms << HLCLogicalBits) | logical counter
+// This has to match the hlc package of the storage nodes
+const HLCLogicalBits = 12
+
+// HLCFromTime returns the smallest hybrid logical clock timestamp issued at or after t
+func HLCFromTime(t time.Time) int64 {
+	return t.UnixMilli() << HLCLogicalBits
+}
+
+// HLCToTime returns the physical time of a hybrid logical clock timestamp
+func HLCToTime(ts int64) time.Time {
+	return time.UnixMilli(ts >> HLCLogicalBits)
+}
+
 type ConditionCode struct {
 	SubSlaChosen consistency.SubSLA
 	LatencyMet bool
@@ -1,14 +1,22 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"sync"
 	"time"
 	"os"
 	"bytes"
+	"strconv"
+
+	"google.golang.org/grpc"
+	"pileus/partition"
+	pileuspb "pileus/proto"
 )
 
 // ========== SLA Definitions ==========
@@ -65,20 +73,29 @@ type Shard struct {
 	RangeStart int `json:"start"`
 	RangeEnd   int `json:"end"`
 	Primary	string `json:"primary"` 
+	PrimaryID string `json:"primaryID"`
 	SecondaryIDs []string `json:"secondaryIDs"`
 	Secondaries []string
 	DefaultRepFreq float64 `json:"defaultRepFreq"`
+	ChangeLogRetention float64 `json:"changeLogRetention,omitempty"`
+	ReplicationMode string `json:"replicationMode,omitempty"`
+	Epoch int64 `json:"epoch"`	// configuration epoch in which the current primary was installed
+	EpochStartTS int64 `json:"epochStartTS"`	// HighTS of the primary when it was installed
 	ReplicationFreqs map[string]float64
 }
 
 type StorageNode struct {
 	Id string `json:"nodeId"`
 	Address   string `json:"nodeAddress"`
+	GRPCAddress string `json:"grpcAddress,omitempty"`
 }
 
 type ReplicationConfig struct {
 	Nodes  []StorageNode `json:"nodes"`
 	Shards []Shard `json:"shards"`
+	Epoch  int64 `json:"epoch"`	// bumped on every reconfiguration, storage nodes and clients only move forward
+	NextShardId int `json:"nextShardId,omitempty"`	// id of the next shard created by a split (ids are never reused)
+	Partitioning partition.Scheme `json:"partitioning,omitempty"`	// how keys map to the shard ranges, fixed for the life of the cluster
 }
 
 // ========== Coordinator State ==========
@@ -94,12 +111,51 @@ var (
 	utilityThreshold = 0.4
 
 	GlobalConfig *ReplicationConfig
+
+	// Primary failure detection: heartbeats to /probe of every primary
+	probeInterval = 1 * time.Second
+	missedProbesForFailover = 3
+	probeClient = &http.Client{Timeout: 1 * time.Second}
+
+	// Shards (by id) with a planned change in progress (primary move, split or merge), and the last primary move of a shard
+	plannedChanges = make(map[int]bool)
+	lastPrimaryMove = make(map[int]time.Time)
+	primaryMoveCooldown = 60 * time.Second
+	catchUpPollInterval = 200 * time.Millisecond
+
+	// The coordinator owns the config: every new epoch is written to statePath, and picked up from there on a restart
+	statePath string
+	// Closed (and replaced) whenever a new epoch is committed, /config long-polls wait on it
+	configUpdated = make(chan struct{})
+	configPollTimeout = 30 * time.Second
 )
 
+// How to invoke: go run coordinator.go [-config path] [-state path] [-grpc address]
 func main() {
-	LoadReplicationConfig("../single_shard_config.json")
+	configPath := flag.String("config", "../single_shard_config.json", "initial replication config, used until the coordinator has a state file")
+	flag.StringVar(&statePath, "state", "coordinator_state.json", "file the coordinator keeps the current config (and its epoch) in")
+	grpcListen := flag.String("grpc", "", "address to serve the Coordinator gRPC service on (e.g. :9091), next to HTTP on :8080")
+	flag.Parse()
+
+	// After a restart the coordinator continues from the last epoch it published
+	path := *configPath
+	if _, err := os.Stat(statePath); err == nil {
+		path = statePath
+	}
+	if err := LoadReplicationConfig(path); err != nil {
+		log.Fatalf("Failed to load the config from %s: %v", path, err)
+	}
 
 	http.HandleFunc("/report", reportHandler)
+	http.HandleFunc("/config", configHandler)
+	http.HandleFunc("/relocate", relocateHandler)
+	http.HandleFunc("/split", splitHandler)
+	http.HandleFunc("/merge", mergeHandler)
+
+	go monitorPrimaries()
+	if *grpcListen != "" {
+		go serveGRPC(*grpcListen)
+	}
 
 	fmt.Println("Coordinator agent running on :8080")
 	log.Fatal(http.ListenAndServe(":8080", nil))
@@ -112,6 +168,15 @@ func reportHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !acceptReport(report) {
+		w.WriteHeader(http.StatusTooManyRequests)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// Starts the analysis of a report, unless one of the same client and region was handled within the cooldown
+func acceptReport(report UtilityDropReport) bool {
 	now := time.Now()
 	key := fmt.Sprintf("%s-%s", report.ClientID, report.Region)
 
@@ -121,8 +186,7 @@ func reportHandler(w http.ResponseWriter, r *http.Request) {
 	lastTime, seen := lastUtilityDropTime[key]
 	if seen && now.Sub(lastTime) < reportCooldown {
 		fmt.Printf("[SKIPPED] Recent utility drop already handled for %s in %s\n", report.ClientID, report.Region)
-		w.WriteHeader(http.StatusTooManyRequests)
-		return
+		return false
 	}
 
 	lastUtilityDropTime[key] = now
@@ -131,8 +195,7 @@ func reportHandler(w http.ResponseWriter, r *http.Request) {
 
 	// Kick off analysis in the background
 	go handleReportAnalysis(report)
-
-	w.WriteHeader(http.StatusOK)
+	return true
 }
 
 // This is right now written for a single shard, thought multi-shard support is very similar (shardID should be passed)
@@ -188,23 +251,22 @@ func handleReportAnalysis(report UtilityDropReport) {
 						}
 					}
 
-					fmt.Println("closest node is %s", closest)
-					fmt.Println("Rep Frequency in it is %d", GlobalConfig.Shards[0].ReplicationFreqs[closest])
+					fmt.Printf("closest node is %s\n", closest)
+					currentFreq, lastUpdate, seen := replicationFreq(closest)
+					fmt.Printf("Rep Frequency in it is %.2f\n", currentFreq)
 					
 					// Contact the secondary node for setting rep frequency
-					currentFreq := GlobalConfig.Shards[0].ReplicationFreqs[closest]
 					if closest != "" {
-						lastUpdate, seen := lastReplicationUpdate[closest]
 
 						// Don't send many close adjusting requests to a server
 						if seen && time.Since(lastUpdate) < time.Duration(currentFreq * 1.5 * float64(time.Second)) {
-							fmt.Println("[SKIPPED] Replication update to %s skipped due to cooldown", closest)
+							fmt.Printf("[SKIPPED] Replication update to %s skipped due to cooldown\n", closest)
 							return
 						}
 
 						if currentFreq <= 5 {
-							fmt.Println("Freq is already too low")
-							// TODO: here should consider tracking these cases and if needed move primary
+							fmt.Println("Freq is already too low, moving the primary closer instead")
+							movePrimaryCloser(0, report, summary.Node)
 							return
 						}
 
@@ -223,8 +285,7 @@ func handleReportAnalysis(report UtilityDropReport) {
 							defer resp.Body.Close()
 							if resp.StatusCode == http.StatusOK {
 								fmt.Println("[SUCCESS] Replication frequency update acknowledged by secondary")
-								GlobalConfig.Shards[0].ReplicationFreqs[closest] = newFreq
-								lastReplicationUpdate[closest] = time.Now()
+								setReplicationFreq(closest, newFreq)
 							} else {
 								fmt.Printf("[WARN] Replication update failed with status: %d\n", resp.StatusCode)
 							}
@@ -233,6 +294,12 @@ func handleReportAnalysis(report UtilityDropReport) {
 
 					break	
 				}
+			} else if cons == 4 && isPrimaryForShard(summary.Node) {
+				// Strong reads can only go to the primary, so only a closer primary helps
+				fmt.Printf("[RECONFIG CANDIDATE] Node %s failing SLA with Consistency=%d Latency=%v\n",
+					report.ClientID, cons, entry.SubSLA.Latency.Duration)
+				movePrimaryCloser(0, report, summary.Node)
+				break
 			}
 		} else if entry.Status == "Consistency_Not_Met" {
 			cons := entry.SubSLA.Consistency
@@ -241,13 +308,12 @@ func handleReportAnalysis(report UtilityDropReport) {
 						report.ClientID, cons, entry.SubSLA.Latency.Duration)
 					
 					// Contact the secondary node for setting rep frequency
-					currentFreq := GlobalConfig.Shards[0].ReplicationFreqs[summary.Node]
+					currentFreq, lastUpdate, seen := replicationFreq(summary.Node)
 					if summary.Node != "" {
-						lastUpdate, seen := lastReplicationUpdate[summary.Node]
 
 						// Don't send many close adjusting requests to a server
 						if seen && time.Since(lastUpdate) < time.Duration(currentFreq * 2 * float64(time.Second)) {
-							fmt.Println("[SKIPPED] Replication update to %s skipped due to cooldown", summary.Node)
+							fmt.Printf("[SKIPPED] Replication update to %s skipped due to cooldown\n", summary.Node)
 							return
 						}
 
@@ -272,8 +338,7 @@ func handleReportAnalysis(report UtilityDropReport) {
 							defer resp.Body.Close()
 							if resp.StatusCode == http.StatusOK {
 								fmt.Println("[SUCCESS] Replication frequency update acknowledged by secondary")
-								GlobalConfig.Shards[0].ReplicationFreqs[summary.Node] = newFreq
-								lastReplicationUpdate[summary.Node] = time.Now()
+								setReplicationFreq(summary.Node, newFreq)
 							} else {
 								fmt.Printf("[WARN] Replication update failed with status: %d\n", resp.StatusCode)
 							}
@@ -286,6 +351,836 @@ func handleReportAnalysis(report UtilityDropReport) {
 	}
 }
 
+// Current replication config, clients fetch it after a write hits a primary of an older epoch
+// With ?after=<epoch> the request is held until there is a newer epoch, or answered with 304 after configPollTimeout
+// (storage nodes and clients long-poll it to pick up every new version)
+func configHandler(w http.ResponseWriter, r *http.Request) {
+	after := int64(-1)
+	if afterStr := r.URL.Query().Get("after"); afterStr != "" {
+		var err error
+		after, err = strconv.ParseInt(afterStr, 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid epoch", http.StatusBadRequest)
+			return
+		}
+	}
+
+	if !waitForConfig(r.Context(), after) {
+		if r.Context().Err() == nil {
+			w.WriteHeader(http.StatusNotModified)
+		}
+		return
+	}
+	defer mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(GlobalConfig)
+}
+
+// Waits (up to configPollTimeout) for a config with an epoch newer than after
+// If there is one, it returns true with mu held, so the caller can send the config before it changes again
+func waitForConfig(ctx context.Context, after int64) bool {
+	mu.Lock()
+	if GlobalConfig.Epoch <= after {
+		updated := configUpdated
+		mu.Unlock()
+
+		select {
+		case <-updated:
+		case <-time.After(configPollTimeout):
+		case <-ctx.Done():
+			return false
+		}
+		mu.Lock()
+	}
+
+	if GlobalConfig.Epoch <= after {
+		mu.Unlock()
+		return false
+	}
+	return true
+}
+
+// Persists the config of a new epoch and wakes up the /config long-polls (must hold mu)
+func commitConfig() {
+	if err := saveConfig(); err != nil {
+		fmt.Printf("[ERROR] Failed to save the config of epoch %d: %v\n", GlobalConfig.Epoch, err)
+	}
+	close(configUpdated)
+	configUpdated = make(chan struct{})
+}
+
+// Writes the config to statePath (through a temp file, so a crash never leaves a truncated one behind)
+func saveConfig() error {
+	data, err := json.MarshalIndent(GlobalConfig, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := statePath + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, statePath)
+}
+
+// ========== Primary Failover ==========
+
+// Heartbeats the primary of every shard, a primary that misses missedProbesForFailover probes in a row is failed over
+// Shards are tracked by id, splits and merges reorder GlobalConfig.Shards in between
+func monitorPrimaries() {
+	missed := make(map[int]int)
+	ticker := time.NewTicker(probeInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		mu.Lock()
+		primaries := make(map[int]string, len(GlobalConfig.Shards))
+		for _, shard := range GlobalConfig.Shards {
+			primaries[shard.ShardId] = shard.Primary
+		}
+		mu.Unlock()
+
+		// Forget the shards that were merged away
+		for id := range missed {
+			if _, ok := primaries[id]; !ok {
+				delete(missed, id)
+			}
+		}
+
+		for id, primary := range primaries {
+			mu.Lock()
+			planned := plannedChanges[id]
+			mu.Unlock()
+
+			// A drained primary is expected to hold writes, the planned change takes care of it
+			if planned || probe(primary) {
+				missed[id] = 0
+				continue
+			}
+
+			missed[id]++
+			fmt.Printf("[WARN] Primary %s of shard %d missed %d probes\n", primary, id, missed[id])
+			if missed[id] < missedProbesForFailover {
+				continue
+			}
+
+			if err := failover(id, primary); err != nil {
+				fmt.Printf("[ERROR] Failover of shard %d failed: %v\n", id, err)
+				continue
+			}
+			missed[id] = 0
+		}
+	}
+}
+
+func probe(node string) bool {
+	resp, err := probeClient.Get(fmt.Sprintf("http://%s/probe", node))
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return resp.StatusCode == http.StatusOK
+}
+
+// Promotes the most up-to-date secondary (highest HighTS in /status) of the shard to primary, in a new epoch
+// The failed primary is dropped from the shard, and every storage node gets the new shard config through /reconfigure
+// The failover holds the planned change of the shard, so no relocation, split or merge changes it meanwhile
+func failover(shardID int, failed string) error {
+	if err := beginPlannedChange(shardID); err != nil {
+		return err
+	}
+	defer endPlannedChange(shardID)
+
+	mu.Lock()
+	i := shardIndex(shardID)
+	if i == -1 {
+		mu.Unlock()
+		return nil
+	}
+	shard := copyShard(GlobalConfig.Shards[i])
+	mu.Unlock()
+
+	if shard.Primary != failed {
+		return nil
+	}
+
+	best := -1
+	var bestHighTS int64
+	for j, secondary := range shard.Secondaries {
+		highTS, err := secondaryHighTS(secondary, shard.ShardId)
+		if err != nil {
+			fmt.Printf("[WARN] Secondary %s can't be promoted: %v\n", secondary, err)
+			continue
+		}
+		if best == -1 || highTS > bestHighTS {
+			best = j
+			bestHighTS = highTS
+		}
+	}
+	if best == -1 {
+		return fmt.Errorf("no reachable secondary for shard %d", shard.ShardId)
+	}
+
+	// The shard may have changed while the secondaries were asked
+	mu.Lock()
+	i = shardIndex(shardID)
+	if i == -1 || GlobalConfig.Shards[i].Primary != failed {
+		mu.Unlock()
+		return nil
+	}
+	GlobalConfig.Epoch++
+	epoch := GlobalConfig.Epoch
+
+	updated := &GlobalConfig.Shards[i]
+	updated.Primary = shard.Secondaries[best]
+	updated.PrimaryID = shard.SecondaryIDs[best]
+	updated.Secondaries = removeAt(shard.Secondaries, best)
+	updated.SecondaryIDs = removeAt(shard.SecondaryIDs, best)
+	delete(updated.ReplicationFreqs, updated.Primary)
+	updated.Epoch = GlobalConfig.Epoch
+	updated.EpochStartTS = bestHighTS
+
+	body, _ := json.Marshal(updated)
+	nodes := GlobalConfig.Nodes
+	commitConfig()
+	mu.Unlock()
+
+	fmt.Printf("[FAILOVER] Shard %d: %s promoted to primary in epoch %d (HighTS %d), %s dropped\n",
+		shard.ShardId, shard.SecondaryIDs[best], epoch, bestHighTS, failed)
+
+	// The failed primary gets it as well, in case it is only unreachable from here
+	publishShardConfig(body, nodes)
+	return nil
+}
+
+// Sends the new config of a shard to every storage node (through /reconfigure)
+func publishShardConfig(body []byte, nodes []StorageNode) {
+	postToNodes("/reconfigure", body, nodes)
+}
+
+func postToNodes(path string, body []byte, nodes []StorageNode) {
+	for _, node := range nodes {
+		resp, err := probeClient.Post(fmt.Sprintf("http://%s%s", node.Address, path), "application/json", bytes.NewBuffer(body))
+		if err != nil {
+			fmt.Printf("[WARN] Failed to reconfigure %s: %v\n", node.Id, err)
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			fmt.Printf("[WARN] Reconfiguring %s failed with status: %d\n", node.Id, resp.StatusCode)
+		}
+	}
+}
+
+// ========== Primary Relocation ==========
+
+// Admin endpoint for a planned primary move: {"shardID": 0, "target": "<address of a secondary>"}
+// Answers once the move is done (or failed)
+func relocateHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		ShardID int    `json:"shardID"`
+		Target  string `json:"target"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid json", http.StatusBadRequest)
+		return
+	}
+
+	mu.Lock()
+	i := shardIndex(req.ShardID)
+	mu.Unlock()
+	if i == -1 {
+		http.Error(w, fmt.Sprintf("unknown shard %d", req.ShardID), http.StatusNotFound)
+		return
+	}
+
+	if err := relocatePrimary(req.ShardID, req.Target); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// Moves the primary of shard #i to the secondary with the lowest RTT from the reporting client, if it is closer than the primary
+func movePrimaryCloser(i int, report UtilityDropReport, primary string) {
+	mu.Lock()
+	shardID := GlobalConfig.Shards[i].ShardId
+	lastMove, seen := lastPrimaryMove[shardID]
+	mu.Unlock()
+	if seen && time.Since(lastMove) < primaryMoveCooldown {
+		fmt.Printf("[SKIPPED] Primary of shard %d was moved recently\n", shardID)
+		return
+	}
+
+	var closest string
+	minRTT, ok := report.RTTs[primary]
+	if !ok {
+		minRTT = 1e9
+	}
+	for node, rtt := range report.RTTs {
+		if node != primary && rtt < minRTT {
+			minRTT = rtt
+			closest = node
+		}
+	}
+	if closest == "" {
+		fmt.Printf("[INFO] No node is closer to %s than the primary %s\n", report.ClientID, primary)
+		return
+	}
+
+	if err := relocatePrimary(shardID, closest); err != nil {
+		fmt.Printf("[ERROR] Moving the primary of shard %d to %s failed: %v\n", shardID, closest, err)
+	}
+}
+
+// Planned move of the primary of a shard to one of its secondaries (target is its address), see switchPrimary
+func relocatePrimary(shardID int, target string) error {
+	if err := beginPlannedChange(shardID); err != nil {
+		return err
+	}
+	defer endPlannedChange(shardID)
+
+	mu.Lock()
+	lastPrimaryMove[shardID] = time.Now()
+	mu.Unlock()
+
+	return switchPrimary(shardID, target)
+}
+
+// Writes are drained on the old primary, the target catches up to the drained HighTS and then the roles are switched
+// in a new epoch: the old primary stays on as a secondary. Storage nodes get the new config through /reconfigure,
+// clients pick it up from /config (the drained primary sends their held writes back with a 421)
+// The caller has to hold the planned change of the shard
+func switchPrimary(shardID int, target string) error {
+	mu.Lock()
+	i := shardIndex(shardID)
+	if i == -1 {
+		mu.Unlock()
+		return fmt.Errorf("unknown shard %d", shardID)
+	}
+	shard := GlobalConfig.Shards[i]
+	mu.Unlock()
+
+	j := -1
+	for k, secondary := range shard.Secondaries {
+		if secondary == target {
+			j = k
+		}
+	}
+	if j == -1 {
+		return fmt.Errorf("%s is not a secondary of shard %d", target, shard.ShardId)
+	}
+
+	// The target gets a couple of replication rounds to catch up, the drain lasts a bit longer in case we fail in between
+	catchUp := time.Duration(2*shard.ReplicationFreqs[target]*float64(time.Second)) + 5*time.Second
+
+	fmt.Printf("[RELOCATE] Moving the primary of shard %d from %s to %s\n", shard.ShardId, shard.Primary, target)
+
+	highTS, err := drainPrimary(shard, catchUp + 5*time.Second)
+	if err != nil {
+		return fmt.Errorf("drain failed: %v", err)
+	}
+
+	if err := waitForCatchUp(target, shard.ShardId, highTS, catchUp); err != nil {
+		cancelDrain(shard)
+		return err
+	}
+
+	mu.Lock()
+	GlobalConfig.Epoch++
+	epoch := GlobalConfig.Epoch
+
+	updated := &GlobalConfig.Shards[shardIndex(shardID)]
+	updated.Primary = target
+	updated.PrimaryID = shard.SecondaryIDs[j]
+	updated.Secondaries = replaceAt(shard.Secondaries, j, shard.Primary)
+	updated.SecondaryIDs = replaceAt(shard.SecondaryIDs, j, shard.PrimaryID)
+	delete(updated.ReplicationFreqs, target)
+	updated.ReplicationFreqs[shard.Primary] = shard.DefaultRepFreq
+	updated.Epoch = epoch
+	updated.EpochStartTS = highTS
+
+	body, _ := json.Marshal(updated)
+	nodes := GlobalConfig.Nodes
+	commitConfig()
+	mu.Unlock()
+
+	fmt.Printf("[RELOCATE] Shard %d: %s is the primary in epoch %d (HighTS %d), %s is a secondary now\n",
+		shard.ShardId, target, epoch, highTS, shard.Primary)
+
+	publishShardConfig(body, nodes)
+	return nil
+}
+
+// Adds the node (by id) as a secondary of the shard in a new epoch, it copies the shard from a snapshot of the primary
+// The caller has to hold the planned change of the shard
+func addSecondary(shardID int, nodeID string) error {
+	mu.Lock()
+	addr, ok := nodeAddress(nodeID)
+	i := shardIndex(shardID)
+	if !ok || i == -1 {
+		mu.Unlock()
+		return fmt.Errorf("unknown node %s or shard %d", nodeID, shardID)
+	}
+
+	GlobalConfig.Epoch++
+	updated := &GlobalConfig.Shards[i]
+	updated.Secondaries = append(append([]string{}, updated.Secondaries...), addr)
+	updated.SecondaryIDs = append(append([]string{}, updated.SecondaryIDs...), nodeID)
+	updated.ReplicationFreqs[addr] = updated.DefaultRepFreq
+	updated.Epoch = GlobalConfig.Epoch
+
+	body, _ := json.Marshal(updated)
+	nodes := GlobalConfig.Nodes
+	commitConfig()
+	mu.Unlock()
+
+	fmt.Printf("[RESHARD] %s added as a secondary of shard %d\n", nodeID, shardID)
+
+	publishShardConfig(body, nodes)
+	return nil
+}
+
+// Marks the shards as changing, fails if one of them already is (e.g. it is being moved)
+func beginPlannedChange(ids ...int) error {
+	mu.Lock()
+	defer mu.Unlock()
+
+	for _, id := range ids {
+		if plannedChanges[id] {
+			return fmt.Errorf("shard %d is already being changed", id)
+		}
+	}
+	for _, id := range ids {
+		plannedChanges[id] = true
+	}
+	return nil
+}
+
+func endPlannedChange(ids ...int) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	for _, id := range ids {
+		delete(plannedChanges, id)
+	}
+}
+
+// ========== Shard Split and Merge ==========
+
+// Body of /reshard on the storage nodes: the new layout of every shard a split or merge touched, in a new epoch
+type ReshardRequest struct {
+	Epoch   int64         `json:"epoch"`
+	Shards  []Shard       `json:"shards"`
+	Removed []int         `json:"removed,omitempty"`
+	From    map[int]int64 `json:"from"`	// shards the new ones are made of -> the HighTS they were drained at
+}
+
+// Admin endpoint that splits a shard at a key position: {"shardID": 0, "at": 5000, "primaryID": "<node id>"}
+// Keys from "at" on go to a new shard, which moves to primaryID if it is given (by default it stays with the primary of the shard)
+// {"key": "<key>"} instead of "at" splits at the position of that key, e.g. a point on the ring with hash partitioning
+// Answers with the id of the new shard once the split is done
+func splitHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		ShardID   int    `json:"shardID"`
+		At        int    `json:"at"`
+		Key       string `json:"key,omitempty"`
+		PrimaryID string `json:"primaryID"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid json", http.StatusBadRequest)
+		return
+	}
+	if req.Key != "" {
+		mu.Lock()
+		scheme := GlobalConfig.Partitioning
+		mu.Unlock()
+
+		at, err := scheme.Position(req.Key)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		req.At = at
+	}
+
+	newID, err := splitShard(req.ShardID, req.At, req.PrimaryID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{
+		"newShardID": newID,
+	})
+}
+
+// Admin endpoint that merges two neighbouring shards into the first one: {"left": 0, "right": 1}
+func mergeHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Left  int `json:"left"`
+		Right int `json:"right"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid json", http.StatusBadRequest)
+		return
+	}
+
+	if err := mergeShards(req.Left, req.Right); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// Splits the shard into [start, at-1] and a new shard [at, end] with the same replicas
+// Writes are drained on the primary until every secondary caught up, so all replicas keep their data and HighTS.
+// If primaryID is given, the new shard is then moved to that node (it is added as a secondary first if needed)
+func splitShard(shardID int, at int, primaryID string) (int, error) {
+	if err := beginPlannedChange(shardID); err != nil {
+		return 0, err
+	}
+	defer endPlannedChange(shardID)
+
+	mu.Lock()
+	i := shardIndex(shardID)
+	if i == -1 {
+		mu.Unlock()
+		return 0, fmt.Errorf("unknown shard %d", shardID)
+	}
+	shard := GlobalConfig.Shards[i]
+	_, knownNode := nodeAddress(primaryID)
+	mu.Unlock()
+
+	if at <= shard.RangeStart || at > shard.RangeEnd {
+		return 0, fmt.Errorf("%d does not split shard %d [%d, %d]", at, shardID, shard.RangeStart, shard.RangeEnd)
+	}
+	if primaryID != "" && !knownNode {
+		return 0, fmt.Errorf("unknown node %s", primaryID)
+	}
+
+	fmt.Printf("[SPLIT] Splitting shard %d [%d, %d] at %d\n", shardID, shard.RangeStart, shard.RangeEnd, at)
+
+	catchUp := catchUpTimeout(shard)
+	highTS, err := drainPrimary(shard, catchUp + 5*time.Second)
+	if err != nil {
+		return 0, fmt.Errorf("drain failed: %v", err)
+	}
+	if err := waitForSecondaries(shard, highTS, catchUp); err != nil {
+		cancelDrain(shard)
+		return 0, err
+	}
+
+	mu.Lock()
+	GlobalConfig.Epoch++
+	epoch := GlobalConfig.Epoch
+	newID := GlobalConfig.NextShardId
+	GlobalConfig.NextShardId++
+
+	i = shardIndex(shardID)
+	left := GlobalConfig.Shards[i]
+	right := copyShard(left)
+
+	left.RangeEnd = at - 1
+	left.Epoch = epoch
+	left.EpochStartTS = highTS
+
+	right.ShardId = newID
+	right.RangeStart = at
+	right.Epoch = epoch
+	right.EpochStartTS = highTS
+
+	GlobalConfig.Shards[i] = left
+	GlobalConfig.Shards = append(GlobalConfig.Shards, right)
+
+	// Nothing else may touch the new shard before the split is done
+	plannedChanges[newID] = true
+
+	body, _ := json.Marshal(ReshardRequest{
+		Epoch:  epoch,
+		Shards: []Shard{left, right},
+		From:   map[int]int64{shardID: highTS},
+	})
+	nodes := GlobalConfig.Nodes
+	commitConfig()
+	mu.Unlock()
+	defer endPlannedChange(newID)
+
+	fmt.Printf("[SPLIT] Shard %d is [%d, %d] and shard %d is [%d, %d] in epoch %d (HighTS %d)\n",
+		shardID, left.RangeStart, left.RangeEnd, newID, right.RangeStart, right.RangeEnd, epoch, highTS)
+
+	postToNodes("/reshard", body, nodes)
+
+	if primaryID == "" || primaryID == right.PrimaryID {
+		return newID, nil
+	}
+	if !contains(right.SecondaryIDs, primaryID) {
+		if err := addSecondary(newID, primaryID); err != nil {
+			return newID, err
+		}
+	}
+	addr, _ := nodeAddress(primaryID)
+	return newID, switchPrimary(newID, addr)
+}
+
+// Merges the right shard into the left one, their ranges have to be next to each other
+// The merged shard keeps the replicas of the left one: they are added to the right shard first (copying it from a snapshot)
+// and its primary is moved to the one of the left shard. Then the writes of both are drained until every secondary caught up.
+func mergeShards(leftID int, rightID int) error {
+	if leftID == rightID {
+		return fmt.Errorf("can't merge shard %d with itself", leftID)
+	}
+	if err := beginPlannedChange(leftID, rightID); err != nil {
+		return err
+	}
+	defer endPlannedChange(leftID, rightID)
+
+	mu.Lock()
+	li, ri := shardIndex(leftID), shardIndex(rightID)
+	if li == -1 || ri == -1 {
+		mu.Unlock()
+		return fmt.Errorf("unknown shard %d or %d", leftID, rightID)
+	}
+	left, right := GlobalConfig.Shards[li], GlobalConfig.Shards[ri]
+	mu.Unlock()
+
+	if left.RangeEnd+1 != right.RangeStart {
+		return fmt.Errorf("shard %d [%d, %d] does not end where shard %d [%d, %d] starts",
+			leftID, left.RangeStart, left.RangeEnd, rightID, right.RangeStart, right.RangeEnd)
+	}
+
+	fmt.Printf("[MERGE] Merging shard %d [%d, %d] into shard %d [%d, %d]\n",
+		rightID, right.RangeStart, right.RangeEnd, leftID, left.RangeStart, left.RangeEnd)
+
+	for _, nodeID := range append([]string{left.PrimaryID}, left.SecondaryIDs...) {
+		if nodeID == right.PrimaryID || contains(right.SecondaryIDs, nodeID) {
+			continue
+		}
+		if err := addSecondary(rightID, nodeID); err != nil {
+			return err
+		}
+	}
+	if right.PrimaryID != left.PrimaryID {
+		if err := switchPrimary(rightID, left.Primary); err != nil {
+			return err
+		}
+	}
+
+	mu.Lock()
+	right = GlobalConfig.Shards[shardIndex(rightID)]
+	mu.Unlock()
+
+	catchUp := catchUpTimeout(left)
+	if other := catchUpTimeout(right); other > catchUp {
+		catchUp = other
+	}
+
+	leftTS, err := drainPrimary(left, catchUp + 5*time.Second)
+	if err != nil {
+		return fmt.Errorf("drain of shard %d failed: %v", leftID, err)
+	}
+	rightTS, err := drainPrimary(right, catchUp + 5*time.Second)
+	if err != nil {
+		cancelDrain(left)
+		return fmt.Errorf("drain of shard %d failed: %v", rightID, err)
+	}
+
+	// The secondaries of the left shard are secondaries of the right one by now
+	err = waitForSecondaries(left, leftTS, catchUp)
+	if err == nil {
+		err = waitForSecondaries(Shard{ShardId: rightID, Secondaries: left.Secondaries}, rightTS, catchUp)
+	}
+	if err != nil {
+		cancelDrain(left)
+		cancelDrain(right)
+		return err
+	}
+
+	mu.Lock()
+	GlobalConfig.Epoch++
+	epoch := GlobalConfig.Epoch
+
+	merged := GlobalConfig.Shards[shardIndex(leftID)]
+	merged.RangeEnd = right.RangeEnd
+	merged.Epoch = epoch
+	merged.EpochStartTS = leftTS
+	if rightTS > merged.EpochStartTS {
+		merged.EpochStartTS = rightTS
+	}
+	GlobalConfig.Shards[shardIndex(leftID)] = merged
+	GlobalConfig.Shards = removeShardAt(GlobalConfig.Shards, shardIndex(rightID))
+
+	body, _ := json.Marshal(ReshardRequest{
+		Epoch:   epoch,
+		Shards:  []Shard{merged},
+		Removed: []int{rightID},
+		From:    map[int]int64{leftID: leftTS, rightID: rightTS},
+	})
+	nodes := GlobalConfig.Nodes
+	commitConfig()
+	mu.Unlock()
+
+	fmt.Printf("[MERGE] Shard %d is [%d, %d] in epoch %d (HighTS %d), shard %d is gone\n",
+		leftID, merged.RangeStart, merged.RangeEnd, epoch, merged.EpochStartTS, rightID)
+
+	postToNodes("/reshard", body, nodes)
+	return nil
+}
+
+// Polls every secondary of the shard until it caught up to highTS
+func waitForSecondaries(shard Shard, highTS int64, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for _, secondary := range shard.Secondaries {
+		if err := waitForCatchUp(secondary, shard.ShardId, highTS, time.Until(deadline)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Time the secondaries of the shard get to catch up: a couple of replication rounds of the slowest one
+func catchUpTimeout(shard Shard) time.Duration {
+	slowest := shard.DefaultRepFreq
+	for _, freq := range shard.ReplicationFreqs {
+		if freq > slowest {
+			slowest = freq
+		}
+	}
+	return time.Duration(2*slowest*float64(time.Second)) + 5*time.Second
+}
+
+// Holds the new writes of the shard on its primary, returns the HighTS that covers all of the accepted ones
+func drainPrimary(shard Shard, timeout time.Duration) (int64, error) {
+	reqBody := map[string]any{"shardID": shard.ShardId, "timeoutSeconds": timeout.Seconds()}
+	jsonData, _ := json.Marshal(reqBody)
+
+	resp, err := probeClient.Post(fmt.Sprintf("http://%s/drain", shard.Primary), "application/json", bytes.NewBuffer(jsonData))
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("status %d from %s", resp.StatusCode, shard.Primary)
+	}
+
+	var result struct {
+		HighTS int64 `json:"highTS"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return 0, err
+	}
+	return result.HighTS, nil
+}
+
+func cancelDrain(shard Shard) {
+	jsonData, _ := json.Marshal(map[string]any{"shardID": shard.ShardId, "cancel": true})
+
+	resp, err := probeClient.Post(fmt.Sprintf("http://%s/drain", shard.Primary), "application/json", bytes.NewBuffer(jsonData))
+	if err != nil {
+		fmt.Printf("[WARN] Failed to cancel the drain on %s: %v\n", shard.Primary, err)
+		return
+	}
+	resp.Body.Close()
+}
+
+// Polls the /status of the secondary until its HighTS of the shard reaches highTS
+func waitForCatchUp(node string, shardID int, highTS int64, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		current, err := secondaryHighTS(node, shardID)
+		if err == nil && current >= highTS {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%s did not catch up to %d within %v (at %d, err %v)", node, highTS, timeout, current, err)
+		}
+		time.Sleep(catchUpPollInterval)
+	}
+}
+
+// HighTS of the shard on a secondary, as reported by its /status
+func secondaryHighTS(node string, shardID int) (int64, error) {
+	resp, err := probeClient.Get(fmt.Sprintf("http://%s/status", node))
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	var status map[int]int64
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		return 0, fmt.Errorf("invalid status: %v", err)
+	}
+	highTS, ok := status[shardID]
+	if !ok {
+		return 0, fmt.Errorf("shard %d not reported", shardID)
+	}
+	return highTS, nil
+}
+
+// Index of the shard in GlobalConfig.Shards, or -1 (must hold mu)
+func shardIndex(id int) int {
+	for i, shard := range GlobalConfig.Shards {
+		if shard.ShardId == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// Address of the storage node (must hold mu)
+func nodeAddress(nodeID string) (string, bool) {
+	for _, node := range GlobalConfig.Nodes {
+		if node.Id == nodeID {
+			return node.Address, true
+		}
+	}
+	return "", false
+}
+
+// Copy of the shard that shares none of its lists
+func copyShard(shard Shard) Shard {
+	shard.Secondaries = append([]string{}, shard.Secondaries...)
+	shard.SecondaryIDs = append([]string{}, shard.SecondaryIDs...)
+	freqs := make(map[string]float64, len(shard.ReplicationFreqs))
+	for node, freq := range shard.ReplicationFreqs {
+		freqs[node] = freq
+	}
+	shard.ReplicationFreqs = freqs
+	return shard
+}
+
+// Copy of the shards without the one at index i
+func removeShardAt(shards []Shard, i int) []Shard {
+	out := make([]Shard, 0, len(shards)-1)
+	out = append(out, shards[:i]...)
+	return append(out, shards[i+1:]...)
+}
+
+func contains(list []string, e string) bool {
+	for _, a := range list {
+		if a == e {
+			return true
+		}
+	}
+	return false
+}
+
+// Copy of the list with the element at index i replaced by e
+func replaceAt(list []string, i int, e string) []string {
+	out := append([]string{}, list...)
+	out[i] = e
+	return out
+}
+
+// Copy of the list without the element at index i
+func removeAt(list []string, i int) []string {
+	out := make([]string, 0, len(list)-1)
+	out = append(out, list[:i]...)
+	return append(out, list[i+1:]...)
+}
+
 func LoadReplicationConfig(path string) error { 
 	data, err := os.ReadFile(path)
 	if err != nil {
@@ -297,6 +1192,16 @@ func LoadReplicationConfig(path string) error {
 		return err
 	}
 
+	// The shard ranges are ranges of key positions of the partitioning
+	if err := config.Partitioning.Validate(); err != nil {
+		return err
+	}
+	for _, shard := range config.Shards {
+		if err := config.Partitioning.CheckRange(shard.RangeStart, shard.RangeEnd); err != nil {
+			return fmt.Errorf("shard %d: %v", shard.ShardId, err)
+		}
+	}
+
 	// From the secondary IDs assign the secondary endpoints
 	nodeIDToAddress := make(map[string]string)
 	for _, node := range config.Nodes {
@@ -319,6 +1224,10 @@ func LoadReplicationConfig(path string) error {
 
 		config.Shards[i].Secondaries = secondaryAddrs
 		config.Shards[i].ReplicationFreqs = replicationFreqs
+
+		if config.Shards[i].ShardId >= config.NextShardId {
+			config.NextShardId = config.Shards[i].ShardId + 1
+		}
 	}
 
 	GlobalConfig = &config
@@ -331,5 +1240,106 @@ func LoadReplicationConfig(path string) error {
 
 // Assumption: Single Shard for curr implementation now
 func isPrimaryForShard(node string) bool {
+	mu.Lock()
+	defer mu.Unlock()
 	return (node == GlobalConfig.Shards[0].Primary)
-}
\ No newline at end of file
+}
+
+// Replication frequency of the secondary in the (single) shard and the last time the coordinator adjusted it
+func replicationFreq(node string) (float64, time.Time, bool) {
+	mu.Lock()
+	defer mu.Unlock()
+	lastUpdate, seen := lastReplicationUpdate[node]
+	return GlobalConfig.Shards[0].ReplicationFreqs[node], lastUpdate, seen
+}
+
+// Records the replication frequency a secondary acknowledged, in the (single) shard of the config
+func setReplicationFreq(node string, freq float64) {
+	mu.Lock()
+	defer mu.Unlock()
+	GlobalConfig.Shards[0].ReplicationFreqs[node] = freq
+	lastReplicationUpdate[node] = time.Now()
+	commitConfig()
+}
+
+// ========== gRPC Transport ==========
+
+// The Coordinator service of proto/pileus.proto, it shares the logic of /report and /config
+type coordinatorService struct {
+	pileuspb.UnimplementedCoordinatorServer
+}
+
+func serveGRPC(address string) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		log.Fatalf("Failed to listen for gRPC on %s: %v", address, err)
+	}
+
+	server := grpc.NewServer()
+	pileuspb.RegisterCoordinatorServer(server, coordinatorService{})
+
+	fmt.Println("Coordinator serving gRPC on", address)
+	if err := server.Serve(listener); err != nil {
+		fmt.Println("gRPC server stopped:", err)
+	}
+}
+
+func (coordinatorService) Report(ctx context.Context, req *pileuspb.UtilityDropReport) (*pileuspb.ReportResponse, error) {
+	report := UtilityDropReport{
+		ClientID:      req.ClientId,
+		Region:        req.Region,
+		AvgUtility:    req.Utility,
+		SLA:           SLA{ID: req.GetSla().GetId()},
+		ReadHistogram: make(map[string]int, len(req.Histogram)),
+		RTTs:          req.Rtts,
+	}
+	for _, sub := range req.GetSla().GetSubSlas() {
+		subSLA := SubSLA{
+			Consistency: ConsistencyLevel(sub.Consistency),
+			Latency:     LatencyBound{Duration: time.Duration(sub.LatencyNanos)},
+			Utility:     sub.Utility,
+		}
+		if sub.StalenessBoundNanos != nil {
+			bound := time.Duration(*sub.StalenessBoundNanos)
+			subSLA.StalenessBound = &bound
+		}
+		report.SLA.SubSLAs = append(report.SLA.SubSLAs, subSLA)
+	}
+	for key, count := range req.Histogram {
+		report.ReadHistogram[key] = int(count)
+	}
+
+	return &pileuspb.ReportResponse{Skipped: !acceptReport(report)}, nil
+}
+
+func (coordinatorService) GetConfig(ctx context.Context, req *pileuspb.ConfigRequest) (*pileuspb.ConfigResponse, error) {
+	if !waitForConfig(ctx, req.After) {
+		return &pileuspb.ConfigResponse{Modified: false}, ctx.Err()
+	}
+	defer mu.Unlock()
+
+	config := &pileuspb.Config{Epoch: GlobalConfig.Epoch, Partitioning: string(GlobalConfig.Partitioning)}
+	for _, node := range GlobalConfig.Nodes {
+		config.Nodes = append(config.Nodes, &pileuspb.StorageNode{
+			Id:          node.Id,
+			Address:     node.Address,
+			GrpcAddress: node.GRPCAddress,
+		})
+	}
+	for _, shard := range GlobalConfig.Shards {
+		config.Shards = append(config.Shards, &pileuspb.Shard{
+			Id:                 int32(shard.ShardId),
+			Start:              int32(shard.RangeStart),
+			End:                int32(shard.RangeEnd),
+			Primary:            shard.Primary,
+			PrimaryId:          shard.PrimaryID,
+			SecondaryIds:       shard.SecondaryIDs,
+			DefaultRepFreq:     shard.DefaultRepFreq,
+			ChangeLogRetention: shard.ChangeLogRetention,
+			ReplicationMode:    shard.ReplicationMode,
+			Epoch:              shard.Epoch,
+			EpochStartTs:       shard.EpochStartTS,
+		})
+	}
+	return &pileuspb.ConfigResponse{Modified: true, Config: config}, nil
+}
@@ -0,0 +1,504 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Storage node that reports a fixed HighTS for every shard in /status (and /drain),
+// and records the /reconfigure, /reshard and /drain requests it gets
+type fakeNode struct {
+	server *httptest.Server
+	highTS map[int]int64
+
+	mu           sync.Mutex
+	reconfigured []Shard
+	reshards     []ReshardRequest
+	drains       []map[string]any
+}
+
+func startFakeNode(t *testing.T, highTS map[int]int64) *fakeNode {
+	t.Helper()
+	statePath = filepath.Join(t.TempDir(), "coordinator_state.json")
+	node := &fakeNode{highTS: highTS}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(node.highTS)
+	})
+	mux.HandleFunc("/reconfigure", func(w http.ResponseWriter, r *http.Request) {
+		var shard Shard
+		if err := json.NewDecoder(r.Body).Decode(&shard); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		node.mu.Lock()
+		node.reconfigured = append(node.reconfigured, shard)
+		node.mu.Unlock()
+	})
+	mux.HandleFunc("/reshard", func(w http.ResponseWriter, r *http.Request) {
+		var req ReshardRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		node.mu.Lock()
+		node.reshards = append(node.reshards, req)
+		node.mu.Unlock()
+	})
+	mux.HandleFunc("/drain", func(w http.ResponseWriter, r *http.Request) {
+		var req map[string]any
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		node.mu.Lock()
+		node.drains = append(node.drains, req)
+		node.mu.Unlock()
+		json.NewEncoder(w).Encode(map[string]int64{"highTS": node.highTS[int(req["shardID"].(float64))]})
+	})
+	node.server = httptest.NewServer(mux)
+	t.Cleanup(node.server.Close)
+	return node
+}
+
+func (n *fakeNode) addr() string {
+	return strings.TrimPrefix(n.server.URL, "http://")
+}
+
+func (n *fakeNode) reconfigurations() []Shard {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return append([]Shard{}, n.reconfigured...)
+}
+
+func TestFailoverPromotesTheMostUpToDateSecondary(t *testing.T) {
+	behind := startFakeNode(t, map[int]int64{7: 100})
+	ahead := startFakeNode(t, map[int]int64{7: 200})
+	failed := "127.0.0.1:1"
+
+	GlobalConfig = &ReplicationConfig{
+		Nodes: []StorageNode{
+			{Id: "node1", Address: failed},
+			{Id: "node2", Address: behind.addr()},
+			{Id: "node3", Address: ahead.addr()},
+		},
+		// Shard 7 is not the first shard, the failover goes by its id
+		Shards: []Shard{
+			{ShardId: 3, Primary: behind.addr(), PrimaryID: "node2"},
+			{
+				ShardId: 7, Primary: failed, PrimaryID: "node1",
+				Secondaries: []string{behind.addr(), ahead.addr()}, SecondaryIDs: []string{"node2", "node3"},
+				ReplicationFreqs: map[string]float64{behind.addr(): 1, ahead.addr(): 1},
+			},
+		},
+		Epoch: 4,
+	}
+
+	if err := failover(7, failed); err != nil {
+		t.Fatal(err)
+	}
+
+	shard := GlobalConfig.Shards[1]
+	if shard.PrimaryID != "node3" || shard.Primary != ahead.addr() {
+		t.Errorf("promoted %s, want node3 (highest HighTS)", shard.PrimaryID)
+	}
+	if len(shard.SecondaryIDs) != 1 || shard.SecondaryIDs[0] != "node2" {
+		t.Errorf("secondaries after the failover = %v, want [node2]", shard.SecondaryIDs)
+	}
+	if _, ok := shard.ReplicationFreqs[ahead.addr()]; ok {
+		t.Error("the new primary still has a replication frequency")
+	}
+	if GlobalConfig.Epoch != 5 || shard.Epoch != 5 || shard.EpochStartTS != 200 {
+		t.Errorf("epoch %d, shard epoch %d since %d, want 5, 5 since 200", GlobalConfig.Epoch, shard.Epoch, shard.EpochStartTS)
+	}
+	if GlobalConfig.Shards[0].PrimaryID != "node2" {
+		t.Error("failover changed another shard")
+	}
+
+	for _, node := range []*fakeNode{behind, ahead} {
+		got := node.reconfigurations()
+		if len(got) != 1 || got[0].ShardId != 7 || got[0].PrimaryID != "node3" || got[0].Epoch != 5 {
+			t.Errorf("node %s was reconfigured with %+v", node.addr(), got)
+		}
+	}
+}
+
+func TestFailoverWithoutAReachableSecondaryKeepsTheConfig(t *testing.T) {
+	failed := "127.0.0.1:1"
+	GlobalConfig = &ReplicationConfig{
+		Nodes: []StorageNode{{Id: "node1", Address: failed}, {Id: "node2", Address: "127.0.0.1:2"}},
+		Shards: []Shard{{
+			ShardId: 0, Primary: failed, PrimaryID: "node1",
+			Secondaries: []string{"127.0.0.1:2"}, SecondaryIDs: []string{"node2"},
+		}},
+		Epoch: 1,
+	}
+
+	if err := failover(0, failed); err == nil {
+		t.Error("failover without a reachable secondary succeeded")
+	}
+	if GlobalConfig.Epoch != 1 || GlobalConfig.Shards[0].PrimaryID != "node1" {
+		t.Errorf("config changed: epoch %d, primary %s", GlobalConfig.Epoch, GlobalConfig.Shards[0].PrimaryID)
+	}
+}
+
+func TestFailoverOfAnAlreadyReplacedPrimaryIsANoOp(t *testing.T) {
+	node := startFakeNode(t, map[int]int64{0: 10})
+	GlobalConfig = &ReplicationConfig{
+		Nodes:  []StorageNode{{Id: "node2", Address: node.addr()}},
+		Shards: []Shard{{ShardId: 0, Primary: node.addr(), PrimaryID: "node2"}},
+		Epoch:  2,
+	}
+
+	if err := failover(0, "127.0.0.1:1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := failover(9, node.addr()); err != nil {
+		t.Fatalf("failover of an unknown shard: %v", err)
+	}
+	if GlobalConfig.Epoch != 2 || len(node.reconfigurations()) != 0 {
+		t.Errorf("stale failovers changed the config (epoch %d) or reconfigured nodes", GlobalConfig.Epoch)
+	}
+}
+
+func (n *fakeNode) drainRequests() []map[string]any {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return append([]map[string]any{}, n.drains...)
+}
+
+func TestRelocateSwapsThePrimaryWithTheCaughtUpSecondary(t *testing.T) {
+	primary := startFakeNode(t, map[int]int64{2: 300})
+	target := startFakeNode(t, map[int]int64{2: 300})
+	other := startFakeNode(t, map[int]int64{2: 250})
+
+	GlobalConfig = &ReplicationConfig{
+		Nodes: []StorageNode{
+			{Id: "node1", Address: primary.addr()},
+			{Id: "node2", Address: target.addr()},
+			{Id: "node3", Address: other.addr()},
+		},
+		Shards: []Shard{{
+			ShardId: 2, Primary: primary.addr(), PrimaryID: "node1", DefaultRepFreq: 4,
+			Secondaries: []string{target.addr(), other.addr()}, SecondaryIDs: []string{"node2", "node3"},
+			ReplicationFreqs: map[string]float64{target.addr(): 1, other.addr(): 2},
+		}},
+		Epoch: 1,
+	}
+
+	if err := relocatePrimary(2, target.addr()); err != nil {
+		t.Fatal(err)
+	}
+
+	shard := GlobalConfig.Shards[0]
+	if shard.PrimaryID != "node2" || shard.Epoch != 2 || shard.EpochStartTS != 300 {
+		t.Errorf("shard after the move: primary %s in epoch %d since %d, want node2 in epoch 2 since 300",
+			shard.PrimaryID, shard.Epoch, shard.EpochStartTS)
+	}
+	// The old primary takes the place of the target, with the default replication frequency
+	if len(shard.SecondaryIDs) != 2 || shard.SecondaryIDs[0] != "node1" || shard.SecondaryIDs[1] != "node3" {
+		t.Errorf("secondaries after the move = %v, want [node1 node3]", shard.SecondaryIDs)
+	}
+	if freq := shard.ReplicationFreqs[primary.addr()]; freq != 4 {
+		t.Errorf("replication frequency of the old primary = %v, want the default 4", freq)
+	}
+	if _, ok := shard.ReplicationFreqs[target.addr()]; ok {
+		t.Error("the new primary still has a replication frequency")
+	}
+
+	if drains := primary.drainRequests(); len(drains) != 1 || drains[0]["cancel"] == true {
+		t.Errorf("old primary got the drains %v, want one", drains)
+	}
+	for _, node := range []*fakeNode{primary, target, other} {
+		if got := node.reconfigurations(); len(got) != 1 || got[0].PrimaryID != "node2" || got[0].Epoch != 2 {
+			t.Errorf("node %s was reconfigured with %+v", node.addr(), got)
+		}
+	}
+
+	// The move starts the cooldown of the shard (see movePrimaryCloser)
+	mu.Lock()
+	_, moved := lastPrimaryMove[2]
+	mu.Unlock()
+	if !moved {
+		t.Error("the move was not recorded for the cooldown")
+	}
+}
+
+func TestRelocateOnlyMovesToASecondary(t *testing.T) {
+	primary := startFakeNode(t, map[int]int64{0: 10})
+	GlobalConfig = &ReplicationConfig{
+		Nodes:  []StorageNode{{Id: "node1", Address: primary.addr()}},
+		Shards: []Shard{{ShardId: 0, Primary: primary.addr(), PrimaryID: "node1"}},
+		Epoch:  1,
+	}
+
+	if err := relocatePrimary(0, "127.0.0.1:1"); err == nil {
+		t.Error("move to a node that is not a secondary succeeded")
+	}
+	if err := relocatePrimary(5, primary.addr()); err == nil {
+		t.Error("move of an unknown shard succeeded")
+	}
+	if GlobalConfig.Epoch != 1 || len(primary.drainRequests()) != 0 {
+		t.Errorf("rejected moves changed the config (epoch %d) or drained the primary", GlobalConfig.Epoch)
+	}
+}
+
+func (n *fakeNode) reshardRequests() []ReshardRequest {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return append([]ReshardRequest{}, n.reshards...)
+}
+
+func TestSplitKeepsTheReplicasOnBothHalves(t *testing.T) {
+	primary := startFakeNode(t, map[int]int64{0: 100})
+	secondary := startFakeNode(t, map[int]int64{0: 100})
+
+	GlobalConfig = &ReplicationConfig{
+		Nodes: []StorageNode{{Id: "node1", Address: primary.addr()}, {Id: "node2", Address: secondary.addr()}},
+		Shards: []Shard{{
+			ShardId: 0, RangeStart: 0, RangeEnd: 999, Primary: primary.addr(), PrimaryID: "node1",
+			Secondaries: []string{secondary.addr()}, SecondaryIDs: []string{"node2"},
+			ReplicationFreqs: map[string]float64{secondary.addr(): 1},
+		}},
+		Epoch:       3,
+		NextShardId: 1,
+	}
+
+	newID, err := splitShard(0, 500, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if newID != 1 || GlobalConfig.NextShardId != 2 {
+		t.Errorf("new shard got id %d (next %d), want 1 (next 2)", newID, GlobalConfig.NextShardId)
+	}
+
+	if len(GlobalConfig.Shards) != 2 {
+		t.Fatalf("%d shards after the split, want 2", len(GlobalConfig.Shards))
+	}
+	left, right := GlobalConfig.Shards[0], GlobalConfig.Shards[1]
+	if left.RangeEnd != 499 || right.ShardId != 1 || right.RangeStart != 500 || right.RangeEnd != 999 {
+		t.Errorf("shards after the split: %d [%d, %d] and %d [%d, %d]",
+			left.ShardId, left.RangeStart, left.RangeEnd, right.ShardId, right.RangeStart, right.RangeEnd)
+	}
+	if right.PrimaryID != "node1" || len(right.SecondaryIDs) != 1 || right.SecondaryIDs[0] != "node2" {
+		t.Errorf("new shard has primary %s and secondaries %v, want the replicas of shard 0", right.PrimaryID, right.SecondaryIDs)
+	}
+	// The halves don't share the lists of the shard they came from
+	right.ReplicationFreqs[secondary.addr()] = 9
+	if left.ReplicationFreqs[secondary.addr()] != 1 {
+		t.Error("the halves share their replication frequencies")
+	}
+	if left.Epoch != 4 || right.Epoch != 4 || right.EpochStartTS != 100 {
+		t.Errorf("halves in epochs %d and %d since %d, want 4 since 100", left.Epoch, right.Epoch, right.EpochStartTS)
+	}
+
+	for _, node := range []*fakeNode{primary, secondary} {
+		reshards := node.reshardRequests()
+		if len(reshards) != 1 || len(reshards[0].Shards) != 2 || reshards[0].From[0] != 100 {
+			t.Errorf("node %s got the reshards %+v", node.addr(), reshards)
+		}
+	}
+	if len(plannedChanges) != 0 {
+		t.Errorf("planned changes left after the split: %v", plannedChanges)
+	}
+}
+
+func TestSplitOnlyInsideTheShard(t *testing.T) {
+	primary := startFakeNode(t, map[int]int64{0: 100})
+	GlobalConfig = &ReplicationConfig{
+		Nodes:  []StorageNode{{Id: "node1", Address: primary.addr()}},
+		Shards: []Shard{{ShardId: 0, RangeStart: 0, RangeEnd: 999, Primary: primary.addr(), PrimaryID: "node1"}},
+	}
+
+	for _, at := range []int{0, 1000} {
+		if _, err := splitShard(0, at, ""); err == nil {
+			t.Errorf("split at %d succeeded", at)
+		}
+	}
+	if _, err := splitShard(0, 500, "node9"); err == nil {
+		t.Error("split to an unknown node succeeded")
+	}
+	if len(GlobalConfig.Shards) != 1 || len(primary.drainRequests()) != 0 {
+		t.Error("a rejected split changed the config or drained the primary")
+	}
+}
+
+func TestMergeJoinsNeighbouringShards(t *testing.T) {
+	primary := startFakeNode(t, map[int]int64{0: 100, 1: 120})
+	secondary := startFakeNode(t, map[int]int64{0: 100, 1: 120})
+
+	// Both shards already have the same replicas, they are listed out of range order
+	GlobalConfig = &ReplicationConfig{
+		Nodes: []StorageNode{{Id: "node1", Address: primary.addr()}, {Id: "node2", Address: secondary.addr()}},
+		Shards: []Shard{
+			{
+				ShardId: 1, RangeStart: 500, RangeEnd: 999, Primary: primary.addr(), PrimaryID: "node1",
+				Secondaries: []string{secondary.addr()}, SecondaryIDs: []string{"node2"},
+				ReplicationFreqs: map[string]float64{secondary.addr(): 1},
+			},
+			{
+				ShardId: 0, RangeStart: 0, RangeEnd: 499, Primary: primary.addr(), PrimaryID: "node1",
+				Secondaries: []string{secondary.addr()}, SecondaryIDs: []string{"node2"},
+				ReplicationFreqs: map[string]float64{secondary.addr(): 1},
+			},
+		},
+		Epoch: 7,
+	}
+
+	if err := mergeShards(0, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(GlobalConfig.Shards) != 1 {
+		t.Fatalf("%d shards after the merge, want 1", len(GlobalConfig.Shards))
+	}
+	merged := GlobalConfig.Shards[0]
+	if merged.ShardId != 0 || merged.RangeStart != 0 || merged.RangeEnd != 999 {
+		t.Errorf("merged shard is %d [%d, %d], want 0 [0, 999]", merged.ShardId, merged.RangeStart, merged.RangeEnd)
+	}
+	// Writes of both halves were drained, the merged shard starts after the later one
+	if merged.Epoch != 8 || merged.EpochStartTS != 120 {
+		t.Errorf("merged shard in epoch %d since %d, want 8 since 120", merged.Epoch, merged.EpochStartTS)
+	}
+
+	reshards := secondary.reshardRequests()
+	if len(reshards) != 1 || len(reshards[0].Removed) != 1 || reshards[0].Removed[0] != 1 ||
+		reshards[0].From[0] != 100 || reshards[0].From[1] != 120 {
+		t.Errorf("secondary got the reshards %+v", reshards)
+	}
+	// No secondary was added and no primary moved
+	if got := secondary.reconfigurations(); len(got) != 0 {
+		t.Errorf("merge of shards with the same replicas reconfigured %+v", got)
+	}
+}
+
+func TestMergeOnlyNeighbouringIdleShards(t *testing.T) {
+	GlobalConfig = &ReplicationConfig{
+		Shards: []Shard{
+			{ShardId: 0, RangeStart: 0, RangeEnd: 499},
+			{ShardId: 1, RangeStart: 600, RangeEnd: 999},
+			{ShardId: 2, RangeStart: 500, RangeEnd: 599},
+		},
+	}
+
+	if err := mergeShards(0, 1); err == nil {
+		t.Error("merge of shards that are not next to each other succeeded")
+	}
+	if err := mergeShards(0, 0); err == nil {
+		t.Error("merge of a shard with itself succeeded")
+	}
+
+	// A shard that is being moved (or failed over) can't be merged meanwhile
+	if err := beginPlannedChange(2); err != nil {
+		t.Fatal(err)
+	}
+	defer endPlannedChange(2)
+	if err := mergeShards(0, 2); err == nil {
+		t.Error("merge of a shard with a planned change in progress succeeded")
+	}
+	if len(GlobalConfig.Shards) != 3 {
+		t.Error("a rejected merge changed the config")
+	}
+}
+
+func TestConfigLongPollWaitsForTheNextEpoch(t *testing.T) {
+	statePath = filepath.Join(t.TempDir(), "coordinator_state.json")
+	GlobalConfig = &ReplicationConfig{Shards: []Shard{{ShardId: 0, PrimaryID: "node1"}}, Epoch: 5}
+
+	// Without "after" the current config is returned right away
+	rec := httptest.NewRecorder()
+	configHandler(rec, httptest.NewRequest(http.MethodGet, "/config", nil))
+	var current ReplicationConfig
+	if err := json.NewDecoder(rec.Body).Decode(&current); err != nil {
+		t.Fatal(err)
+	}
+	if current.Epoch != 5 {
+		t.Errorf("config epoch = %d, want 5", current.Epoch)
+	}
+
+	done := make(chan *httptest.ResponseRecorder, 1)
+	go func() {
+		rec := httptest.NewRecorder()
+		configHandler(rec, httptest.NewRequest(http.MethodGet, "/config?after=5", nil))
+		done <- rec
+	}()
+	select {
+	case rec := <-done:
+		t.Fatalf("poll after the current epoch was answered with %d right away", rec.Code)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	mu.Lock()
+	GlobalConfig.Epoch++
+	GlobalConfig.Shards[0].PrimaryID = "node2"
+	commitConfig()
+	mu.Unlock()
+
+	select {
+	case rec := <-done:
+		var next ReplicationConfig
+		if err := json.NewDecoder(rec.Body).Decode(&next); err != nil {
+			t.Fatal(err)
+		}
+		if next.Epoch != 6 || next.Shards[0].PrimaryID != "node2" {
+			t.Errorf("poll got epoch %d with primary %s, want epoch 6 with node2", next.Epoch, next.Shards[0].PrimaryID)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("poll was not answered after the commit")
+	}
+}
+
+func TestConfigLongPollTimesOutWithNotModified(t *testing.T) {
+	GlobalConfig = &ReplicationConfig{Epoch: 2}
+	defer func(timeout time.Duration) { configPollTimeout = timeout }(configPollTimeout)
+	configPollTimeout = 10 * time.Millisecond
+
+	rec := httptest.NewRecorder()
+	configHandler(rec, httptest.NewRequest(http.MethodGet, "/config?after=2", nil))
+	if rec.Code != http.StatusNotModified {
+		t.Errorf("poll without a new epoch answered %d, want %d", rec.Code, http.StatusNotModified)
+	}
+
+	rec = httptest.NewRecorder()
+	configHandler(rec, httptest.NewRequest(http.MethodGet, "/config?after=1", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("poll after an older epoch answered %d, want %d", rec.Code, http.StatusOK)
+	}
+}
+
+func TestCommittedConfigIsLoadedAfterARestart(t *testing.T) {
+	statePath = filepath.Join(t.TempDir(), "coordinator_state.json")
+	GlobalConfig = &ReplicationConfig{
+		Nodes: []StorageNode{{Id: "node1", Address: "host1:8080"}, {Id: "node2", Address: "host2:8080"}},
+		Shards: []Shard{
+			{ShardId: 0, RangeStart: 0, RangeEnd: 499, PrimaryID: "node1", Primary: "host1:8080", SecondaryIDs: []string{"node2"}, DefaultRepFreq: 2},
+			{ShardId: 3, RangeStart: 500, RangeEnd: 999, PrimaryID: "node2", Primary: "host2:8080"},
+		},
+		Epoch:       9,
+		NextShardId: 7,
+	}
+	mu.Lock()
+	commitConfig()
+	mu.Unlock()
+
+	GlobalConfig = nil
+	if err := LoadReplicationConfig(statePath); err != nil {
+		t.Fatal(err)
+	}
+	// The next shard id is kept as well, ids of merged away shards are not handed out again
+	if GlobalConfig.Epoch != 9 || GlobalConfig.NextShardId != 7 || len(GlobalConfig.Shards) != 2 {
+		t.Fatalf("loaded epoch %d, next shard %d, %d shards, want 9, 7 and 2",
+			GlobalConfig.Epoch, GlobalConfig.NextShardId, len(GlobalConfig.Shards))
+	}
+	// Secondary addresses and frequencies are filled in from the nodes, as for the initial config
+	shard := GlobalConfig.Shards[0]
+	if len(shard.Secondaries) != 1 || shard.Secondaries[0] != "host2:8080" || shard.ReplicationFreqs["host2:8080"] != 2 {
+		t.Errorf("loaded shard 0 with secondaries %v and frequencies %v", shard.Secondaries, shard.ReplicationFreqs)
+	}
+}
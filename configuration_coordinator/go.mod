@@ -0,0 +1,22 @@
+module coordinator
+
+go 1.18
+
+require (
+	google.golang.org/grpc v1.57.1
+	pileus/partition v0.0.0
+	pileus/proto v0.0.0
+)
+
+require (
+	github.com/golang/protobuf v1.5.3 // indirect
+	golang.org/x/net v0.9.0 // indirect
+	golang.org/x/sys v0.7.0 // indirect
+	golang.org/x/text v0.9.0 // indirect
+	google.golang.org/genproto/googleapis/rpc v0.0.0-20230525234030-28d5490b6b19 // indirect
+	google.golang.org/protobuf v1.33.0 // indirect
+)
+
+replace pileus/proto => ../proto
+
+replace pileus/partition => ../partition
@@ -0,0 +1,3 @@
+module pileus/partition
+
+go 1.18
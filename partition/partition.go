@@ -0,0 +1,100 @@
+package partition
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"regexp"
+	"strconv"
+)
+
+// Scheme decides which shard a key belongs to: every key has a position, and every shard owns an inclusive range [start, end]
+// of positions (the "start" and "end" of the shards in the config). Storage nodes, clients and the coordinator all go through
+// this package, so a key is routed the same way everywhere.
+type Scheme string
+
+const (
+	// Range: the position is the number in the key (its first run of digits, "user42" is 42), keys without one are rejected
+	Range Scheme = "range"
+	// Hash: consistent hashing, the position is the hash of the whole key on a ring of RingSize positions, so any string is a key.
+	// The shards split the ring into arcs, splitting or merging shards only moves the keys of the arcs involved.
+	Hash Scheme = "hash"
+)
+
+// RingSize is the number of positions of the Hash scheme, they fit the int32 ranges of the config messages
+const RingSize = 1 << 31
+
+var keyNumericRegex = regexp.MustCompile(`\d+`)
+
+// Validate returns an error for an unknown scheme ("" is Range, the scheme of configs that name none)
+func (s Scheme) Validate() error {
+	switch s {
+	case "", Range, Hash:
+		return nil
+	}
+	return fmt.Errorf("unknown partitioning scheme '%s' (expected '%s' or '%s')", s, Range, Hash)
+}
+
+// Position returns the position of the key in the key space of the scheme
+func (s Scheme) Position(key string) (int, error) {
+	switch s {
+	case "", Range:
+		match := keyNumericRegex.FindString(key)
+		if match == "" {
+			return 0, fmt.Errorf("key '%s' has no numeric part, which range partitioning needs", key)
+		}
+		return strconv.Atoi(match)
+	case Hash:
+		h := fnv.New32a()
+		h.Write([]byte(key))
+		return int(h.Sum32() % RingSize), nil
+	}
+	return 0, s.Validate()
+}
+
+// Bounds returns the lowest and highest position of the scheme, shards that cover them all cover every key
+func (s Scheme) Bounds() (int, int) {
+	if s == Hash {
+		return 0, RingSize - 1
+	}
+	return 0, math.MaxInt32
+}
+
+// ShardRange is the inclusive range [Start, End] of positions owned by the shard ID
+type ShardRange struct {
+	ID    int
+	Start int
+	End   int
+}
+
+// Owner returns the index (in ranges) of the range that holds the position, or -1 if there is none
+// Ranges are inclusive on both ends, so on a shared boundary the shard with the lowest id wins, whatever the order of the ranges
+func Owner(position int, ranges []ShardRange) int {
+	owner := -1
+	for i, r := range ranges {
+		if position < r.Start || position > r.End {
+			continue
+		}
+		if owner < 0 || r.ID < ranges[owner].ID {
+			owner = i
+		}
+	}
+	return owner
+}
+
+// CheckRange returns an error if [start, end] is not a range of positions of the scheme
+func (s Scheme) CheckRange(start int, end int) error {
+	lowest, highest := s.Bounds()
+	if start > end || start < lowest || end > highest {
+		return fmt.Errorf("[%d, %d] is not a range of %s positions [%d, %d]", start, end, s.Name(), lowest, highest)
+	}
+	return nil
+}
+
+// Name returns the name of the scheme for logs, with the default filled in
+func (s Scheme) Name() string {
+	if s == "" {
+		return string(Range)
+	}
+	return string(s)
+}
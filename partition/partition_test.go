@@ -0,0 +1,142 @@
+package partition
+
+import (
+	"math"
+	"testing"
+)
+
+func TestPosition(t *testing.T) {
+	tests := []struct {
+		name    string
+		scheme  Scheme
+		key     string
+		want    int
+		wantErr bool
+	}{
+		{"default is range", "", "user42", 42, false},
+		{"range prefix", Range, "user42", 42, false},
+		{"range first run of digits", Range, "user12_item34", 12, false},
+		{"range leading zeros", Range, "key007", 7, false},
+		{"range digits only", Range, "1234", 1234, false},
+		{"range no digits", Range, "user", 0, true},
+		{"range empty key", Range, "", 0, true},
+		{"range number overflows an int", Range, "user99999999999999999999", 0, true},
+		{"unknown scheme", Scheme("modulo"), "user42", 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.scheme.Position(tt.key)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Position(%q) error = %v, wantErr %v", tt.key, err, tt.wantErr)
+			}
+			if !tt.wantErr && got != tt.want {
+				t.Errorf("Position(%q) = %d, want %d", tt.key, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHashPosition(t *testing.T) {
+	tests := []struct {
+		name string
+		key  string
+	}{
+		{"numeric key", "user42"},
+		{"key without digits", "session-token"},
+		{"empty key", ""},
+		{"unicode key", "clé"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Hash.Position(tt.key)
+			if err != nil {
+				t.Fatalf("Position(%q) error = %v", tt.key, err)
+			}
+			if got < 0 || got >= RingSize {
+				t.Errorf("Position(%q) = %d, outside of the ring [0, %d)", tt.key, got, RingSize)
+			}
+			again, _ := Hash.Position(tt.key)
+			if again != got {
+				t.Errorf("Position(%q) is not stable: %d then %d", tt.key, got, again)
+			}
+		})
+	}
+}
+
+func TestCheckRange(t *testing.T) {
+	tests := []struct {
+		name    string
+		scheme  Scheme
+		start   int
+		end     int
+		wantErr bool
+	}{
+		{"range full", Range, 0, math.MaxInt32, false},
+		{"range single position", Range, 5, 5, false},
+		{"range default scheme", "", 0, 9999, false},
+		{"range inverted", Range, 10, 5, true},
+		{"range negative start", Range, -1, 5, true},
+		{"hash full ring", Hash, 0, RingSize - 1, false},
+		{"hash arc", Hash, 1000, 2000, false},
+		{"hash past the ring", Hash, 0, RingSize, true},
+		{"hash inverted", Hash, 2000, 1000, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.scheme.CheckRange(tt.start, tt.end)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("CheckRange(%d, %d) error = %v, wantErr %v", tt.start, tt.end, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		scheme  Scheme
+		name    string
+		wantErr bool
+	}{
+		{"", "range", false},
+		{Range, "range", false},
+		{Hash, "hash", false},
+		{Scheme("modulo"), "modulo", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.scheme.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got := tt.scheme.Name(); got != tt.name {
+				t.Errorf("Name() = %q, want %q", got, tt.name)
+			}
+		})
+	}
+}
+
+func TestOwnerOfASharedBoundaryIsTheLowestShardID(t *testing.T) {
+	// Shard 3 was split off shard 1 at 500, the config lists it first
+	ranges := []ShardRange{{ID: 3, Start: 500, End: 1000}, {ID: 1, Start: 0, End: 500}, {ID: 2, Start: 1001, End: 2000}}
+	tests := []struct {
+		position int
+		want     int
+	}{
+		{0, 1},
+		{499, 1},
+		{500, 1},
+		{501, 0},
+		{1000, 0},
+		{1001, 2},
+		{2001, -1},
+	}
+
+	for _, tt := range tests {
+		if got := Owner(tt.position, ranges); got != tt.want {
+			t.Errorf("Owner(%d) = %d, want %d", tt.position, got, tt.want)
+		}
+	}
+}
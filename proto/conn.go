@@ -0,0 +1,57 @@
+package pileuspb
+
+import (
+	"strconv"
+	"sync"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+)
+
+// Trailers of the failed writes (see the Storage service)
+const (
+	EpochTrailer            = "epoch"
+	CurrentTimestampTrailer = "current-timestamp"
+)
+
+// Conns keeps one connection per gRPC address, it is shared by all calls to that node (like the keep-alive connections of the HTTP transport)
+type Conns struct {
+	mu    sync.Mutex
+	conns map[string]*grpc.ClientConn
+}
+
+func NewConns() *Conns {
+	return &Conns{conns: make(map[string]*grpc.ClientConn)}
+}
+
+// Get returns the connection to the address, it is dialed on first use (the traffic between the nodes is not encrypted, as with HTTP)
+func (c *Conns) Get(address string) (*grpc.ClientConn, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if conn, ok := c.conns[address]; ok {
+		return conn, nil
+	}
+	conn, err := grpc.Dial(address, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return nil, err
+	}
+	c.conns[address] = conn
+	return conn, nil
+}
+
+// TrailerInt returns the integer value of a trailer (0 if it is missing or invalid)
+func TrailerInt(md metadata.MD, key string) int64 {
+	values := md.Get(key)
+	if len(values) == 0 {
+		return 0
+	}
+	n, _ := strconv.ParseInt(values[0], 10, 64)
+	return n
+}
+
+// IntTrailer builds a trailer with an integer value
+func IntTrailer(key string, n int64) metadata.MD {
+	return metadata.Pairs(key, strconv.FormatInt(n, 10))
+}
@@ -0,0 +1,751 @@
+package bolt
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+	"go.etcd.io/bbolt"
+	"pileus/encoding"
+	"pileus/hlc"
+	"pileus/store"
+	"pileus/util"
+)
+
+// Buckets of the database
+// Every primary shard also gets two change index buckets (see changesBucket/changeKeysBucket)
+var dataBucket = []byte("data")             // key -> encoded VersionedValue
+var versionsBucket = []byte("versions")     // key -> encoded older versions ([]VersionedValue ordered by timestamp)
+var tombstonesBucket = []byte("tombstones") // key -> timestamp of the tombstones that are still stored
+var metaBucket = []byte("meta")             // per-shard trim watermarks and HighTS
+
+// Change index of a shard, ordered by timestamp: (timestamp + key) -> nothing
+func changesBucket(shardID int) []byte {
+	return []byte(fmt.Sprintf("changes:%d", shardID))
+}
+
+// Reverse change index of a shard: key -> timestamp of its entry in changesBucket
+// A key that is written several times only keeps its latest timestamp in the index
+func changeKeysBucket(shardID int) []byte {
+	return []byte(fmt.Sprintf("change_keys:%d", shardID))
+}
+
+// Highest timestamp that has been trimmed from the change index of the shard
+func watermarkKey(shardID int) []byte {
+	return []byte(fmt.Sprintf("changes_trimmed:%d", shardID))
+}
+
+// Persisted HighTS of the shard
+func highTSKey(shardID int) []byte {
+	return []byte(fmt.Sprintf("hights:%d", shardID))
+}
+
+// Timestamps are encoded big-endian with the sign bit flipped, so the byte order of the keys is the timestamp order
+func encodeTS(ts int64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, uint64(ts)^(1<<63))
+	return b
+}
+
+func decodeTS(b []byte) int64 {
+	return int64(binary.BigEndian.Uint64(b[:8]) ^ (1 << 63))
+}
+
+// Store keeps the records in an embedded on-disk database (bbolt), so no separate process is needed
+// Every operation is a single bbolt transaction, writes are serialized by bbolt itself.
+// Shards holds the shards (by id) that the storage node is primary for, writes outside of them are rejected
+type Store struct {
+	db        *bbolt.DB
+	retention store.Retention
+	codec     encoding.Codec
+	clock     *hlc.Clock
+	Shards    *util.ShardSet
+}
+
+var _ store.Store = (*Store)(nil)
+
+// Options are the options for the bolt store.
+type Options struct {
+	Path string					// Optional ("pileus.db" by default).
+	Shards *util.ShardSet	// Shards the node is primary for (none by default).
+	Timeout *time.Duration		// Optional (how long to wait for the lock on the database file, 2 * time.Second by default).
+	Retention *store.Retention	// Optional (store.DefaultRetention by default).
+	Codec encoding.Codec		// Optional (encoding.JSON by default).
+	Clock *hlc.Clock			// Optional (an in-memory clock by default).
+}
+
+var defaultTimeout = 2 * time.Second
+
+// DefaultOptions is an Options object with default values.
+var DefaultOptions = Options{
+	Path:    "pileus.db",
+	Timeout:   &defaultTimeout,
+	Retention: &store.DefaultRetention,
+	Codec:     encoding.JSON,
+}
+
+// NewStore opens (or creates) the database file.
+// You must call the Close() method on the store when you're done working with it.
+func NewStore(options Options) (*Store, error) {
+	if options.Path == "" {
+		options.Path = DefaultOptions.Path
+	}
+	if options.Shards == nil {
+		options.Shards = util.NewShardSet()
+	}
+	if options.Timeout == nil {
+		options.Timeout = DefaultOptions.Timeout
+	}
+	if options.Retention == nil {
+		options.Retention = DefaultOptions.Retention
+	}
+	if options.Codec == nil {
+		options.Codec = DefaultOptions.Codec
+	}
+	if options.Clock == nil {
+		options.Clock, _ = hlc.NewClock("")
+	}
+
+	db, err := bbolt.Open(options.Path, 0600, &bbolt.Options{Timeout: *options.Timeout})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(createBuckets)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &Store{
+		db:        db,
+		retention: *options.Retention,
+		codec:     options.Codec,
+		clock:     options.Clock,
+		Shards:    options.Shards,
+	}, nil
+}
+
+func createBuckets(tx *bbolt.Tx) error {
+	for _, name := range [][]byte{dataBucket, versionsBucket, tombstonesBucket, metaBucket} {
+		if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Set stores the value with a new timestamp and adds the key to the change index of its shard
+func (s *Store) Set(k string, v any) (int64, error) {
+	if err := util.CheckKeyAndValue(k, v); err != nil {
+		return -1, err
+	}
+	return s.write(k, store.VersionedValue{Value: v}, nil)
+}
+
+// SetIfVersion stores the value only if the current object timestamp of the key equals expectedTS
+func (s *Store) SetIfVersion(k string, v any, expectedTS int64) (int64, error) {
+	if err := util.CheckKeyAndValue(k, v); err != nil {
+		return -1, err
+	}
+	return s.write(k, store.VersionedValue{Value: v}, &expectedTS)
+}
+
+// SetExpiring stores the value with an absolute expiry, conditional if expectedTS is given
+func (s *Store) SetExpiring(k string, v any, expiresAt int64, expectedTS *int64) (int64, error) {
+	if err := util.CheckKeyAndValue(k, v); err != nil {
+		return -1, err
+	}
+	return s.write(k, store.VersionedValue{Value: v, ExpiresAt: expiresAt}, expectedTS)
+}
+
+// Tombstone stores a timestamped tombstone instead of the value
+func (s *Store) Tombstone(k string) (int64, error) {
+	if err := util.CheckKey(k); err != nil {
+		return -1, err
+	}
+	return s.write(k, store.VersionedValue{Deleted: true}, nil)
+}
+
+// Stamps the record with a new timestamp and stores it, for keys of the shards the node is primary for
+// The check and the write are in the same read-write transaction, so compare-and-set can't race with other writes
+func (s *Store) write(k string, record store.VersionedValue, expectedTS *int64) (int64, error) {
+	position, err := util.KeyPosition(k)
+	if err != nil {
+		return -1, err
+	}
+
+	shard := s.Shards.ForKey(k)
+	if shard == nil {
+		return -1, fmt.Errorf("key '%s' at position %d is out of the ranges of the %d shards this node is primary for",
+			k, position, s.Shards.Len())
+	}
+	record.Epoch = shard.Epoch
+
+	var currentTS int64
+	err = s.db.Update(func(tx *bbolt.Tx) error {
+		var current store.VersionedValue
+		if _, err := s.get(tx, k, &current); err != nil {
+			return err
+		}
+		currentTS = current.Timestamp
+		if expectedTS != nil && currentTS != *expectedTS {
+			return store.ErrVersionConflict
+		}
+		record.Prev = &currentTS
+
+		ts, err := s.clock.Now()
+		if err != nil {
+			return fmt.Errorf("failed to issue a timestamp: %v", err)
+		}
+		record.Timestamp = ts
+
+		if err := s.put(tx, k, record); err != nil {
+			return err
+		}
+		if err := raiseMeta(tx, highTSKey(shard.ShardId), ts); err != nil {
+			return err
+		}
+		return indexChange(tx, shard.ShardId, k, ts)
+	})
+
+	if err == store.ErrVersionConflict {
+		return currentTS, err
+	}
+	if err != nil {
+		return -1, err
+	}
+	return record.Timestamp, nil
+}
+
+// SetTxn writes several keys of one shard with a single timestamp, in one read-write transaction
+func (s *Store) SetTxn(writes map[string]store.VersionedValue) (int64, error) {
+	shard, err := store.TxnShard(s.Shards, writes)
+	if err != nil {
+		return -1, err
+	}
+
+	var ts int64
+	err = s.db.Update(func(tx *bbolt.Tx) error {
+		now, err := s.clock.Now()
+		if err != nil {
+			return fmt.Errorf("failed to issue a timestamp: %v", err)
+		}
+		ts = now
+
+		for k, record := range store.StampTxn(writes, ts, shard.Epoch) {
+			var current store.VersionedValue
+			if _, err := s.get(tx, k, &current); err != nil {
+				return err
+			}
+			record.Prev = &current.Timestamp
+
+			if err := s.put(tx, k, record); err != nil {
+				return err
+			}
+			if err := indexChange(tx, shard.ShardId, k, ts); err != nil {
+				return err
+			}
+		}
+		return raiseMeta(tx, highTSKey(shard.ShardId), ts)
+	})
+	if err != nil {
+		return -1, err
+	}
+	return ts, nil
+}
+
+// Moves the entry of the key in the change index of the shard to ts
+func indexChange(tx *bbolt.Tx, shardID int, k string, ts int64) error {
+	changes, err := tx.CreateBucketIfNotExists(changesBucket(shardID))
+	if err != nil {
+		return err
+	}
+	changeKeys, err := tx.CreateBucketIfNotExists(changeKeysBucket(shardID))
+	if err != nil {
+		return err
+	}
+
+	if old := changeKeys.Get([]byte(k)); old != nil {
+		if err := changes.Delete(append(old[:8:8], k...)); err != nil {
+			return err
+		}
+	}
+	if err := changes.Put(append(encodeTS(ts), k...), nil); err != nil {
+		return err
+	}
+	return changeKeys.Put([]byte(k), encodeTS(ts))
+}
+
+// SetVersioned stores a record as is, e.g. preloaded keys or a shard snapshot (the clock observes its timestamp)
+func (s *Store) SetVersioned(k string, vv store.VersionedValue) error {
+	if err := util.CheckKey(k); err != nil {
+		return err
+	}
+	s.clock.Update(vv.Timestamp)
+
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		return s.put(tx, k, vv)
+	})
+}
+
+// SetReplicated stores a record replicated from the primary of the shard (if it is newer) and raises the HighTS of the shard
+func (s *Store) SetReplicated(shardID int, k string, vv store.VersionedValue) error {
+	if err := util.CheckKey(k); err != nil {
+		return err
+	}
+	s.clock.Update(vv.Timestamp)
+
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		var current store.VersionedValue
+		found, err := s.get(tx, k, &current)
+		if err != nil {
+			return err
+		}
+		if !found || current.Timestamp < vv.Timestamp {
+			if err := s.put(tx, k, vv); err != nil {
+				return err
+			}
+		}
+		return raiseMeta(tx, highTSKey(shardID), vv.Timestamp)
+	})
+}
+
+// SetReplicatedTxn stores the records of a replicated transaction (the ones that are newer) in one read-write transaction
+func (s *Store) SetReplicatedTxn(shardID int, records map[string]store.VersionedValue) error {
+	for k, vv := range records {
+		if err := util.CheckKey(k); err != nil {
+			return err
+		}
+		s.clock.Update(vv.Timestamp)
+	}
+
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		for k, vv := range records {
+			var current store.VersionedValue
+			found, err := s.get(tx, k, &current)
+			if err != nil {
+				return err
+			}
+			if !found || current.Timestamp < vv.Timestamp {
+				if err := s.put(tx, k, vv); err != nil {
+					return err
+				}
+			}
+			if err := raiseMeta(tx, highTSKey(shardID), vv.Timestamp); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// LoadHighTS returns the persisted HighTS of the shard (0 if none)
+func (s *Store) LoadHighTS(shardID int) (highTS int64, err error) {
+	err = s.db.View(func(tx *bbolt.Tx) error {
+		highTS = readMeta(tx, highTSKey(shardID))
+		return nil
+	})
+	return highTS, err
+}
+
+// SaveHighTS raises the persisted HighTS of the shard to ts
+func (s *Store) SaveHighTS(shardID int, ts int64) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		return raiseMeta(tx, highTSKey(shardID), ts)
+	})
+}
+
+// Encodes and stores the record + keeps the older versions and the tombstone index up to date
+func (s *Store) put(tx *bbolt.Tx, k string, vv store.VersionedValue) error {
+	var current store.VersionedValue
+	found, err := s.get(tx, k, &current)
+	if err != nil {
+		return err
+	}
+	older, err := s.older(tx, k)
+	if err != nil {
+		return err
+	}
+	var replaced *store.VersionedValue
+	if found {
+		replaced = &current
+	}
+	if err := s.setOlder(tx, k, s.retention.Retain(older, replaced, vv)); err != nil {
+		return err
+	}
+
+	data, err := s.codec.Marshal(vv)
+	if err != nil {
+		return err
+	}
+	if err := tx.Bucket(dataBucket).Put([]byte(k), data); err != nil {
+		return err
+	}
+
+	if vv.Deleted {
+		return tx.Bucket(tombstonesBucket).Put([]byte(k), encodeTS(vv.Timestamp))
+	}
+	return tx.Bucket(tombstonesBucket).Delete([]byte(k))
+}
+
+// Get retrieves the stored value for the given key. If no value is found it returns (false, nil).
+func (s *Store) Get(k string, v any) (found bool, err error) {
+	if err := util.CheckKeyAndValue(k, v); err != nil {
+		return false, err
+	}
+
+	err = s.db.View(func(tx *bbolt.Tx) error {
+		found, err = s.get(tx, k, v)
+		return err
+	})
+	return found, err
+}
+
+func (s *Store) get(tx *bbolt.Tx, k string, v any) (bool, error) {
+	data := tx.Bucket(dataBucket).Get([]byte(k))
+	if data == nil {
+		return false, nil
+	}
+	return true, s.codec.Unmarshal(data, v)
+}
+
+// Older versions of the key, ordered by timestamp
+func (s *Store) older(tx *bbolt.Tx, k string) ([]store.VersionedValue, error) {
+	data := tx.Bucket(versionsBucket).Get([]byte(k))
+	if data == nil {
+		return nil, nil
+	}
+	var older []store.VersionedValue
+	return older, s.codec.Unmarshal(data, &older)
+}
+
+func (s *Store) setOlder(tx *bbolt.Tx, k string, older []store.VersionedValue) error {
+	if len(older) == 0 {
+		return tx.Bucket(versionsBucket).Delete([]byte(k))
+	}
+	data, err := s.codec.Marshal(older)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(versionsBucket).Put([]byte(k), data)
+}
+
+// GetAt returns the version of the key as of timestamp at, out of the current and the older versions of the key (read in one transaction)
+func (s *Store) GetAt(k string, at int64) (vv store.VersionedValue, found bool, err error) {
+	if err := util.CheckKey(k); err != nil {
+		return store.VersionedValue{}, false, err
+	}
+
+	err = s.db.View(func(tx *bbolt.Tx) error {
+		var current store.VersionedValue
+		hasCurrent, err := s.get(tx, k, &current)
+		if err != nil {
+			return err
+		}
+		older, err := s.older(tx, k)
+		if err != nil {
+			return err
+		}
+		if hasCurrent {
+			vv, found, err = s.retention.VersionAt(older, &current, at)
+		} else {
+			vv, found, err = s.retention.VersionAt(older, nil, at)
+		}
+		return err
+	})
+	return vv, found, err
+}
+
+// GetMulti retrieves the stored values of several keys (in one transaction), keys without a value are left out of the returned map.
+func (s *Store) GetMulti(keys []string) (map[string]store.VersionedValue, error) {
+	for _, k := range keys {
+		if err := util.CheckKey(k); err != nil {
+			return nil, err
+		}
+	}
+
+	values := make(map[string]store.VersionedValue, len(keys))
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		for _, k := range keys {
+			var vv store.VersionedValue
+			found, err := s.get(tx, k, &vv)
+			if err != nil {
+				return err
+			}
+			if found {
+				values[k] = vv
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+// Delete removes the stored value of the key and its older versions (without leaving a tombstone)
+func (s *Store) Delete(k string) error {
+	if err := util.CheckKey(k); err != nil {
+		return err
+	}
+
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		if err := tx.Bucket(dataBucket).Delete([]byte(k)); err != nil {
+			return err
+		}
+		if err := tx.Bucket(versionsBucket).Delete([]byte(k)); err != nil {
+			return err
+		}
+		return tx.Bucket(tombstonesBucket).Delete([]byte(k))
+	})
+}
+
+// ScanUpdatedKeys returns the records of the shard that were updated after "since" (exclusive), ordered by timestamp
+// The change index is ordered by timestamp, so only the updates after "since" are visited (and with limit > 0, only until limit of them were read)
+func (s *Store) ScanUpdatedKeys(shardID int, since int64, limit int) ([]util.Record, int64, bool, error) {
+	var updates []util.Record
+	upTo := since
+	more := false
+
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		if since < watermark(tx, shardID) {
+			return store.ErrChangesTrimmed
+		}
+
+		changes := tx.Bucket(changesBucket(shardID))
+		if changes == nil {
+			return nil
+		}
+
+		c := changes.Cursor()
+		for entry, _ := c.Seek(encodeTS(since + 1)); entry != nil; entry, _ = c.Next() {
+			if limit > 0 && len(updates) == limit {
+				more = true
+				break
+			}
+			upTo = decodeTS(entry[:8])
+			key := string(entry[8:])
+
+			var vv store.VersionedValue
+			found, err := s.get(tx, key, &vv)
+			if err != nil {
+				fmt.Printf("Error decoding key %s: %v\n", key, err)
+				continue
+			}
+			if !found || vv.Timestamp <= since {
+				continue
+			}
+			updates = append(updates, util.Record{
+				Key:       key,
+				Value:     vv.Value,
+				Timestamp: vv.Timestamp,
+				Deleted:   vv.Deleted,
+				Epoch:     vv.Epoch,
+				Prev:      vv.Prev,
+				Txn:       vv.Txn,
+				ExpiresAt: vv.ExpiresAt,
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, since, false, err
+	}
+	return updates, upTo, more, nil
+}
+
+// Trim watermark of the shard (0 if nothing was trimmed yet)
+func watermark(tx *bbolt.Tx, shardID int) int64 {
+	return readMeta(tx, watermarkKey(shardID))
+}
+
+func raiseWatermark(tx *bbolt.Tx, shardID int, ts int64) error {
+	return raiseMeta(tx, watermarkKey(shardID), ts)
+}
+
+// Timestamp stored under the key of the meta bucket (0 if missing)
+func readMeta(tx *bbolt.Tx, key []byte) int64 {
+	b := tx.Bucket(metaBucket).Get(key)
+	if b == nil {
+		return 0
+	}
+	return decodeTS(b)
+}
+
+// Raises the timestamp stored under the key of the meta bucket to ts if it is higher
+func raiseMeta(tx *bbolt.Tx, key []byte, ts int64) error {
+	if ts <= readMeta(tx, key) {
+		return nil
+	}
+	return tx.Bucket(metaBucket).Put(key, encodeTS(ts))
+}
+
+// TrimChangeLog drops all change index entries of the shard with a timestamp <= before
+func (s *Store) TrimChangeLog(shardID int, before int64) (int64, error) {
+	var removed int64
+
+	err := s.db.Update(func(tx *bbolt.Tx) error {
+		changes := tx.Bucket(changesBucket(shardID))
+		if changes == nil {
+			return nil
+		}
+		changeKeys := tx.Bucket(changeKeysBucket(shardID))
+
+		// Collect first, deleting while moving the cursor skips entries
+		var trimmed [][]byte
+		c := changes.Cursor()
+		for entry, _ := c.First(); entry != nil && decodeTS(entry) <= before; entry, _ = c.Next() {
+			trimmed = append(trimmed, append([]byte(nil), entry...))
+		}
+		if len(trimmed) == 0 {
+			return nil
+		}
+
+		for _, entry := range trimmed {
+			if err := changes.Delete(entry); err != nil {
+				return err
+			}
+			if err := changeKeys.Delete(entry[8:]); err != nil {
+				return err
+			}
+		}
+		removed = int64(len(trimmed))
+
+		return raiseWatermark(tx, shardID, decodeTS(trimmed[len(trimmed)-1]))
+	})
+	return removed, err
+}
+
+// PurgeTombstones physically removes the tombstones of the shard with a timestamp <= upTo
+// The caller has to make sure that every node replicating the shard has seen them.
+// Since the purged deletes can't be replicated anymore, the trim watermark of the change index is raised as well.
+// Tombstones above the retention horizon are kept, reads "as of" before them still need the older versions of their key.
+func (s *Store) PurgeTombstones(shard *util.Shard, upTo int64) (int, error) {
+	purged := 0
+	if horizon := s.retention.Horizon(); upTo > horizon {
+		upTo = horizon
+	}
+
+	err := s.db.Update(func(tx *bbolt.Tx) error {
+		tombstones := tx.Bucket(tombstonesBucket)
+
+		var keys []string
+		var timestamps []int64
+		err := tombstones.ForEach(func(k, v []byte) error {
+			ts := decodeTS(v)
+			if ts > upTo {
+				return nil
+			}
+			position, err := util.KeyPosition(string(k))
+			if err != nil || position < shard.RangeStart || position > shard.RangeEnd {
+				return nil
+			}
+			keys = append(keys, string(k))
+			timestamps = append(timestamps, ts)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		changes := tx.Bucket(changesBucket(shard.ShardId))
+		changeKeys := tx.Bucket(changeKeysBucket(shard.ShardId))
+
+		for i, key := range keys {
+			if err := tx.Bucket(dataBucket).Delete([]byte(key)); err != nil {
+				return err
+			}
+			if err := tx.Bucket(versionsBucket).Delete([]byte(key)); err != nil {
+				return err
+			}
+			if err := tombstones.Delete([]byte(key)); err != nil {
+				return err
+			}
+			if changeKeys != nil {
+				if old := changeKeys.Get([]byte(key)); old != nil {
+					if err := changes.Delete(append(old[:8:8], key...)); err != nil {
+						return err
+					}
+					if err := changeKeys.Delete([]byte(key)); err != nil {
+						return err
+					}
+				}
+			}
+			if err := raiseWatermark(tx, shard.ShardId, timestamps[i]); err != nil {
+				return err
+			}
+			purged++
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return purged, nil
+}
+
+// ScanShard calls fn for every stored record (including tombstones) whose key position is in [startKey, endKey]
+// The records are read in one transaction and passed to fn afterwards, so fn is free to write to the store
+func (s *Store) ScanShard(startKey int, endKey int, fn func(util.Record) error) error {
+	var records []util.Record
+
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		return tx.Bucket(dataBucket).ForEach(func(k, data []byte) error {
+			position, err := util.KeyPosition(string(k))
+			if err != nil || position < startKey || position > endKey {
+				return nil
+			}
+			var vv store.VersionedValue
+			if err := s.codec.Unmarshal(data, &vv); err != nil {
+				return err
+			}
+			records = append(records, util.Record{
+				Key:       string(k),
+				Value:     vv.Value,
+				Timestamp: vv.Timestamp,
+				Deleted:   vv.Deleted,
+				Epoch:     vv.Epoch,
+				Prev:      vv.Prev,
+				Txn:       vv.Txn,
+				ExpiresAt: vv.ExpiresAt,
+			})
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, rec := range records {
+		if err := fn(rec); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// FlushAll drops all buckets (records, indexes and watermarks)
+func (s *Store) FlushAll() error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		var names [][]byte
+		err := tx.ForEach(func(name []byte, _ *bbolt.Bucket) error {
+			names = append(names, append([]byte(nil), name...))
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			if err := tx.DeleteBucket(name); err != nil {
+				return err
+			}
+		}
+		return createBuckets(tx)
+	})
+}
+
+// Close closes the database file.
+func (s *Store) Close() error {
+	return s.db.Close()
+}
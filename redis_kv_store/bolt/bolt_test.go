@@ -0,0 +1,204 @@
+package bolt
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"pileus/store"
+	"pileus/util"
+)
+
+// Opens a store in the test's temporary directory that is primary for shard 0 ([0, 1000])
+func openTestStore(t *testing.T, path string) *Store {
+	t.Helper()
+	opts := DefaultOptions
+	opts.Path = path
+	opts.Shards = util.NewShardSet()
+	opts.Shards.Put(&util.Shard{ShardId: 0, RangeStart: 0, RangeEnd: 1000})
+
+	s, err := NewStore(opts)
+	if err != nil {
+		t.Fatalf("NewStore: %v", err)
+	}
+	return s
+}
+
+func TestEncodedTimestampsSortLikeTheTimestamps(t *testing.T) {
+	stamps := []int64{-1 << 40, -1, 0, 1, 1 << 40}
+	for i := 1; i < len(stamps); i++ {
+		if bytes.Compare(encodeTS(stamps[i-1]), encodeTS(stamps[i])) >= 0 {
+			t.Errorf("encoded %d does not sort before encoded %d", stamps[i-1], stamps[i])
+		}
+	}
+	for _, ts := range stamps {
+		if got := decodeTS(encodeTS(ts)); got != ts {
+			t.Errorf("decodeTS(encodeTS(%d)) = %d", ts, got)
+		}
+	}
+}
+
+func TestChangeIndexKeepsTheLatestWriteOfAKey(t *testing.T) {
+	s := openTestStore(t, filepath.Join(t.TempDir(), "pileus.db"))
+	defer s.Close()
+
+	first, err := s.Set("key1", "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Set("key2", "b"); err != nil {
+		t.Fatal(err)
+	}
+	rewritten, err := s.Set("key1", "c")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	updates, _, _, err := s.ScanUpdatedKeys(0, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(updates) != 2 || updates[0].Key != "key2" || updates[1].Key != "key1" || updates[1].Timestamp != rewritten {
+		t.Errorf("updates since 0 = %+v, want key2 then key1@%d", updates, rewritten)
+	}
+
+	// Only the latest entry of key1 is left, so trimming up to its first write drops nothing
+	removed, err := s.TrimChangeLog(0, first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 0 {
+		t.Errorf("trimmed %d entries up to the replaced write, want 0", removed)
+	}
+}
+
+func TestScanUpdatedKeysPagesThroughTheChangeIndex(t *testing.T) {
+	s := openTestStore(t, filepath.Join(t.TempDir(), "pileus.db"))
+	defer s.Close()
+
+	var stamps []int64
+	for _, key := range []string{"key1", "key2", "key3"} {
+		ts, err := s.Set(key, "v")
+		if err != nil {
+			t.Fatal(err)
+		}
+		stamps = append(stamps, ts)
+	}
+
+	updates, upTo, more, err := s.ScanUpdatedKeys(0, 0, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(updates) != 2 || updates[1].Key != "key2" || upTo != stamps[1] || !more {
+		t.Fatalf("first page = %v up to %d (more: %v), want key1 and key2 up to %d with more", updates, upTo, more, stamps[1])
+	}
+
+	updates, upTo, more, err = s.ScanUpdatedKeys(0, upTo, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(updates) != 1 || updates[0].Key != "key3" || upTo != stamps[2] || more {
+		t.Errorf("second page = %v up to %d (more: %v), want key3 up to %d without more", updates, upTo, more, stamps[2])
+	}
+}
+
+func TestChangeIndexAndWatermarkSurviveAReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pileus.db")
+	s := openTestStore(t, path)
+
+	first, err := s.Set("key1", "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := s.Set("key2", "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.TrimChangeLog(0, first); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	s = openTestStore(t, path)
+	defer s.Close()
+
+	if _, _, _, err := s.ScanUpdatedKeys(0, first-1, 0); err != store.ErrChangesTrimmed {
+		t.Errorf("ScanUpdatedKeys behind the trim after a reopen = %v, want ErrChangesTrimmed", err)
+	}
+	updates, _, _, err := s.ScanUpdatedKeys(0, first, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(updates) != 1 || updates[0].Key != "key2" || updates[0].Timestamp != second {
+		t.Errorf("updates after the trim point = %+v, want key2@%d", updates, second)
+	}
+}
+
+func TestSetIfVersionAndPurgeOfADeletedKey(t *testing.T) {
+	s := openTestStore(t, filepath.Join(t.TempDir(), "pileus.db"))
+	defer s.Close()
+	// No reads as of the past, so the tombstones can be purged once the clock moved past them
+	s.retention.MaxAge = 0
+
+	created, err := s.SetIfVersion("key1", "a", 0)
+	if err != nil {
+		t.Fatalf("SetIfVersion of a missing key: %v", err)
+	}
+	deletedAt, err := s.Tombstone("key1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if current, err := s.SetIfVersion("key1", "b", created); err != store.ErrVersionConflict || current != deletedAt {
+		t.Errorf("SetIfVersion over the deleted version = (%d, %v), want (%d, ErrVersionConflict)", current, err, deletedAt)
+	}
+	time.Sleep(2 * time.Millisecond)
+
+	shard, _ := s.Shards.Get(0)
+	purged, err := s.PurgeTombstones(shard, deletedAt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if purged != 1 {
+		t.Errorf("purged %d tombstones, want 1", purged)
+	}
+	var vv store.VersionedValue
+	if found, _ := s.Get("key1", &vv); found {
+		t.Errorf("purged key1 is still stored: %+v", vv)
+	}
+	// A purged key is missing again, so it can be created with version 0
+	if _, err := s.SetIfVersion("key1", "b", 0); err != nil {
+		t.Errorf("SetIfVersion(0) after the purge: %v", err)
+	}
+}
+
+func TestHighTSSurvivesAReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pileus.db")
+	s := openTestStore(t, path)
+
+	written, err := s.Set("key1", "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetReplicated(1, "key2000", store.VersionedValue{Value: "b", Timestamp: 42}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	s = openTestStore(t, path)
+	defer s.Close()
+
+	if highTS, err := s.LoadHighTS(0); err != nil || highTS != written {
+		t.Errorf("HighTS of the primary shard after a reopen = (%d, %v), want %d", highTS, err, written)
+	}
+	if highTS, err := s.LoadHighTS(1); err != nil || highTS != 42 {
+		t.Errorf("HighTS of the replicated shard after a reopen = (%d, %v), want 42", highTS, err)
+	}
+	if highTS, err := s.LoadHighTS(2); err != nil || highTS != 0 {
+		t.Errorf("HighTS of an unknown shard = (%d, %v), want 0", highTS, err)
+	}
+}
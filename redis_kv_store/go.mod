@@ -2,10 +2,28 @@ module pileus
 
 go 1.18
 
-require github.com/redis/go-redis/v9 v9.7.3
+require (
+	github.com/alicebob/miniredis/v2 v2.36.1
+	github.com/google/uuid v1.6.0
+	github.com/redis/go-redis/v9 v9.7.3
+	go.etcd.io/bbolt v1.3.8
+	google.golang.org/grpc v1.57.1
+	pileus/partition v0.0.0
+	pileus/proto v0.0.0
+)
 
 require (
 	github.com/cespare/xxhash/v2 v2.2.0 // indirect
 	github.com/dgryski/go-rendezvous v0.0.0-20200823014737-9f7001d12a5f // indirect
-	github.com/google/uuid v1.6.0 // indirect
+	github.com/golang/protobuf v1.5.3 // indirect
+	github.com/yuin/gopher-lua v1.1.1 // indirect
+	golang.org/x/net v0.9.0 // indirect
+	golang.org/x/sys v0.7.0 // indirect
+	golang.org/x/text v0.9.0 // indirect
+	google.golang.org/genproto/googleapis/rpc v0.0.0-20230525234030-28d5490b6b19 // indirect
+	google.golang.org/protobuf v1.33.0 // indirect
 )
+
+replace pileus/proto => ../proto
+
+replace pileus/partition => ../partition
@@ -0,0 +1,150 @@
+package hlc
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// A hybrid logical clock timestamp is packed in an int64 as (physical ms << LogicalBits) | logical counter.
+// It keeps the ordering of plain int64 comparisons, and stays below 2^53 so it survives being a redis sorted set score.
+// When the logical counter overflows it simply carries into the physical part (i.e. the clock runs 1ms ahead).
+const LogicalBits = 12
+
+const logicalMask = 1<<LogicalBits - 1
+
+// How far ahead of the last issued timestamp the persisted upper bound is moved,
+// so the state file is only rewritten about once per window instead of on every write
+const persistWindow = 10 * time.Second
+
+// FromPhysical returns the smallest timestamp with the given physical time (in ms)
+func FromPhysical(ms int64) int64 {
+	return ms << LogicalBits
+}
+
+// FromTime returns the smallest timestamp issued at or after t
+func FromTime(t time.Time) int64 {
+	return FromPhysical(t.UnixMilli())
+}
+
+// Physical returns the physical part (in ms) of a timestamp
+func Physical(ts int64) int64 {
+	return ts >> LogicalBits
+}
+
+// Logical returns the logical counter of a timestamp
+func Logical(ts int64) int64 {
+	return ts & logicalMask
+}
+
+// Clock issues strictly increasing timestamps, also across restarts when it is backed by a state file
+type Clock struct {
+	mu             sync.Mutex
+	last           int64 	// last issued (or observed) timestamp
+	persistedUntil int64 	// physical ms that the persisted state covers
+	path           string
+}
+
+type clockState struct {
+	PhysicalUntil int64 `json:"physical_until"`
+}
+
+// NewClock creates a clock that persists its state to path (an empty path keeps it in memory only)
+// On restart, all timestamps issued before are below the persisted bound, so the clock resumes above it.
+func NewClock(path string) (*Clock, error) {
+	c := &Clock{path: path}
+	if path == "" {
+		return c, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return c, nil
+		}
+		return nil, err
+	}
+
+	var state clockState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("invalid clock state in %s: %v", path, err)
+	}
+	c.last = FromPhysical(state.PhysicalUntil)
+	c.persistedUntil = state.PhysicalUntil
+
+	return c, nil
+}
+
+// Now issues a new timestamp for a local event (e.g. a write on the primary)
+func (c *Clock) Now() (int64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ts := FromTime(time.Now())
+	if ts <= c.last {
+		ts = c.last + 1
+	}
+
+	if err := c.persist(ts); err != nil {
+		return -1, err
+	}
+	c.last = ts
+	return ts, nil
+}
+
+// Update merges a timestamp received from another node, so later local timestamps are issued above it
+func (c *Clock) Update(remote int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if remote > c.last {
+		c.last = remote
+	}
+}
+
+// Last returns the highest timestamp issued or observed so far
+func (c *Clock) Last() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.last
+}
+
+// Moves the persisted bound ahead of ts if needed (must hold c.mu)
+func (c *Clock) persist(ts int64) error {
+	if c.path == "" || Physical(ts) < c.persistedUntil {
+		return nil
+	}
+
+	until := Physical(ts) + persistWindow.Milliseconds()
+	data, err := json.Marshal(clockState{PhysicalUntil: until})
+	if err != nil {
+		return err
+	}
+
+	// Write to a temp file and rename, so a crash never leaves a truncated state behind
+	tmp := c.path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, c.path); err != nil {
+		return err
+	}
+
+	c.persistedUntil = until
+	return nil
+}
@@ -0,0 +1,235 @@
+package hlc
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPacking(t *testing.T) {
+	tests := []struct {
+		name     string
+		ts       int64
+		physical int64
+		logical  int64
+	}{
+		{"zero", 0, 0, 0},
+		{"physical only", FromPhysical(1700000000000), 1700000000000, 0},
+		{"physical and logical", FromPhysical(42) + 7, 42, 7},
+		{"last logical", FromPhysical(42) + logicalMask, 42, logicalMask},
+		{"logical overflow carries", FromPhysical(42) + logicalMask + 1, 43, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Physical(tt.ts); got != tt.physical {
+				t.Errorf("Physical(%d) = %d, want %d", tt.ts, got, tt.physical)
+			}
+			if got := Logical(tt.ts); got != tt.logical {
+				t.Errorf("Logical(%d) = %d, want %d", tt.ts, got, tt.logical)
+			}
+		})
+	}
+}
+
+func TestFromTimeKeepsOrder(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name    string
+		earlier time.Time
+		later   time.Time
+	}{
+		{"one millisecond apart", now, now.Add(time.Millisecond)},
+		{"one second apart", now, now.Add(time.Second)},
+		{"one day apart", now.Add(-24 * time.Hour), now},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if FromTime(tt.earlier) >= FromTime(tt.later) {
+				t.Errorf("FromTime(%v) = %d is not below FromTime(%v) = %d",
+					tt.earlier, FromTime(tt.earlier), tt.later, FromTime(tt.later))
+			}
+		})
+	}
+}
+
+// Timestamps are redis sorted set scores (doubles), they must stay exact (12 logical bits leave room until 2039)
+func TestTimestampsFitARedisScore(t *testing.T) {
+	for _, at := range []time.Time{time.Now(), time.Date(2035, 1, 1, 0, 0, 0, 0, time.UTC)} {
+		if ts := FromTime(at) + logicalMask; ts >= 1<<53 {
+			t.Errorf("timestamp %d of %v does not fit a double exactly", ts, at)
+		}
+	}
+}
+
+func TestConcurrentTimestampsAreUnique(t *testing.T) {
+	c, err := NewClock("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const writers, perWriter = 8, 500
+	issued := make(chan int64, writers*perWriter)
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < perWriter; i++ {
+				ts, err := c.Now()
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				issued <- ts
+			}
+		}()
+	}
+	wg.Wait()
+	close(issued)
+
+	seen := make(map[int64]bool)
+	for ts := range issued {
+		if seen[ts] {
+			t.Fatalf("timestamp %d was issued twice", ts)
+		}
+		seen[ts] = true
+	}
+}
+
+func TestNowIsStrictlyIncreasing(t *testing.T) {
+	ahead := FromTime(time.Now().Add(time.Hour))
+	tests := []struct {
+		name   string
+		remote int64 // merged with Update before the timestamps are issued (0: none)
+	}{
+		{"local clock only", 0},
+		{"behind the local clock", FromTime(time.Now().Add(-time.Hour))},
+		{"ahead of the local clock", ahead},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := NewClock("")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.remote != 0 {
+				c.Update(tt.remote)
+			}
+
+			prev := tt.remote
+			for i := 0; i < 1000; i++ {
+				ts, err := c.Now()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if ts <= prev {
+					t.Fatalf("timestamp %d issued after %d", ts, prev)
+				}
+				if c.Last() != ts {
+					t.Fatalf("Last() = %d after issuing %d", c.Last(), ts)
+				}
+				prev = ts
+			}
+		})
+	}
+}
+
+func TestUpdateOnlyMovesForward(t *testing.T) {
+	tests := []struct {
+		name    string
+		updates []int64
+		want    int64
+	}{
+		{"single", []int64{100}, 100},
+		{"increasing", []int64{100, 200, 300}, 300},
+		{"older one ignored", []int64{300, 100}, 300},
+		{"equal", []int64{200, 200}, 200},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := NewClock("")
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, remote := range tt.updates {
+				c.Update(remote)
+			}
+			if got := c.Last(); got != tt.want {
+				t.Errorf("Last() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestClockResumesAbovePersistedBound(t *testing.T) {
+	tests := []struct {
+		name   string
+		issued int // timestamps issued before the restart
+	}{
+		{"nothing issued", 0},
+		{"one issued", 1},
+		{"many issued", 100},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "hlc_state.json")
+
+			before, err := NewClock(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var last int64
+			for i := 0; i < tt.issued; i++ {
+				if last, err = before.Now(); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			after, err := NewClock(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ts, err := after.Now()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ts <= last {
+				t.Errorf("restarted clock issued %d, not above %d issued before the restart", ts, last)
+			}
+		})
+	}
+}
+
+func TestNewClockRejectsCorruptState(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		wantErr bool
+	}{
+		{"valid state", `{"physical_until": 1700000000000}`, false},
+		{"empty object", `{}`, false},
+		{"truncated", `{"physical_until": 17`, true},
+		{"not json", `garbage`, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "hlc_state.json")
+			if err := os.WriteFile(path, []byte(tt.content), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			_, err := NewClock(path)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("NewClock() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
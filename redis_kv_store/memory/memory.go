@@ -0,0 +1,644 @@
+package memory
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"pileus/encoding"
+	"pileus/hlc"
+	"pileus/store"
+	"pileus/util"
+)
+
+// Store keeps everything in the memory of the storage node (nothing survives a restart)
+// It behaves like the redis backend, so nodes can be run without a local redis instance.
+// Shards holds the shards (by id) that the storage node is primary for, writes outside of them are rejected
+type Store struct {
+	mu         sync.Mutex
+	data       map[string][]byte        // key -> encoded VersionedValue
+	versions   map[string][]byte        // key -> encoded older versions ([]VersionedValue ordered by timestamp)
+	changes    map[int]*changeLog       // per-shard change index
+	watermarks map[int]int64            // per-shard highest timestamp trimmed from the change index
+	tombstones map[string]int64         // key -> timestamp of the tombstones that are still stored
+	highTS     map[int]int64            // per-shard persisted HighTS
+	retention  store.Retention
+	codec      encoding.Codec
+	clock      *hlc.Clock
+	Shards     *util.ShardSet
+}
+
+var _ store.Store = (*Store)(nil)
+
+// Options are the options for the in-memory store.
+type Options struct {
+	Shards *util.ShardSet	// Shards the node is primary for (none by default).
+	Retention *store.Retention	// Optional (store.DefaultRetention by default).
+	Codec encoding.Codec		// Optional (encoding.JSON by default).
+	Clock *hlc.Clock			// Optional (an in-memory clock by default).
+}
+
+// NewStore creates a new, empty in-memory store.
+func NewStore(options Options) (*Store, error) {
+	if options.Shards == nil {
+		options.Shards = util.NewShardSet()
+	}
+	if options.Retention == nil {
+		options.Retention = &store.DefaultRetention
+	}
+	if options.Codec == nil {
+		options.Codec = encoding.JSON
+	}
+	if options.Clock == nil {
+		options.Clock, _ = hlc.NewClock("")
+	}
+
+	s := &Store{
+		retention: *options.Retention,
+		codec:     options.Codec,
+		clock:     options.Clock,
+		Shards:    options.Shards,
+	}
+	s.reset()
+	return s, nil
+}
+
+func (s *Store) reset() {
+	s.data = make(map[string][]byte)
+	s.versions = make(map[string][]byte)
+	s.changes = make(map[int]*changeLog)
+	s.watermarks = make(map[int]int64)
+	s.tombstones = make(map[string]int64)
+	s.highTS = make(map[int]int64)
+}
+
+// Set stores the value with a new timestamp and adds the key to the change index of its shard
+func (s *Store) Set(k string, v any) (int64, error) {
+	if err := util.CheckKeyAndValue(k, v); err != nil {
+		return -1, err
+	}
+	return s.write(k, store.VersionedValue{Value: v}, nil)
+}
+
+// SetIfVersion stores the value only if the current object timestamp of the key equals expectedTS
+func (s *Store) SetIfVersion(k string, v any, expectedTS int64) (int64, error) {
+	if err := util.CheckKeyAndValue(k, v); err != nil {
+		return -1, err
+	}
+	return s.write(k, store.VersionedValue{Value: v}, &expectedTS)
+}
+
+// SetExpiring stores the value with an absolute expiry, conditional if expectedTS is given
+func (s *Store) SetExpiring(k string, v any, expiresAt int64, expectedTS *int64) (int64, error) {
+	if err := util.CheckKeyAndValue(k, v); err != nil {
+		return -1, err
+	}
+	return s.write(k, store.VersionedValue{Value: v, ExpiresAt: expiresAt}, expectedTS)
+}
+
+// Tombstone stores a timestamped tombstone instead of the value
+func (s *Store) Tombstone(k string) (int64, error) {
+	if err := util.CheckKey(k); err != nil {
+		return -1, err
+	}
+	return s.write(k, store.VersionedValue{Deleted: true}, nil)
+}
+
+// Stamps the record with a new timestamp and stores it, for keys of the shards the node is primary for
+// The whole write holds the lock, so the compare-and-set check can't race with other writes
+func (s *Store) write(k string, record store.VersionedValue, expectedTS *int64) (int64, error) {
+	position, err := util.KeyPosition(k)
+	if err != nil {
+		return -1, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	shard := s.Shards.ForKey(k)
+	if shard == nil {
+		return -1, fmt.Errorf("key '%s' at position %d is out of the ranges of the %d shards this node is primary for",
+			k, position, s.Shards.Len())
+	}
+	record.Epoch = shard.Epoch
+
+	var current store.VersionedValue
+	if _, err := s.get(k, &current); err != nil {
+		return -1, err
+	}
+	if expectedTS != nil && current.Timestamp != *expectedTS {
+		return current.Timestamp, store.ErrVersionConflict
+	}
+	record.Prev = &current.Timestamp
+
+	ts, err := s.clock.Now()
+	if err != nil {
+		return -1, fmt.Errorf("failed to issue a timestamp: %v", err)
+	}
+	record.Timestamp = ts
+
+	if err := s.put(k, record); err != nil {
+		return -1, err
+	}
+	s.changeLog(shard.ShardId).add(k, ts)
+	s.raiseHighTS(shard.ShardId, ts)
+
+	return ts, nil
+}
+
+// SetTxn writes several keys of one shard with a single timestamp, the whole transaction holds the lock
+func (s *Store) SetTxn(writes map[string]store.VersionedValue) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	shard, err := store.TxnShard(s.Shards, writes)
+	if err != nil {
+		return -1, err
+	}
+
+	ts, err := s.clock.Now()
+	if err != nil {
+		return -1, fmt.Errorf("failed to issue a timestamp: %v", err)
+	}
+
+	for k, record := range store.StampTxn(writes, ts, shard.Epoch) {
+		var current store.VersionedValue
+		if _, err := s.get(k, &current); err != nil {
+			return -1, err
+		}
+		record.Prev = &current.Timestamp
+
+		if err := s.put(k, record); err != nil {
+			return -1, err
+		}
+		s.changeLog(shard.ShardId).add(k, ts)
+	}
+	s.raiseHighTS(shard.ShardId, ts)
+
+	return ts, nil
+}
+
+// SetVersioned stores a record as is, e.g. preloaded keys or a shard snapshot (the clock observes its timestamp)
+func (s *Store) SetVersioned(k string, vv store.VersionedValue) error {
+	if err := util.CheckKey(k); err != nil {
+		return err
+	}
+	s.clock.Update(vv.Timestamp)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.put(k, vv)
+}
+
+// SetReplicated stores a record replicated from the primary of the shard (if it is newer) and raises the HighTS of the shard
+func (s *Store) SetReplicated(shardID int, k string, vv store.VersionedValue) error {
+	if err := util.CheckKey(k); err != nil {
+		return err
+	}
+	s.clock.Update(vv.Timestamp)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var current store.VersionedValue
+	found, err := s.get(k, &current)
+	if err != nil {
+		return err
+	}
+	if !found || current.Timestamp < vv.Timestamp {
+		if err := s.put(k, vv); err != nil {
+			return err
+		}
+	}
+	s.raiseHighTS(shardID, vv.Timestamp)
+	return nil
+}
+
+// SetReplicatedTxn stores the records of a replicated transaction (the ones that are newer) under one lock, so readers see all or none of them
+func (s *Store) SetReplicatedTxn(shardID int, records map[string]store.VersionedValue) error {
+	for k, vv := range records {
+		if err := util.CheckKey(k); err != nil {
+			return err
+		}
+		s.clock.Update(vv.Timestamp)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for k, vv := range records {
+		var current store.VersionedValue
+		found, err := s.get(k, &current)
+		if err != nil {
+			return err
+		}
+		if !found || current.Timestamp < vv.Timestamp {
+			if err := s.put(k, vv); err != nil {
+				return err
+			}
+		}
+		s.raiseHighTS(shardID, vv.Timestamp)
+	}
+	return nil
+}
+
+// LoadHighTS returns the HighTS of the shard (0 if none)
+func (s *Store) LoadHighTS(shardID int) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.highTS[shardID], nil
+}
+
+// SaveHighTS raises the HighTS of the shard to ts
+func (s *Store) SaveHighTS(shardID int, ts int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.raiseHighTS(shardID, ts)
+	return nil
+}
+
+// must hold s.mu
+func (s *Store) raiseHighTS(shardID int, ts int64) {
+	if ts > s.highTS[shardID] {
+		s.highTS[shardID] = ts
+	}
+}
+
+// Encodes and stores the record + keeps the older versions and the tombstone index up to date (must hold s.mu)
+func (s *Store) put(k string, vv store.VersionedValue) error {
+	var current store.VersionedValue
+	found, err := s.get(k, &current)
+	if err != nil {
+		return err
+	}
+	older, err := s.older(k)
+	if err != nil {
+		return err
+	}
+	var replaced *store.VersionedValue
+	if found {
+		replaced = &current
+	}
+	if err := s.setOlder(k, s.retention.Retain(older, replaced, vv)); err != nil {
+		return err
+	}
+
+	data, err := s.codec.Marshal(vv)
+	if err != nil {
+		return err
+	}
+	s.data[k] = data
+
+	if vv.Deleted {
+		s.tombstones[k] = vv.Timestamp
+	} else {
+		delete(s.tombstones, k)
+	}
+	return nil
+}
+
+// Get retrieves the stored value for the given key. If no value is found it returns (false, nil).
+func (s *Store) Get(k string, v any) (bool, error) {
+	if err := util.CheckKeyAndValue(k, v); err != nil {
+		return false, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.get(k, v)
+}
+
+// must hold s.mu
+func (s *Store) get(k string, v any) (bool, error) {
+	data, ok := s.data[k]
+	if !ok {
+		return false, nil
+	}
+	return true, s.codec.Unmarshal(data, v)
+}
+
+// Older versions of the key, ordered by timestamp (must hold s.mu)
+func (s *Store) older(k string) ([]store.VersionedValue, error) {
+	data, ok := s.versions[k]
+	if !ok {
+		return nil, nil
+	}
+	var older []store.VersionedValue
+	return older, s.codec.Unmarshal(data, &older)
+}
+
+// must hold s.mu
+func (s *Store) setOlder(k string, older []store.VersionedValue) error {
+	if len(older) == 0 {
+		delete(s.versions, k)
+		return nil
+	}
+	data, err := s.codec.Marshal(older)
+	if err != nil {
+		return err
+	}
+	s.versions[k] = data
+	return nil
+}
+
+// GetAt returns the version of the key as of timestamp at, out of the current and the older versions of the key
+func (s *Store) GetAt(k string, at int64) (store.VersionedValue, bool, error) {
+	if err := util.CheckKey(k); err != nil {
+		return store.VersionedValue{}, false, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var current store.VersionedValue
+	found, err := s.get(k, &current)
+	if err != nil {
+		return store.VersionedValue{}, false, err
+	}
+	older, err := s.older(k)
+	if err != nil {
+		return store.VersionedValue{}, false, err
+	}
+	if !found {
+		return s.retention.VersionAt(older, nil, at)
+	}
+	return s.retention.VersionAt(older, &current, at)
+}
+
+// GetMulti retrieves the stored values of several keys, keys without a value are left out of the returned map.
+func (s *Store) GetMulti(keys []string) (map[string]store.VersionedValue, error) {
+	for _, k := range keys {
+		if err := util.CheckKey(k); err != nil {
+			return nil, err
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	values := make(map[string]store.VersionedValue, len(keys))
+	for _, k := range keys {
+		var vv store.VersionedValue
+		found, err := s.get(k, &vv)
+		if err != nil {
+			return nil, err
+		}
+		if found {
+			values[k] = vv
+		}
+	}
+	return values, nil
+}
+
+// Delete removes the stored value of the key and its older versions (without leaving a tombstone)
+func (s *Store) Delete(k string) error {
+	if err := util.CheckKey(k); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.data, k)
+	delete(s.versions, k)
+	delete(s.tombstones, k)
+	return nil
+}
+
+// ScanUpdatedKeys returns the records of the shard that were updated after "since" (exclusive), ordered by timestamp
+// With limit > 0 only the oldest limit updates are returned
+func (s *Store) ScanUpdatedKeys(shardID int, since int64, limit int) ([]util.Record, int64, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if since < s.watermarks[shardID] {
+		return nil, since, false, store.ErrChangesTrimmed
+	}
+
+	entries, more := s.changeLog(shardID).after(since, limit)
+
+	var updates []util.Record
+	for _, entry := range entries {
+		key := entry.key
+		var vv store.VersionedValue
+		found, err := s.get(key, &vv)
+		if err != nil {
+			fmt.Printf("Error decoding key %s: %v\n", key, err)
+			continue
+		}
+		if !found || vv.Timestamp <= since {
+			continue
+		}
+		updates = append(updates, util.Record{
+			Key:       key,
+			Value:     vv.Value,
+			Timestamp: vv.Timestamp,
+			Deleted:   vv.Deleted,
+			Epoch:     vv.Epoch,
+			Prev:      vv.Prev,
+			Txn:       vv.Txn,
+			ExpiresAt: vv.ExpiresAt,
+		})
+	}
+
+	upTo := since
+	if len(entries) > 0 {
+		upTo = entries[len(entries)-1].ts
+	}
+	return updates, upTo, more, nil
+}
+
+// TrimChangeLog drops all change index entries of the shard with a timestamp <= before
+func (s *Store) TrimChangeLog(shardID int, before int64) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	removed, trimmedTS := s.changeLog(shardID).trim(before)
+	s.raiseWatermark(shardID, trimmedTS)
+	return removed, nil
+}
+
+// PurgeTombstones physically removes the tombstones of the shard with a timestamp <= upTo
+// The caller has to make sure that every node replicating the shard has seen them.
+// Tombstones above the retention horizon are kept, reads "as of" before them still need the older versions of their key.
+func (s *Store) PurgeTombstones(shard *util.Shard, upTo int64) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if horizon := s.retention.Horizon(); upTo > horizon {
+		upTo = horizon
+	}
+
+	purged := 0
+	for key, ts := range s.tombstones {
+		if ts > upTo {
+			continue
+		}
+		position, err := util.KeyPosition(key)
+		if err != nil || position < shard.RangeStart || position > shard.RangeEnd {
+			continue
+		}
+
+		delete(s.data, key)
+		delete(s.versions, key)
+		delete(s.tombstones, key)
+		s.changeLog(shard.ShardId).remove(key)
+		purged++
+
+		// The purged deletes can't be replicated anymore, so a secondary that is further behind has to resync
+		s.raiseWatermark(shard.ShardId, ts)
+	}
+	return purged, nil
+}
+
+// Change index of the shard, created on first use (must hold s.mu)
+func (s *Store) changeLog(shardID int) *changeLog {
+	log, ok := s.changes[shardID]
+	if !ok {
+		log = &changeLog{latest: make(map[string]int64)}
+		s.changes[shardID] = log
+	}
+	return log
+}
+
+// must hold s.mu
+func (s *Store) raiseWatermark(shardID int, ts int64) {
+	if ts > s.watermarks[shardID] {
+		s.watermarks[shardID] = ts
+	}
+}
+
+// ScanShard calls fn for every stored record (including tombstones) whose key position is in [startKey, endKey]
+// The records are copied first, so fn is free to use the store
+func (s *Store) ScanShard(startKey int, endKey int, fn func(util.Record) error) error {
+	var records []util.Record
+
+	s.mu.Lock()
+	for key := range s.data {
+		position, err := util.KeyPosition(key)
+		if err != nil || position < startKey || position > endKey {
+			continue
+		}
+		var vv store.VersionedValue
+		if _, err := s.get(key, &vv); err != nil {
+			s.mu.Unlock()
+			return err
+		}
+		records = append(records, util.Record{
+			Key:       key,
+			Value:     vv.Value,
+			Timestamp: vv.Timestamp,
+			Deleted:   vv.Deleted,
+			Epoch:     vv.Epoch,
+			Prev:      vv.Prev,
+			Txn:       vv.Txn,
+			ExpiresAt: vv.ExpiresAt,
+		})
+	}
+	s.mu.Unlock()
+
+	for _, rec := range records {
+		if err := fn(rec); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Store) FlushAll() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.reset()
+	return nil
+}
+
+// Close is a no-op, there is nothing to release
+func (s *Store) Close() error {
+	return nil
+}
+
+// Change index of a shard: the writes in timestamp order, so a page is read from where the previous one stopped
+// A key written again keeps its older entries until they are trimmed, they are skipped since latest has moved on
+type changeLog struct {
+	entries []changeEntry
+	latest  map[string]int64	// key -> timestamp of its last write
+}
+
+type changeEntry struct {
+	ts  int64
+	key string
+}
+
+func (l *changeLog) add(k string, ts int64) {
+	// Timestamps are issued in order under the lock of the store, so this is an append (insert otherwise)
+	i := len(l.entries)
+	if i > 0 && l.entries[i-1].ts > ts {
+		i = sort.Search(len(l.entries), func(j int) bool { return l.entries[j].ts > ts })
+	}
+	l.entries = append(l.entries, changeEntry{})
+	copy(l.entries[i+1:], l.entries[i:])
+	l.entries[i] = changeEntry{ts: ts, key: k}
+	l.latest[k] = ts
+
+	// Drop the skipped entries once they outnumber the live ones
+	if len(l.entries) > 2*len(l.latest)+64 {
+		l.compact()
+	}
+}
+
+func (l *changeLog) remove(k string) {
+	delete(l.latest, k)
+}
+
+func (l *changeLog) live(entry changeEntry) bool {
+	ts, ok := l.latest[entry.key]
+	return ok && ts == entry.ts
+}
+
+// Live entries with a timestamp > since (at most limit of them if limit > 0), and whether there are more after them
+func (l *changeLog) after(since int64, limit int) ([]changeEntry, bool) {
+	start := sort.Search(len(l.entries), func(i int) bool { return l.entries[i].ts > since })
+
+	var entries []changeEntry
+	for _, entry := range l.entries[start:] {
+		if !l.live(entry) {
+			continue
+		}
+		if limit > 0 && len(entries) == limit {
+			return entries, true
+		}
+		entries = append(entries, entry)
+	}
+	return entries, false
+}
+
+// Drops the entries with a timestamp <= before, returns how many live ones were dropped and the highest dropped timestamp
+func (l *changeLog) trim(before int64) (int64, int64) {
+	end := sort.Search(len(l.entries), func(i int) bool { return l.entries[i].ts > before })
+
+	var removed, highest int64
+	for _, entry := range l.entries[:end] {
+		if !l.live(entry) {
+			continue
+		}
+		delete(l.latest, entry.key)
+		removed++
+		highest = entry.ts
+	}
+	l.entries = append([]changeEntry(nil), l.entries[end:]...)
+	return removed, highest
+}
+
+func (l *changeLog) compact() {
+	entries := make([]changeEntry, 0, len(l.latest))
+	for _, entry := range l.entries {
+		if l.live(entry) {
+			entries = append(entries, entry)
+		}
+	}
+	l.entries = entries
+}
@@ -0,0 +1,306 @@
+package memory
+
+import (
+	"sort"
+	"testing"
+	"time"
+
+	"pileus/store"
+	"pileus/util"
+)
+
+// Store that is primary for shard 0 ([0, 1000])
+func newTestStore(t *testing.T) *Store {
+	t.Helper()
+	shards := util.NewShardSet()
+	shards.Put(&util.Shard{ShardId: 0, RangeStart: 0, RangeEnd: 1000})
+	s, err := NewStore(Options{Shards: shards})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func set(t *testing.T, s *Store, key string, value any) int64 {
+	t.Helper()
+	ts, err := s.Set(key, value)
+	if err != nil {
+		t.Fatalf("Set(%s): %v", key, err)
+	}
+	return ts
+}
+
+func scanKeys(t *testing.T, s *Store, since int64) []string {
+	t.Helper()
+	updates, _, _, err := s.ScanUpdatedKeys(0, since, 0)
+	if err != nil {
+		t.Fatalf("ScanUpdatedKeys(%d): %v", since, err)
+	}
+	var keys []string
+	for _, update := range updates {
+		keys = append(keys, update.Key)
+	}
+	return keys
+}
+
+func equalKeys(got []string, want []string) bool {
+	if len(got) != len(want) {
+		return false
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestSetAndGetKeepTheTimestamp(t *testing.T) {
+	s := newTestStore(t)
+	ts := set(t, s, "key1", "a")
+
+	var vv store.VersionedValue
+	found, err := s.Get("key1", &vv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !found || vv.Value != "a" || vv.Timestamp != ts {
+		t.Errorf("Get(key1) = %+v (found: %v), want a@%d", vv, found, ts)
+	}
+
+	if found, err := s.Get("key2", &vv); found || err != nil {
+		t.Errorf("Get of a missing key = (%v, %v), want (false, nil)", found, err)
+	}
+	if _, err := s.Set("key1001", "a"); err == nil {
+		t.Error("Set of a key outside of [0, 1000] succeeded")
+	}
+}
+
+func TestScanUpdatedKeysIsOrderedAndExclusive(t *testing.T) {
+	s := newTestStore(t)
+	first := set(t, s, "key3", "a")
+	set(t, s, "key1", "b")
+	set(t, s, "key2", "c")
+	last := set(t, s, "key3", "d")
+
+	if got := scanKeys(t, s, 0); !equalKeys(got, []string{"key1", "key2", "key3"}) {
+		t.Errorf("updates since 0 = %v, want key3 after its rewrite", got)
+	}
+	if got := scanKeys(t, s, first); !equalKeys(got, []string{"key1", "key2", "key3"}) {
+		t.Errorf("updates since the first write = %v", got)
+	}
+	if got := scanKeys(t, s, last); len(got) != 0 {
+		t.Errorf("updates since the last write = %v, want none", got)
+	}
+}
+
+func TestScanUpdatedKeysPagesThroughTheChangeIndex(t *testing.T) {
+	s := newTestStore(t)
+	set(t, s, "key1", "a")
+	second := set(t, s, "key2", "b")
+	set(t, s, "key3", "c")
+	set(t, s, "key1", "d")
+	last := set(t, s, "key4", "e")
+
+	updates, upTo, more, err := s.ScanUpdatedKeys(0, 0, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(updates) != 2 || updates[0].Key != "key2" || updates[1].Key != "key3" || !more {
+		t.Fatalf("first page = %v (more: %v), want key2 and key3 with more (key1 was rewritten)", updates, more)
+	}
+	if upTo != updates[1].Timestamp || upTo <= second {
+		t.Errorf("first page upTo = %d, want the timestamp of key3", upTo)
+	}
+
+	updates, upTo, more, err = s.ScanUpdatedKeys(0, upTo, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(updates) != 2 || updates[0].Key != "key1" || updates[1].Key != "key4" || more {
+		t.Fatalf("second page = %v (more: %v), want key1 and key4 without more", updates, more)
+	}
+	if upTo != last {
+		t.Errorf("second page upTo = %d, want %d", upTo, last)
+	}
+
+	updates, upTo, more, err = s.ScanUpdatedKeys(0, last, 2)
+	if err != nil || len(updates) != 0 || upTo != last || more {
+		t.Errorf("page after the last write = (%v, %d, %v, %v), want an empty page up to %d", updates, upTo, more, err, last)
+	}
+}
+
+func TestTrimChangeLogReportsTheTrimmedRange(t *testing.T) {
+	s := newTestStore(t)
+	first := set(t, s, "key1", "a")
+	second := set(t, s, "key2", "b")
+	set(t, s, "key3", "c")
+
+	removed, err := s.TrimChangeLog(0, second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 2 {
+		t.Errorf("trimmed %d entries, want 2", removed)
+	}
+	if _, _, _, err := s.ScanUpdatedKeys(0, first, 0); err != store.ErrChangesTrimmed {
+		t.Errorf("ScanUpdatedKeys behind the trim = %v, want ErrChangesTrimmed", err)
+	}
+	if got := scanKeys(t, s, second); !equalKeys(got, []string{"key3"}) {
+		t.Errorf("updates after the trim point = %v", got)
+	}
+}
+
+func TestSetIfVersionRejectsAStaleVersion(t *testing.T) {
+	s := newTestStore(t)
+	created, err := s.SetIfVersion("key1", "a", 0)
+	if err != nil {
+		t.Fatalf("SetIfVersion of a missing key: %v", err)
+	}
+	updated, err := s.SetIfVersion("key1", "b", created)
+	if err != nil {
+		t.Fatalf("SetIfVersion over the current version: %v", err)
+	}
+
+	current, err := s.SetIfVersion("key1", "c", created)
+	if err != store.ErrVersionConflict || current != updated {
+		t.Errorf("SetIfVersion over a stale version = (%d, %v), want (%d, ErrVersionConflict)", current, err, updated)
+	}
+}
+
+func TestPurgeTombstonesOfTheShard(t *testing.T) {
+	s := newTestStore(t)
+	// No reads as of the past, so the tombstones can be purged once the clock moved past them
+	s.retention.MaxAge = 0
+	set(t, s, "key1", "a")
+	deletedAt, err := s.Tombstone("key1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	laterDelete, err := s.Tombstone("key2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Replicated tombstone of another shard
+	if err := s.SetVersioned("key2000", store.VersionedValue{Deleted: true, Timestamp: 1}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(2 * time.Millisecond)
+
+	shard, _ := s.Shards.Get(0)
+	purged, err := s.PurgeTombstones(shard, deletedAt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if purged != 1 {
+		t.Errorf("purged %d tombstones, want 1", purged)
+	}
+
+	var vv store.VersionedValue
+	if found, _ := s.Get("key1", &vv); found {
+		t.Errorf("purged key1 is still stored: %+v", vv)
+	}
+	if found, _ := s.Get("key2", &vv); !found || vv.Timestamp != laterDelete {
+		t.Errorf("tombstone of key2 = %+v (found: %v), want it kept", vv, found)
+	}
+	if found, _ := s.Get("key2000", &vv); !found {
+		t.Error("tombstone of another shard was purged")
+	}
+	if _, _, _, err := s.ScanUpdatedKeys(0, deletedAt-1, 0); err != store.ErrChangesTrimmed {
+		t.Errorf("ScanUpdatedKeys behind the purged tombstone = %v, want ErrChangesTrimmed", err)
+	}
+}
+
+func TestSetTxnWritesTheKeysOfOneShardTogether(t *testing.T) {
+	s := newTestStore(t)
+	ts, err := s.SetTxn(map[string]store.VersionedValue{"key1": {Value: "a"}, "key2": {Deleted: true}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	updates, _, _, err := s.ScanUpdatedKeys(0, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(updates) != 2 || updates[0].Timestamp != ts || updates[1].Timestamp != ts {
+		t.Fatalf("updates = %+v, want both keys at %d", updates, ts)
+	}
+	var vv store.VersionedValue
+	if found, _ := s.Get("key1", &vv); !found || len(vv.Txn) != 1 || vv.Txn[0] != "key2" {
+		t.Errorf("key1 = %+v, want it to name key2 as the other key of the transaction", vv)
+	}
+
+	// Keys of another shard fail the whole transaction
+	if _, err := s.SetTxn(map[string]store.VersionedValue{"key3": {Value: "c"}, "key2000": {Value: "d"}}); err == nil {
+		t.Error("SetTxn with a key outside of the shard succeeded")
+	}
+	if found, _ := s.Get("key3", &vv); found {
+		t.Errorf("key3 of the failed transaction was written: %+v", vv)
+	}
+}
+
+func TestScanShardCanWriteToTheStore(t *testing.T) {
+	s := newTestStore(t)
+	set(t, s, "key1", "a")
+	set(t, s, "key500", "b")
+	set(t, s, "key1000", "c")
+
+	// fn runs without the lock, so a resync can apply what it scans
+	var keys []string
+	err := s.ScanShard(1, 999, func(rec util.Record) error {
+		keys = append(keys, rec.Key)
+		return s.SetVersioned(rec.Key, store.VersionedValue{Value: rec.Value, Timestamp: rec.Timestamp})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(keys)
+	if !equalKeys(keys, []string{"key1", "key500"}) {
+		t.Errorf("ScanShard(1, 999) visited %v", keys)
+	}
+}
+
+func TestSetVersionedMovesTheClockPastTheReplicatedTimestamp(t *testing.T) {
+	s := newTestStore(t)
+	own := set(t, s, "key1", "a")
+
+	replicated := own + 1<<30
+	if err := s.SetVersioned("key2", store.VersionedValue{Value: "b", Timestamp: replicated}); err != nil {
+		t.Fatal(err)
+	}
+	if next := set(t, s, "key3", "c"); next <= replicated {
+		t.Errorf("write after a replicated record got timestamp %d, want > %d", next, replicated)
+	}
+}
+
+func TestSetReplicatedKeepsTheNewerVersionAndRaisesHighTS(t *testing.T) {
+	s := newTestStore(t)
+
+	if err := s.SetReplicated(1, "key2000", store.VersionedValue{Value: "new", Timestamp: 20}); err != nil {
+		t.Fatal(err)
+	}
+	// A late, older version of the key (e.g. a pull that overlaps a push) does not overwrite it
+	if err := s.SetReplicated(1, "key2000", store.VersionedValue{Value: "old", Timestamp: 10}); err != nil {
+		t.Fatal(err)
+	}
+
+	var vv store.VersionedValue
+	if _, err := s.Get("key2000", &vv); err != nil {
+		t.Fatal(err)
+	}
+	if vv.Value != "new" || vv.Timestamp != 20 {
+		t.Errorf("stored %+v, want new@20", vv)
+	}
+	if highTS, _ := s.LoadHighTS(1); highTS != 20 {
+		t.Errorf("HighTS of shard 1 = %d, want 20", highTS)
+	}
+
+	// Primary writes raise the HighTS of their own shard, SaveHighTS never lowers it
+	ts := set(t, s, "key1", "a")
+	if err := s.SaveHighTS(0, ts-1); err != nil {
+		t.Fatal(err)
+	}
+	if highTS, _ := s.LoadHighTS(0); highTS != ts {
+		t.Errorf("HighTS of shard 0 = %d, want %d", highTS, ts)
+	}
+}
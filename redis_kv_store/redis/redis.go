@@ -3,94 +3,519 @@ package redis
 import (
 	"fmt"
 	"context"
+	"strconv"
+	"sync"
 	"time"
 	"github.com/redis/go-redis/v9"
 	"pileus/encoding"
+	"pileus/hlc"
+	"pileus/store"
 	"pileus/util"
 )
 
-// For incoming (k,v) pairs, we also store the timestamp/version
-type VersionedValue struct {
-	Value     any    `json:"value"`
-	Timestamp int64 `json:"timestamp"`
-}
+// The stored records and the errors are shared by all store backends
+type VersionedValue = store.VersionedValue
 
 var defaultTimeout = 2 * time.Second
 
+var ErrChangesTrimmed = store.ErrChangesTrimmed
+var ErrVersionConflict = store.ErrVersionConflict
+var ErrVersionTrimmed = store.ErrVersionTrimmed
+
+// Client satisfies the store.Store interface
+var _ store.Store = (*Client)(nil)
+
+// Internal keys are prefixed so they never collide with client keys
+const internalKeyPrefix = "__pileus:"
+
+// Per-shard sorted set of (member = key, score = object timestamp), written together with every Set
+// Since a member is unique, a key that is written several times only keeps its latest timestamp in the index
+func changeIndexKey(shardID int) string {
+	return fmt.Sprintf("%schanges:%d", internalKeyPrefix, shardID)
+}
+
+// Highest timestamp that has been trimmed from the change index of the shard
+func changeWatermarkKey(shardID int) string {
+	return fmt.Sprintf("%schanges_trimmed:%d", internalKeyPrefix, shardID)
+}
+
+// Older versions of a key (encoded []VersionedValue ordered by timestamp), written together with the key
+func versionsKey(k string) string {
+	return internalKeyPrefix + "versions:" + k
+}
+
+// Node-wide sorted set of (member = key, score = timestamp) of the tombstones that are still stored
+var tombstoneIndexKey = internalKeyPrefix + "tombstones"
+
+// Node-wide sorted set of (member = key, score = key position) of every stored key, so a shard is scanned by its range
+var positionIndexKey = internalKeyPrefix + "positions"
+
+// Keys of a shard read per round trip by ScanShard
+const scanPageSize = 1000
+
+// Attempts of a WATCH transaction, it is run again while a watched key is written meanwhile
+const maxTxAttempts = 16
+
+// Persisted HighTS of the shard
+func highTSKey(shardID int) string {
+	return fmt.Sprintf("%shights:%d", internalKeyPrefix, shardID)
+}
+
+// Raises the value of KEYS[1] (e.g. a trim watermark or a HighTS) to ARGV[1] if it is higher
+var raiseScript = redis.NewScript(`
+local current = redis.call('GET', KEYS[1])
+if (not current) or tonumber(ARGV[1]) > tonumber(current) then
+	redis.call('SET', KEYS[1], ARGV[1])
+	return 1
+end
+return 0
+`)
+
+// Removes all entries with score <= ARGV[1] and moves the trim watermark up to the highest removed score
+// Scores are passed back as the strings redis returned, so no precision is lost in lua
+var trimChangeIndexScript = redis.NewScript(`
+local top = redis.call('ZREVRANGEBYSCORE', KEYS[1], ARGV[1], '-inf', 'WITHSCORES', 'LIMIT', 0, 1)
+if #top == 0 then
+	return 0
+end
+local removed = redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', ARGV[1])
+local current = redis.call('GET', KEYS[2])
+if (not current) or tonumber(top[2]) > tonumber(current) then
+	redis.call('SET', KEYS[2], top[2])
+end
+return removed
+`)
+
 // Client is a gokv.Store implementation for Redis.
-// NOTE: for now assuming that a storage node is primary for only 1 shard
+// Shards holds the shards (by id) that the storage node is primary for, writes outside of them are rejected
 type Client struct {
-	c       *redis.Client
-	timeOut time.Duration
-	codec   encoding.Codec
-	ShardRangeStart int
-	ShardRangeEnd   int
+	c         *redis.Client
+	timeOut   time.Duration
+	retention store.Retention
+	codec     encoding.Codec
+	clock   *hlc.Clock
+	Shards  *util.ShardSet
+	writeLocks *shardLocks
+}
+
+// The writes of a shard hold its lock from issuing their timestamp until they are committed, so they commit in timestamp order
+// (like the writes of the memory and bolt stores). A scan of the change index then never sees a write without the older ones
+// of its shard, and the HighTS (raised once a write is committed) only covers writes that are stored.
+type shardLocks struct {
+	mu    sync.Mutex
+	locks map[int]*sync.Mutex
+}
+
+// Locks the shard and returns the unlock
+func (l *shardLocks) lock(shardID int) func() {
+	l.mu.Lock()
+	lock, ok := l.locks[shardID]
+	if !ok {
+		lock = &sync.Mutex{}
+		l.locks[shardID] = lock
+	}
+	l.mu.Unlock()
+
+	lock.Lock()
+	return lock.Unlock
 }
 
 // Set stores the given value for the given key.(The key must not be "" and the value must not be nil.)
 // Values are automatically marshalled to JSON or gob (depending on the configuration).
 // It also checks weather the node is the primary for the given key
+// The key is added to the change index of the shard in the same transaction, so replication never misses it
 
 // Returns: object timestamp + any errors
-func (c Client) Set(k string, v any) (obj_ts int64, err error) {
+func (c *Client) Set(k string, v any) (obj_ts int64, err error) {
 	if err := util.CheckKeyAndValue(k, v); err != nil {
 		return -1, err
 	}
+	return c.write(k, VersionedValue{Value: v}, nil)
+}
+
+// SetIfVersion stores the value only if the current object timestamp of the key equals expectedTS (compare-and-set)
+// A missing key has timestamp 0 (preloaded keys have -1, deleted keys the timestamp of their tombstone).
+// Returns: new object timestamp, or the current one together with ErrVersionConflict
+func (c *Client) SetIfVersion(k string, v any, expectedTS int64) (obj_ts int64, err error) {
+	if err := util.CheckKeyAndValue(k, v); err != nil {
+		return -1, err
+	}
+	return c.write(k, VersionedValue{Value: v}, &expectedTS)
+}
 
+// SetExpiring stores the value with an absolute expiry, compare-and-set on the object timestamp if expectedTS is given
+// The key is not expired by redis itself: every node decides on the timestamp of the read (see VersionedValue.Expired)
+func (c *Client) SetExpiring(k string, v any, expiresAt int64, expectedTS *int64) (obj_ts int64, err error) {
+	if err := util.CheckKeyAndValue(k, v); err != nil {
+		return -1, err
+	}
+	return c.write(k, VersionedValue{Value: v, ExpiresAt: expiresAt}, expectedTS)
+}
+
+// Tombstone deletes the key on the primary by storing a timestamped tombstone instead of the value
+// The tombstone is replicated like any write, and purged later (see PurgeTombstones)
+// Returns: tombstone timestamp + any errors
+func (c *Client) Tombstone(k string) (obj_ts int64, err error) {
+	if err := util.CheckKey(k); err != nil {
+		return -1, err
+	}
+	return c.write(k, VersionedValue{Deleted: true}, nil)
+}
+
+// Stamps the record with a new timestamp and stores it, for keys of the shards the node is primary for
+// The key is always watched (the version it replaces is kept), with expectedTS it is only written if its current timestamp matches
+func (c *Client) write(k string, record VersionedValue, expectedTS *int64) (int64, error) {
 	// Check if the node is primary for the given key
-	numericKey, err := util.KeyToInt(k)
+	position, err := util.KeyPosition(k)
 	if err != nil {
-		return -1, fmt.Errorf("invalid key format: %v", err)
+		return -1, err
 	}
 
-	if numericKey < c.ShardRangeStart || numericKey > c.ShardRangeEnd {
-		return -1, fmt.Errorf("key '%s' with numeric value %d is out of shard range [%d, %d]",
-			k, numericKey, c.ShardRangeStart, c.ShardRangeEnd)
+	shard := c.Shards.ForKey(k)
+	if shard == nil {
+		return -1, fmt.Errorf("key '%s' at position %d is out of the ranges of the %d shards this node is primary for",
+			k, position, c.Shards.Len())
 	}
+	record.Epoch = shard.Epoch
+
+	defer c.writeLocks.lock(shard.ShardId)()
+
+	tctx, cancel := context.WithTimeout(context.Background(), c.timeOut)
+	defer cancel()
+
+	// The key and its older versions are watched, so the MULTI fails if the key is written between the read and the store
+	// (by a store of records as they are, e.g. a preload: the writes of the shard are serialized)
+	var currentTS int64
+	for attempt := 1; ; attempt++ {
+		err = c.c.Watch(tctx, func(tx *redis.Tx) error {
+			current, older, err := c.readVersions(tctx, tx, k)
+			if err != nil {
+				return err
+			}
+			currentTS = 0
+			if current != nil {
+				currentTS = current.Timestamp
+			}
+			if expectedTS != nil && currentTS != *expectedTS {
+				return ErrVersionConflict
+			}
+			prev := currentTS
+			record.Prev = &prev
+
+			ts, err := c.clock.Now()
+			if err != nil {
+				return fmt.Errorf("failed to issue a timestamp: %v", err)
+			}
+			record.Timestamp = ts
+
+			// fmt.Println("The data being set has the timestamp %d\n",record.Timestamp)
+
+			// Stores the record + its older versions and indexes it, all in one MULTI
+			_, err = tx.TxPipelined(tctx, func(pipe redis.Pipeliner) error {
+				if err := c.queuePut(tctx, pipe, k, record, current, older); err != nil {
+					return err
+				}
+				pipe.ZAdd(tctx, changeIndexKey(shard.ShardId), redis.Z{Score: float64(record.Timestamp), Member: k})
+				// The HighTS is only ever raised, like the HighTS of the shard
+				raiseScript.Eval(tctx, pipe, []string{highTSKey(shard.ShardId)}, record.Timestamp)
+				return nil
+			})
+			return err
+		}, k, versionsKey(k))
 
-	record := VersionedValue{
-		Value: v,
-		Timestamp: time.Now().UTC().UnixNano() / int64(time.Millisecond),
+		// Someone else wrote the key meanwhile: a plain write goes on top of it
+		if err != redis.TxFailedErr || expectedTS != nil || attempt == maxTxAttempts {
+			break
+		}
 	}
 
-	// fmt.Println("The data being set has the timestamp %d\n",record.Timestamp)
+	// Compare-and-set reports the version they wrote
+	if err == redis.TxFailedErr && expectedTS != nil {
+		var current VersionedValue
+		if _, err := c.Get(k, &current); err != nil {
+			return -1, err
+		}
+		return current.Timestamp, ErrVersionConflict
+	}
+	if err == ErrVersionConflict {
+		return currentTS, err
+	}
+	if err == redis.TxFailedErr {
+		return -1, fmt.Errorf("key '%s' kept being written meanwhile, gave up after %d attempts", k, maxTxAttempts)
+	}
+	if err != nil {
+		return -1, err
+	}
+	return record.Timestamp, nil
+}
 
-	data, err := c.codec.Marshal(record)
+// SetTxn writes several keys of one shard with a single timestamp, in one MULTI
+// All keys (and their older versions) are watched, the whole transaction is retried if one of them is written meanwhile
+func (c *Client) SetTxn(writes map[string]VersionedValue) (int64, error) {
+	shard, err := store.TxnShard(c.Shards, writes)
 	if err != nil {
 		return -1, err
 	}
 
+	defer c.writeLocks.lock(shard.ShardId)()
+
 	tctx, cancel := context.WithTimeout(context.Background(), c.timeOut)
 	defer cancel()
 
-	err = c.c.Set(tctx, k, string(data), 0).Err()
+	watched := make([]string, 0, 2*len(writes))
+	for k := range writes {
+		watched = append(watched, k, versionsKey(k))
+	}
+
+	// Retried as a whole while one of the keys is written meanwhile
+	var ts int64
+	for attempt := 1; attempt <= maxTxAttempts; attempt++ {
+		err = c.c.Watch(tctx, func(tx *redis.Tx) error {
+			currents := make(map[string]*VersionedValue, len(writes))
+			olders := make(map[string][]VersionedValue, len(writes))
+			for k := range writes {
+				current, older, err := c.readVersions(tctx, tx, k)
+				if err != nil {
+					return err
+				}
+				currents[k] = current
+				olders[k] = older
+			}
+
+			now, err := c.clock.Now()
+			if err != nil {
+				return fmt.Errorf("failed to issue a timestamp: %v", err)
+			}
+			ts = now
+
+			_, err = tx.TxPipelined(tctx, func(pipe redis.Pipeliner) error {
+				for k, record := range store.StampTxn(writes, ts, shard.Epoch) {
+					var prev int64
+					if currents[k] != nil {
+						prev = currents[k].Timestamp
+					}
+					record.Prev = &prev
+
+					if err := c.queuePut(tctx, pipe, k, record, currents[k], olders[k]); err != nil {
+						return err
+					}
+					pipe.ZAdd(tctx, changeIndexKey(shard.ShardId), redis.Z{Score: float64(ts), Member: k})
+				}
+				raiseScript.Eval(tctx, pipe, []string{highTSKey(shard.ShardId)}, ts)
+				return nil
+			})
+			return err
+		}, watched...)
+		if err != redis.TxFailedErr {
+			break
+		}
+	}
+	if err == redis.TxFailedErr {
+		return -1, fmt.Errorf("the %d keys kept being written meanwhile, gave up after %d attempts", len(writes), maxTxAttempts)
+	}
 	if err != nil {
 		return -1, err
 	}
-	return record.Timestamp, nil
+	return ts, nil
 }
 
-// This function is only called during the replication phase, where secondaries pull data from primaries
-// NOTE: Here we don't check the key range constraints anymore, because this is only callled by secondary storage nodes (the inital puts from clients, do not hit this function)
-func (c Client) SetVersioned(k string, vv VersionedValue) error {
-	if err := util.CheckKey(k); err != nil {
-		return err
+// Reads the current version (nil if missing) and the older versions of the key, in a WATCH transaction
+func (c *Client) readVersions(ctx context.Context, tx *redis.Tx, k string) (*VersionedValue, []VersionedValue, error) {
+	results, err := tx.MGet(ctx, k, versionsKey(k)).Result()
+	if err != nil {
+		return nil, nil, err
 	}
+	return c.decodeVersions(results)
+}
 
+// Decodes the MGET results of the key and its older versions
+func (c *Client) decodeVersions(results []any) (*VersionedValue, []VersionedValue, error) {
+	var current *VersionedValue
+	if dataString, ok := results[0].(string); ok {
+		current = &VersionedValue{}
+		if err := c.codec.Unmarshal([]byte(dataString), current); err != nil {
+			return nil, nil, err
+		}
+	}
+	var older []VersionedValue
+	if dataString, ok := results[1].(string); ok {
+		if err := c.codec.Unmarshal([]byte(dataString), &older); err != nil {
+			return nil, nil, err
+		}
+	}
+	return current, older, nil
+}
+
+// Queues the commands storing vv as the current version of the key, the replaced version (current) joins its older versions
+// Replicated tombstones are tracked too, so the secondary can purge them later
+func (c *Client) queuePut(ctx context.Context, pipe redis.Pipeliner, k string, vv VersionedValue, current *VersionedValue, older []VersionedValue) error {
 	data, err := c.codec.Marshal(vv)
 	if err != nil {
 		return err
 	}
+	pipe.Set(ctx, k, string(data), 0)
+
+	older = c.retention.Retain(older, current, vv)
+	if len(older) == 0 {
+		pipe.Del(ctx, versionsKey(k))
+	} else {
+		olderData, err := c.codec.Marshal(older)
+		if err != nil {
+			return err
+		}
+		pipe.Set(ctx, versionsKey(k), string(olderData), 0)
+	}
+
+	if vv.Deleted {
+		pipe.ZAdd(ctx, tombstoneIndexKey, redis.Z{Score: float64(vv.Timestamp), Member: k})
+	}
+	if position, err := util.KeyPosition(k); err == nil {
+		pipe.ZAdd(ctx, positionIndexKey, redis.Z{Score: float64(position), Member: k})
+	}
+	return nil
+}
+
+// This function stores records as they are: preloaded keys, and shard snapshots copied by secondaries from primaries
+// (the updates pulled/streamed afterwards go through SetReplicated)
+// NOTE: Here we don't check the key range constraints anymore, because the inital puts from clients do not hit this function
+// The clock observes the replicated timestamp, so if this node ever issues timestamps they are above it
+func (c *Client) SetVersioned(k string, vv VersionedValue) error {
+	if err := util.CheckKey(k); err != nil {
+		return err
+	}
+	c.clock.Update(vv.Timestamp)
 
 	tctx, cancel := context.WithTimeout(context.Background(), c.timeOut)
 	defer cancel()
 
-	return c.c.Set(tctx, k, string(data), 0).Err()
+	// Another snapshot record (or a preload) of the key may come in between, this one is stored on top of it
+	var err error
+	for attempt := 1; attempt <= maxTxAttempts; attempt++ {
+		err = c.c.Watch(tctx, func(tx *redis.Tx) error {
+			current, older, err := c.readVersions(tctx, tx, k)
+			if err != nil {
+				return err
+			}
+			_, err = tx.TxPipelined(tctx, func(pipe redis.Pipeliner) error {
+				return c.queuePut(tctx, pipe, k, vv, current, older)
+			})
+			return err
+		}, k, versionsKey(k))
+		if err != redis.TxFailedErr {
+			return err
+		}
+	}
+	return fmt.Errorf("key '%s' kept being written meanwhile, gave up after %d attempts", k, maxTxAttempts)
+}
+
+// SetReplicated stores a record pulled (or streamed) from the primary of the shard, together with the new HighTS
+// Updates may be delivered again or after a newer one, so a record that is not newer than the stored one is skipped
+// (the HighTS is still raised, since the update was received)
+func (c *Client) SetReplicated(shardID int, k string, vv VersionedValue) error {
+	if err := util.CheckKey(k); err != nil {
+		return err
+	}
+	c.clock.Update(vv.Timestamp)
+
+	tctx, cancel := context.WithTimeout(context.Background(), c.timeOut)
+	defer cancel()
+
+	// Only the primary writes the key, so a concurrent write is the same update delivered twice
+	var err error
+	for attempt := 1; attempt <= maxTxAttempts; attempt++ {
+		err = c.c.Watch(tctx, func(tx *redis.Tx) error {
+			current, older, err := c.readVersions(tctx, tx, k)
+			if err != nil {
+				return err
+			}
+			newer := current == nil || current.Timestamp < vv.Timestamp
+
+			_, err = tx.TxPipelined(tctx, func(pipe redis.Pipeliner) error {
+				if newer {
+					if err := c.queuePut(tctx, pipe, k, vv, current, older); err != nil {
+						return err
+					}
+				}
+				raiseScript.Eval(tctx, pipe, []string{highTSKey(shardID)}, vv.Timestamp)
+				return nil
+			})
+			return err
+		}, k, versionsKey(k))
+		if err != redis.TxFailedErr {
+			return err
+		}
+	}
+	return fmt.Errorf("key '%s' kept being written meanwhile, gave up after %d attempts", k, maxTxAttempts)
+}
+
+// SetReplicatedTxn stores the records of a replicated transaction (the ones that are newer) in one MULTI, so readers see all or none of them
+func (c *Client) SetReplicatedTxn(shardID int, records map[string]VersionedValue) error {
+	watched := make([]string, 0, 2*len(records))
+	for k, vv := range records {
+		if err := util.CheckKey(k); err != nil {
+			return err
+		}
+		c.clock.Update(vv.Timestamp)
+		watched = append(watched, k, versionsKey(k))
+	}
+
+	tctx, cancel := context.WithTimeout(context.Background(), c.timeOut)
+	defer cancel()
+
+	// Only the primary writes the keys, so a concurrent write is an update delivered twice
+	var err error
+	for attempt := 1; attempt <= maxTxAttempts; attempt++ {
+		err = c.c.Watch(tctx, func(tx *redis.Tx) error {
+			currents := make(map[string]*VersionedValue, len(records))
+			olders := make(map[string][]VersionedValue, len(records))
+			for k := range records {
+				current, older, err := c.readVersions(tctx, tx, k)
+				if err != nil {
+					return err
+				}
+				currents[k] = current
+				olders[k] = older
+			}
+
+			_, err := tx.TxPipelined(tctx, func(pipe redis.Pipeliner) error {
+				for k, vv := range records {
+					if currents[k] == nil || currents[k].Timestamp < vv.Timestamp {
+						if err := c.queuePut(tctx, pipe, k, vv, currents[k], olders[k]); err != nil {
+							return err
+						}
+					}
+					raiseScript.Eval(tctx, pipe, []string{highTSKey(shardID)}, vv.Timestamp)
+				}
+				return nil
+			})
+			return err
+		}, watched...)
+		if err != redis.TxFailedErr {
+			return err
+		}
+	}
+	return fmt.Errorf("the %d keys kept being written meanwhile, gave up after %d attempts", len(records), maxTxAttempts)
+}
+
+// LoadHighTS returns the persisted HighTS of the shard (0 if none)
+func (c *Client) LoadHighTS(shardID int) (int64, error) {
+	tctx, cancel := context.WithTimeout(context.Background(), c.timeOut)
+	defer cancel()
+
+	return parseScore(c.c.Get(tctx, highTSKey(shardID)))
+}
+
+// SaveHighTS raises the persisted HighTS of the shard to ts
+func (c *Client) SaveHighTS(shardID int, ts int64) error {
+	tctx, cancel := context.WithTimeout(context.Background(), c.timeOut)
+	defer cancel()
+
+	return raiseScript.Run(tctx, c.c, []string{highTSKey(shardID)}, ts).Err()
 }
 
 // Get retrieves the stored value for the given key. If no value is found it returns (false, nil).
 // Get should also return: High TS of the node, and the timestamp of the object as well
-func (c Client) Get(k string, v any) (found bool, err error) {
+func (c *Client) Get(k string, v any) (found bool, err error) {
 	if err := util.CheckKeyAndValue(k, v); err != nil {
 		return false, err
 	}
@@ -109,10 +534,67 @@ func (c Client) Get(k string, v any) (found bool, err error) {
 	return true, c.codec.Unmarshal([]byte(dataString), v)
 }
 
-// Delete deletes the stored value for the given key.
+// GetAt returns the version of the key as of timestamp at, the key and its older versions are read with a single MGET
+func (c *Client) GetAt(k string, at int64) (VersionedValue, bool, error) {
+	if err := util.CheckKey(k); err != nil {
+		return VersionedValue{}, false, err
+	}
+
+	tctx, cancel := context.WithTimeout(context.Background(), c.timeOut)
+	defer cancel()
+
+	results, err := c.c.MGet(tctx, k, versionsKey(k)).Result()
+	if err != nil {
+		return VersionedValue{}, false, err
+	}
+	current, older, err := c.decodeVersions(results)
+	if err != nil {
+		return VersionedValue{}, false, err
+	}
+	return c.retention.VersionAt(older, current, at)
+}
+
+// GetMulti retrieves the stored values of several keys with a single MGET.
+// Keys without a value are left out of the returned map.
+func (c *Client) GetMulti(keys []string) (map[string]VersionedValue, error) {
+	values := make(map[string]VersionedValue, len(keys))
+	if len(keys) == 0 {
+		return values, nil
+	}
+	for _, k := range keys {
+		if err := util.CheckKey(k); err != nil {
+			return nil, err
+		}
+	}
+
+	tctx, cancel := context.WithTimeout(context.Background(), c.timeOut)
+	defer cancel()
+
+	results, err := c.c.MGet(tctx, keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	for i, res := range results {
+		// MGET returns nil for missing keys
+		dataString, ok := res.(string)
+		if !ok {
+			continue
+		}
+		var vv VersionedValue
+		if err := c.codec.Unmarshal([]byte(dataString), &vv); err != nil {
+			return nil, err
+		}
+		values[keys[i]] = vv
+	}
+
+	return values, nil
+}
+
+// Delete deletes the stored value (and the older versions) for the given key.
 // Deleting a non-existing key-value pair does NOT lead to an error.
 // The key must not be "".
-func (c Client) Delete(k string) error {
+func (c *Client) Delete(k string) error {
 	if err := util.CheckKey(k); err != nil {
 		return err
 	}
@@ -120,76 +602,282 @@ func (c Client) Delete(k string) error {
 	tctx, cancel := context.WithTimeout(context.Background(), c.timeOut)
 	defer cancel()
 
-	_, err := c.c.Del(tctx, k).Result()
+	_, err := c.c.TxPipelined(tctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(tctx, k, versionsKey(k))
+		pipe.ZRem(tctx, positionIndexKey, k)
+		return nil
+	})
 	return err
 }
 
-// TODO: this should be more efficient
-func (c *Client) ScanUpdatedKeys(since time.Time, startKey int, endKey int) []util.Record {
-	var updates []util.Record
-
+// ScanUpdatedKeys returns the records (including tombstones) of the shard that were updated after "since" (exclusive), ordered by timestamp
+// Only the change index of the shard is read, so the cost is O(updates) instead of O(keyspace)
+// If the updates after "since" were already trimmed, ErrChangesTrimmed is returned
+// With limit > 0 at most limit entries of the index are read (one more is asked for, to tell whether there are more)
+// upTo is the score of the last index entry read, values written again after the index was read are left for the next scan
+func (c *Client) ScanUpdatedKeys(shardID int, since int64, limit int) ([]util.Record, int64, bool, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), c.timeOut)
 	defer cancel()
 
-	iter := c.c.Scan(ctx, 0, "*", 0).Iterator()
-	for iter.Next(ctx) {
-		key := iter.Val()
-
-		numericKey, err := util.KeyToInt(key)
-		if err != nil {
-			continue 
+	// Read the index and the trim watermark in one transaction, so a concurrent trim can't hide updates
+	var keysCmd *redis.ZSliceCmd
+	var watermarkCmd *redis.StringCmd
+	_, err := c.c.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		rangeBy := &redis.ZRangeBy{
+			Min: fmt.Sprintf("(%d", since),
+			Max: "+inf",
 		}
+		if limit > 0 {
+			rangeBy.Count = int64(limit + 1)
+		}
+		keysCmd = pipe.ZRangeByScoreWithScores(ctx, changeIndexKey(shardID), rangeBy)
+		watermarkCmd = pipe.Get(ctx, changeWatermarkKey(shardID))
+		return nil
+	})
+	if err != nil && err != redis.Nil {
+		return nil, since, false, err
+	}
+
+	watermark, err := parseScore(watermarkCmd)
+	if err != nil {
+		return nil, since, false, err
+	}
+	if since < watermark {
+		return nil, since, false, ErrChangesTrimmed
+	}
 
-		// Skip keys not in the shard range
-		if numericKey < startKey || numericKey >= endKey {
-			continue 
+	entries := keysCmd.Val()
+	more := false
+	if limit > 0 && len(entries) > limit {
+		entries = entries[:limit]
+		more = true
+	}
+	if len(entries) == 0 {
+		return nil, since, false, nil
+	}
+	upTo := int64(entries[len(entries)-1].Score)
+	keys := make([]string, len(entries))
+	for i, entry := range entries {
+		keys[i] = fmt.Sprint(entry.Member)
+	}
+
+	// Fetch the values of the updated keys in one round trip
+	getCmds := make([]*redis.StringCmd, len(keys))
+	_, err = c.c.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, key := range keys {
+			getCmds[i] = pipe.Get(ctx, key)
 		}
+		return nil
+	})
+	if err != nil && err != redis.Nil {
+		return nil, since, false, err
+	}
 
+	var updates []util.Record
+	for i, key := range keys {
+		dataString, err := getCmds[i].Result()
+		if err != nil {
+			continue
+		}
 		var vv VersionedValue
-		found, err := c.Get(key, &vv)
-		if err != nil || !found {
+		if err := c.codec.Unmarshal([]byte(dataString), &vv); err != nil {
+			fmt.Printf("Error decoding key %s: %v\n", key, err)
 			continue
 		}
-		if vv.Timestamp > since.UnixMilli() {
+		if vv.Timestamp > since && vv.Timestamp <= upTo {
 			updates = append(updates, util.Record{
 				Key:       key,
 				Value:     vv.Value,
 				Timestamp: vv.Timestamp,
+				Deleted:   vv.Deleted,
+				Epoch:     vv.Epoch,
+				Prev:      vv.Prev,
+				Txn:       vv.Txn,
+				ExpiresAt: vv.ExpiresAt,
+			})
+		}
+	}
+
+	return updates, upTo, more, nil
+}
+
+// TrimChangeLog drops all change index entries of the shard with a timestamp <= before
+// Secondaries asking for updates older than the trimmed entries will get ErrChangesTrimmed
+func (c *Client) TrimChangeLog(shardID int, before int64) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeOut)
+	defer cancel()
+
+	keys := []string{changeIndexKey(shardID), changeWatermarkKey(shardID)}
+	return trimChangeIndexScript.Run(ctx, c.c, keys, before).Int64()
+}
+
+// PurgeTombstones physically removes the tombstones of the shard with a timestamp <= upTo
+// The caller has to make sure that every node replicating the shard has seen them (e.g. their HighTS is >= upTo).
+// Since the purged deletes can't be replicated anymore, the trim watermark of the change index is raised as well,
+// so a secondary that is further behind is told to resync.
+// Tombstones above the retention horizon are kept, reads "as of" before them still need the older versions of their key.
+func (c *Client) PurgeTombstones(shard *util.Shard, upTo int64) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeOut)
+	defer cancel()
+
+	if horizon := c.retention.Horizon(); upTo > horizon {
+		upTo = horizon
+	}
+
+	candidates, err := c.c.ZRangeByScoreWithScores(ctx, tombstoneIndexKey, &redis.ZRangeBy{
+		Min: "-inf",
+		Max: strconv.FormatInt(upTo, 10),
+	}).Result()
+	if err != nil {
+		return 0, err
+	}
+
+	purged := 0
+	var highestPurged int64
+	for _, z := range candidates {
+		key := z.Member.(string)
+
+		position, err := util.KeyPosition(key)
+		if err != nil || position < shard.RangeStart || position > shard.RangeEnd {
+			continue
+		}
+
+		// Only drop the key if it is still the same tombstone (it may have been written again meanwhile)
+		err = c.c.Watch(ctx, func(tx *redis.Tx) error {
+			var vv VersionedValue
+			stillDeleted := false
+			dataString, err := tx.Get(ctx, key).Result()
+			if err == nil {
+				if err := c.codec.Unmarshal([]byte(dataString), &vv); err != nil {
+					return err
+				}
+				stillDeleted = vv.Deleted && vv.Timestamp <= upTo
+			} else if err != redis.Nil {
+				return err
+			}
+
+			_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				if stillDeleted {
+					pipe.Del(ctx, key, versionsKey(key))
+					pipe.ZRem(ctx, changeIndexKey(shard.ShardId), key)
+					pipe.ZRem(ctx, positionIndexKey, key)
+				}
+				pipe.ZRem(ctx, tombstoneIndexKey, key)
+				return nil
 			})
+			if err == nil && stillDeleted {
+				purged++
+				if vv.Timestamp > highestPurged {
+					highestPurged = vv.Timestamp
+				}
+			}
+			return err
+		}, key)
+		if err == redis.TxFailedErr {
+			continue // written concurrently, try again in the next round
+		}
+		if err != nil {
+			return purged, err
 		}
 	}
-	if err := iter.Err(); err != nil {
-		fmt.Printf("Error scanning keys: %v\n", err)
+
+	if purged > 0 {
+		err = raiseScript.Run(ctx, c.c, []string{changeWatermarkKey(shard.ShardId)}, highestPurged).Err()
+		if err != nil {
+			return purged, err
+		}
+	}
+	return purged, nil
+}
+
+// ScanShard calls fn for every stored record (including tombstones) whose key position is in [startKey, endKey]
+// The keys are read from the position index by range, a page of scanPageSize keys at a time
+func (c *Client) ScanShard(startKey int, endKey int, fn func(util.Record) error) error {
+	for offset := int64(0); ; offset += scanPageSize {
+		tctx, cancel := context.WithTimeout(context.Background(), c.timeOut)
+		keys, err := c.c.ZRangeByScore(tctx, positionIndexKey, &redis.ZRangeBy{
+			Min:    strconv.Itoa(startKey),
+			Max:    strconv.Itoa(endKey),
+			Offset: offset,
+			Count:  scanPageSize,
+		}).Result()
+		cancel()
+		if err != nil {
+			return err
+		}
+
+		values, err := c.GetMulti(keys)
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			vv, found := values[key]
+			if !found {
+				continue
+			}
+
+			err = fn(util.Record{
+				Key:       key,
+				Value:     vv.Value,
+				Timestamp: vv.Timestamp,
+				Deleted:   vv.Deleted,
+				Epoch:     vv.Epoch,
+				Prev:      vv.Prev,
+				Txn:       vv.Txn,
+				ExpiresAt: vv.ExpiresAt,
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		if len(keys) < scanPageSize {
+			return nil
+		}
 	}
+}
 
-	return updates
+// Scores are stored as doubles by redis, read them back as int64 timestamps (missing = 0)
+func parseScore(cmd *redis.StringCmd) (int64, error) {
+	str, err := cmd.Result()
+	if err == redis.Nil {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	f, err := strconv.ParseFloat(str, 64)
+	if err != nil {
+		return 0, err
+	}
+	return int64(f), nil
 }
 
 // Close closes the client.
 // It must be called to release any open resources.
-func (c Client) Close() error {
+func (c *Client) Close() error {
 	return c.c.Close()
 }
 
 // Options are the options for the Redis client.
 type Options struct {	
 	Address string  		// Optional ("localhost:6379" by default).
-	ShardRangeStart int
-	ShardRangeEnd int
+	Shards *util.ShardSet	// Shards the node is primary for (none by default).
 	Password string 		// Optional ("" by default).	
 	DB int 					// Optional (0 by default).
 	Timeout *time.Duration	// Optional (2 * time.Second by default).
+	Retention *store.Retention	// Optional (store.DefaultRetention by default).
 	Codec encoding.Codec	// Optional (encoding.JSON by default).
+	Clock *hlc.Clock		// Optional (an in-memory clock by default, which is not monotonic across restarts).
 }
 
 // DefaultOptions is an Options object with default values.
 // Address: "localhost:6379", Password: "", DB: 0, Timeout: 2 * time.Second, Codec: encoding.JSON
 var DefaultOptions = Options{
 	Address: "localhost:6379",
-	ShardRangeStart: 0,
-	ShardRangeEnd: 0,
-	Timeout: &defaultTimeout,
-	Codec:   encoding.JSON,
+	Timeout:   &defaultTimeout,
+	Retention: &store.DefaultRetention,
+	Codec:     encoding.JSON,
 	// No need to set Password or DB because their Go zero values are fine for that.
 }
 
@@ -202,18 +890,21 @@ func NewClient(options Options) (Client, error) {
 	if options.Address == "" {
 		options.Address = DefaultOptions.Address
 	}
-	if options.ShardRangeStart == 0 {
-		options.ShardRangeStart = DefaultOptions.ShardRangeStart
-	}
-	if options.ShardRangeEnd == 0 {
-		options.ShardRangeEnd = DefaultOptions.ShardRangeEnd
+	if options.Shards == nil {
+		options.Shards = util.NewShardSet()
 	}
 	if options.Timeout == nil {
 		options.Timeout = DefaultOptions.Timeout
 	}
+	if options.Retention == nil {
+		options.Retention = DefaultOptions.Retention
+	}
 	if options.Codec == nil {
 		options.Codec = DefaultOptions.Codec
 	}
+	if options.Clock == nil {
+		options.Clock, _ = hlc.NewClock("")
+	}
 
 	client := redis.NewClient(&redis.Options{
 		Addr:     options.Address,
@@ -231,9 +922,11 @@ func NewClient(options Options) (Client, error) {
 
 	result.c = client
 	result.timeOut = *options.Timeout
+	result.retention = *options.Retention
 	result.codec = options.Codec
-	result.ShardRangeStart = options.ShardRangeStart
-	result.ShardRangeEnd = options.ShardRangeEnd
+	result.clock = options.Clock
+	result.Shards = options.Shards
+	result.writeLocks = &shardLocks{locks: make(map[int]*sync.Mutex)}
 
 	return result, nil
 }
@@ -0,0 +1,432 @@
+package redis
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"pileus/util"
+)
+
+// Client of shard 0 ([0, 1000]) on an in-process redis
+func newTestClient(t *testing.T) Client {
+	t.Helper()
+	server := miniredis.RunT(t)
+
+	opts := DefaultOptions
+	opts.Address = server.Addr()
+	opts.Shards = util.NewShardSet()
+	opts.Shards.Put(&util.Shard{ShardId: 0, RangeStart: 0, RangeEnd: 1000})
+
+	client, err := NewClient(opts)
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+// Writes the keys in order, each one in a later millisecond, and returns their timestamps
+func setInOrder(t *testing.T, c Client, keys ...string) []int64 {
+	t.Helper()
+	var stamps []int64
+	for _, key := range keys {
+		time.Sleep(2 * time.Millisecond)
+		ts, err := c.Set(key, "value of "+key)
+		if err != nil {
+			t.Fatalf("Set(%s): %v", key, err)
+		}
+		stamps = append(stamps, ts)
+	}
+	return stamps
+}
+
+func updatedKeys(t *testing.T, c Client, since int64) []string {
+	t.Helper()
+	updates, _, _, err := c.ScanUpdatedKeys(0, since, 0)
+	if err != nil {
+		t.Fatalf("ScanUpdatedKeys(%d): %v", since, err)
+	}
+	var keys []string
+	for _, update := range updates {
+		keys = append(keys, update.Key)
+	}
+	return keys
+}
+
+func TestScanUpdatedKeysReadsTheChangeIndex(t *testing.T) {
+	c := newTestClient(t)
+	stamps := setInOrder(t, c, "key1", "key2", "key3")
+
+	if got := updatedKeys(t, c, 0); !equalKeys(got, []string{"key1", "key2", "key3"}) {
+		t.Errorf("updates since 0 = %v", got)
+	}
+	// "since" is exclusive
+	if got := updatedKeys(t, c, stamps[0]); !equalKeys(got, []string{"key2", "key3"}) {
+		t.Errorf("updates since the first write = %v", got)
+	}
+	if got := updatedKeys(t, c, stamps[2]); len(got) != 0 {
+		t.Errorf("updates since the last write = %v, want none", got)
+	}
+}
+
+func TestScanUpdatedKeysReportsARewrittenKeyOnce(t *testing.T) {
+	c := newTestClient(t)
+	stamps := setInOrder(t, c, "key1", "key2", "key1")
+
+	updates, _, _, err := c.ScanUpdatedKeys(0, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(updates) != 2 {
+		t.Fatalf("got %d updates, want 2: %v", len(updates), updates)
+	}
+	if updates[1].Key != "key1" || updates[1].Timestamp != stamps[2] {
+		t.Errorf("last update is %s@%d, want key1@%d", updates[1].Key, updates[1].Timestamp, stamps[2])
+	}
+}
+
+func TestScanUpdatedKeysPagesThroughTheChangeIndex(t *testing.T) {
+	c := newTestClient(t)
+	stamps := setInOrder(t, c, "key1", "key2", "key3")
+
+	updates, upTo, more, err := c.ScanUpdatedKeys(0, 0, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(updates) != 2 || updates[1].Key != "key2" || upTo != stamps[1] || !more {
+		t.Fatalf("first page = %v up to %d (more: %v), want key1 and key2 up to %d with more", updates, upTo, more, stamps[1])
+	}
+
+	updates, upTo, more, err = c.ScanUpdatedKeys(0, upTo, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(updates) != 1 || updates[0].Key != "key3" || upTo != stamps[2] || more {
+		t.Errorf("second page = %v up to %d (more: %v), want key3 up to %d without more", updates, upTo, more, stamps[2])
+	}
+}
+
+func TestSetRejectsKeysOutsideTheShard(t *testing.T) {
+	c := newTestClient(t)
+	if _, err := c.Set("key1001", "v"); err == nil {
+		t.Error("Set of a key outside of [0, 1000] succeeded")
+	}
+	if got := updatedKeys(t, c, 0); len(got) != 0 {
+		t.Errorf("rejected write is in the change index: %v", got)
+	}
+}
+
+func TestTrimmedChangesAreReported(t *testing.T) {
+	c := newTestClient(t)
+	stamps := setInOrder(t, c, "key1", "key2", "key3")
+
+	removed, err := c.TrimChangeLog(0, stamps[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 2 {
+		t.Errorf("trimmed %d entries, want 2", removed)
+	}
+
+	// A secondary that is behind the trimmed entries has to resync
+	if _, _, _, err := c.ScanUpdatedKeys(0, stamps[0], 0); err != ErrChangesTrimmed {
+		t.Errorf("ScanUpdatedKeys behind the trim = %v, want ErrChangesTrimmed", err)
+	}
+	// One that saw everything up to the trim point keeps pulling
+	if got := updatedKeys(t, c, stamps[1]); !equalKeys(got, []string{"key3"}) {
+		t.Errorf("updates after the trim point = %v", got)
+	}
+
+	// Trimming below the watermark leaves it in place
+	if _, err := c.TrimChangeLog(0, stamps[0]); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err := c.ScanUpdatedKeys(0, stamps[0], 0); err != ErrChangesTrimmed {
+		t.Errorf("the trim watermark moved back: %v", err)
+	}
+}
+
+func equalKeys(got []string, want []string) bool {
+	if len(got) != len(want) {
+		return false
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestScanShardVisitsOnlyTheKeysOfTheRange(t *testing.T) {
+	c := newTestClient(t)
+	setInOrder(t, c, "key1", "key500", "key1000")
+	// Written by a secondary of another shard, outside of the range scanned below
+	if err := c.SetVersioned("key2000", VersionedValue{Value: "v", Timestamp: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	var keys []string
+	err := c.ScanShard(1, 999, func(rec util.Record) error {
+		keys = append(keys, rec.Key)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(keys)
+	if !equalKeys(keys, []string{"key1", "key500"}) {
+		t.Errorf("ScanShard(1, 999) visited %v, want key1 and key500 (and no change index)", keys)
+	}
+}
+
+func TestScanShardPagesThroughThePositionIndex(t *testing.T) {
+	c := newTestClient(t)
+	for i := 0; i < scanPageSize+10; i++ {
+		if err := c.SetVersioned(fmt.Sprintf("key%d", i), VersionedValue{Value: "v", Timestamp: 1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := c.Delete("key7"); err != nil {
+		t.Fatal(err)
+	}
+
+	visited := map[string]bool{}
+	err := c.ScanShard(0, scanPageSize+9, func(rec util.Record) error {
+		visited[rec.Key] = true
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(visited) != scanPageSize+9 || visited["key7"] || !visited[fmt.Sprintf("key%d", scanPageSize+9)] {
+		t.Errorf("ScanShard visited %d keys (key7: %v), want all %d stored ones", len(visited), visited["key7"], scanPageSize+9)
+	}
+}
+
+func TestWritesOfSeveralShardsKeepSeparateChangeIndexes(t *testing.T) {
+	c := newTestClient(t)
+	c.Shards.Put(&util.Shard{ShardId: 1, RangeStart: 2000, RangeEnd: 2999})
+
+	setInOrder(t, c, "key1", "key2000", "key2", "key2999")
+	if _, err := c.Set("key1500", "v"); err == nil {
+		t.Error("Set of a key between the two shards succeeded")
+	}
+
+	if got := updatedKeys(t, c, 0); !equalKeys(got, []string{"key1", "key2"}) {
+		t.Errorf("updates of shard 0 = %v", got)
+	}
+	updates, _, _, err := c.ScanUpdatedKeys(1, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(updates) != 2 || updates[0].Key != "key2000" || updates[1].Key != "key2999" {
+		t.Errorf("updates of shard 1 = %v, want key2000 and key2999", updates)
+	}
+}
+
+func TestTombstoneIsReplicatedAsADelete(t *testing.T) {
+	c := newTestClient(t)
+	setInOrder(t, c, "key1")
+	time.Sleep(2 * time.Millisecond)
+	deletedAt, err := c.Tombstone("key1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var vv VersionedValue
+	found, err := c.Get("key1", &vv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !found || !vv.Deleted || vv.Timestamp != deletedAt {
+		t.Errorf("stored record after the delete = %+v (found: %v), want a tombstone at %d", vv, found, deletedAt)
+	}
+
+	updates, _, _, err := c.ScanUpdatedKeys(0, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(updates) != 1 || !updates[0].Deleted || updates[0].Timestamp != deletedAt {
+		t.Errorf("change index after the delete = %+v, want only the tombstone of key1", updates)
+	}
+}
+
+func TestPurgeTombstonesDropsOnlyTheSeenTombstonesOfTheShard(t *testing.T) {
+	c := newTestClient(t)
+	// No reads as of the past, so the tombstones can be purged right away
+	c.retention.MaxAge = 0
+	setInOrder(t, c, "key1", "key2", "key3")
+	first, err := c.Tombstone("key1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(2 * time.Millisecond)
+	if _, err := c.Tombstone("key2"); err != nil {
+		t.Fatal(err)
+	}
+	// A replicated tombstone of another shard is left to that shard's purge
+	if err := c.SetVersioned("key2000", VersionedValue{Deleted: true, Timestamp: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	shard, _ := c.Shards.Get(0)
+	purged, err := c.PurgeTombstones(shard, first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if purged != 1 {
+		t.Errorf("purged %d tombstones up to the first delete, want 1", purged)
+	}
+
+	var vv VersionedValue
+	if found, _ := c.Get("key1", &vv); found {
+		t.Errorf("purged key1 is still stored: %+v", vv)
+	}
+	if found, _ := c.Get("key2", &vv); !found || !vv.Deleted {
+		t.Errorf("tombstone of key2 (after upTo) = %+v (found: %v), want it kept", vv, found)
+	}
+	if found, _ := c.Get("key2000", &vv); !found {
+		t.Error("tombstone of another shard was purged")
+	}
+
+	// A secondary behind the purged delete can't learn about it from the change index anymore
+	if _, _, _, err := c.ScanUpdatedKeys(0, first-1, 0); err != ErrChangesTrimmed {
+		t.Errorf("ScanUpdatedKeys behind the purged tombstone = %v, want ErrChangesTrimmed", err)
+	}
+}
+
+func TestPurgeTombstonesKeepsARewrittenKey(t *testing.T) {
+	c := newTestClient(t)
+	// No reads as of the past, so the tombstones can be purged right away
+	c.retention.MaxAge = 0
+	if _, err := c.Tombstone("key1"); err != nil {
+		t.Fatal(err)
+	}
+	stamps := setInOrder(t, c, "key1")
+
+	shard, _ := c.Shards.Get(0)
+	purged, err := c.PurgeTombstones(shard, stamps[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if purged != 0 {
+		t.Errorf("purged %d tombstones, want 0", purged)
+	}
+
+	var vv VersionedValue
+	if found, _ := c.Get("key1", &vv); !found || vv.Deleted || vv.Value != "value of key1" {
+		t.Errorf("key1 written again after its delete = %+v (found: %v)", vv, found)
+	}
+	// Nothing was purged, so the change index stays complete
+	if got := updatedKeys(t, c, 0); !equalKeys(got, []string{"key1"}) {
+		t.Errorf("updates since 0 = %v", got)
+	}
+}
+
+func TestSetIfVersionWritesOnlyOverTheExpectedVersion(t *testing.T) {
+	c := newTestClient(t)
+
+	// A missing key has version 0
+	created, err := c.SetIfVersion("key1", "a", 0)
+	if err != nil {
+		t.Fatalf("SetIfVersion of a missing key: %v", err)
+	}
+	time.Sleep(2 * time.Millisecond)
+
+	updated, err := c.SetIfVersion("key1", "b", created)
+	if err != nil {
+		t.Fatalf("SetIfVersion over the current version: %v", err)
+	}
+	if updated <= created {
+		t.Errorf("new version %d is not after %d", updated, created)
+	}
+
+	// A stale version is rejected and the current one is reported back
+	current, err := c.SetIfVersion("key1", "c", created)
+	if err != ErrVersionConflict {
+		t.Fatalf("SetIfVersion over a stale version = %v, want ErrVersionConflict", err)
+	}
+	if current != updated {
+		t.Errorf("conflict reported version %d, want %d", current, updated)
+	}
+
+	var vv VersionedValue
+	if _, err := c.Get("key1", &vv); err != nil {
+		t.Fatal(err)
+	}
+	if vv.Value != "b" || vv.Timestamp != updated {
+		t.Errorf("stored %+v after the conflict, want b@%d", vv, updated)
+	}
+	if got := updatedKeys(t, c, updated); len(got) != 0 {
+		t.Errorf("rejected write is in the change index: %v", got)
+	}
+}
+
+func TestSetIfVersionOfADeletedKeyExpectsTheTombstone(t *testing.T) {
+	c := newTestClient(t)
+	setInOrder(t, c, "key1")
+	deletedAt, err := c.Tombstone("key1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := c.SetIfVersion("key1", "a", 0); err != ErrVersionConflict {
+		t.Errorf("SetIfVersion(0) of a deleted key = %v, want ErrVersionConflict", err)
+	}
+	if _, err := c.SetIfVersion("key1", "a", deletedAt); err != nil {
+		t.Errorf("SetIfVersion over the tombstone: %v", err)
+	}
+}
+
+func TestHighTSIsStoredWithTheWrites(t *testing.T) {
+	c := newTestClient(t)
+	stamps := setInOrder(t, c, "key1", "key2")
+
+	if highTS, err := c.LoadHighTS(0); err != nil || highTS != stamps[1] {
+		t.Errorf("HighTS after two writes = (%d, %v), want %d", highTS, err, stamps[1])
+	}
+
+	if err := c.SetReplicated(1, "key2000", VersionedValue{Value: "new", Timestamp: 20}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.SetReplicated(1, "key2000", VersionedValue{Value: "old", Timestamp: 10}); err != nil {
+		t.Fatal(err)
+	}
+	var vv VersionedValue
+	if _, err := c.Get("key2000", &vv); err != nil {
+		t.Fatal(err)
+	}
+	if vv.Value != "new" {
+		t.Errorf("an older replicated version overwrote the key: %+v", vv)
+	}
+	if highTS, err := c.LoadHighTS(1); err != nil || highTS != 20 {
+		t.Errorf("HighTS of the replicated shard = (%d, %v), want 20", highTS, err)
+	}
+}
+
+func TestConcurrentWritesOfAKeyAreRetried(t *testing.T) {
+	c := newTestClient(t)
+
+	// Every round of WATCH transactions has a winner, so the others get through within the bounded attempts
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for i := 1; i <= 8; i++ {
+		wg.Add(1)
+		go func(ts int64) {
+			defer wg.Done()
+			errs <- c.SetVersioned("key1", VersionedValue{Value: "v", Timestamp: ts})
+		}(int64(i))
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package replication
+
+import (
+	"sync"
+
+	"pileus/util"
+)
+
+// Hub fans out the writes accepted by a primary to the secondaries that stream from it (push-based replication)
+type Hub struct {
+	mu          sync.Mutex
+	subscribers map[int]map[*Subscription]bool 	// Map of shardID -> open subscriptions
+	bufferSize  int
+}
+
+// Subscription is the stream of updates of one shard for one secondary
+// C is closed when the subscriber falls behind by more than the buffer size, the secondary should then reconnect and catch up
+type Subscription struct {
+	C       <-chan util.Record
+	ch      chan util.Record
+	shardID int
+}
+
+func NewHub(bufferSize int) *Hub {
+	return &Hub{
+		subscribers: make(map[int]map[*Subscription]bool),
+		bufferSize:  bufferSize,
+	}
+}
+
+func (h *Hub) Subscribe(shardID int) *Subscription {
+	ch := make(chan util.Record, h.bufferSize)
+	sub := &Subscription{C: ch, ch: ch, shardID: shardID}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.subscribers[shardID] == nil {
+		h.subscribers[shardID] = make(map[*Subscription]bool)
+	}
+	h.subscribers[shardID][sub] = true
+	return sub
+}
+
+// Unsubscribe is safe to call on a subscription that was already dropped
+func (h *Hub) Unsubscribe(sub *Subscription) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.subscribers[sub.shardID][sub] {
+		delete(h.subscribers[sub.shardID], sub)
+		close(sub.ch)
+	}
+}
+
+// Subscribed tells whether any secondary streams the shard, so the primary can skip preparing updates nobody reads
+func (h *Hub) Subscribed(shardID int) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return len(h.subscribers[shardID]) > 0
+}
+
+// Publish never blocks the write path: a subscriber whose buffer is full is dropped instead
+func (h *Hub) Publish(shardID int, rec util.Record) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for sub := range h.subscribers[shardID] {
+		select {
+		case sub.ch <- rec:
+		default:
+			delete(h.subscribers[shardID], sub)
+			close(sub.ch)
+		}
+	}
+}
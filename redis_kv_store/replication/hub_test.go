@@ -0,0 +1,76 @@
+package replication
+
+import (
+	"testing"
+
+	"pileus/util"
+)
+
+// Reads what is buffered in the subscription without blocking, and whether it was closed
+func drain(sub *Subscription) (keys []string, closed bool) {
+	for {
+		select {
+		case rec, ok := <-sub.C:
+			if !ok {
+				return keys, true
+			}
+			keys = append(keys, rec.Key)
+		default:
+			return keys, false
+		}
+	}
+}
+
+func TestPublishReachesTheSubscribersOfTheShard(t *testing.T) {
+	hub := NewHub(4)
+	shard0 := hub.Subscribe(0)
+	alsoShard0 := hub.Subscribe(0)
+	shard1 := hub.Subscribe(1)
+
+	hub.Publish(0, util.Record{Key: "key1"})
+	hub.Publish(0, util.Record{Key: "key2"})
+
+	for _, sub := range []*Subscription{shard0, alsoShard0} {
+		if keys, closed := drain(sub); closed || len(keys) != 2 || keys[0] != "key1" || keys[1] != "key2" {
+			t.Errorf("subscriber of shard 0 got %v (closed: %v), want [key1 key2] in order", keys, closed)
+		}
+	}
+	if keys, _ := drain(shard1); len(keys) != 0 {
+		t.Errorf("subscriber of shard 1 got %v", keys)
+	}
+}
+
+func TestSlowSubscriberIsDropped(t *testing.T) {
+	hub := NewHub(2)
+	slow := hub.Subscribe(0)
+
+	// The third write does not fit the buffer: the subscription is closed instead of blocking the primary
+	for _, key := range []string{"key1", "key2", "key3"} {
+		hub.Publish(0, util.Record{Key: key})
+	}
+
+	keys, closed := drain(slow)
+	if !closed {
+		t.Fatal("subscription that fell behind was not closed")
+	}
+	if len(keys) != 2 {
+		t.Errorf("dropped subscriber got %v before the close, want the 2 buffered writes", keys)
+	}
+
+	// Later writes and an unsubscribe of the dropped subscription are fine
+	hub.Publish(0, util.Record{Key: "key4"})
+	hub.Unsubscribe(slow)
+}
+
+func TestUnsubscribeClosesOnce(t *testing.T) {
+	hub := NewHub(2)
+	sub := hub.Subscribe(0)
+
+	hub.Unsubscribe(sub)
+	hub.Unsubscribe(sub)
+	hub.Publish(0, util.Record{Key: "key1"})
+
+	if keys, closed := drain(sub); !closed || len(keys) != 0 {
+		t.Errorf("unsubscribed subscription got %v (closed: %v)", keys, closed)
+	}
+}
@@ -1,167 +1,415 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"os"
+	"sort"
 	"time"
 	"strconv"
+	"net"
 	"net/http"
+	"pileus/bolt"
+	"pileus/hlc"
+	"pileus/memory"
 	"pileus/redis"
+	"pileus/replication"
+	"pileus/store"
 	"pileus/util"
 	"os/signal"
+	"sync"
 	"syscall"
 	"github.com/google/uuid"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	pileuspb "pileus/proto"
 )
 
-// each storage node is co-located with a local redis instance
-var localStore redis.Client
+// each storage node is co-located with a local store (by default a local redis instance, see the -store flag)
+var localStore store.Store
 var storageID string
 var configPath string
-var shard_range_start int
-var shard_range_end int
-var primaryShard util.Shard		// Note: Assumption that each storage node is primary for 1 shard for now
-var secondaryShards []util.Shard
+// Base URL of the configuration coordinator (optional), the node loads its config from there and watches it for new versions
+var coordinatorURL string
+// Shards this node is primary/secondary for, keyed by shard id
+var primaryShards = util.NewShardSet()
+var secondaryShards = util.NewShardSet()
 
-// How to invoke: go run storage_server.go <storage_id>  <replication-config-path>
+// Serializes /reconfigure requests, so a shard is never moved by two of them at once
+var reconfigureMu sync.Mutex
+
+// Writes hold writeMu (shared) while they are checked and applied, so a drain waits for the writes in flight
+// Drained shards (shard id -> closed when the drain ends) hold their new writes while the primary is moved to another node
+var writeMu sync.RWMutex
+var draining = make(map[int]chan struct{})
+
+// How long a write waits for the drain of its shard to end, before it fails with 503
+const drainWaitTimeout = 10 * time.Second
+// Used when /drain does not say how long the drain may last (it ends on its own, e.g. if the coordinator is gone)
+const defaultDrainDuration = 30 * time.Second
+
+// Clock of the node, a promoted primary moves it past the HighTS it takes over
+var clock *hlc.Clock
+
+// Map of node id -> node address, from the replication config (replaced by newer config versions)
+var nodeAddresses = make(map[string]string)
+// Map of node address -> gRPC address, for the nodes that serve gRPC
+var nodeGRPCAddresses = make(map[string]string)
+var nodeAddressesMu sync.RWMutex
+
+// Epoch of the last full config applied from the coordinator, the watch asks for the versions after it
+var configEpoch int64
+
+// Watches are long-polls that the coordinator holds open until the next version
+var watchClient = &http.Client{}
+
+const configWatchRetryDelay = 1 * time.Second
+
+// The last issued clock is persisted here, so timestamps stay monotonic across restarts
+const clockStatePath = "hlc_state.json"
+
+// Used when the config does not set a change log retention for a shard
+const defaultChangeLogRetention = 10 * time.Minute
+const changeLogTrimInterval = 10 * time.Second
+
+// Tombstones are purged once every secondary of the shard has seen them
+const tombstonePurgeInterval = 30 * time.Second
+
+// Writes persist the HighTS together with the data, the moves without data (heartbeats, empty pulls) are checkpointed
+const highTSCheckpointInterval = 5 * time.Second
+
+var statusClient = &http.Client{Timeout: 2 * time.Second}
+
+// Push-based replication: writes of the primary shards are fanned out to the streaming secondaries
+var pushHub = replication.NewHub(pushBufferSize)
+
+const pushBufferSize = 1024
+const pushHeartbeatInterval = 1 * time.Second
+const pushReconnectDelay = 1 * time.Second
+
+// Long-lived streams must not be cut by a client timeout
+var streamClient = &http.Client{}
+
+// Pull-based replication is paged, so a secondary that was offline for a while doesn't get its whole backlog in one response
+const defaultReplicationPageSize = 1000
+const maxReplicationPageSize = 10000
+
+// Transport of the pull-based replication (see -transport), gRPC is used for the primaries that have a gRPC address in the config
+const (
+	httpTransport = "http"
+	grpcTransport = "grpc"
+)
+
+var replicationTransport = httpTransport
+var grpcConns = pileuspb.NewConns()
+
+// How to invoke: go run storage_server.go [-store redis|memory|bolt] [-db path] [-recover] [-coordinator url] [-grpc address] [-transport http|grpc] <storage_id> [<replication-config-path>]
+// With -coordinator the config comes from the coordinator (the replication config path is not needed)
 func main() {
-	if len(os.Args) < 3 {
-		fmt.Println("Usage: go run storage_server.go <storage-id> <replication-config-path>")
+	backend := flag.String("store", "redis", "storage backend: redis (local redis on :6379), memory or bolt (embedded on-disk database)")
+	dbPath := flag.String("db", "", "database file of the bolt backend (default pileus_<storage-id>.db)")
+	recoverData := flag.Bool("recover", false, "keep the data of the local store (e.g. after a crash) instead of flushing and preloading it")
+	flag.StringVar(&coordinatorURL, "coordinator", "", "base URL of the configuration coordinator (e.g. http://host:8080) to load and watch the config from")
+	grpcListen := flag.String("grpc", "", "address to serve the gRPC transport on (e.g. :9090), next to HTTP on :8080")
+	maxVersions := flag.Int("versions", store.DefaultRetention.MaxVersions, "older versions kept per key, for reads as of a timestamp (/get?at=)")
+	versionRetention := flag.Duration("version-retention", store.DefaultRetention.MaxAge, "how long replaced versions are kept, for reads as of a timestamp")
+	flag.StringVar(&replicationTransport, "transport", httpTransport, "transport of the pull-based replication: http or grpc (for primaries with a grpcAddress in the config)")
+	flag.Parse()
+
+	if flag.NArg() < 1 || (flag.NArg() < 2 && coordinatorURL == "") ||
+		(replicationTransport != httpTransport && replicationTransport != grpcTransport) {
+		fmt.Println("Usage: go run storage_server.go [-store redis|memory|bolt] [-db path] [-recover] [-coordinator url] [-grpc address] [-transport http|grpc] [-versions n] [-version-retention duration] <storage-id> [<replication-config-path>]")
 		os.Exit(1)
 	}
-	storageID = os.Args[1]
-	configPath = os.Args[2]
+	storageID = flag.Arg(0)
+	configPath = flag.Arg(1)
 
 	fmt.Println("Starting storage node with ID:", storageID)
-	fmt.Println("Using replication config:", configPath)
 
-	// Load the key/shard ranges that this node is primary/secondary for (using storageID)
-	// Note: I think in the paper's evaluation only one shard is assumed
-	initShards(configPath)
+	var conf *util.Config
+	var err error
+	if coordinatorURL != "" {
+		fmt.Println("Using replication config of the coordinator:", coordinatorURL)
+		conf, err = fetchConfig(statusClient, -1)
+	} else {
+		fmt.Println("Using replication config:", configPath)
+		conf, err = util.LoadConfig(configPath)
+	}
+	if err != nil {
+		panic(err)
+	}
+
+	// Keys are routed by the partitioning of the config for the whole life of the node
+	if err := conf.Partitioning.Validate(); err != nil {
+		panic(err)
+	}
+	util.Partitioning = conf.Partitioning
+	fmt.Println("Partitioning keys by", util.Partitioning.Name())
 
-	opts := redis.DefaultOptions
-	opts.Address = "localhost:6379" // connect to local Redis
-	// shard range is also set in opts of the redisClient
-	opts.ShardRangeStart = shard_range_start
-	opts.ShardRangeEnd = shard_range_end
+	// Load the key/shard ranges that this node is primary/secondary for (using storageID)
+	initShards(conf)
 
-	var err error
-	localStore, err = redis.NewClient(opts)
+	clock, err = hlc.NewClock(clockStatePath)
 	if err != nil {
 		panic(err)
 	}
 
-	err = localStore.FlushAll()
+	retention := store.Retention{MaxVersions: *maxVersions, MaxAge: *versionRetention}
+	localStore, err = openStore(*backend, *dbPath, clock, &retention)
 	if err != nil {
-		fmt.Println("Failed to flush Redis:", err)
-		os.Exit(1)
+		panic(err)
+	}
+
+	if *recoverData {
+		// The HighTS of every shard is restored from the local store, next to the data it describes
+		for _, shard := range primaryShards.All() {
+			if err := recoverHighTS(shard); err != nil {
+				panic(err)
+			}
+		}
+		for _, shard := range secondaryShards.All() {
+			if err := recoverHighTS(shard); err != nil {
+				panic(err)
+			}
+		}
+	} else {
+		err = localStore.FlushAll()
+		if err != nil {
+			fmt.Println("Failed to flush the local store:", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Local store (%s) flushed successfully\n", *backend)
+
+		// preload the store with data
+		preloadKeys(conf, 10000)
 	}
-	fmt.Println("Redis flushed successfully")
 
-	// preload the store with data
-	preloadKeys(10000)
+	// Never issue timestamps below a HighTS we already know of
+	for _, shard := range primaryShards.All() {
+		clock.Update(shard.GetHighTS())
+	}
+	for _, shard := range secondaryShards.All() {
+		clock.Update(shard.GetHighTS())
+	}
+
+	// Keep the change index of the primary shards within their retention, and replicate the secondary ones
+	for _, shard := range primaryShards.All() {
+		go trimChangeLog(shard)
+	}
+	for _, shard := range secondaryShards.All() {
+		startReplication(shard, false)
+	}
+	go purgeTombstones()
+	go checkpointHighTS()
+	if coordinatorURL != "" {
+		go watchConfig()
+	}
 
 	http.HandleFunc("/set", handleSet)
 	http.HandleFunc("/get", handleGet)
+	http.HandleFunc("/mset", handleMSet)
+	http.HandleFunc("/txn", handleTxn)
+	http.HandleFunc("/mget", handleMGet)
+	http.HandleFunc("/delete", handleDelete)
 	http.HandleFunc("/replicate", replicationHandler)
+	http.HandleFunc("/snapshot", snapshotHandler)
+	http.HandleFunc("/subscribe", subscribeHandler)
 	http.HandleFunc("/probe", handleProbe)
 	http.HandleFunc("/status", sendLatestStatus)
 	http.HandleFunc("/adjust_replication", adjustReplicationHandler)
+	http.HandleFunc("/reconfigure", reconfigureHandler)
+	http.HandleFunc("/drain", drainHandler)
+	http.HandleFunc("/reshard", reshardHandler)
+
+	if *grpcListen != "" {
+		go serveGRPC(*grpcListen)
+	}
 
-	// Shutdown Signal Handler: For storing the high timestamp information (on Redis)
+	// Shutdown Signal Handler: For storing the high timestamp information (in the local store)
 	go handleShutdown()
 
 	fmt.Println("Storage node listening on :8080")
 	http.ListenAndServe(":8080", nil)
 }
 
-func initShards(configPath string) {
-
-	var err error
-
-	conf, err := util.LoadConfig(configPath)
-	if err != nil {
-		panic(err)
+// Opens the local store of the given backend
+// The primary shards are shared with the store (by reference), so it can reject writes outside of their ranges
+func openStore(backend string, dbPath string, clock *hlc.Clock, retention *store.Retention) (store.Store, error) {
+	switch backend {
+	case "redis":
+		opts := redis.DefaultOptions
+		opts.Address = "localhost:6379" // connect to local Redis
+		opts.Shards = primaryShards
+		opts.Retention = retention
+		opts.Clock = clock
+
+		client, err := redis.NewClient(opts)
+		if err != nil {
+			return nil, err
+		}
+		return &client, nil
+
+	case "memory":
+		return memory.NewStore(memory.Options{
+			Shards:    primaryShards,
+			Retention: retention,
+			Clock:     clock,
+		})
+
+	case "bolt":
+		opts := bolt.DefaultOptions
+		opts.Path = dbPath
+		if opts.Path == "" {
+			opts.Path = fmt.Sprintf("pileus_%s.db", storageID)
+		}
+		opts.Shards = primaryShards
+		opts.Retention = retention
+		opts.Clock = clock
+		return bolt.NewStore(opts)
 	}
+	return nil, fmt.Errorf("unknown storage backend %q", backend)
+}
+
+func initShards(conf *util.Config) {
+	setNodeAddresses(conf.Nodes)
+	configEpoch = conf.Epoch
 
 	for _, shard := range conf.Shards {
     
-		// Find the shard that the storage node is the primary for
-		// TODO: for this version, we assume that each node is the primary for 1 shard
+		// Find the shards that the storage node is the primary for
         if storageID == shard.PrimaryID {
-			shard_range_start = shard.RangeStart
-			shard_range_end = shard.RangeEnd
-			shard.AmIPrimary = true
-			shard.AmISecondary = false
-			// If it does not exist, return 0
-			shard.HighTS=loadHighTSFromSnapshot(shard.ShardId)
-			primaryShard = shard
+			primary := shard
+			primary.AmIPrimary = true
+			primary.AmISecondary = false
+			// Restored from the local store later on (with -recover)
+			primary.SetHighTS(0)
+			primaryShards.Put(&primary)
         }
 
 		// Also find the shards that the storage node is secondary for
 		if util.Contains(shard.Secondaries, storageID) {
-			shard.AmIPrimary = false
-			shard.AmISecondary = true
-			fmt.Println("loading the shard highTS from secondary\n")
-			shard.HighTS= loadHighTSFromSnapshot(shard.ShardId)
-			secondaryShards = append(secondaryShards, shard)
+			secondary := shard
+			secondary.AmIPrimary = false
+			secondary.AmISecondary = true
+			secondary.SetHighTS(0)
+			secondaryShards.Put(&secondary)
 		}
     }
 
-	// Then set-up tasks for the secondary shards replication pulls
-	fmt.Printf("Secondary for shards: %+v\n", secondaryShards)
+	for _, shard := range secondaryShards.All() {
+		fmt.Printf("Secondary shard %d: %+v\n", shard.ShardId, *shard)
+	}
+	for _, shard := range primaryShards.All() {
+		fmt.Printf("Primary shard %d: %+v\n", shard.ShardId, *shard)
+	}
+}
+
+// Starts pulling (or streaming) updates of a secondary shard, the local store has to be ready by now
+// The replication stops once the shard is replaced in secondaryShards (e.g. on a reconfiguration)
+// With resync, the shard is first copied from a snapshot of the primary
+func startReplication(shard *util.Shard, resync bool) {
+	if shard.ReplicationMode == util.PushReplication {
+		fmt.Printf("Streaming updates of shard %d from %s\n", shard.ShardId, shard.Primary)
+		go streamFromPrimary(shard, resync)
+		return
+	}
 
-	fmt.Printf("Secondary shards after snapshot loading: %+v\n", secondaryShards)
-	fmt.Printf("Primary shard after snapshot loading: %+v\n", primaryShard)
+	// go func(shard *util.Shard) {
+	// 	// ticker := time.NewTicker(20 * time.Second)
+	// 	fmt.Println("Setting rep freq to ", shard.ReplicationFrequencySeconds)
+	// 	ticker := time.NewTicker(time.Duration(shard.ReplicationFrequencySeconds) * time.Second)
+	// 	defer ticker.Stop()
+
+	// 	for range ticker.C {
+	// 		err := pullFromPrimary(shard)
+	// 		if err != nil {
+	// 			fmt.Printf("Replication error from primary %s: %v\n", shard.Primary, err)
+	// 		}
+	// 	}
+	// }(shard)
+
+	go func(shard *util.Shard) {
+		for {
+			freq := shard.ReplicationFrequency()
+			fmt.Printf("Sleeping for %.2f seconds before pulling updates...\n", freq)
+
+			timer := time.NewTimer(time.Duration(freq) * time.Second)
+			<-timer.C
+
+			if !isCurrentSecondary(shard) {
+				fmt.Printf("Stopped pulling shard %d from %s\n", shard.ShardId, shard.Primary)
+				return
+			}
 
-	for i := range secondaryShards {
-		shard := &secondaryShards[i]
-		// go func(shard *util.Shard) {
-		// 	// ticker := time.NewTicker(20 * time.Second)
-		// 	fmt.Println("Setting rep freq to ", shard.ReplicationFrequencySeconds)
-		// 	ticker := time.NewTicker(time.Duration(shard.ReplicationFrequencySeconds) * time.Second)
-		// 	defer ticker.Stop()
-	
-		// 	for range ticker.C {
-		// 		err := pullFromPrimary(shard)
-		// 		if err != nil {
-		// 			fmt.Printf("Replication error from primary %s: %v\n", shard.Primary, err)
-		// 		}
-		// 	}
-		// }(shard)
-
-		go func(shard *util.Shard) {
-			for {
-				freq := shard.ReplicationFrequencySeconds
-				fmt.Printf("Sleeping for %d seconds before pulling updates...\n", freq)
-	
-				timer := time.NewTimer(time.Duration(freq) * time.Second)
-				<-timer.C
-	
-				err := pullFromPrimary(shard)
-				if err != nil {
-					fmt.Printf("Replication error from primary %s: %v\n", shard.Primary, err)
-				}
+			var err error
+			if resync {
+				err = bootstrapFromSnapshot(shard)
+				resync = err != nil
+			} else {
+				err = pullFromPrimary(shard)
 			}
-		}(shard)
-	}
+			if err != nil {
+				fmt.Printf("Replication error from primary %s: %v\n", shard.Primary, err)
+			}
+		}
+	}(shard)
+}
+
+// Reports whether the shard is still the one registered as secondary (and not replaced by a reconfiguration)
+func isCurrentSecondary(shard *util.Shard) bool {
+	current, ok := secondaryShards.Get(shard.ShardId)
+	return ok && current == shard
+}
 
+// Checks a replicated write against the latest configuration of its shard
+// Writes an old primary accepted after the new one took over are dropped (see util.Shard.StaleEpochWrite)
+func staleEpochWrite(shardID int, rec util.Record) bool {
+	current, ok := secondaryShards.Get(shardID)
+	if !ok || !current.StaleEpochWrite(rec) {
+		return false
+	}
+	fmt.Printf("Dropping write of key %s at %d from epoch %d, shard %d is in epoch %d since %d\n",
+		rec.Key, rec.Timestamp, rec.Epoch, shardID, current.Epoch, current.EpochStartTS)
+	return true
 }
 
+// If expected_timestamp is given, the write is conditional: it only succeeds if the object timestamp still matches
+// If ttl_ms is given, the key reads as missing from that long after the write on (see expiresAt)
 func handleSet(w http.ResponseWriter, r *http.Request) {
-	var rec util.Record
-	if err := json.NewDecoder(r.Body).Decode(&rec); err != nil {
+	var req struct {
+		util.Record
+		ExpectedTimestamp *int64 `json:"expected_timestamp,omitempty"`
+		TTLMs             int64  `json:"ttl_ms,omitempty"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	if req.TTLMs < 0 {
+		http.Error(w, "ttl_ms must not be negative", http.StatusBadRequest)
+		return
+	}
+	rec := req.Record
 
-	// Attempt to store the key-value pair
-	obj_ts, err := localStore.Set(rec.Key, rec.Value)
+	if rej := beginWrite([]util.Record{rec}); rej != nil {
+		rej.writeHTTP(w)
+		return
+	}
+	defer writeMu.RUnlock()
 
-	// Update HighTS if successful
-	if err == nil {
-		primaryShard.HighTS = obj_ts
-		fmt.Println("Primary shard is updated to %v\n:", primaryShard)
+	obj_ts, err := setKey(rec, req.ExpectedTimestamp, time.Duration(req.TTLMs) * time.Millisecond)
+
+	// The client gets the current version back, so it can re-read and retry
+	if err == store.ErrVersionConflict {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]int64{
+			"current_timestamp": obj_ts,
+		})
+		return
 	}
 
 	if err != nil {
@@ -177,284 +425,1831 @@ func handleSet(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(response)
 }
 
-func handleGet(w http.ResponseWriter, r *http.Request) {
-	key := r.URL.Query().Get("key")
+// Stores a write accepted by beginWrite, conditional if expectedTS is given (a conflict returns the current timestamp)
+// A ttl > 0 is stored as an absolute expiry, which replicates with the value so all nodes expire the key at the same timestamp
+func setKey(rec util.Record, expectedTS *int64, ttl time.Duration) (int64, error) {
+	// Attempt to store the key-value pair
+	var obj_ts int64
+	var err error
+	var expiresAt int64
+	if ttl > 0 {
+		expiresAt = hlc.FromTime(time.Now().Add(ttl))
+		obj_ts, err = localStore.SetExpiring(rec.Key, rec.Value, expiresAt, expectedTS)
+	} else if expectedTS != nil {
+		obj_ts, err = localStore.SetIfVersion(rec.Key, rec.Value, *expectedTS)
+	} else {
+		obj_ts, err = localStore.Set(rec.Key, rec.Value)
+	}
 
-	numericKey, err := util.KeyToInt(key)
-	if err != nil {
-		return 
+	// Update HighTS of the key's shard if successful
+	if err == nil {
+		primaryWritten(util.Record{Key: rec.Key, Value: rec.Value, Timestamp: obj_ts, ExpiresAt: expiresAt})
 	}
-	
-	var record redis.VersionedValue
-	found, err := localStore.Get(key, &record)
+	return obj_ts, err
+}
 
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+// Writes the tombstone of a delete accepted by beginWrite
+func deleteKey(key string) (int64, error) {
+	obj_ts, err := localStore.Tombstone(key)
+	if err == nil {
+		primaryWritten(util.Record{Key: key, Timestamp: obj_ts, Deleted: true})
 	}
-	if !found {
-		http.NotFound(w, r)
+	return obj_ts, err
+}
+
+// A request the node turned down, each transport reports it in its own way (HTTP status or gRPC code)
+type rejection struct {
+	status  int		// HTTP status
+	message string
+	epoch   int64	// epoch of the shard, for a request routed with another epoch (421)
+}
+
+// Misdirected requests are answered with the epoch of the node (as JSON), so the client can catch up with the config
+func (rej *rejection) writeHTTP(w http.ResponseWriter) {
+	if rej.status != http.StatusMisdirectedRequest {
+		http.Error(w, rej.message, rej.status)
 		return
 	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusMisdirectedRequest)
+	json.NewEncoder(w).Encode(map[string]any{
+		"error": rej.message,
+		"epoch": rej.epoch,
+	})
+}
 
-	// Find HighTS of the shard for the requested key [should either be the primary shard or the secondary shard]
-	// TODO: Is this even correct?
-	var shardHighTS int64
-	if primaryShard.RangeStart <= numericKey && numericKey <= primaryShard.RangeEnd {
-		shardHighTS = primaryShard.HighTS
-	} else {
-		for _, shard := range secondaryShards {
-			if shard.RangeStart <= numericKey && numericKey <= shard.RangeEnd {
-				shardHighTS = shard.HighTS
-				break
-			}
+// Holds a write while the shard of one of its keys is drained, then checks the epochs of its keys (a primary move bumps them)
+// On success (nil) the caller holds writeMu (shared) and has to release it once the write is applied
+func beginWrite(recs []util.Record) *rejection {
+	deadline := time.NewTimer(drainWaitTimeout)
+	defer deadline.Stop()
+
+	for {
+		writeMu.RLock()
+		drained := drainingFor(recs)
+		if drained == nil {
+			break
 		}
-	}
+		writeMu.RUnlock()
 
-	
-	// Return: Key,Value + Obj timestamp + Shard/Node High Timestamp
-	response := struct {
-		Key       string `json:"key"`
-		Value     any    `json:"value"`
-		Timestamp int64  `json:"timestamp"`
-		HighTS	  int64  `json:"highTS"`
-	}{
-		Key:       key,
-		Value:     record.Value,
-		Timestamp: record.Timestamp,
-		HighTS: shardHighTS,
+		select {
+		case <-drained:
+		case <-deadline.C:
+			return &rejection{status: http.StatusServiceUnavailable, message: "The primary of the shard is being moved, retry later"}
+		}
 	}
 
-	json.NewEncoder(w).Encode(response)
-}
-
-func adjustReplicationHandler(w http.ResponseWriter, r *http.Request) {
-	var req struct {
-		ShardID int `json:"shardID"`
-		NewFreq float64 `json:"new_freq"`
-	}
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "invalid json", http.StatusBadRequest)
-		return
+	for _, rec := range recs {
+		if rej := checkWriteEpoch(rec.Key, rec.Epoch); rej != nil {
+			writeMu.RUnlock()
+			return rej
+		}
 	}
+	return nil
+}
 
-	for i := range secondaryShards {
-		if secondaryShards[i].ShardId == req.ShardID {
-			fmt.Printf("Updating replication frequency for shard %d to %d seconds\n", req.ShardID, req.NewFreq)
-			secondaryShards[i].ReplicationFrequencySeconds = req.NewFreq
-			w.WriteHeader(http.StatusOK)
-			return
+// Returns the drain of a shard (this node is primary for) that one of the keys belongs to, or nil (must hold writeMu)
+func drainingFor(recs []util.Record) chan struct{} {
+	for _, rec := range recs {
+		shard := primaryShards.ForKey(rec.Key)
+		if shard == nil {
+			continue
+		}
+		if drained, ok := draining[shard.ShardId]; ok {
+			return drained
 		}
 	}
-	w.WriteHeader(http.StatusOK)
+	return nil
 }
 
-// Endpoint for replciation between storage nodes (pull-based)
-// only invoked for shards that the current storage node is primary for
-func replicationHandler(w http.ResponseWriter, r *http.Request) {
-	sinceStr := r.URL.Query().Get("since")
-	startKeyStr := r.URL.Query().Get("start")
-	endKeyStr := r.URL.Query().Get("end")
-
-	sinceTS, err := strconv.ParseInt(sinceStr, 10, 64)
-	if err != nil {
-		http.Error(w, "Invalid timestamp", http.StatusBadRequest)
-		return
+// Writes carry the configuration epoch the client routed them with (0 until the first failover)
+// If this node is not the primary of the key in that epoch, the write is answered with 421 and the epoch of the node,
+// so the client can fetch the current configuration from the coordinator and retry
+func checkWriteEpoch(key string, epoch int64) *rejection {
+	shard := primaryShards.ForKey(key)
+	if shard == nil {
+		shard = secondaryShards.ForKey(key)
+		if shard == nil {
+			// Not a key of this node at all, the store rejects it
+			return nil
+		}
+	} else if shard.Epoch == epoch {
+		return nil
 	}
-	sinceTime := time.UnixMilli(sinceTS)
 
-	startKey, err := strconv.Atoi(startKeyStr)
-	if err != nil {
-		http.Error(w, "Invalid start range", http.StatusBadRequest)
-		return
+	return &rejection{
+		status:  http.StatusMisdirectedRequest,
+		message: fmt.Sprintf("not the primary of key %s in epoch %d", key, epoch),
+		epoch:   shard.Epoch,
 	}
+}
 
-	endKey, err := strconv.Atoi(endKeyStr)
-	if err != nil {
-		http.Error(w, "Invalid end range", http.StatusBadRequest)
+// Publishes writes accepted by this primary (one write, or the records of a transaction) to the push subscribers and moves the HighTS of their shard
+// All of them are published first, so a heartbeat never announces a HighTS before its updates
+func primaryWritten(recs ...util.Record) {
+	shard := primaryShards.ForKey(recs[0].Key)
+	if shard == nil {
+		// The shard was handed over by a reconfiguration in the meantime
 		return
 	}
-
-	// scan the shard for the timestamps > sinceTime
-	// TODO: this should be improved, right now very expensive
-	updates := localStore.ScanUpdatedKeys(sinceTime, startKey, endKey)
-
-	w.Header().Set("Content-Type", "application/json")
-
-	type Response struct {
-		Updates []util.Record `json:"updates"`
-		Version int64    `json:"version"`
-	}
-
-	var resp Response
-
-	// If no updates, still share the HTS of the shard
-	// NOTE: this is based on the assumption that each node is primary for a shard for now [and this endpoint is only called regarding the same shard that the current node is primary for]
-	if len(updates) == 0 {
-		fmt.Println("No updates to send just sharing the HighTS\n")
-		resp = Response{
-			Updates: nil,
-			Version: primaryShard.HighTS, // TODO: according to 4.3, should this be the node's timestamp itself?
-		}
-	} else {
-		fmt.Println("There exists updates to share with secondaries\n")
-		resp = Response{
-			Updates: updates,
-			Version: -1,
+	for _, rec := range recs {
+		rec.Epoch = shard.Epoch
+		// Subscribers need the version the write replaced to serve reads "as of" before it (left unknown if the key moved on already)
+		if pushHub.Subscribed(shard.ShardId) {
+			if vv, _, err := localStore.GetAt(rec.Key, rec.Timestamp); err == nil && vv.Timestamp == rec.Timestamp {
+				rec.Prev = vv.Prev
+			}
 		}
+		pushHub.Publish(shard.ShardId, rec)
 	}
-
-	if err := json.NewEncoder(w).Encode(resp); err != nil {
-		http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+	for _, rec := range recs {
+		shard.RaiseHighTS(rec.Timestamp)
 	}
+	fmt.Printf("Primary shard %d is updated to HighTS %d\n", shard.ShardId, shard.GetHighTS())
 }
 
-func pullFromPrimary(shard *util.Shard) error {
-	url := fmt.Sprintf("http://%s/replicate?since=%d&start=%d&end=%d", shard.Primary, shard.HighTS, shard.RangeStart, shard.RangeEnd)
-	fmt.Println(url)
-
-	resp, err := http.Get(url)
-	if err != nil {
-		return err
+// Writes several keys in one request (only for keys of the shards this node is primary for)
+// Every key is written on its own, so some keys can fail while the others are stored
+// The epochs are checked up front, a misdirected key fails the whole request
+func handleMSet(w http.ResponseWriter, r *http.Request) {
+	// Every record can expire on its own, like the key of a /set
+	var req struct {
+		Records []struct {
+			util.Record
+			TTLMs int64 `json:"ttl_ms,omitempty"`
+		} `json:"records"`
 	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		fmt.Println(resp);
-		return fmt.Errorf("non-200 from primary: %d", resp.StatusCode)
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
 
-	// Assuming that key and values are being returned with timestamps from the shard primary
-	var response struct {
-		Updates     []struct {
-			Key       string `json:"key"`
-			Value     string `json:"value"`
-			Timestamp int64  `json:"timestamp"`
-		} `json:"updates"`
-		Version int64 `json:"version"` 
+	records := make([]util.Record, 0, len(req.Records))
+	for _, item := range req.Records {
+		if item.TTLMs < 0 {
+			http.Error(w, fmt.Sprintf("ttl_ms of key '%s' must not be negative", item.Key), http.StatusBadRequest)
+			return
+		}
+		records = append(records, item.Record)
 	}
 
-	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
-		return err
+	if rej := beginWrite(records); rej != nil {
+		rej.writeHTTP(w)
+		return
 	}
+	defer writeMu.RUnlock()
 
-	// If there are no updates, then just update the HighTS
-	if len(response.Updates) == 0 {
-		shard.HighTS = response.Version
-	} else {
-		// Apply the updates and HS of the shard
-		for _, update := range response.Updates {
-			fmt.Printf("update recieved is %v\n", update)
+	type msetResult struct {
+		Key          string `json:"key"`
+		PutTimestamp int64  `json:"put_timestamp"`
+		Error        string `json:"error,omitempty"`
+	}
+	results := make([]msetResult, 0, len(req.Records))
 
-			vv := redis.VersionedValue{
-				Value:     update.Value,
-				Timestamp: update.Timestamp,
-			}
-			err := localStore.SetVersioned(update.Key, vv)
-			if err != nil {
-				fmt.Printf("Error setting key %s: %v\n", update.Key, err)
-				continue
-			}
-		
-			// Updating the shard HighTS
-			if update.Timestamp > shard.HighTS {
-				fmt.Printf("Updating the shard HighTs to %d\n", update.Timestamp)
-				shard.HighTS = update.Timestamp
-			}
+	for _, item := range req.Records {
+		obj_ts, err := setKey(item.Record, nil, time.Duration(item.TTLMs) * time.Millisecond)
+		if err != nil {
+			results = append(results, msetResult{Key: item.Key, Error: err.Error()})
+			continue
 		}
+		results = append(results, msetResult{Key: item.Key, PutTimestamp: obj_ts})
 	}
 
-	return nil
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"results": results,
+	})
 }
 
-// This endpoint is called when the primary want to check how up-to-date the secondaries are
-func sendLatestStatus(w http.ResponseWriter, r *http.Request) {
-	// Make a Map of shardID -> high timestamp
-	status := make(map[int]int64) 
-	
-	for _, shard := range secondaryShards {
-		status[shard.ShardId] = shard.HighTS
+// Writes several keys of one shard atomically (only on the primary of the shard): they get a single timestamp and are replicated
+// as one unit, so secondaries never show some of the writes without the others. A record with "deleted": true deletes its key.
+func handleTxn(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Records []util.Record `json:"records"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(req.Records) == 0 {
+		http.Error(w, store.ErrEmptyTxn.Error(), http.StatusBadRequest)
+		return
 	}
-	json.NewEncoder(w).Encode(status)
-}
-
-func handleProbe(w http.ResponseWriter, r *http.Request) {
-	w.WriteHeader(http.StatusOK)
-}
 
-// Before shutting down, persist the shard hightimestam information
-func handleShutdown() {
-	sigs := make(chan os.Signal, 1)
-	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	if rej := beginWrite(req.Records); rej != nil {
+		rej.writeHTTP(w)
+		return
+	}
+	defer writeMu.RUnlock()
 
-	<-sigs
-	fmt.Println("\nReceived shutdown signal. Saving HighTS to disk...")
+	writes := make(map[string]store.VersionedValue, len(req.Records))
+	for _, rec := range req.Records {
+		writes[rec.Key] = store.VersionedValue{Value: rec.Value, Deleted: rec.Deleted}
+	}
+	obj_ts, err := localStore.SetTxn(writes)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 
-	snapshotHighTS()
+	// The published records name the other keys of the transaction, so push subscribers apply them together
+	written := make([]util.Record, 0, len(writes))
+	for key, vv := range store.StampTxn(writes, obj_ts, 0) {
+		written = append(written, util.Record{Key: key, Value: vv.Value, Timestamp: obj_ts, Deleted: vv.Deleted, Txn: vv.Txn, ExpiresAt: vv.ExpiresAt})
+	}
+	primaryWritten(written...)
 
-	os.Exit(0)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int64{
+		"put_timestamp": obj_ts,
+	})
 }
 
-func snapshotHighTS() {
-	snapshot := make(map[int]int64)
-
-	// Add primary shard
-	if (primaryShard.AmIPrimary) {
-		snapshot[primaryShard.ShardId] = primaryShard.HighTS
+// Deletes the key by writing a tombstone (only accepted for keys of the shards this node is primary for)
+func handleDelete(w http.ResponseWriter, r *http.Request) {
+	var rec util.Record
+	if err := json.NewDecoder(r.Body).Decode(&rec); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
-	
 
-	// Add secondary shards
-	for _, shard := range secondaryShards {
-		if (shard.AmISecondary) {
-			snapshot[shard.ShardId] = shard.HighTS
-		}	
+	if rej := beginWrite([]util.Record{rec}); rej != nil {
+		rej.writeHTTP(w)
+		return
 	}
+	defer writeMu.RUnlock()
 
-	data, err := json.MarshalIndent(snapshot, "", "  ")
+	obj_ts, err := deleteKey(rec.Key)
 	if err != nil {
-		fmt.Println("Failed to serialize HighTS snapshot:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	err = os.WriteFile("high_ts_snapshot.json", data, 0644)
-	if err != nil {
-		fmt.Println("Failed to write HighTS snapshot to file:", err)
+	response := map[string]int64{
+		"delete_timestamp": obj_ts,
 	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
 }
 
-// TODO: here we should double check this aligns with existence of these keys in Redis
-func loadHighTSFromSnapshot(shardId int) int64 {
-	data, err := os.ReadFile("high_ts_snapshot.json")
-	if err != nil {
-		fmt.Println("No existing HighTS snapshot found.")
-		return 0
-	}
+// Returned by /get, and per key by /mget
+type getResponse struct {
+	Key       string `json:"key"`
+	Value     any    `json:"value"`
+	Timestamp int64  `json:"timestamp"`
+	HighTS	  int64  `json:"highTS"`
+	Deleted   bool   `json:"deleted,omitempty"`
+	Found     bool   `json:"found"`
+	ExpiresAt int64  `json:"expiresAt,omitempty"`
+}
 
-	var snapshot map[int]int64
-	if err := json.Unmarshal(data, &snapshot); err != nil {
-		fmt.Println("Failed to parse HighTS snapshot:", err)
-		return 0
+// Builds the response for a key read from the local store, as of timestamp at (nil for the latest version)
+// An expiring key is missing once the read timestamp reaches its expiry: for a latest read that is the current time on the primary,
+// and the HighTS of the shard on a secondary, so secondaries that caught up as far agree regardless of their local clocks
+func readResponse(key string, record store.VersionedValue, found bool, at *int64) getResponse {
+	// Find HighTS of the shard for the requested key [should either be one of the primary shards or a secondary shard]
+	var shardHighTS, readTS int64
+	if shard := primaryShards.ForKey(key); shard != nil {
+		shardHighTS = shard.GetHighTS()
+		readTS = hlc.FromTime(time.Now())
+		if readTS < shardHighTS {
+			readTS = shardHighTS
+		}
+	} else if shard := secondaryShards.ForKey(key); shard != nil {
+		shardHighTS = shard.GetHighTS()
+		readTS = shardHighTS
 	}
-
-	if ts, ok := snapshot[shardId]; ok {
-		return ts
+	if at != nil {
+		readTS = *at
+	}
+	expired := record.Expired(readTS)
+	if expired {
+		record.Value = nil
 	}
 
-	return 0
+	// Return: Key,Value + Obj timestamp + Shard/Node High Timestamp
+	return getResponse{
+		Key:       key,
+		Value:     record.Value,
+		Timestamp: record.Timestamp,
+		HighTS: shardHighTS,
+		Deleted: record.Deleted,
+		Found: found && !record.Deleted && !expired,
+		ExpiresAt: record.ExpiresAt,
+	}
 }
 
-func preloadKeys(count int) {
-	fmt.Println("Preloading Redis with deterministic key-value pairs")
+// With ?at=<timestamp> the version of the key as of that timestamp is returned instead of the latest one (see readAt)
+func handleGet(w http.ResponseWriter, r *http.Request) {
+	key := r.URL.Query().Get("key")
+
+	var record store.VersionedValue
+	var found bool
+	var at *int64
+	if atStr := r.URL.Query().Get("at"); atStr != "" {
+		ts, err := strconv.ParseInt(atStr, 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid at timestamp", http.StatusBadRequest)
+			return
+		}
+		at = &ts
+		var rej *rejection
+		record, found, rej = readAt(key, ts)
+		if rej != nil {
+			rej.writeHTTP(w)
+			return
+		}
+	} else {
+		var err error
+		found, err = localStore.Get(key, &record)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	response := readResponse(key, record, found, at)
+
+	// Missing and deleted keys are a 404, but the timestamps are still returned so the client can check consistency
+	w.Header().Set("Content-Type", "application/json")
+	if !response.Found {
+		w.WriteHeader(http.StatusNotFound)
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+// Reads the version of the key as of timestamp at, from the versions the local store retained
+// A secondary only answers once the HighTS of the shard covers at (425 otherwise, the client can ask another node),
+// a primary moves its clock past at first, so no later write is stamped at or below it.
+// A version that was dropped by the retention (or never received by this node) is a 410.
+func readAt(key string, at int64) (store.VersionedValue, bool, *rejection) {
+	if shard := primaryShards.ForKey(key); shard != nil {
+		if at > hlc.FromTime(time.Now()) {
+			return store.VersionedValue{}, false, &rejection{status: http.StatusTooEarly, message: fmt.Sprintf("timestamp %d is in the future", at)}
+		}
+		clock.Update(at)
+	} else if shard := secondaryShards.ForKey(key); shard != nil && shard.GetHighTS() < at {
+		return store.VersionedValue{}, false, &rejection{
+			status:  http.StatusTooEarly,
+			message: fmt.Sprintf("HighTS %d of shard %d does not cover timestamp %d yet", shard.GetHighTS(), shard.ShardId, at),
+		}
+	}
+
+	record, found, err := localStore.GetAt(key, at)
+	if err == store.ErrVersionTrimmed {
+		return store.VersionedValue{}, false, &rejection{status: http.StatusGone, message: err.Error()}
+	}
+	if err != nil {
+		return store.VersionedValue{}, false, &rejection{status: http.StatusInternalServerError, message: err.Error()}
+	}
+	return record, found, nil
+}
+
+// Reads several keys in one request, the results are in the order of the requested keys
+// Missing and deleted keys are returned with found = false (the request itself does not fail)
+func handleMGet(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Keys []string `json:"keys"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	records, err := localStore.GetMulti(req.Keys)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	results := make([]getResponse, 0, len(req.Keys))
+	for _, key := range req.Keys {
+		record, found := records[key]
+		results = append(results, readResponse(key, record, found, nil))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"results": results,
+	})
+}
+
+func adjustReplicationHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		ShardID int `json:"shardID"`
+		NewFreq float64 `json:"new_freq"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid json", http.StatusBadRequest)
+		return
+	}
+
+	if shard, ok := secondaryShards.Get(req.ShardID); ok {
+		fmt.Printf("Updating replication frequency for shard %d to %.2f seconds\n", req.ShardID, req.NewFreq)
+		shard.SetReplicationFrequency(req.NewFreq)
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// Called by the coordinator when the configuration of a shard changes, e.g. its primary failed over to a secondary
+// Only a newer epoch is applied, the node takes the role the new configuration gives it.
+// The loops of the old shard object stop on their own, the ones of the new role are started here
+func reconfigureHandler(w http.ResponseWriter, r *http.Request) {
+	var update util.Shard
+	if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+		http.Error(w, "invalid json", http.StatusBadRequest)
+		return
+	}
+
+	reconfigureMu.Lock()
+	defer reconfigureMu.Unlock()
+
+	if epoch, applied := applyShardConfig(update, nil); !applied {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]int64{
+			"epoch": epoch,
+		})
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// Installs the configuration of a shard, unless the node already has it in the same or a newer epoch (must hold reconfigureMu)
+// For a split or merge, drained (not nil) holds the shards the new one is made of, as this node had them at the drain
+// Returns the epoch of the shard on this node + whether the update was applied
+func applyShardConfig(update util.Shard, drained []*util.Shard) (int64, bool) {
+	current, known := heldShard(update.ShardId)
+	if known && update.Epoch <= current.Epoch {
+		return current.Epoch, false
+	}
+
+	shard := update
+	// A node new to the shard, or one ahead of the takeover point of a new primary (it may hold writes the new primary never got), copies the shard
+	resync := !known
+	if known {
+		// The node keeps its own settings of the shard (and its HighTS), only the range and the roles change
+		shard = *current
+		shard.RangeStart = update.RangeStart
+		shard.RangeEnd = update.RangeEnd
+		shard.Primary = update.Primary
+		shard.PrimaryID = update.PrimaryID
+		shard.Secondaries = update.Secondaries
+		shard.Epoch = update.Epoch
+		shard.EpochStartTS = update.EpochStartTS
+
+		// A range that grew (a merge this node did not take part in) is missing keys
+		resync = update.RangeStart < current.RangeStart || update.RangeEnd > current.RangeEnd ||
+			(current.PrimaryID != shard.PrimaryID && shard.GetHighTS() > shard.EpochStartTS)
+	}
+	shard.AmIPrimary = shard.PrimaryID == storageID
+	shard.AmISecondary = !shard.AmIPrimary && util.Contains(shard.Secondaries, storageID)
+
+	if drained != nil {
+		// Nothing was written to the range since the drain, so a node holding all of it is exactly at the point of the change
+		hasData := coversRange(drained, shard.RangeStart, shard.RangeEnd)
+		resync = !hasData
+		shard.SetHighTS(0)
+		if hasData {
+			shard.SetHighTS(shard.EpochStartTS)
+			if err := localStore.SaveHighTS(shard.ShardId, shard.GetHighTS()); err != nil {
+				fmt.Printf("Failed to save the HighTS of shard %d: %v\n", shard.ShardId, err)
+			}
+		} else if shard.AmIPrimary {
+			fmt.Printf("[WARN] Primary of shard %d without all of its data up to %d\n", shard.ShardId, shard.EpochStartTS)
+		}
+	}
+
+	if shard.AmIPrimary {
+		// Writes of the new epoch must be stamped above everything the shard had when it was taken over
+		shard.RaiseHighTS(shard.EpochStartTS)
+		clock.Update(shard.GetHighTS())
+
+		secondaryShards.Remove(shard.ShardId)
+		primaryShards.Put(&shard)
+		go trimChangeLog(&shard)
+	} else if shard.AmISecondary {
+		primaryShards.Remove(shard.ShardId)
+		secondaryShards.Put(&shard)
+		startReplication(&shard, resync)
+	} else {
+		primaryShards.Remove(shard.ShardId)
+		secondaryShards.Remove(shard.ShardId)
+	}
+
+	// Writes held by a drain now find the shard moved and are sent to the new primary
+	endDrain(shard.ShardId, nil)
+
+	fmt.Printf("Shard %d reconfigured to [%d, %d] in epoch %d: primary %s (%s), secondaries %v, HighTS %d\n",
+		shard.ShardId, shard.RangeStart, shard.RangeEnd, shard.Epoch, shard.PrimaryID, shard.Primary, shard.Secondaries, shard.GetHighTS())
+	return shard.Epoch, true
+}
+
+// Gets /config from the coordinator, with after >= 0 it waits for a version with a newer epoch (nil if none came up)
+func fetchConfig(client *http.Client, after int64) (*util.Config, error) {
+	url := coordinatorURL + "/config"
+	if after >= 0 {
+		url = fmt.Sprintf("%s?after=%d", url, after)
+	}
+
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotModified {
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("non-200 from the coordinator: %d", resp.StatusCode)
+	}
+
+	var conf util.Config
+	if err := json.NewDecoder(resp.Body).Decode(&conf); err != nil {
+		return nil, fmt.Errorf("invalid config: %v", err)
+	}
+	return &conf, nil
+}
+
+// Long-polls the coordinator for new config versions, they cover the changes that were pushed while the node was unreachable
+// (changes pushed through /reconfigure and /reshard are in the next version as well, and skipped as already applied)
+func watchConfig() {
+	for {
+		conf, err := fetchConfig(watchClient, configEpoch)
+		if err != nil {
+			fmt.Printf("Failed to watch the config of the coordinator: %v\n", err)
+			time.Sleep(configWatchRetryDelay)
+			continue
+		}
+		// The stored keys would have to move to other shards, which is not supported
+		if conf != nil && conf.Partitioning.Name() != util.Partitioning.Name() {
+			fmt.Printf("Ignoring config epoch %d: it partitions keys by %s instead of %s\n", conf.Epoch, conf.Partitioning.Name(), util.Partitioning.Name())
+			time.Sleep(configWatchRetryDelay)
+			continue
+		}
+		if conf != nil {
+			applyConfig(conf)
+		}
+	}
+}
+
+// Brings every shard of this node up to a full config version of the coordinator
+func applyConfig(conf *util.Config) {
+	reconfigureMu.Lock()
+	defer reconfigureMu.Unlock()
+
+	if conf.Epoch <= configEpoch {
+		return
+	}
+	setNodeAddresses(conf.Nodes)
+
+	inConfig := make(map[int]bool)
+	for _, shard := range conf.Shards {
+		inConfig[shard.ShardId] = true
+
+		_, known := heldShard(shard.ShardId)
+		if known || shard.PrimaryID == storageID || util.Contains(shard.Secondaries, storageID) {
+			applyShardConfig(shard, nil)
+		}
+	}
+
+	// Shards that were merged into others in the meantime
+	for _, shard := range append(primaryShards.All(), secondaryShards.All()...) {
+		if !inConfig[shard.ShardId] {
+			fmt.Printf("Shard %d is not in config epoch %d anymore, dropping it\n", shard.ShardId, conf.Epoch)
+			primaryShards.Remove(shard.ShardId)
+			secondaryShards.Remove(shard.ShardId)
+			endDrain(shard.ShardId, nil)
+		}
+	}
+
+	configEpoch = conf.Epoch
+	fmt.Printf("Applied config epoch %d\n", conf.Epoch)
+}
+
+func setNodeAddresses(nodes []util.StorageNode) {
+	nodeAddressesMu.Lock()
+	defer nodeAddressesMu.Unlock()
+
+	nodeAddresses = make(map[string]string, len(nodes))
+	nodeGRPCAddresses = make(map[string]string)
+	for _, node := range nodes {
+		nodeAddresses[node.Id] = node.Address
+		if node.GRPCAddress != "" {
+			nodeGRPCAddresses[node.Address] = node.GRPCAddress
+		}
+	}
+}
+
+func nodeAddress(id string) (string, bool) {
+	nodeAddressesMu.RLock()
+	defer nodeAddressesMu.RUnlock()
+
+	addr, ok := nodeAddresses[id]
+	return addr, ok
+}
+
+// The gRPC address of the node with the given (HTTP) address, if it serves gRPC
+func nodeGRPCAddress(address string) (string, bool) {
+	nodeAddressesMu.RLock()
+	defer nodeAddressesMu.RUnlock()
+
+	addr, ok := nodeGRPCAddresses[address]
+	return addr, ok
+}
+
+// Called by the coordinator before it moves the primary of a shard (this node is primary for) to another node
+// New writes of the shard are held once the ones in flight are done, the returned HighTS covers every accepted write.
+// The drain ends with the /reconfigure of the move, when it is cancelled, or after timeoutSeconds
+func drainHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		ShardID        int     `json:"shardID"`
+		Cancel         bool    `json:"cancel"`
+		TimeoutSeconds float64 `json:"timeoutSeconds"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid json", http.StatusBadRequest)
+		return
+	}
+
+	if req.Cancel {
+		endDrain(req.ShardID, nil)
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	shard, ok := primaryShards.Get(req.ShardID)
+	if !ok {
+		http.Error(w, fmt.Sprintf("Not the primary for shard %d", req.ShardID), http.StatusNotFound)
+		return
+	}
+
+	timeout := time.Duration(req.TimeoutSeconds * float64(time.Second))
+	if timeout <= 0 {
+		timeout = defaultDrainDuration
+	}
+
+	writeMu.Lock()
+	if _, already := draining[req.ShardID]; !already {
+		drained := make(chan struct{})
+		draining[req.ShardID] = drained
+		time.AfterFunc(timeout, func() {
+			endDrain(req.ShardID, drained)
+		})
+	}
+	highTS := shard.GetHighTS()
+	writeMu.Unlock()
+
+	fmt.Printf("Drained the writes of shard %d at HighTS %d\n", req.ShardID, highTS)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int64{
+		"highTS": highTS,
+	})
+}
+
+// Ends the drain of the shard (if drained is given, only that drain) and lets the held writes continue
+func endDrain(shardID int, drained chan struct{}) {
+	writeMu.Lock()
+	defer writeMu.Unlock()
+
+	current, ok := draining[shardID]
+	if !ok || (drained != nil && current != drained) {
+		return
+	}
+	close(current)
+	delete(draining, shardID)
+	fmt.Printf("Drain of shard %d ended\n", shardID)
+}
+
+// Returns the shard if this node is primary or secondary for it
+func heldShard(id int) (*util.Shard, bool) {
+	if shard, ok := primaryShards.Get(id); ok {
+		return shard, true
+	}
+	return secondaryShards.Get(id)
+}
+
+// Called by the coordinator when shards are split or merged, with the new layout of every shard the change touched
+// The new shards are made of the ones in "from", drained by their primary at the given HighTS. A node that has all of
+// them up to that point keeps its data, any other replica of a new shard copies it from a snapshot of the primary.
+func reshardHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Epoch   int64         `json:"epoch"`
+		Shards  []util.Shard  `json:"shards"`
+		Removed []int         `json:"removed"`
+		From    map[int]int64 `json:"from"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid json", http.StatusBadRequest)
+		return
+	}
+
+	reconfigureMu.Lock()
+	defer reconfigureMu.Unlock()
+
+	involved := append([]int{}, req.Removed...)
+	for _, shard := range req.Shards {
+		involved = append(involved, shard.ShardId)
+	}
+	for id := range req.From {
+		involved = append(involved, id)
+	}
+	for _, id := range involved {
+		if current, ok := heldShard(id); ok && req.Epoch <= current.Epoch {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(map[string]int64{
+				"epoch": current.Epoch,
+			})
+			return
+		}
+	}
+
+	// The shards the new ones are made of, as this node has them before the change (empty, not nil: see applyShardConfig)
+	parents := []*util.Shard{}
+	for id, drainedTS := range req.From {
+		if parent, ok := heldShard(id); ok && parent.GetHighTS() >= drainedTS {
+			parents = append(parents, parent)
+		}
+	}
+
+	for _, id := range req.Removed {
+		primaryShards.Remove(id)
+		secondaryShards.Remove(id)
+	}
+
+	for _, update := range req.Shards {
+		applyShardConfig(update, parents)
+	}
+
+	// Writes held by the drains now find the new layout, and the epoch of their key moved on
+	for id := range req.From {
+		endDrain(id, nil)
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// Reports whether the shards together hold every key in [start, end]
+func coversRange(shards []*util.Shard, start int, end int) bool {
+	sorted := append([]*util.Shard{}, shards...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].RangeStart < sorted[j].RangeStart
+	})
+
+	next := start
+	for _, shard := range sorted {
+		if shard.RangeStart > next {
+			break
+		}
+		if shard.RangeEnd >= next {
+			next = shard.RangeEnd + 1
+		}
+	}
+	return next > end
+}
+
+// Endpoint for replciation between storage nodes (pull-based)
+// only invoked for shards that the current storage node is primary for
+// At most "limit" updates are returned per call, the version of the response is where the next page continues from (as "since")
+func replicationHandler(w http.ResponseWriter, r *http.Request) {
+	sinceStr := r.URL.Query().Get("since")
+	shardStr := r.URL.Query().Get("shard")
+
+	sinceTS, err := strconv.ParseInt(sinceStr, 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid timestamp", http.StatusBadRequest)
+		return
+	}
+
+	shardID, err := strconv.Atoi(shardStr)
+	if err != nil {
+		http.Error(w, "Invalid shard id", http.StatusBadRequest)
+		return
+	}
+
+	epoch, err := epochParam(r)
+	if err != nil {
+		http.Error(w, "Invalid epoch", http.StatusBadRequest)
+		return
+	}
+
+	limit := 0
+	if limitStr := r.URL.Query().Get("limit"); limitStr != "" {
+		limit, err = strconv.Atoi(limitStr)
+		if err != nil || limit <= 0 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+	}
+
+	page, rej := readReplicationPage(shardID, sinceTS, epoch, limit)
+	if rej != nil {
+		rej.writeHTTP(w)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(page); err != nil {
+		http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+	}
+}
+
+// A page of updates for a secondary (pull-based replication)
+type replicationPage struct {
+	Updates []util.Record `json:"updates"`
+	Version int64    `json:"version"`
+	More    bool     `json:"more,omitempty"`	// there are updates after this page, continue with since = version
+}
+
+// Reads the updates after sinceTS of a shard this node is primary for, at most limit of them (the default page size if 0)
+func readReplicationPage(shardID int, sinceTS int64, epoch *int64, limit int) (*replicationPage, *rejection) {
+	if limit <= 0 {
+		limit = defaultReplicationPageSize
+	}
+	if limit > maxReplicationPageSize {
+		limit = maxReplicationPageSize
+	}
+
+	shard, ok := primaryShards.Get(shardID)
+	if !ok {
+		return nil, &rejection{status: http.StatusNotFound, message: fmt.Sprintf("Not the primary for shard %d", shardID)}
+	}
+	if rej := checkReplicationEpoch(shard, epoch, sinceTS); rej != nil {
+		return nil, rej
+	}
+
+	// Taken before the scan: the stores commit the writes of a shard in timestamp order and the HighTS is raised once a write
+	// is committed, so every write up to it is either in the scan or was overwritten by a later one that is
+	highTS := shard.GetHighTS()
+
+	// read the updates with timestamps > sinceTS from the change index of the shard
+	updates, upTo, more, err := localStore.ScanUpdatedKeys(shardID, sinceTS, limit)
+	if err == store.ErrChangesTrimmed {
+		return nil, &rejection{status: http.StatusGone, message: err.Error()}
+	}
+	if err != nil {
+		return nil, &rejection{status: http.StatusInternalServerError, message: err.Error()}
+	}
+
+	// The page covers the change index up to the last entry read (not the timestamps of the values, which may be newer)
+	page := &replicationPage{
+		Updates: completeTransactions(updates),
+		Version: upTo,
+		More:    more,
+	}
+	if len(updates) > 0 {
+		fmt.Printf("Sharing %d updates of shard %d with a secondary (more: %v)\n", len(updates), shardID, more)
+	}
+	// Only the last page covers everything up to the HighTS (if no updates, still share the HTS of the shard)
+	// Not the clock of the node: a write may already hold an older timestamp without being committed yet
+	if !more && highTS > page.Version {
+		page.Version = highTS
+	}
+	return page, nil
+}
+
+// Adds the records of the transactions in updates that are missing from it (written again since, or cut off by the page limit),
+// as of the transaction timestamp, so a secondary gets every transaction as a whole (the records with the same timestamp)
+// A record whose version was dropped by the retention is left out, it only reaches the secondaries with its newer version
+func completeTransactions(updates []util.Record) []util.Record {
+	completed := make([]util.Record, 0, len(updates))
+	for i := 0; i < len(updates); {
+		j := i + 1
+		for j < len(updates) && updates[j].Timestamp == updates[i].Timestamp {
+			j++
+		}
+		group := updates[i:j]
+		completed = append(completed, group...)
+		i = j
+
+		present := make(map[string]bool, len(group))
+		for _, rec := range group {
+			present[rec.Key] = true
+		}
+		for _, key := range group[0].Txn {
+			if present[key] {
+				continue
+			}
+			vv, _, err := localStore.GetAt(key, group[0].Timestamp)
+			if err != nil || vv.Timestamp != group[0].Timestamp {
+				continue
+			}
+			completed = append(completed, util.Record{
+				Key:       key,
+				Value:     vv.Value,
+				Timestamp: vv.Timestamp,
+				Deleted:   vv.Deleted,
+				Epoch:     vv.Epoch,
+				Prev:      vv.Prev,
+				Txn:       vv.Txn,
+				ExpiresAt: vv.ExpiresAt,
+			})
+		}
+	}
+	return completed
+}
+
+// The epoch a secondary replicates in (nil if the request has none)
+func epochParam(r *http.Request) (*int64, error) {
+	epochStr := r.URL.Query().Get("epoch")
+	if epochStr == "" {
+		return nil, nil
+	}
+	epoch, err := strconv.ParseInt(epochStr, 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	return &epoch, nil
+}
+
+// Secondaries replicate in the epoch they know of, one of another epoch gets a 421 (until it is reconfigured as well)
+// A secondary that is behind the point where this primary took over has to resync,
+// the change index of the shard only covers the writes of this primary
+func checkReplicationEpoch(shard *util.Shard, epoch *int64, sinceTS int64) *rejection {
+	if epoch != nil && *epoch != shard.Epoch {
+		return &rejection{
+			status:  http.StatusMisdirectedRequest,
+			message: fmt.Sprintf("Shard %d is in epoch %d, not %d", shard.ShardId, shard.Epoch, *epoch),
+			epoch:   shard.Epoch,
+		}
+	}
+
+	if sinceTS < shard.EpochStartTS {
+		return &rejection{
+			status:  http.StatusGone,
+			message: fmt.Sprintf("Shard %d changed primary at %d, resync from a snapshot", shard.ShardId, shard.EpochStartTS),
+		}
+	}
+	return nil
+}
+
+// Pulls the updates of the shard since its HighTS from the primary, page by page
+// The HighTS only moves past a page once all of it is applied, so a failure in between resumes from there
+func pullFromPrimary(shard *util.Shard) error {
+	for {
+		since := shard.GetHighTS()
+		more, err := pullPage(shard)
+		if err != nil {
+			return err
+		}
+		// Stop on the last page, when the shard was reconfigured meanwhile or when the primary made no progress
+		if !more || !isCurrentSecondary(shard) || shard.GetHighTS() <= since {
+			return nil
+		}
+	}
+}
+
+// Pulls and applies one page of updates, reports whether the primary has more of them
+func pullPage(shard *util.Shard) (bool, error) {
+	var page *replicationPage
+	var err error
+	if grpcAddress, ok := nodeGRPCAddress(shard.Primary); ok && replicationTransport == grpcTransport {
+		page, err = fetchPageGRPC(shard, grpcAddress)
+	} else {
+		page, err = fetchPageHTTP(shard)
+	}
+
+	// The primary already trimmed some of the updates we are missing, so the whole shard has to be copied
+	if err == store.ErrChangesTrimmed {
+		fmt.Printf("Shard %d is behind the change log retention of %s, bootstrapping from a snapshot\n", shard.ShardId, shard.Primary)
+		return false, bootstrapFromSnapshot(shard)
+	}
+	if err != nil {
+		return false, err
+	}
+
+	// Apply the updates and HS of the shard, the records of a transaction (same timestamp) together
+	for i := 0; i < len(page.Updates); {
+		j := i + 1
+		for j < len(page.Updates) && page.Updates[j].Timestamp == page.Updates[i].Timestamp {
+			j++
+		}
+		// The HighTS must not pass an update that is missing, the next pull retries from here
+		if err := applyReplicated(shard, page.Updates[i:j]); err != nil {
+			return false, err
+		}
+		i = j
+	}
+
+	// The whole page is applied, so everything up to its version is here
+	shard.RaiseHighTS(page.Version)
+	return page.More, nil
+}
+
+// Stores updates of the shard from its primary (one write, or the records of one transaction, which are stored at once) and moves the HighTS
+// The persisted HighTS moves with the updates, so a crash never leaves it ahead of the data
+func applyReplicated(shard *util.Shard, updates []util.Record) error {
+	records := make(map[string]store.VersionedValue, len(updates))
+	var highest int64
+	for _, update := range updates {
+		if staleEpochWrite(shard.ShardId, update) {
+			continue
+		}
+		records[update.Key] = replicatedValue(update)
+		if update.Timestamp > highest {
+			highest = update.Timestamp
+		}
+	}
+	if len(records) == 0 {
+		return nil
+	}
+
+	if len(records) == 1 {
+		for key, vv := range records {
+			if err := localStore.SetReplicated(shard.ShardId, key, vv); err != nil {
+				return fmt.Errorf("error setting key %s: %v", key, err)
+			}
+		}
+	} else if err := localStore.SetReplicatedTxn(shard.ShardId, records); err != nil {
+		return fmt.Errorf("error setting the %d keys of the transaction at %d: %v", len(records), highest, err)
+	}
+
+	// Updating the shard HighTS
+	if shard.RaiseHighTS(highest) {
+		fmt.Printf("Updating the shard HighTs to %d\n", highest)
+	}
+	return nil
+}
+
+// The record of a replicated update, as stored by the secondary
+func replicatedValue(rec util.Record) store.VersionedValue {
+	vv := store.VersionedValue{
+		Value:     rec.Value,
+		Timestamp: rec.Timestamp,
+		Deleted:   rec.Deleted,
+		Epoch:     rec.Epoch,
+		Prev:      rec.Prev,
+		Txn:       rec.Txn,
+		ExpiresAt: rec.ExpiresAt,
+	}
+	if rec.Deleted {
+		vv.Value = nil
+	}
+	return vv
+}
+
+// Fetches the next page of the shard from /replicate of the primary (ErrChangesTrimmed on a 410)
+func fetchPageHTTP(shard *util.Shard) (*replicationPage, error) {
+	url := fmt.Sprintf("http://%s/replicate?since=%d&shard=%d&epoch=%d&limit=%d", shard.Primary, shard.GetHighTS(), shard.ShardId, shard.Epoch, defaultReplicationPageSize)
+
+	resp, err := http.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusGone {
+		return nil, store.ErrChangesTrimmed
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("non-200 from primary: %d", resp.StatusCode)
+	}
+
+	// Assuming that key and values are being returned with timestamps from the shard primary
+	var page replicationPage
+	if err := json.NewDecoder(resp.Body).Decode(&page); err != nil {
+		return nil, err
+	}
+	return &page, nil
+}
+
+// Header of a /snapshot response, followed by one JSON record per line
+type snapshotHeader struct {
+	ShardID int   `json:"shard"`
+	HighTS  int64 `json:"highTS"`
+}
+
+// Streams every key of a shard (that this node is primary for) as newline delimited JSON
+// The HighTS is taken before the dump: the writes of a shard commit in timestamp order before raising it,
+// so all writes up to it are included and later ones are picked up by the next pulls
+func snapshotHandler(w http.ResponseWriter, r *http.Request) {
+	shardID, err := strconv.Atoi(r.URL.Query().Get("shard"))
+	if err != nil {
+		http.Error(w, "Invalid shard id", http.StatusBadRequest)
+		return
+	}
+
+	shard, ok := primaryShards.Get(shardID)
+	if !ok {
+		http.Error(w, fmt.Sprintf("Not the primary for shard %d", shardID), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	enc := json.NewEncoder(w)
+
+	header := snapshotHeader{
+		ShardID: shardID,
+		HighTS:  shard.GetHighTS(),
+	}
+	if err := enc.Encode(header); err != nil {
+		return
+	}
+
+	count := 0
+	err = localStore.ScanShard(shard.RangeStart, shard.RangeEnd, func(rec util.Record) error {
+		count++
+		return enc.Encode(rec)
+	})
+	if err != nil {
+		// The status line is already sent, the secondary notices the truncated stream
+		fmt.Printf("Failed to stream the snapshot of shard %d: %v\n", shardID, err)
+		return
+	}
+	fmt.Printf("Sent snapshot of shard %d with %d keys and HighTS %d\n", shardID, count, header.HighTS)
+}
+
+// Replaces the local copy of the shard with a snapshot of the primary and adopts the primary's HighTS
+func bootstrapFromSnapshot(shard *util.Shard) error {
+	url := fmt.Sprintf("http://%s/snapshot?shard=%d", shard.Primary, shard.ShardId)
+
+	resp, err := http.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("non-200 from primary for snapshot: %d", resp.StatusCode)
+	}
+
+	dec := json.NewDecoder(resp.Body)
+
+	var header snapshotHeader
+	if err := dec.Decode(&header); err != nil {
+		return fmt.Errorf("invalid snapshot header: %v", err)
+	}
+
+	// The whole snapshot is staged first, a broken stream leaves the shard as it was
+	staged := make(map[string]store.VersionedValue)
+	for dec.More() {
+		var rec util.Record
+		if err := dec.Decode(&rec); err != nil {
+			return fmt.Errorf("snapshot stream broken after %d keys: %v", len(staged), err)
+		}
+		staged[rec.Key] = replicatedValue(rec)
+	}
+	keys := len(staged)
+
+	// Local keys of the shard that the primary does not have anymore were deleted (and purged) by its HighTS,
+	// they get a tombstone at it, so their older versions stay readable "as of" before it
+	stale := 0
+	err = localStore.ScanShard(shard.RangeStart, shard.RangeEnd, func(rec util.Record) error {
+		if _, ok := staged[rec.Key]; !ok && !rec.Deleted {
+			prev := rec.Timestamp
+			staged[rec.Key] = store.VersionedValue{Timestamp: header.HighTS, Deleted: true, Epoch: shard.Epoch, Prev: &prev}
+			stale++
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// Applied in one transaction, so readers see the shard either as it was or as of the snapshot, never half of it
+	if len(staged) > 0 {
+		if err := localStore.SetReplicatedTxn(shard.ShardId, staged); err != nil {
+			return err
+		}
+	}
+
+	shard.SetHighTS(header.HighTS)
+	if err := localStore.SaveHighTS(shard.ShardId, shard.GetHighTS()); err != nil {
+		return err
+	}
+	fmt.Printf("Bootstrapped shard %d from snapshot: %d keys, %d stale keys deleted, HighTS %d\n", shard.ShardId, keys, stale, shard.GetHighTS())
+	return nil
+}
+
+// One line of a /subscribe stream: either an update, or a heartbeat carrying the HighTS of the primary shard
+type pushMessage struct {
+	Update *util.Record `json:"update,omitempty"`
+	HighTS int64        `json:"highTS"`
+}
+
+// Endpoint for push-based replication: streams the writes of a shard that this node is primary for
+// First the backlog after "since" is read from the change index, then every accepted Set is forwarded as it happens
+func subscribeHandler(w http.ResponseWriter, r *http.Request) {
+	sinceTS, err := strconv.ParseInt(r.URL.Query().Get("since"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid timestamp", http.StatusBadRequest)
+		return
+	}
+
+	shardID, err := strconv.Atoi(r.URL.Query().Get("shard"))
+	if err != nil {
+		http.Error(w, "Invalid shard id", http.StatusBadRequest)
+		return
+	}
+
+	shard, ok := primaryShards.Get(shardID)
+	if !ok {
+		http.Error(w, fmt.Sprintf("Not the primary for shard %d", shardID), http.StatusNotFound)
+		return
+	}
+	epoch, err := epochParam(r)
+	if err != nil {
+		http.Error(w, "Invalid epoch", http.StatusBadRequest)
+		return
+	}
+	if rej := checkReplicationEpoch(shard, epoch, sinceTS); rej != nil {
+		rej.writeHTTP(w)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	// Subscribe before reading the backlog so no write falls in between (duplicates are fine for the secondary)
+	sub := pushHub.Subscribe(shardID)
+	defer pushHub.Unsubscribe(sub)
+
+	backlogHighTS := shard.GetHighTS()
+	backlog, _, _, err := localStore.ScanUpdatedKeys(shardID, sinceTS, 0)
+	if err == store.ErrChangesTrimmed {
+		http.Error(w, err.Error(), http.StatusGone)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	backlog = completeTransactions(backlog)
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	enc := json.NewEncoder(w)
+
+	for i := range backlog {
+		if err := enc.Encode(pushMessage{Update: &backlog[i]}); err != nil {
+			return
+		}
+	}
+	if err := enc.Encode(pushMessage{HighTS: backlogHighTS}); err != nil {
+		return
+	}
+	flusher.Flush()
+	fmt.Printf("Secondary subscribed to shard %d (sent %d backlog updates)\n", shardID, len(backlog))
+
+	heartbeat := time.NewTicker(pushHeartbeatInterval)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+
+		case rec, ok := <-sub.C:
+			if !ok {
+				fmt.Printf("Secondary fell behind on shard %d, closing its stream\n", shardID)
+				return
+			}
+			if err := enc.Encode(pushMessage{Update: &rec}); err != nil {
+				return
+			}
+			flusher.Flush()
+
+		case <-heartbeat.C:
+			// Read the HighTS first, then send whatever was published before it
+			highTS := shard.GetHighTS()
+			for pending := true; pending; {
+				select {
+				case rec, ok := <-sub.C:
+					if !ok {
+						return
+					}
+					if err := enc.Encode(pushMessage{Update: &rec}); err != nil {
+						return
+					}
+				default:
+					pending = false
+				}
+			}
+			if err := enc.Encode(pushMessage{HighTS: highTS}); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+// Keeps a /subscribe stream to the primary of the shard open, reconnecting whenever it breaks
+// It stops once the shard is replaced by a reconfiguration (noticed at the latest with the next heartbeat)
+func streamFromPrimary(shard *util.Shard, resync bool) {
+	for isCurrentSecondary(shard) {
+		var err error
+		if resync {
+			err = bootstrapFromSnapshot(shard)
+			resync = err != nil
+		} else {
+			err = applyPushStream(shard)
+		}
+		if err != nil {
+			fmt.Printf("Push replication error from primary %s: %v\n", shard.Primary, err)
+		}
+		time.Sleep(pushReconnectDelay)
+	}
+	fmt.Printf("Stopped streaming shard %d from %s\n", shard.ShardId, shard.Primary)
+}
+
+func applyPushStream(shard *util.Shard) error {
+	url := fmt.Sprintf("http://%s/subscribe?since=%d&shard=%d&epoch=%d", shard.Primary, shard.GetHighTS(), shard.ShardId, shard.Epoch)
+
+	resp, err := streamClient.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusGone {
+		fmt.Printf("Shard %d is behind the change log retention of %s, bootstrapping from a snapshot\n", shard.ShardId, shard.Primary)
+		return bootstrapFromSnapshot(shard)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("non-200 from primary: %d", resp.StatusCode)
+	}
+
+	// Records of a transaction are held back (by timestamp) until all of them arrived,
+	// or a heartbeat says that nothing more is coming (some of them may only be replicated with a newer version)
+	pending := make(map[int64]map[string]util.Record)
+
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var msg pushMessage
+		if err := dec.Decode(&msg); err != nil {
+			return err
+		}
+
+		if !isCurrentSecondary(shard) {
+			return nil
+		}
+
+		if msg.Update != nil {
+			update := *msg.Update
+			var updates []util.Record
+			if len(update.Txn) == 0 {
+				updates = []util.Record{update}
+			} else {
+				if pending[update.Timestamp] == nil {
+					pending[update.Timestamp] = make(map[string]util.Record)
+				}
+				pending[update.Timestamp][update.Key] = update
+				if len(pending[update.Timestamp]) <= len(update.Txn) {
+					continue
+				}
+				updates = txnRecords(pending[update.Timestamp])
+				delete(pending, update.Timestamp)
+			}
+
+			// Streams may deliver an update more than once or after a newer one, older versions are skipped by the store
+			if err := applyReplicated(shard, updates); err != nil {
+				fmt.Println(err)
+			}
+			continue
+		}
+
+		for ts, records := range pending {
+			if ts > msg.HighTS {
+				continue
+			}
+			if err := applyReplicated(shard, txnRecords(records)); err != nil {
+				fmt.Println(err)
+			}
+			delete(pending, ts)
+		}
+		shard.RaiseHighTS(msg.HighTS)
+	}
+}
+
+// The records of a transaction held back by applyPushStream
+func txnRecords(records map[string]util.Record) []util.Record {
+	updates := make([]util.Record, 0, len(records))
+	for _, rec := range records {
+		updates = append(updates, rec)
+	}
+	return updates
+}
+
+// This endpoint is called when the primary want to check how up-to-date the secondaries are
+func sendLatestStatus(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(secondaryStatus())
+}
+
+// Map of shardID -> high timestamp, for the shards this node is secondary for
+func secondaryStatus() map[int]int64 {
+	status := make(map[int]int64) 
+	
+	for _, shard := range secondaryShards.All() {
+		status[shard.ShardId] = shard.GetHighTS()
+	}
+	return status
+}
+
+// Periodically drops change index entries that are older than the retention of the shard
+func trimChangeLog(shard *util.Shard) {
+	retention := time.Duration(shard.ChangeLogRetentionSeconds * float64(time.Second))
+	if retention <= 0 {
+		retention = defaultChangeLogRetention
+	}
+
+	ticker := time.NewTicker(changeLogTrimInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		// Stop once the shard is handed over (or replaced) by a reconfiguration
+		if current, ok := primaryShards.Get(shard.ShardId); !ok || current != shard {
+			return
+		}
+
+		cutoff := hlc.FromTime(time.Now().Add(-retention))
+		removed, err := localStore.TrimChangeLog(shard.ShardId, cutoff)
+		if err != nil {
+			fmt.Printf("Failed to trim the change log of shard %d: %v\n", shard.ShardId, err)
+			continue
+		}
+		if removed > 0 {
+			fmt.Printf("Trimmed %d entries from the change log of shard %d\n", removed, shard.ShardId)
+		}
+	}
+}
+
+// Periodically drops tombstones that all replicas of their shard have applied
+func purgeTombstones() {
+	ticker := time.NewTicker(tombstonePurgeInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		for _, shard := range primaryShards.All() {
+			upTo, err := minSecondaryHighTS(shard)
+			if err != nil {
+				fmt.Printf("Not purging tombstones of shard %d: %v\n", shard.ShardId, err)
+				continue
+			}
+			purgeShardTombstones(shard, upTo)
+		}
+
+		// Nobody replicates from a secondary, so it can drop everything it has applied
+		for _, shard := range secondaryShards.All() {
+			purgeShardTombstones(shard, shard.GetHighTS())
+		}
+	}
+}
+
+func purgeShardTombstones(shard *util.Shard, upTo int64) {
+	purged, err := localStore.PurgeTombstones(shard, upTo)
+	if err != nil {
+		fmt.Printf("Failed to purge tombstones of shard %d: %v\n", shard.ShardId, err)
+		return
+	}
+	if purged > 0 {
+		fmt.Printf("Purged %d tombstones of shard %d up to %d\n", purged, shard.ShardId, upTo)
+	}
+}
+
+// Lowest HighTS of the shard over all of its secondaries (asked through /status)
+func minSecondaryHighTS(shard *util.Shard) (int64, error) {
+	minHighTS := shard.GetHighTS()
+
+	for _, secondaryID := range shard.Secondaries {
+		addr, ok := nodeAddress(secondaryID)
+		if !ok {
+			return 0, fmt.Errorf("no address for secondary %s", secondaryID)
+		}
+
+		resp, err := statusClient.Get(fmt.Sprintf("http://%s/status", addr))
+		if err != nil {
+			return 0, err
+		}
+
+		var status map[int]int64
+		err = json.NewDecoder(resp.Body).Decode(&status)
+		resp.Body.Close()
+		if err != nil {
+			return 0, fmt.Errorf("invalid status from %s: %v", addr, err)
+		}
+
+		highTS, ok := status[shard.ShardId]
+		if !ok {
+			return 0, fmt.Errorf("secondary %s does not report shard %d", secondaryID, shard.ShardId)
+		}
+		if highTS < minHighTS {
+			minHighTS = highTS
+		}
+	}
+	return minHighTS, nil
+}
+
+func handleProbe(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+}
+
+// ========== gRPC transport ==========
+
+// The Storage and Replication services of proto/pileus.proto, they share the logic of the HTTP handlers
+type storageService struct {
+	pileuspb.UnimplementedStorageServer
+}
+
+type replicationService struct {
+	pileuspb.UnimplementedReplicationServer
+}
+
+func serveGRPC(address string) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		fmt.Printf("Failed to listen for gRPC on %s: %v\n", address, err)
+		os.Exit(1)
+	}
+
+	server := grpc.NewServer()
+	pileuspb.RegisterStorageServer(server, storageService{})
+	pileuspb.RegisterReplicationServer(server, replicationService{})
+
+	fmt.Println("Storage node serving gRPC on", address)
+	if err := server.Serve(listener); err != nil {
+		fmt.Println("gRPC server stopped:", err)
+	}
+}
+
+func (storageService) Get(ctx context.Context, req *pileuspb.GetRequest) (*pileuspb.GetResponse, error) {
+	var record store.VersionedValue
+	var found bool
+	if req.At != nil {
+		var rej *rejection
+		record, found, rej = readAt(req.Key, *req.At)
+		if rej != nil {
+			return nil, rej.grpcError(ctx)
+		}
+	} else {
+		var err error
+		found, err = localStore.Get(req.Key, &record)
+		if err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+
+	response := readResponse(req.Key, record, found, req.At)
+	return &pileuspb.GetResponse{
+		Key:       response.Key,
+		Value:     valueString(response.Value),
+		Timestamp: response.Timestamp,
+		HighTs:    response.HighTS,
+		Deleted:   response.Deleted,
+		Found:     response.Found,
+		ExpiresAt: response.ExpiresAt,
+	}, nil
+}
+
+func (storageService) Set(ctx context.Context, req *pileuspb.SetRequest) (*pileuspb.WriteResponse, error) {
+	rec := util.Record{Key: req.Key, Value: req.Value, Epoch: req.Epoch}
+	if req.TtlMs < 0 {
+		return nil, status.Error(codes.InvalidArgument, "ttl_ms must not be negative")
+	}
+	if rej := beginWrite([]util.Record{rec}); rej != nil {
+		return nil, rej.grpcError(ctx)
+	}
+	defer writeMu.RUnlock()
+
+	obj_ts, err := setKey(rec, req.ExpectedTimestamp, time.Duration(req.TtlMs) * time.Millisecond)
+	if err == store.ErrVersionConflict {
+		grpc.SetTrailer(ctx, pileuspb.IntTrailer(pileuspb.CurrentTimestampTrailer, obj_ts))
+		return nil, status.Error(codes.Aborted, err.Error())
+	}
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return &pileuspb.WriteResponse{Timestamp: obj_ts}, nil
+}
+
+func (storageService) Delete(ctx context.Context, req *pileuspb.DeleteRequest) (*pileuspb.WriteResponse, error) {
+	rec := util.Record{Key: req.Key, Epoch: req.Epoch}
+	if rej := beginWrite([]util.Record{rec}); rej != nil {
+		return nil, rej.grpcError(ctx)
+	}
+	defer writeMu.RUnlock()
+
+	obj_ts, err := deleteKey(req.Key)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return &pileuspb.WriteResponse{Timestamp: obj_ts}, nil
+}
+
+func (storageService) Status(ctx context.Context, req *pileuspb.StatusRequest) (*pileuspb.StatusResponse, error) {
+	response := &pileuspb.StatusResponse{HighTs: make(map[int32]int64)}
+	for shardID, highTS := range secondaryStatus() {
+		response.HighTs[int32(shardID)] = highTS
+	}
+	return response, nil
+}
+
+func (storageService) Probe(ctx context.Context, req *pileuspb.ProbeRequest) (*pileuspb.ProbeResponse, error) {
+	return &pileuspb.ProbeResponse{}, nil
+}
+
+func (replicationService) Replicate(ctx context.Context, req *pileuspb.ReplicateRequest) (*pileuspb.ReplicateResponse, error) {
+	page, rej := readReplicationPage(int(req.Shard), req.Since, req.Epoch, int(req.Limit))
+	if rej != nil {
+		return nil, rej.grpcError(ctx)
+	}
+
+	response := &pileuspb.ReplicateResponse{
+		Updates: make([]*pileuspb.Record, 0, len(page.Updates)),
+		Version: page.Version,
+		More:    page.More,
+	}
+	for _, rec := range page.Updates {
+		response.Updates = append(response.Updates, &pileuspb.Record{
+			Key:       rec.Key,
+			Value:     valueString(rec.Value),
+			Timestamp: rec.Timestamp,
+			Deleted:   rec.Deleted,
+			Epoch:     rec.Epoch,
+			Prev:      rec.Prev,
+			Txn:       rec.Txn,
+			ExpiresAt: rec.ExpiresAt,
+		})
+	}
+	return response, nil
+}
+
+// Fetches the next page of the shard from the Replication service of the primary (ErrChangesTrimmed on OUT_OF_RANGE)
+func fetchPageGRPC(shard *util.Shard, address string) (*replicationPage, error) {
+	conn, err := grpcConns.Get(address)
+	if err != nil {
+		return nil, err
+	}
+
+	epoch := shard.Epoch
+	response, err := pileuspb.NewReplicationClient(conn).Replicate(context.Background(), &pileuspb.ReplicateRequest{
+		Shard: int32(shard.ShardId),
+		Since: shard.GetHighTS(),
+		Epoch: &epoch,
+		Limit: defaultReplicationPageSize,
+	})
+	if status.Code(err) == codes.OutOfRange {
+		return nil, store.ErrChangesTrimmed
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	page := &replicationPage{
+		Updates: make([]util.Record, 0, len(response.Updates)),
+		Version: response.Version,
+		More:    response.More,
+	}
+	for _, rec := range response.Updates {
+		page.Updates = append(page.Updates, util.Record{
+			Key:       rec.Key,
+			Value:     rec.Value,
+			Timestamp: rec.Timestamp,
+			Deleted:   rec.Deleted,
+			Epoch:     rec.Epoch,
+			Prev:      rec.Prev,
+			Txn:       rec.Txn,
+			ExpiresAt: rec.ExpiresAt,
+		})
+	}
+	return page, nil
+}
+
+// The gRPC code of the rejection, a misdirected request also gets the epoch of the shard as trailer
+func (rej *rejection) grpcError(ctx context.Context) error {
+	code := codes.Internal
+	switch rej.status {
+	case http.StatusBadRequest:
+		code = codes.InvalidArgument
+	case http.StatusNotFound:
+		code = codes.NotFound
+	case http.StatusGone:
+		code = codes.OutOfRange
+	case http.StatusServiceUnavailable, http.StatusTooEarly:
+		code = codes.Unavailable
+	case http.StatusMisdirectedRequest:
+		code = codes.FailedPrecondition
+		grpc.SetTrailer(ctx, pileuspb.IntTrailer(pileuspb.EpochTrailer, rej.epoch))
+	}
+	return status.Error(code, rej.message)
+}
+
+// Values are strings on the gRPC transport, others are sent as JSON
+func valueString(v any) string {
+	switch value := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return value
+	}
+	data, _ := json.Marshal(v)
+	return string(data)
+}
+
+// Before shutting down, persist the shard hightimestam information
+func handleShutdown() {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+
+	<-sigs
+	fmt.Println("\nReceived shutdown signal. Saving HighTS to the local store...")
+
+	saveHighTS()
+	localStore.Close()
+
+	os.Exit(0)
+}
+
+// Periodically persists the HighTS of all shards, for the moves that were not persisted with a write
+func checkpointHighTS() {
+	ticker := time.NewTicker(highTSCheckpointInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		saveHighTS()
+	}
+}
+
+func saveHighTS() {
+	for _, shard := range primaryShards.All() {
+		if err := localStore.SaveHighTS(shard.ShardId, shard.GetHighTS()); err != nil {
+			fmt.Printf("Failed to save the HighTS of shard %d: %v\n", shard.ShardId, err)
+		}
+	}
+	for _, shard := range secondaryShards.All() {
+		if err := localStore.SaveHighTS(shard.ShardId, shard.GetHighTS()); err != nil {
+			fmt.Printf("Failed to save the HighTS of shard %d: %v\n", shard.ShardId, err)
+		}
+	}
+}
+
+// Restores the HighTS of the shard from the local store, and checks it against the records of the shard that are stored
+func recoverHighTS(shard *util.Shard) error {
+	persisted, err := localStore.LoadHighTS(shard.ShardId)
+	if err != nil {
+		return err
+	}
+
+	var count int
+	var maxTS int64
+	err = localStore.ScanShard(shard.RangeStart, shard.RangeEnd, func(rec util.Record) error {
+		count++
+		if rec.Timestamp > maxTS {
+			maxTS = rec.Timestamp
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if shard.AmIPrimary && maxTS > persisted {
+		// Every record of a primary shard was written by this node, so the HighTS can't be below any of them
+		fmt.Printf("Shard %d: persisted HighTS %d is below the newest stored write %d, using the latter\n", shard.ShardId, persisted, maxTS)
+		persisted = maxTS
+	} else if shard.AmISecondary && count == 0 && persisted > 0 {
+		// The records this HighTS stands for are gone, so replicate the shard from the start again
+		fmt.Printf("Shard %d: persisted HighTS %d but no records are stored, starting over from 0\n", shard.ShardId, persisted)
+		persisted = 0
+	}
+
+	shard.SetHighTS(persisted)
+	fmt.Printf("Recovered shard %d with %d stored keys and HighTS %d\n", shard.ShardId, count, shard.GetHighTS())
+	return nil
+}
+
+// Only the keys of the shards of this node are stored, they are routed by the partitioning of the config like every other key
+func preloadKeys(conf *util.Config, count int) {
+	fmt.Println("Preloading Redis with deterministic key-value pairs")
 
 	namespace := uuid.NewSHA1(uuid.NameSpaceDNS, []byte("pileus"))
 
+	shards := make(map[int]*util.Shard, len(conf.Shards))
+	for i := range conf.Shards {
+		shards[conf.Shards[i].ShardId] = &conf.Shards[i]
+	}
+
 	for i := 0; i < count; i++ {
 		key := fmt.Sprintf("%04d", i)
+		owner := util.ShardForKey(shards, key)
+		if owner == nil {
+			continue
+		}
+		if _, ok := primaryShards.Get(owner.ShardId); !ok {
+			if _, ok := secondaryShards.Get(owner.ShardId); !ok {
+				continue
+			}
+		}
 		// Generate a deterministic UUID based on the key name
 		value := uuid.NewMD5(namespace, []byte(fmt.Sprintf("%04d", i))).String()
 
-		vv := redis.VersionedValue{
+		vv := store.VersionedValue{
 			Value:     value,
 			Timestamp: -1,
 		}
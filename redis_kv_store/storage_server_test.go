@@ -0,0 +1,917 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"pileus/hlc"
+	"pileus/redis"
+	"pileus/store"
+	"pileus/util"
+)
+
+// Makes this node the primary of shard 0 ([0, 1000]) only, on an in-process redis
+func setupPrimary(t *testing.T) {
+	t.Helper()
+	server := miniredis.RunT(t)
+
+	primaryShards = util.NewShardSet()
+	primaryShards.Put(&util.Shard{ShardId: 0, RangeStart: 0, RangeEnd: 1000, AmIPrimary: true})
+	secondaryShards = util.NewShardSet()
+
+	opts := redis.DefaultOptions
+	opts.Address = server.Addr()
+	opts.Shards = primaryShards
+	clock, _ = hlc.NewClock("")
+	opts.Clock = clock
+	client, err := redis.NewClient(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+
+	localStore = &client
+}
+
+// Shard 0 as this node currently has it
+func primaryShard() *util.Shard {
+	shard, _ := primaryShards.Get(0)
+	return shard
+}
+
+func replicate(t *testing.T, since int64, shard int) *httptest.ResponseRecorder {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	replicationHandler(rec, httptest.NewRequest(http.MethodGet, fmt.Sprintf("/replicate?since=%d&shard=%d", since, shard), nil))
+	return rec
+}
+
+// Pulls a page of at most limit updates of shard 0
+func replicatePage(t *testing.T, since int64, limit int) ([]util.Record, int64, bool) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	replicationHandler(rec, httptest.NewRequest(http.MethodGet, fmt.Sprintf("/replicate?since=%d&shard=0&limit=%d", since, limit), nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	var page struct {
+		Updates []util.Record `json:"updates"`
+		Version int64         `json:"version"`
+		More    bool          `json:"more"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&page); err != nil {
+		t.Fatal(err)
+	}
+	return page.Updates, page.Version, page.More
+}
+
+func TestReplicateServesTheChangeIndex(t *testing.T) {
+	setupPrimary(t)
+
+	first, err := localStore.Set("key1", "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(2 * time.Millisecond)
+	if _, err := localStore.Set("key2", "b"); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := replicate(t, first, 0)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	var resp struct {
+		Updates []util.Record `json:"updates"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Updates) != 1 || resp.Updates[0].Key != "key2" {
+		t.Errorf("updates since the first write = %v, want only key2", resp.Updates)
+	}
+}
+
+func TestReplicatePagesTheChangeIndex(t *testing.T) {
+	setupPrimary(t)
+
+	var stamps []int64
+	for _, key := range []string{"key1", "key2", "key3"} {
+		ts, err := localStore.Set(key, "v")
+		if err != nil {
+			t.Fatal(err)
+		}
+		stamps = append(stamps, ts)
+	}
+	primaryShard().SetHighTS(stamps[2])
+
+	updates, version, more := replicatePage(t, 0, 2)
+	if len(updates) != 2 || !more || version != stamps[1] {
+		t.Fatalf("first page = %v up to %d (more: %v), want 2 updates up to %d with more", updates, version, more, stamps[1])
+	}
+	updates, version, more = replicatePage(t, version, 2)
+	if len(updates) != 1 || updates[0].Key != "key3" || more || version != stamps[2] {
+		t.Errorf("second page = %v up to %d (more: %v), want key3 up to the HighTS %d without more", updates, version, more, stamps[2])
+	}
+}
+
+func TestReplicateAnswersGoneBehindTheTrim(t *testing.T) {
+	setupPrimary(t)
+
+	first, err := localStore.Set("key1", "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := localStore.TrimChangeLog(0, first); err != nil {
+		t.Fatal(err)
+	}
+
+	if rec := replicate(t, first-1, 0); rec.Code != http.StatusGone {
+		t.Errorf("pull behind the trim answered %d, want %d", rec.Code, http.StatusGone)
+	}
+	if rec := replicate(t, first, 0); rec.Code != http.StatusOK {
+		t.Errorf("pull from the trim point answered %d, want %d", rec.Code, http.StatusOK)
+	}
+}
+
+func TestReplicateOnlyServesTheOwnShard(t *testing.T) {
+	setupPrimary(t)
+
+	if rec := replicate(t, 0, 1); rec.Code != http.StatusNotFound {
+		t.Errorf("pull of another shard answered %d, want %d", rec.Code, http.StatusNotFound)
+	}
+	if rec := replicate(t, 0, 0); rec.Code != http.StatusOK {
+		t.Errorf("pull of the own shard answered %d, want %d", rec.Code, http.StatusOK)
+	}
+}
+
+func TestSnapshotStreamsTheShardAfterItsHighTS(t *testing.T) {
+	setupPrimary(t)
+
+	for _, key := range []string{"key1", "key2"} {
+		ts, err := localStore.Set(key, "v")
+		if err != nil {
+			t.Fatal(err)
+		}
+		primaryShard().SetHighTS(ts)
+	}
+
+	rec := httptest.NewRecorder()
+	snapshotHandler(rec, httptest.NewRequest(http.MethodGet, "/snapshot?shard=0", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+
+	dec := json.NewDecoder(rec.Body)
+	var header snapshotHeader
+	if err := dec.Decode(&header); err != nil {
+		t.Fatal(err)
+	}
+	if header.ShardID != 0 || header.HighTS != primaryShard().GetHighTS() {
+		t.Errorf("header = %+v, want shard 0 at HighTS %d", header, primaryShard().GetHighTS())
+	}
+
+	keys := map[string]bool{}
+	for dec.More() {
+		var record util.Record
+		if err := dec.Decode(&record); err != nil {
+			t.Fatal(err)
+		}
+		keys[record.Key] = true
+	}
+	if len(keys) != 2 || !keys["key1"] || !keys["key2"] {
+		t.Errorf("snapshot holds %v, want key1 and key2", keys)
+	}
+}
+
+func TestBootstrapAppliesTheSnapshotAndTombstonesTheDroppedKeys(t *testing.T) {
+	setupPrimary(t)
+	now := hlc.FromTime(time.Now())
+	for _, key := range []string{"key1500", "key1600"} {
+		if err := localStore.SetVersioned(key, store.VersionedValue{Value: "old", Timestamp: now}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The primary has a newer key1500 and purged key1600
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(snapshotHeader{ShardID: 1, HighTS: now + 20})
+		json.NewEncoder(w).Encode(util.Record{Key: "key1500", Value: "new", Timestamp: now + 10})
+	}))
+	defer primary.Close()
+	shard := &util.Shard{ShardId: 1, RangeStart: 1001, RangeEnd: 2000, Primary: strings.TrimPrefix(primary.URL, "http://")}
+	secondaryShards.Put(shard)
+
+	if err := bootstrapFromSnapshot(shard); err != nil {
+		t.Fatal(err)
+	}
+	if shard.GetHighTS() != now+20 {
+		t.Errorf("HighTS = %d, want %d", shard.GetHighTS(), now+20)
+	}
+
+	var vv store.VersionedValue
+	if found, err := localStore.Get("key1500", &vv); err != nil || !found || vv.Value != "new" {
+		t.Errorf("key1500 = %+v (found: %v, err: %v), want the snapshot value", vv, found, err)
+	}
+	if found, err := localStore.Get("key1600", &vv); err != nil || !found || !vv.Deleted || vv.Timestamp != now+20 {
+		t.Errorf("key1600 = %+v (found: %v, err: %v), want a tombstone at the HighTS of the snapshot", vv, found, err)
+	}
+	// The version before the tombstone is kept for reads as of an earlier timestamp
+	if old, found, err := localStore.GetAt("key1600", now+10); err != nil || !found || old.Value != "old" {
+		t.Errorf("key1600 before its tombstone = %+v (found: %v, err: %v), want the old value", old, found, err)
+	}
+}
+
+func TestDeletedKeyIsReadAsNotFoundWithItsTimestamp(t *testing.T) {
+	setupPrimary(t)
+	if _, err := localStore.Set("key1", "a"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(2 * time.Millisecond)
+
+	rec := httptest.NewRecorder()
+	handleDelete(rec, httptest.NewRequest(http.MethodPost, "/delete", strings.NewReader(`{"key": "key1"}`)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("delete answered %d: %s", rec.Code, rec.Body)
+	}
+	var deleted struct {
+		Timestamp int64 `json:"delete_timestamp"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&deleted); err != nil {
+		t.Fatal(err)
+	}
+	if primaryShard().GetHighTS() != deleted.Timestamp {
+		t.Errorf("HighTS after the delete = %d, want %d", primaryShard().GetHighTS(), deleted.Timestamp)
+	}
+
+	rec = httptest.NewRecorder()
+	handleGet(rec, httptest.NewRequest(http.MethodGet, "/get?key=key1", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("get of a deleted key answered %d, want %d", rec.Code, http.StatusNotFound)
+	}
+	var got struct {
+		Timestamp int64 `json:"timestamp"`
+		Deleted   bool  `json:"deleted"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	if !got.Deleted || got.Timestamp != deleted.Timestamp {
+		t.Errorf("get of a deleted key = %+v, want the tombstone at %d", got, deleted.Timestamp)
+	}
+}
+
+func TestConditionalSetAnswersConflictWithTheCurrentVersion(t *testing.T) {
+	setupPrimary(t)
+	current, err := localStore.Set("key1", "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	body := `{"key": "key1", "value": "b", "expected_timestamp": 1}`
+	handleSet(rec, httptest.NewRequest(http.MethodPost, "/set", strings.NewReader(body)))
+	if rec.Code != http.StatusConflict {
+		t.Fatalf("conditional set over a stale version answered %d, want %d", rec.Code, http.StatusConflict)
+	}
+	var conflict struct {
+		Timestamp int64 `json:"current_timestamp"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&conflict); err != nil {
+		t.Fatal(err)
+	}
+	if conflict.Timestamp != current {
+		t.Errorf("conflict reported version %d, want %d", conflict.Timestamp, current)
+	}
+	if primaryShard().GetHighTS() > current {
+		t.Errorf("rejected write moved HighTS to %d", primaryShard().GetHighTS())
+	}
+
+	rec = httptest.NewRecorder()
+	body = fmt.Sprintf(`{"key": "key1", "value": "b", "expected_timestamp": %d}`, current)
+	handleSet(rec, httptest.NewRequest(http.MethodPost, "/set", strings.NewReader(body)))
+	if rec.Code != http.StatusOK {
+		t.Errorf("conditional set over the current version answered %d: %s", rec.Code, rec.Body)
+	}
+}
+
+func TestMSetReportsEachKeyAndMGetKeepsTheRequestOrder(t *testing.T) {
+	setupPrimary(t)
+
+	rec := httptest.NewRecorder()
+	body := `{"records": [{"key": "key1", "value": "a"}, {"key": "key2000", "value": "b"}, {"key": "key2", "value": "c"}]}`
+	handleMSet(rec, httptest.NewRequest(http.MethodPost, "/mset", strings.NewReader(body)))
+	var written struct {
+		Results []struct {
+			Key          string `json:"key"`
+			PutTimestamp int64  `json:"put_timestamp"`
+			Error        string `json:"error"`
+		} `json:"results"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&written); err != nil {
+		t.Fatal(err)
+	}
+	if len(written.Results) != 3 {
+		t.Fatalf("mset returned %d results, want 3", len(written.Results))
+	}
+	// key2000 is not in a shard of this primary, the other keys are written anyway
+	if written.Results[0].Error != "" || written.Results[2].Error != "" || written.Results[1].Error == "" {
+		t.Errorf("mset results = %+v, want only key2000 to fail", written.Results)
+	}
+
+	rec = httptest.NewRecorder()
+	handleMGet(rec, httptest.NewRequest(http.MethodPost, "/mget", strings.NewReader(`{"keys": ["key2", "key3", "key1"]}`)))
+	var read struct {
+		Results []getResponse `json:"results"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&read); err != nil {
+		t.Fatal(err)
+	}
+	if len(read.Results) != 3 {
+		t.Fatalf("mget returned %d results, want 3", len(read.Results))
+	}
+	want := []struct {
+		key   string
+		value any
+		found bool
+	}{{"key2", "c", true}, {"key3", nil, false}, {"key1", "a", true}}
+	for i, w := range want {
+		got := read.Results[i]
+		if got.Key != w.key || got.Found != w.found || got.Value != w.value {
+			t.Errorf("mget result %d = %+v, want %s (found: %v, value: %v)", i, got, w.key, w.found, w.value)
+		}
+	}
+	if read.Results[0].Timestamp != written.Results[2].PutTimestamp {
+		t.Errorf("mget timestamp of key2 = %d, want %d", read.Results[0].Timestamp, written.Results[2].PutTimestamp)
+	}
+}
+
+func TestTxnWritesAllKeysWithOneTimestamp(t *testing.T) {
+	setupPrimary(t)
+
+	rec := httptest.NewRecorder()
+	body := `{"records": [{"key": "key1", "value": "a"}, {"key": "key2", "value": "b"}, {"key": "key3", "value": "c"}]}`
+	handleTxn(rec, httptest.NewRequest(http.MethodPost, "/txn", strings.NewReader(body)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	var written struct {
+		PutTimestamp int64 `json:"put_timestamp"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&written); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []string{"key1", "key2", "key3"} {
+		var vv store.VersionedValue
+		if found, err := localStore.Get(key, &vv); err != nil || !found || vv.Timestamp != written.PutTimestamp {
+			t.Errorf("%s = %+v (found: %v, err: %v), want it written at %d", key, vv, found, err, written.PutTimestamp)
+		}
+	}
+
+	// A page cut inside the transaction still carries all of it
+	updates, _, _ := replicatePage(t, 0, 1)
+	if len(updates) != 3 {
+		t.Errorf("page of 1 update has %d records of the transaction, want all 3: %v", len(updates), updates)
+	}
+}
+
+func TestTxnAcrossShardsWritesNothing(t *testing.T) {
+	setupPrimary(t)
+	primaryShards.Put(&util.Shard{ShardId: 1, RangeStart: 1001, RangeEnd: 2000, AmIPrimary: true})
+
+	rec := httptest.NewRecorder()
+	body := `{"records": [{"key": "key1", "value": "a"}, {"key": "key1500", "value": "b"}]}`
+	handleTxn(rec, httptest.NewRequest(http.MethodPost, "/txn", strings.NewReader(body)))
+	if rec.Code == http.StatusOK {
+		t.Fatal("transaction across two shards succeeded")
+	}
+
+	for _, key := range []string{"key1", "key1500"} {
+		var vv store.VersionedValue
+		if found, _ := localStore.Get(key, &vv); found {
+			t.Errorf("%s of the rejected transaction was written: %+v", key, vv)
+		}
+	}
+}
+
+func TestExpiringKeyIsMissingFromItsExpiryAtTheReadTimestamp(t *testing.T) {
+	setupPrimary(t)
+
+	rec := httptest.NewRecorder()
+	handleSet(rec, httptest.NewRequest(http.MethodPost, "/set", strings.NewReader(`{"key": "key1", "value": "a", "ttl_ms": 50}`)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	var vv store.VersionedValue
+	if found, err := localStore.Get("key1", &vv); err != nil || !found || vv.ExpiresAt <= vv.Timestamp {
+		t.Fatalf("key1 = %+v (found: %v, err: %v), want an expiry after its timestamp", vv, found, err)
+	}
+	time.Sleep(60 * time.Millisecond)
+
+	// A read as of a timestamp before the expiry still finds the value, the latest read doesn't
+	for _, tc := range []struct {
+		query string
+		found bool
+	}{
+		{fmt.Sprintf("key=key1&at=%d", vv.ExpiresAt-1), true},
+		{fmt.Sprintf("key=key1&at=%d", vv.ExpiresAt), false},
+		{"key=key1", false},
+	} {
+		rec := httptest.NewRecorder()
+		handleGet(rec, httptest.NewRequest(http.MethodGet, "/get?"+tc.query, nil))
+		var got getResponse
+		if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+			t.Fatal(err)
+		}
+		if got.Found != tc.found || (rec.Code == http.StatusOK) != tc.found {
+			t.Errorf("get %s = %d %+v, want found: %v", tc.query, rec.Code, got, tc.found)
+		}
+	}
+}
+
+func TestMSetExpiresEachRecordWithItsOwnTTL(t *testing.T) {
+	setupPrimary(t)
+
+	rec := httptest.NewRecorder()
+	body := `{"records": [{"key": "key1", "value": "a", "ttl_ms": 50}, {"key": "key2", "value": "b"}]}`
+	handleMSet(rec, httptest.NewRequest(http.MethodPost, "/mset", strings.NewReader(body)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+
+	for key, expires := range map[string]bool{"key1": true, "key2": false} {
+		var vv store.VersionedValue
+		if found, err := localStore.Get(key, &vv); err != nil || !found {
+			t.Fatalf("%s not stored (err: %v)", key, err)
+		}
+		if (vv.ExpiresAt > vv.Timestamp) != expires {
+			t.Errorf("%s = %+v, want an expiry: %v", key, vv, expires)
+		}
+	}
+
+	rec = httptest.NewRecorder()
+	handleMSet(rec, httptest.NewRequest(http.MethodPost, "/mset", strings.NewReader(`{"records": [{"key": "key3", "value": "c", "ttl_ms": -1}]}`)))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("mset with a negative ttl_ms = %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+}
+
+func TestPreloadOnlyStoresTheKeysOfTheShardsOfTheNode(t *testing.T) {
+	setupPrimary(t)
+
+	// 1000 is on the boundary of both shards, it belongs to shard 0 of this node
+	conf := &util.Config{Shards: []util.Shard{
+		{ShardId: 1, RangeStart: 1000, RangeEnd: 2000},
+		{ShardId: 0, RangeStart: 0, RangeEnd: 1000},
+	}}
+	preloadKeys(conf, 1100)
+
+	for key, want := range map[string]bool{"0000": true, "0999": true, "1000": true, "1001": false, "1099": false} {
+		var vv store.VersionedValue
+		if found, err := localStore.Get(key, &vv); err != nil || found != want {
+			t.Errorf("preloaded key %s found: %v (err: %v), want %v", key, found, err, want)
+		}
+	}
+}
+
+// Run with -race: replication moves the HighTS and /frequency changes the pull interval while requests read them
+func TestSecondaryShardIsReadWhileItIsReplicated(t *testing.T) {
+	setupPrimary(t)
+	shard := &util.Shard{ShardId: 1, RangeStart: 1001, RangeEnd: 2000, AmISecondary: true}
+	secondaryShards.Put(shard)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for ts := int64(1); ts <= 50; ts++ {
+			if err := applyReplicated(shard, []util.Record{{Key: "key1500", Value: "v", Timestamp: ts}}); err != nil {
+				t.Error(err)
+				return
+			}
+			rec := httptest.NewRecorder()
+			adjustReplicationHandler(rec, httptest.NewRequest(http.MethodPost, "/adjust", strings.NewReader(`{"shardID": 1, "new_freq": 2}`)))
+		}
+	}()
+	for i := 0; i < 50; i++ {
+		readResponse("key1500", store.VersionedValue{Value: "v"}, true, nil)
+		shard.ReplicationFrequency()
+	}
+	<-done
+
+	if shard.GetHighTS() != 50 || shard.ReplicationFrequency() != 2 {
+		t.Errorf("HighTS %d and frequency %v, want 50 and 2", shard.GetHighTS(), shard.ReplicationFrequency())
+	}
+}
+
+func TestSecondaryExpiresAKeyAtItsHighTS(t *testing.T) {
+	setupPrimary(t)
+	secondaryShards.Put(&util.Shard{ShardId: 1, RangeStart: 1001, RangeEnd: 2000, HighTS: 99})
+
+	// The local clock of the secondary is far past the expiry, only the HighTS counts
+	record := store.VersionedValue{Value: "a", Timestamp: 10, ExpiresAt: 100}
+	if got := readResponse("key1500", record, true, nil); !got.Found || got.Value != "a" {
+		t.Errorf("read below the expiry = %+v, want the value", got)
+	}
+	shard, _ := secondaryShards.Get(1)
+	shard.SetHighTS(100)
+	if got := readResponse("key1500", record, true, nil); got.Found || got.Value != nil {
+		t.Errorf("read at the expiry = %+v, want it missing", got)
+	}
+}
+
+func reconfigure(t *testing.T, shard util.Shard) *httptest.ResponseRecorder {
+	t.Helper()
+	body, err := json.Marshal(shard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	reconfigureHandler(rec, httptest.NewRequest(http.MethodPost, "/reconfigure", bytes.NewReader(body)))
+	return rec
+}
+
+func TestReconfigurePromotesTheSecondaryPastTheTakeoverPoint(t *testing.T) {
+	setupPrimary(t)
+	storageID = "node2"
+	secondaryShards.Put(&util.Shard{
+		ShardId: 1, RangeStart: 2000, RangeEnd: 2999, PrimaryID: "node1", Primary: "127.0.0.1:1",
+		Secondaries: []string{"node2"}, AmISecondary: true, HighTS: 50,
+	})
+
+	takeover := hlc.FromTime(time.Now().Add(time.Hour))
+	rec := reconfigure(t, util.Shard{ShardId: 1, RangeStart: 2000, RangeEnd: 2999, PrimaryID: "node2", Primary: "127.0.0.1:2", Epoch: 1, EpochStartTS: takeover})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("reconfigure answered %d: %s", rec.Code, rec.Body)
+	}
+
+	shard, ok := primaryShards.Get(1)
+	if !ok || !shard.AmIPrimary || shard.Epoch != 1 || shard.GetHighTS() != takeover {
+		t.Fatalf("promoted shard = %+v, want a primary in epoch 1 at HighTS %d", shard, takeover)
+	}
+	if _, ok := secondaryShards.Get(1); ok {
+		t.Error("promoted shard is still replicated as a secondary")
+	}
+
+	// Writes of the new epoch are stamped above the takeover point, even if the local clock is behind it
+	ts, err := localStore.Set("key2000", "v")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ts <= takeover {
+		t.Errorf("first write of the new primary got %d, want > %d", ts, takeover)
+	}
+}
+
+func TestReconfigureRejectsAnEpochThatIsNotNewer(t *testing.T) {
+	setupPrimary(t)
+	storageID = "node1"
+	primaryShard().Epoch = 3
+
+	rec := reconfigure(t, util.Shard{ShardId: 0, RangeStart: 0, RangeEnd: 1000, PrimaryID: "node2", Epoch: 3})
+	if rec.Code != http.StatusConflict {
+		t.Errorf("reconfigure to the same epoch answered %d, want %d", rec.Code, http.StatusConflict)
+	}
+	if shard := primaryShard(); shard == nil || !shard.AmIPrimary {
+		t.Error("a rejected reconfiguration demoted the primary")
+	}
+}
+
+func TestWriteOfAnotherEpochIsMisdirected(t *testing.T) {
+	setupPrimary(t)
+	primaryShard().Epoch = 2
+
+	rec := httptest.NewRecorder()
+	handleSet(rec, httptest.NewRequest(http.MethodPost, "/set", strings.NewReader(`{"key": "key1", "value": "a", "epoch": 1}`)))
+	if rec.Code != http.StatusMisdirectedRequest {
+		t.Fatalf("write of epoch 1 answered %d, want %d", rec.Code, http.StatusMisdirectedRequest)
+	}
+	var resp struct {
+		Epoch int64 `json:"epoch"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Epoch != 2 {
+		t.Errorf("misdirected write reported epoch %d, want 2", resp.Epoch)
+	}
+
+	var vv store.VersionedValue
+	if found, _ := localStore.Get("key1", &vv); found {
+		t.Error("the misdirected write was stored")
+	}
+}
+
+func TestReplicateAcrossAFailover(t *testing.T) {
+	setupPrimary(t)
+	shard := primaryShard()
+	shard.Epoch = 2
+	shard.EpochStartTS = 100
+
+	// A secondary still in the old epoch has to be reconfigured first
+	rec := httptest.NewRecorder()
+	replicationHandler(rec, httptest.NewRequest(http.MethodGet, "/replicate?since=100&shard=0&epoch=1", nil))
+	if rec.Code != http.StatusMisdirectedRequest {
+		t.Errorf("pull of epoch 1 answered %d, want %d", rec.Code, http.StatusMisdirectedRequest)
+	}
+	// One behind the takeover point may hold writes of the old primary that this one never got
+	if rec := replicate(t, 99, 0); rec.Code != http.StatusGone {
+		t.Errorf("pull from before the takeover answered %d, want %d", rec.Code, http.StatusGone)
+	}
+	if rec := replicate(t, 100, 0); rec.Code != http.StatusOK {
+		t.Errorf("pull from the takeover point answered %d, want %d", rec.Code, http.StatusOK)
+	}
+}
+
+func drain(t *testing.T, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	drainHandler(rec, httptest.NewRequest(http.MethodPost, "/drain", strings.NewReader(body)))
+	return rec
+}
+
+// Sends the write in the background, the recorder is delivered once the handler returns
+func setInBackground(body string) <-chan *httptest.ResponseRecorder {
+	done := make(chan *httptest.ResponseRecorder, 1)
+	go func() {
+		rec := httptest.NewRecorder()
+		handleSet(rec, httptest.NewRequest(http.MethodPost, "/set", strings.NewReader(body)))
+		done <- rec
+	}()
+	return done
+}
+
+func TestDrainHoldsWritesUntilThePrimaryMoved(t *testing.T) {
+	setupPrimary(t)
+	storageID = "node1"
+	written, err := localStore.Set("key1", "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	primaryShard().SetHighTS(written)
+	// The demoted node replicates from the new primary, but not within the test
+	primaryShard().SetReplicationFrequency(3600)
+
+	rec := drain(t, `{"shardID": 0, "timeoutSeconds": 10}`)
+	var drained struct {
+		HighTS int64 `json:"highTS"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&drained); err != nil {
+		t.Fatal(err)
+	}
+	if drained.HighTS != written {
+		t.Errorf("drain reported HighTS %d, want %d", drained.HighTS, written)
+	}
+
+	held := setInBackground(`{"key": "key2", "value": "b"}`)
+	select {
+	case rec := <-held:
+		t.Fatalf("write during the drain was answered with %d", rec.Code)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if rec := reconfigure(t, util.Shard{
+		ShardId: 0, RangeStart: 0, RangeEnd: 1000, PrimaryID: "node2", Primary: "127.0.0.1:1",
+		Secondaries: []string{"node1"}, Epoch: 1, EpochStartTS: written,
+	}); rec.Code != http.StatusOK {
+		t.Fatalf("reconfigure answered %d: %s", rec.Code, rec.Body)
+	}
+
+	// The held write is sent back to the client, which retries on the new primary
+	select {
+	case rec := <-held:
+		if rec.Code != http.StatusMisdirectedRequest {
+			t.Errorf("held write answered %d after the move, want %d", rec.Code, http.StatusMisdirectedRequest)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("held write was not released by the reconfiguration")
+	}
+	var vv store.VersionedValue
+	if found, _ := localStore.Get("key2", &vv); found {
+		t.Error("the held write was stored on the old primary")
+	}
+}
+
+func TestCancelledDrainReleasesTheHeldWrites(t *testing.T) {
+	setupPrimary(t)
+
+	if rec := drain(t, `{"shardID": 0}`); rec.Code != http.StatusOK {
+		t.Fatalf("drain answered %d: %s", rec.Code, rec.Body)
+	}
+	held := setInBackground(`{"key": "key1", "value": "a"}`)
+	time.Sleep(20 * time.Millisecond)
+	if rec := drain(t, `{"shardID": 0, "cancel": true}`); rec.Code != http.StatusOK {
+		t.Fatalf("cancel answered %d", rec.Code)
+	}
+
+	select {
+	case rec := <-held:
+		if rec.Code != http.StatusOK {
+			t.Errorf("held write answered %d after the cancel: %s", rec.Code, rec.Body)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("held write was not released by the cancel")
+	}
+}
+
+func TestDrainOfAShardOfAnotherPrimary(t *testing.T) {
+	setupPrimary(t)
+	if rec := drain(t, `{"shardID": 1}`); rec.Code != http.StatusNotFound {
+		t.Errorf("drain of a shard this node is not primary for answered %d, want %d", rec.Code, http.StatusNotFound)
+	}
+}
+
+func reshard(t *testing.T, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	reshardHandler(rec, httptest.NewRequest(http.MethodPost, "/reshard", strings.NewReader(body)))
+	return rec
+}
+
+func TestReshardSplitsThePrimaryShardInPlace(t *testing.T) {
+	setupPrimary(t)
+	storageID = "node1"
+	written, err := localStore.Set("key700", "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	primaryShard().SetHighTS(written)
+	primaryShard().PrimaryID = "node1"
+
+	rec := reshard(t, fmt.Sprintf(`{"epoch": 1, "from": {"0": %d}, "shards": [
+		{"id": 0, "start": 0, "end": 499, "primaryID": "node1", "epoch": 1, "epochStartTS": %d},
+		{"id": 1, "start": 500, "end": 1000, "primaryID": "node1", "epoch": 1, "epochStartTS": %d}]}`, written, written, written))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("reshard answered %d: %s", rec.Code, rec.Body)
+	}
+
+	left, _ := primaryShards.Get(0)
+	right, ok := primaryShards.Get(1)
+	if !ok || left.RangeEnd != 499 || right.RangeStart != 500 || right.RangeEnd != 1000 {
+		t.Fatalf("primary shards after the split: %+v and %+v", left, right)
+	}
+	// The node had the whole shard up to the drain, so both halves start there
+	if left.GetHighTS() != written || right.GetHighTS() != written {
+		t.Errorf("HighTS of the halves = %d and %d, want %d", left.GetHighTS(), right.GetHighTS(), written)
+	}
+	if shard := primaryShards.ForKey("key700"); shard == nil || shard.ShardId != 1 {
+		t.Errorf("key700 belongs to %+v after the split, want shard 1", shard)
+	}
+
+	// New writes of the upper half go to the change index of the new shard
+	ts, err := localStore.Set("key800", "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	updates, _, _, err := localStore.ScanUpdatedKeys(1, written, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(updates) != 1 || updates[0].Key != "key800" || updates[0].Timestamp != ts {
+		t.Errorf("updates of the new shard = %+v, want key800@%d", updates, ts)
+	}
+}
+
+func TestReshardMergesTwoPrimaryShards(t *testing.T) {
+	setupPrimary(t)
+	storageID = "node1"
+	primaryShard().RangeEnd = 499
+	primaryShard().PrimaryID = "node1"
+	primaryShards.Put(&util.Shard{ShardId: 1, RangeStart: 500, RangeEnd: 1000, PrimaryID: "node1", AmIPrimary: true})
+
+	leftTS, err := localStore.Set("key1", "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	primaryShard().SetHighTS(leftTS)
+	rightTS, err := localStore.Set("key600", "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	right, _ := primaryShards.Get(1)
+	right.SetHighTS(rightTS)
+
+	rec := reshard(t, fmt.Sprintf(`{"epoch": 2, "removed": [1], "from": {"0": %d, "1": %d}, "shards": [
+		{"id": 0, "start": 0, "end": 1000, "primaryID": "node1", "epoch": 2, "epochStartTS": %d}]}`, leftTS, rightTS, rightTS))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("reshard answered %d: %s", rec.Code, rec.Body)
+	}
+
+	if _, ok := primaryShards.Get(1); ok {
+		t.Error("the merged away shard is still served")
+	}
+	merged := primaryShard()
+	if merged.RangeEnd != 1000 || merged.GetHighTS() != rightTS || merged.Epoch != 2 {
+		t.Errorf("merged shard = %+v, want [0, 1000] at HighTS %d in epoch 2", merged, rightTS)
+	}
+	if _, err := localStore.Set("key600", "c"); err != nil {
+		t.Errorf("write to the merged range: %v", err)
+	}
+}
+
+func TestReshardRejectsAnEpochThatIsNotNewer(t *testing.T) {
+	setupPrimary(t)
+	primaryShard().Epoch = 2
+
+	rec := reshard(t, `{"epoch": 2, "from": {"0": 1}, "shards": [{"id": 0, "start": 0, "end": 499, "epoch": 2}]}`)
+	if rec.Code != http.StatusConflict {
+		t.Errorf("reshard to the same epoch answered %d, want %d", rec.Code, http.StatusConflict)
+	}
+	if primaryShard().RangeEnd != 1000 {
+		t.Error("a rejected reshard changed the range of the shard")
+	}
+}
+
+func TestCoversRange(t *testing.T) {
+	tests := []struct {
+		name   string
+		shards []*util.Shard
+		start  int
+		end    int
+		want   bool
+	}{
+		{"no shards", nil, 0, 100, false},
+		{"single shard exactly", []*util.Shard{{RangeStart: 0, RangeEnd: 100}}, 0, 100, true},
+		{"single shard wider", []*util.Shard{{RangeStart: 0, RangeEnd: 200}}, 50, 100, true},
+		{"single shard too short", []*util.Shard{{RangeStart: 0, RangeEnd: 99}}, 0, 100, false},
+		{"single shard starts late", []*util.Shard{{RangeStart: 1, RangeEnd: 100}}, 0, 100, false},
+		{"split halves", []*util.Shard{{RangeStart: 0, RangeEnd: 49}, {RangeStart: 50, RangeEnd: 100}}, 0, 100, true},
+		{"split halves out of order", []*util.Shard{{RangeStart: 50, RangeEnd: 100}, {RangeStart: 0, RangeEnd: 49}}, 0, 100, true},
+		{"gap between halves", []*util.Shard{{RangeStart: 0, RangeEnd: 48}, {RangeStart: 50, RangeEnd: 100}}, 0, 100, false},
+		{"overlapping shards", []*util.Shard{{RangeStart: 0, RangeEnd: 60}, {RangeStart: 40, RangeEnd: 100}}, 0, 100, true},
+		{"shard nested in another", []*util.Shard{{RangeStart: 0, RangeEnd: 100}, {RangeStart: 20, RangeEnd: 30}}, 0, 100, true},
+		{"single position", []*util.Shard{{RangeStart: 5, RangeEnd: 5}}, 5, 5, true},
+		{"shards outside the range", []*util.Shard{{RangeStart: 200, RangeEnd: 300}}, 0, 100, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := coversRange(tt.shards, tt.start, tt.end); got != tt.want {
+				t.Errorf("coversRange([%d, %d]) = %v, want %v", tt.start, tt.end, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestApplyConfigCatchesUpAndDropsMergedShards(t *testing.T) {
+	setupPrimary(t)
+	storageID = "node1"
+	configEpoch = 1
+	primaryShard().PrimaryID = "node1"
+	primaryShard().RangeEnd = 499
+	primaryShards.Put(&util.Shard{ShardId: 1, RangeStart: 500, RangeEnd: 1000, PrimaryID: "node1", AmIPrimary: true})
+
+	// Shard 1 was merged into shard 0 while the node did not get the /reshard
+	applyConfig(&util.Config{
+		Epoch: 4,
+		Nodes: []util.StorageNode{{Id: "node1", Address: "host1:8080"}},
+		Shards: []util.Shard{{ShardId: 0, RangeStart: 0, RangeEnd: 1000, PrimaryID: "node1", Epoch: 4}},
+	})
+
+	if configEpoch != 4 {
+		t.Errorf("config epoch after the update = %d, want 4", configEpoch)
+	}
+	if _, ok := primaryShards.Get(1); ok {
+		t.Error("the merged away shard is still served")
+	}
+	if shard := primaryShard(); shard.RangeEnd != 1000 || shard.Epoch != 4 {
+		t.Errorf("shard 0 after the update = %+v, want [0, 1000] in epoch 4", shard)
+	}
+	if addr, ok := nodeAddress("node1"); !ok || addr != "host1:8080" {
+		t.Errorf("address of node1 = %q, want host1:8080", addr)
+	}
+
+	// An older version (e.g. a delayed poll) is ignored
+	applyConfig(&util.Config{Epoch: 3, Shards: []util.Shard{{ShardId: 0, RangeStart: 0, RangeEnd: 499, PrimaryID: "node1", Epoch: 3}}})
+	if configEpoch != 4 || primaryShard().RangeEnd != 1000 {
+		t.Errorf("an older config was applied: epoch %d, range end %d", configEpoch, primaryShard().RangeEnd)
+	}
+}
+
+func TestFetchConfigWaitsForTheEpochAfterTheGivenOne(t *testing.T) {
+	coordinator := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("after") == "7" {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		json.NewEncoder(w).Encode(util.Config{Epoch: 7})
+	}))
+	defer coordinator.Close()
+	coordinatorURL = coordinator.URL
+
+	conf, err := fetchConfig(coordinator.Client(), -1)
+	if err != nil || conf == nil || conf.Epoch != 7 {
+		t.Fatalf("fetchConfig(-1) = (%+v, %v), want epoch 7", conf, err)
+	}
+	// No new version within the poll of the coordinator
+	if conf, err := fetchConfig(coordinator.Client(), 7); conf != nil || err != nil {
+		t.Errorf("fetchConfig(7) = (%+v, %v), want (nil, nil)", conf, err)
+	}
+}
@@ -0,0 +1,92 @@
+package store
+
+import (
+	"errors"
+	"pileus/util"
+)
+
+// For incoming (k,v) pairs, we also store the timestamp/version
+// Timestamps are hybrid logical clock values (see the hlc package)
+// A deleted key keeps a tombstone (Deleted = true, no value) until all secondaries have seen it
+type VersionedValue struct {
+	Value     any    `json:"value"`
+	Timestamp int64 `json:"timestamp"`
+	Deleted   bool   `json:"deleted,omitempty"`
+	Epoch     int64  `json:"epoch,omitempty"`	// configuration epoch of the primary that stamped the write
+	Prev      *int64 `json:"prev,omitempty"`	// timestamp of the version this one replaced (0 if the key was missing, nil if unknown)
+	Txn       []string `json:"txn,omitempty"`	// other keys written by the same transaction (with the same timestamp)
+	ExpiresAt int64  `json:"expiresAt,omitempty"`	// timestamp from which the value reads as missing (0 if it never expires)
+}
+
+// Expired tells whether the value reads as missing at timestamp ts
+// Every node decides on the timestamp of the read, not on its local time, so replicas that caught up as far agree
+func (vv VersionedValue) Expired(ts int64) bool {
+	return vv.ExpiresAt != 0 && vv.ExpiresAt <= ts
+}
+
+// ErrChangesTrimmed is returned by ScanUpdatedKeys when the requested updates were already trimmed from the change index
+// The caller (a lagging secondary) has to resync the whole shard instead
+var ErrChangesTrimmed = errors.New("requested updates were trimmed from the change index")
+
+// ErrVersionConflict is returned by SetIfVersion when the object timestamp is not the expected one
+var ErrVersionConflict = errors.New("object timestamp does not match the expected version")
+
+// ErrVersionTrimmed is returned by GetAt when the version of the key at the requested timestamp is not retained
+// (it was dropped by the retention, or the node never received it)
+var ErrVersionTrimmed = errors.New("requested version is not retained anymore")
+
+// Store is the local storage of a storage node
+// Writes through Set/SetIfVersion/Tombstone are only accepted for keys of the shards the node is primary for,
+// they are stamped with a new timestamp (and the epoch of their shard) and added to the change index of their shard.
+// A replaced version is kept as an older version of its key for a while (see Retention).
+// Backends: redis (a local redis instance), memory (nothing is persisted) and bolt (an embedded on-disk database)
+type Store interface {
+	// Returns: object timestamp + any errors
+	Set(k string, v any) (int64, error)
+	// Compare-and-set on the object timestamp (missing keys have timestamp 0)
+	// Returns: new object timestamp, or the current one together with ErrVersionConflict
+	SetIfVersion(k string, v any, expectedTS int64) (int64, error)
+	// Set with an absolute expiry (see VersionedValue.ExpiresAt), conditional like SetIfVersion if expectedTS is given
+	SetExpiring(k string, v any, expiresAt int64, expectedTS *int64) (int64, error)
+	// Stores a timestamped tombstone instead of the value, returns the tombstone timestamp
+	Tombstone(k string) (int64, error)
+	// Writes several keys of one shard atomically, all stamped with the same timestamp (a Deleted record is stored as a tombstone)
+	// Returns: the timestamp of the transaction
+	SetTxn(writes map[string]VersionedValue) (int64, error)
+	// Stores a record as is (no range check, no new timestamp), e.g. preloaded keys or a shard snapshot
+	SetVersioned(k string, vv VersionedValue) error
+	// Stores a record replicated from the primary of the shard, unless a version at least as new is stored already
+	// The persisted HighTS of the shard is raised to the record timestamp in the same transaction
+	SetReplicated(shardID int, k string, vv VersionedValue) error
+	// Stores the records of one transaction replicated from the primary atomically, each as in SetReplicated
+	SetReplicatedTxn(shardID int, records map[string]VersionedValue) error
+
+	// Persisted HighTS of the shard (0 if none), primary writes and SetReplicated keep it up to date
+	LoadHighTS(shardID int) (int64, error)
+	// Raises the persisted HighTS of the shard to ts (a lower ts is ignored)
+	SaveHighTS(shardID int, ts int64) error
+
+	// Returns (false, nil) if no value is found
+	Get(k string, v any) (bool, error)
+	// Version of the key as of timestamp at (the newest one <= at), out of the versions the store retained
+	// Returns (found = false) if the key was missing or deleted at that time, or ErrVersionTrimmed
+	GetAt(k string, at int64) (VersionedValue, bool, error)
+	// Keys without a value are left out of the returned map
+	GetMulti(keys []string) (map[string]VersionedValue, error)
+	// Deleting a non-existing key does NOT lead to an error, the older versions of the key are dropped as well
+	Delete(k string) error
+
+	// Records of the shard updated after "since" (exclusive), ordered by timestamp, or ErrChangesTrimmed
+	// With limit > 0 at most limit change index entries are read, more reports whether there are entries after them
+	// upTo is the timestamp of the last change index entry read ("since" if none): the updates cover (since, upTo]
+	ScanUpdatedKeys(shardID int, since int64, limit int) (updates []util.Record, upTo int64, more bool, err error)
+	// Drops the change index entries of the shard with a timestamp <= before, returns how many were dropped
+	TrimChangeLog(shardID int, before int64) (int64, error)
+	// Removes the tombstones of the shard with a timestamp <= upTo (and below the retention horizon), returns how many were purged
+	PurgeTombstones(shard *util.Shard, upTo int64) (int, error)
+	// Calls fn for every stored record (including tombstones) whose key position (see util.KeyPosition) is in [startKey, endKey]
+	ScanShard(startKey int, endKey int, fn func(util.Record) error) error
+
+	FlushAll() error
+	Close() error
+}
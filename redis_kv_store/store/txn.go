@@ -0,0 +1,70 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"pileus/util"
+)
+
+// ErrEmptyTxn is returned by SetTxn for a transaction without writes
+var ErrEmptyTxn = errors.New("transaction has no writes")
+
+// TxnShard checks the writes of a transaction and returns the shard (of shards, the ones the node is primary for) they all belong to
+// Values are checked like in Set, except for the tombstones (Deleted)
+func TxnShard(shards *util.ShardSet, writes map[string]VersionedValue) (*util.Shard, error) {
+	if len(writes) == 0 {
+		return nil, ErrEmptyTxn
+	}
+
+	var shard *util.Shard
+	for k, vv := range writes {
+		var err error
+		if vv.Deleted {
+			err = util.CheckKey(k)
+		} else {
+			err = util.CheckKeyAndValue(k, vv.Value)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		keyShard := shards.ForKey(k)
+		if keyShard == nil {
+			return nil, fmt.Errorf("key '%s' is out of the ranges of the %d shards this node is primary for", k, shards.Len())
+		}
+		if shard != nil && keyShard.ShardId != shard.ShardId {
+			return nil, fmt.Errorf("keys of a transaction must belong to one shard, '%s' is in shard %d instead of %d", k, keyShard.ShardId, shard.ShardId)
+		}
+		shard = keyShard
+	}
+	return shard, nil
+}
+
+// StampTxn returns the writes of a transaction with their timestamp and epoch,
+// every record also names the other keys of the transaction (Txn), so replication can keep them together
+func StampTxn(writes map[string]VersionedValue, ts int64, epoch int64) map[string]VersionedValue {
+	keys := make([]string, 0, len(writes))
+	for k := range writes {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	stamped := make(map[string]VersionedValue, len(writes))
+	for _, k := range keys {
+		vv := writes[k]
+		vv.Timestamp = ts
+		vv.Epoch = epoch
+		vv.Txn = nil
+		for _, other := range keys {
+			if other != k {
+				vv.Txn = append(vv.Txn, other)
+			}
+		}
+		if vv.Deleted {
+			vv.Value = nil
+		}
+		stamped[k] = vv
+	}
+	return stamped
+}
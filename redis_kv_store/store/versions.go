@@ -0,0 +1,89 @@
+package store
+
+import (
+	"sort"
+	"time"
+	"pileus/hlc"
+)
+
+// Retention bounds the older versions the backends keep per key, for reads "as of" a timestamp (see GetAt)
+// Versions are only dropped when their key is written again, so a key that is not written anymore keeps up to MaxVersions of them
+type Retention struct {
+	MaxVersions int				// older versions kept per key (0: only the current version is kept)
+	MaxAge      time.Duration	// versions replaced longer ago than this are dropped
+}
+
+// DefaultRetention keeps up to 16 older versions per key, replaced within the last 5 minutes
+var DefaultRetention = Retention{
+	MaxVersions: 16,
+	MaxAge:      5 * time.Minute,
+}
+
+// Horizon is the oldest timestamp that can still be read "as of"
+// Tombstones are not purged above it, since a purged key reads as missing at any timestamp
+func (r Retention) Horizon() int64 {
+	return hlc.FromTime(time.Now().Add(-r.MaxAge))
+}
+
+// Retain returns the older versions of a key (ordered by timestamp) once its current version (nil if missing) is replaced by next
+// Older versions that are not newer than next are dropped (e.g. a snapshot record stored as is), and so are the ones beyond the retention
+func (r Retention) Retain(older []VersionedValue, current *VersionedValue, next VersionedValue) []VersionedValue {
+	kept := make([]VersionedValue, 0, len(older)+1)
+	for _, vv := range older {
+		if vv.Timestamp < next.Timestamp {
+			kept = append(kept, vv)
+		}
+	}
+	if current != nil && current.Timestamp < next.Timestamp {
+		kept = append(kept, *current)
+	}
+
+	// A version that was replaced before the horizon can't be read anymore
+	horizon := r.Horizon()
+	drop := 0
+	for drop < len(kept) {
+		replacedAt := next.Timestamp
+		if drop+1 < len(kept) {
+			replacedAt = kept[drop+1].Timestamp
+		}
+		if replacedAt >= horizon {
+			break
+		}
+		drop++
+	}
+	if len(kept)-drop > r.MaxVersions {
+		drop = len(kept) - r.MaxVersions
+	}
+	return kept[drop:]
+}
+
+// VersionAt picks the version of a key as of timestamp at, out of its older versions and its current one (nil if missing)
+// A version only answers for the time until the next one if that one names it as Prev, otherwise versions in between are
+// missing (dropped by the retention, or never received by a secondary that caught up) and ErrVersionTrimmed is returned
+func (r Retention) VersionAt(older []VersionedValue, current *VersionedValue, at int64) (VersionedValue, bool, error) {
+	if at < r.Horizon() && (current == nil || current.Timestamp > at) {
+		return VersionedValue{}, false, ErrVersionTrimmed
+	}
+
+	versions := older[:len(older):len(older)]
+	if current != nil {
+		versions = append(versions, *current)
+	}
+
+	i := sort.Search(len(versions), func(i int) bool {
+		return versions[i].Timestamp > at
+	}) - 1
+	if i < 0 {
+		// Nothing that old: fine if the oldest version is the first one of the key (or there is none at all)
+		if len(versions) == 0 || (versions[0].Prev != nil && *versions[0].Prev == 0) {
+			return VersionedValue{}, false, nil
+		}
+		return VersionedValue{}, false, ErrVersionTrimmed
+	}
+	if i+1 < len(versions) {
+		if prev := versions[i+1].Prev; prev == nil || *prev != versions[i].Timestamp {
+			return VersionedValue{}, false, ErrVersionTrimmed
+		}
+	}
+	return versions[i], !versions[i].Deleted && !versions[i].Expired(at), nil
+}
@@ -0,0 +1,130 @@
+package store
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"pileus/hlc"
+)
+
+func prevTS(ts int64) *int64 {
+	return &ts
+}
+
+func version(ts int64) VersionedValue {
+	return VersionedValue{Value: "v", Timestamp: ts}
+}
+
+func current(ts int64) *VersionedValue {
+	vv := version(ts)
+	return &vv
+}
+
+func timestamps(versions []VersionedValue) []int64 {
+	ts := make([]int64, 0, len(versions))
+	for _, vv := range versions {
+		ts = append(ts, vv.Timestamp)
+	}
+	return ts
+}
+
+func TestRetain(t *testing.T) {
+	retention := Retention{MaxVersions: 3, MaxAge: 5 * time.Minute}
+	now := hlc.FromTime(time.Now())
+	hourAgo := hlc.FromTime(time.Now().Add(-time.Hour))
+	halfHourAgo := hlc.FromTime(time.Now().Add(-30 * time.Minute))
+
+	tests := []struct {
+		name      string
+		retention Retention
+		older     []VersionedValue
+		current   *VersionedValue
+		next      VersionedValue
+		want      []int64
+	}{
+		{"first write of the key", retention, nil, nil, version(now), []int64{}},
+		{"current becomes older", retention, nil, current(now - 10), version(now), []int64{now - 10}},
+		{"within max versions", retention,
+			[]VersionedValue{version(now - 30), version(now - 20)}, current(now - 10), version(now),
+			[]int64{now - 30, now - 20, now - 10}},
+		{"oldest beyond max versions dropped", retention,
+			[]VersionedValue{version(now - 40), version(now - 30), version(now - 20)}, current(now - 10), version(now),
+			[]int64{now - 30, now - 20, now - 10}},
+		{"no older versions kept", Retention{MaxVersions: 0, MaxAge: 5 * time.Minute},
+			[]VersionedValue{version(now - 20)}, current(now - 10), version(now),
+			[]int64{}},
+		{"versions not older than next dropped", retention,
+			[]VersionedValue{version(now - 30), version(now + 10)}, current(now + 20), version(now),
+			[]int64{now - 30}},
+		{"version replaced before the horizon dropped", retention,
+			[]VersionedValue{version(hourAgo)}, current(halfHourAgo), version(now),
+			[]int64{halfHourAgo}},
+		{"everything replaced before the horizon", retention,
+			nil, current(hourAgo), version(halfHourAgo),
+			[]int64{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := timestamps(tt.retention.Retain(tt.older, tt.current, tt.next))
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Retain() kept %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestVersionAt(t *testing.T) {
+	retention := Retention{MaxVersions: 16, MaxAge: 5 * time.Minute}
+	now := hlc.FromTime(time.Now())
+	v1, v2, v3 := now-300, now-200, now-100
+	hourAgo := hlc.FromTime(time.Now().Add(-time.Hour))
+
+	chain := []VersionedValue{
+		{Value: "a", Timestamp: v1, Prev: prevTS(0)},
+		{Value: "b", Timestamp: v2, Prev: prevTS(v1)},
+	}
+	latest := &VersionedValue{Value: "c", Timestamp: v3, Prev: prevTS(v2)}
+
+	tests := []struct {
+		name      string
+		older     []VersionedValue
+		current   *VersionedValue
+		at        int64
+		wantTS    int64
+		wantFound bool
+		wantErr   error
+	}{
+		{"current version", chain, latest, now, v3, true, nil},
+		{"exactly an older version", chain, latest, v2, v2, true, nil},
+		{"between two versions", chain, latest, v2 + 50, v2, true, nil},
+		{"before the first version of the key", chain, latest, v1 - 1, 0, false, nil},
+		{"key never written", nil, nil, now, 0, false, nil},
+		{"gap in the chain", chain[:1], latest, v1, 0, false, ErrVersionTrimmed},
+		{"oldest retained is not the first version", chain[1:], latest, v1, 0, false, ErrVersionTrimmed},
+		{"unknown prev", nil, &VersionedValue{Value: "c", Timestamp: v3}, v1, 0, false, ErrVersionTrimmed},
+		{"deleted at the time", []VersionedValue{{Timestamp: v1, Prev: prevTS(0)}, {Timestamp: v2, Prev: prevTS(v1), Deleted: true}},
+			latest, v2, v2, false, nil},
+		{"not expired yet", nil, &VersionedValue{Value: "a", Timestamp: v1, Prev: prevTS(0), ExpiresAt: v2}, v2 - 1, v1, true, nil},
+		{"expired at the time", nil, &VersionedValue{Value: "a", Timestamp: v1, Prev: prevTS(0), ExpiresAt: v2}, v2, v1, false, nil},
+		{"before the horizon", chain, latest, hourAgo, 0, false, ErrVersionTrimmed},
+		{"before the horizon, current old enough", nil, &VersionedValue{Value: "a", Timestamp: hourAgo - 10, Prev: prevTS(0)},
+			hourAgo, hourAgo - 10, true, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, found, err := retention.VersionAt(tt.older, tt.current, tt.at)
+			if err != tt.wantErr {
+				t.Fatalf("VersionAt(%d) error = %v, want %v", tt.at, err, tt.wantErr)
+			}
+			if found != tt.wantFound {
+				t.Errorf("VersionAt(%d) found = %v, want %v", tt.at, found, tt.wantFound)
+			}
+			if got.Timestamp != tt.wantTS {
+				t.Errorf("VersionAt(%d) returned version %d, want %d", tt.at, got.Timestamp, tt.wantTS)
+			}
+		})
+	}
+}
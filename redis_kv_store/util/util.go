@@ -4,14 +4,21 @@ import (
 	"errors"
 	"os"
 	"encoding/json"
-	"regexp"
-	"strconv"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"pileus/partition"
 )
 
 type Record struct {
 	Key       string    `json:"key"`
 	Value     any       `json:"value"`
 	Timestamp int64
+	Deleted   bool      `json:"deleted,omitempty"`
+	Epoch     int64     `json:"epoch,omitempty"`	// configuration epoch of the primary that stamped the write
+	Prev      *int64    `json:"prev,omitempty"`	// timestamp of the version it replaced (see store.VersionedValue)
+	Txn       []string  `json:"txn,omitempty"`	// other keys written by the same transaction
+	ExpiresAt int64     `json:"expiresAt,omitempty"`	// timestamp from which the value reads as missing (0 if never)
 }
 
 // All data shards that the node is primary or secondary for are stored as shards
@@ -23,20 +30,87 @@ type Shard struct {
 	PrimaryID string `json:"primaryID"` 
 	Secondaries []string `json:"secondaryIDs"`
 	ReplicationFrequencySeconds float64  `json:"defaultRepFreq"`
+	ChangeLogRetentionSeconds float64 `json:"changeLogRetention"`	// how long the primary keeps entries in the change index
+	ReplicationMode string `json:"replicationMode"`	// "pull" (default) or "push"
+	Epoch int64 `json:"epoch"`	// configuration epoch in which the current primary was installed
+	EpochStartTS int64 `json:"epochStartTS"`	// HighTS of the primary when it was installed (writes of older epochs above it were lost)
 	AmIPrimary bool
 	AmISecondary bool
 	HighTS  int64 // highest known timestamp from this shard
 }
 
+// The HighTS and the replication frequency of a shard change while requests read them, they go through these accessors
+
+// GetHighTS returns the highest known timestamp of the shard
+func (shard *Shard) GetHighTS() int64 {
+	return atomic.LoadInt64(&shard.HighTS)
+}
+
+// SetHighTS replaces the HighTS, e.g. when the shard is replicated from the start again
+func (shard *Shard) SetHighTS(ts int64) {
+	atomic.StoreInt64(&shard.HighTS, ts)
+}
+
+// RaiseHighTS moves the HighTS up to ts, it reports whether it was lower
+func (shard *Shard) RaiseHighTS(ts int64) bool {
+	for {
+		current := atomic.LoadInt64(&shard.HighTS)
+		if ts <= current {
+			return false
+		}
+		if atomic.CompareAndSwapInt64(&shard.HighTS, current, ts) {
+			return true
+		}
+	}
+}
+
+// Guards the ReplicationFrequencySeconds of all shards, it is changed by /frequency while the replication loops read it
+var frequencyMu sync.RWMutex
+
+// ReplicationFrequency returns the seconds between two pulls of the shard
+func (shard *Shard) ReplicationFrequency() float64 {
+	frequencyMu.RLock()
+	defer frequencyMu.RUnlock()
+	return shard.ReplicationFrequencySeconds
+}
+
+// SetReplicationFrequency changes the seconds between two pulls of the shard
+func (shard *Shard) SetReplicationFrequency(seconds float64) {
+	frequencyMu.Lock()
+	defer frequencyMu.Unlock()
+	shard.ReplicationFrequencySeconds = seconds
+}
+
+// StaleEpochWrite reports whether the record was stamped by a primary that was replaced, after the point the new primary took over
+// Such writes never reached the new primary, so they must not be applied anywhere
+func (shard *Shard) StaleEpochWrite(rec Record) bool {
+	return rec.Epoch < shard.Epoch && rec.Timestamp > shard.EpochStartTS
+}
+
+const (
+	PullReplication = "pull"
+	PushReplication = "push"
+)
+
+type StorageNode struct {
+	Id      string `json:"nodeId"`
+	Address string `json:"nodeAddress"`
+	GRPCAddress string `json:"grpcAddress,omitempty"`	// where the node serves gRPC (see -grpc), if it does
+}
+
 type Config struct {
+	Nodes  []StorageNode `json:"nodes"`
 	Shards []Shard `json:"shards"`
+	Epoch  int64 `json:"epoch"`	// version of the config, the coordinator bumps it on every reconfiguration
+	Partitioning partition.Scheme `json:"partitioning,omitempty"`	// how keys map to the shard ranges ("range" by default, or "hash")
 }
 
 type ShardHighTSSnapshot struct {
 	Shards map[int]int64   `json:"shards"`
 }
 
-var keyNumericRegex = regexp.MustCompile(`\d+`)
+// Partitioning of the keys, set from the config when the node starts (it can't change while the node runs, the data would have to move)
+var Partitioning partition.Scheme
 
 // CheckKeyAndValue returns an error if k == "" or if v == nil
 func CheckKeyAndValue(k string, v any) error {
@@ -62,12 +136,92 @@ func CheckVal(v any) error {
 	return nil
 }
 
-func KeyToInt(k string) (int, error) {
-	match := keyNumericRegex.FindString(k)
-	if match == "" {
-		return 0, errors.New("no numeric part found in key")
+// KeyPosition returns the position of the key under the partitioning, the shards own ranges of positions
+func KeyPosition(k string) (int, error) {
+	return Partitioning.Position(k)
+}
+
+// ShardForKey returns the shard (out of the given ones) whose range holds the key, or nil if there is none
+// A key on a shared boundary goes to the shard of partition.Owner, as on the clients
+func ShardForKey(shards map[int]*Shard, k string) *Shard {
+	position, err := KeyPosition(k)
+	if err != nil {
+		return nil
+	}
+
+	candidates := make([]*Shard, 0, len(shards))
+	ranges := make([]partition.ShardRange, 0, len(shards))
+	for _, shard := range shards {
+		candidates = append(candidates, shard)
+		ranges = append(ranges, partition.ShardRange{ID: shard.ShardId, Start: shard.RangeStart, End: shard.RangeEnd})
+	}
+	if i := partition.Owner(position, ranges); i >= 0 {
+		return candidates[i]
 	}
-	return strconv.Atoi(match)
+	return nil
+}
+
+// ShardSet holds shards by id, it is safe for concurrent use since shards move between sets when the configuration changes
+type ShardSet struct {
+	mu     sync.RWMutex
+	shards map[int]*Shard
+}
+
+func NewShardSet() *ShardSet {
+	return &ShardSet{shards: make(map[int]*Shard)}
+}
+
+func (s *ShardSet) Get(id int) (*Shard, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	shard, ok := s.shards[id]
+	return shard, ok
+}
+
+// Put adds the shard, or replaces the one with the same id
+func (s *ShardSet) Put(shard *Shard) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.shards[shard.ShardId] = shard
+}
+
+func (s *ShardSet) Remove(id int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.shards, id)
+}
+
+// ForKey returns the shard whose range holds the key, or nil (see ShardForKey)
+func (s *ShardSet) ForKey(k string) *Shard {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return ShardForKey(s.shards, k)
+}
+
+// All returns the shards ordered by id
+func (s *ShardSet) All() []*Shard {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	all := make([]*Shard, 0, len(s.shards))
+	for _, shard := range s.shards {
+		all = append(all, shard)
+	}
+	sort.Slice(all, func(i, j int) bool {
+		return all[i].ShardId < all[j].ShardId
+	})
+	return all
+}
+
+func (s *ShardSet) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return len(s.shards)
 }
 
 func LoadConfig(path string) (*Config, error) { 